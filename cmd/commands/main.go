@@ -0,0 +1,160 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+	"github.com/sklirg/tardis/config"
+	"github.com/sklirg/tardis/modules"
+	"github.com/sklirg/tardis/server"
+)
+
+// Options selects which scopes the command tooling acts on.
+type Options struct {
+	Config *config.Config
+	// GuildID limits the action to a single guild.
+	GuildID string
+	// Global acts on the global commands instead of guild commands.
+	Global bool
+}
+
+// Sync registers the bot's application commands, only overwriting the
+// registered commands where they differ.
+func Sync(opts Options) error {
+	s, appID, err := connect(opts.Config)
+	if err != nil {
+		return err
+	}
+	desired := server.ApplicationCommandDefinitions(modules.ApplicationCommands(nil, nil))
+
+	guilds, err := scopes(opts)
+	if err != nil {
+		return err
+	}
+	for _, guildID := range guilds {
+		changed, err := server.SyncApplicationCommands(s, appID, guildID, desired)
+		if err != nil {
+			return fmt.Errorf("failed to sync commands for %s: %w", scopeName(guildID), err)
+		}
+		status := "up to date"
+		if changed {
+			status = "updated"
+		}
+		fmt.Printf("%s: %d commands %s\n", scopeName(guildID), len(desired), status)
+	}
+	return nil
+}
+
+// List prints the application commands registered with Discord.
+func List(opts Options) error {
+	s, appID, err := connect(opts.Config)
+	if err != nil {
+		return err
+	}
+
+	guilds, err := scopes(opts)
+	if err != nil {
+		return err
+	}
+	for _, guildID := range guilds {
+		registered, err := s.ApplicationCommands(appID, guildID)
+		if err != nil {
+			return fmt.Errorf("failed to list commands for %s: %w", scopeName(guildID), err)
+		}
+		fmt.Printf("%s: %d commands\n", scopeName(guildID), len(registered))
+		for _, cmd := range registered {
+			fmt.Printf("  %-24s %-20s %s\n", cmd.Name, cmd.ID, commandType(cmd.Type))
+		}
+	}
+	return nil
+}
+
+// Purge removes every registered application command.
+func Purge(opts Options) error {
+	s, appID, err := connect(opts.Config)
+	if err != nil {
+		return err
+	}
+
+	guilds, err := scopes(opts)
+	if err != nil {
+		return err
+	}
+	for _, guildID := range guilds {
+		if err := server.PurgeApplicationCommands(s, appID, guildID); err != nil {
+			return fmt.Errorf("failed to purge commands for %s: %w", scopeName(guildID), err)
+		}
+		fmt.Printf("%s: purged\n", scopeName(guildID))
+	}
+	return nil
+}
+
+func connect(cfg *config.Config) (*discordgo.Session, string, error) {
+	if err := cfg.Require(config.DiscordToken, config.ApplicationID); err != nil {
+		return nil, "", err
+	}
+
+	s, err := discordgo.New("Bot " + cfg.DiscordToken)
+	if err != nil {
+		log.WithError(err).Error("Failed to set up Discord session")
+		return nil, "", err
+	}
+	return s, cfg.ApplicationID, nil
+}
+
+// scopes returns the guild IDs to act on, where an empty ID is the
+// global scope.
+func scopes(opts Options) ([]string, error) {
+	if opts.Global {
+		return []string{""}, nil
+	}
+	if opts.GuildID != "" {
+		return []string{opts.GuildID}, nil
+	}
+
+	// The guilds the bot is in are recorded in the database
+	if err := opts.Config.Require(config.DatabaseURL); err != nil {
+		return nil, fmt.Errorf("pass --guild or --global, or configure the database to act on every known guild: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Config.DatabaseConnectTimeout)
+	defer cancel()
+	db, err := server.Connect(ctx, opts.Config.DatabaseURL, opts.Config.DatabasePool)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	registry := server.GuildRegistry{Store: server.NewDiscordServerStore(db)}
+	if err := registry.Load(ctx); err != nil {
+		return nil, fmt.Errorf("failed to load guilds: %w", err)
+	}
+	guilds := registry.Guilds()
+	if len(guilds) == 0 {
+		return nil, fmt.Errorf("no known guilds, pass --guild or start the bot to record the guilds it is in")
+	}
+	ids := make([]string, 0, len(guilds))
+	for _, guild := range guilds {
+		ids = append(ids, guild.ID)
+	}
+	return ids, nil
+}
+
+func scopeName(guildID string) string {
+	if guildID == "" {
+		return "global"
+	}
+	return fmt.Sprintf("guild %s", guildID)
+}
+
+func commandType(t discordgo.ApplicationCommandType) string {
+	switch t {
+	case discordgo.ChatApplicationCommand:
+		return "chat input"
+	case discordgo.UserApplicationCommand:
+		return "user"
+	case discordgo.MessageApplicationCommand:
+		return "message"
+	}
+	return fmt.Sprintf("type %d", t)
+}
@@ -0,0 +1,486 @@
+package doctor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/sklirg/tardis/cmd/migrate"
+	"github.com/sklirg/tardis/config"
+	"github.com/sklirg/tardis/server"
+)
+
+// Options selects what the doctor checks, and how it reports it.
+type Options struct {
+	Config *config.Config
+	// ConfigErr is why the configuration failed to load, if it did.
+	ConfigErr error
+	// GuildID limits the guild checks to a single guild.
+	GuildID string
+	// JSON prints the report as JSON instead of text.
+	JSON bool
+}
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	StatusOK      Status = "ok"
+	StatusWarning Status = "warning"
+	StatusError   Status = "error"
+	// StatusSkipped is a check which couldn't run, because one it
+	// depends on failed.
+	StatusSkipped Status = "skipped"
+)
+
+// Check is the outcome of checking one thing.
+type Check struct {
+	Name   string `json:"name"`
+	Status Status `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// GuildReport has the checks of a guild.
+type GuildReport struct {
+	ID     string  `json:"id"`
+	Name   string  `json:"name"`
+	Checks []Check `json:"checks"`
+}
+
+// Report is everything the doctor checked.
+type Report struct {
+	Checks []Check        `json:"checks"`
+	Guilds []*GuildReport `json:"guilds"`
+}
+
+// Healthy returns whether no check failed.
+func (r *Report) Healthy() bool {
+	for _, check := range r.Checks {
+		if check.Status == StatusError {
+			return false
+		}
+	}
+	for _, guild := range r.Guilds {
+		for _, check := range guild.Checks {
+			if check.Status == StatusError {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ErrUnhealthy is returned by Run when a check failed.
+var ErrUnhealthy = errors.New("found problems, see the report")
+
+// Run checks the configuration, the database and Discord, and every
+// guild the bot is in, and prints a report. It returns ErrUnhealthy if a
+// check failed.
+func Run(ctx context.Context, opts Options) error {
+	report := Diagnose(ctx, opts)
+	if opts.JSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		report.Print(os.Stdout)
+	}
+
+	if !report.Healthy() {
+		return ErrUnhealthy
+	}
+	return nil
+}
+
+// Diagnose runs the checks.
+func Diagnose(ctx context.Context, opts Options) *Report {
+	d := doctor{opts: opts, store: server.NewDiscordServerStore(nil)}
+	defer d.store.Close()
+	report := &Report{
+		Checks: make([]Check, 0),
+		Guilds: make([]*GuildReport, 0),
+	}
+
+	report.Checks = append(report.Checks, d.checkConfig())
+	if opts.Config == nil {
+		return report
+	}
+	report.Checks = append(report.Checks, d.checkDatabase()...)
+	report.Checks = append(report.Checks, d.checkDiscord()...)
+	if d.session == nil {
+		return report
+	}
+
+	guilds, err := d.guilds()
+	if err != nil {
+		report.Checks = append(report.Checks, Check{Name: "guilds", Status: StatusError, Detail: err.Error()})
+		return report
+	}
+	for _, guild := range guilds {
+		report.Guilds = append(report.Guilds, d.checkGuild(ctx, guild))
+	}
+	return report
+}
+
+// Print prints the report for humans.
+func (r *Report) Print(w io.Writer) {
+	printChecks(w, r.Checks)
+	for _, guild := range r.Guilds {
+		fmt.Fprintf(w, "\nGuild %s (%s)\n", guild.Name, guild.ID)
+		printChecks(w, guild.Checks)
+	}
+	if r.Healthy() {
+		fmt.Fprintln(w, "\nNo problems found")
+	} else {
+		fmt.Fprintln(w, "\nFound problems")
+	}
+}
+
+func printChecks(w io.Writer, checks []Check) {
+	for _, check := range checks {
+		fmt.Fprintf(w, "  %-8s %-20s %s\n", check.Status, check.Name, check.Detail)
+	}
+}
+
+type doctor struct {
+	opts    Options
+	store   *server.DiscordServerStore
+	session *discordgo.Session
+	botUser *discordgo.User
+	// databaseOK is whether the stored configuration of guilds can be
+	// checked.
+	databaseOK bool
+}
+
+func (d *doctor) checkConfig() Check {
+	check := Check{Name: "configuration", Status: StatusOK, Detail: "required settings are set"}
+	if d.opts.ConfigErr != nil {
+		check.Status, check.Detail = StatusError, d.opts.ConfigErr.Error()
+		return check
+	}
+	if err := d.opts.Config.Require(config.DiscordToken, config.ApplicationID, config.DatabaseURL); err != nil {
+		check.Status, check.Detail = StatusError, err.Error()
+	}
+	return check
+}
+
+func (d *doctor) checkDatabase() []Check {
+	cfg := d.opts.Config
+	if cfg.DatabaseURL == "" {
+		return []Check{{Name: "database", Status: StatusSkipped, Detail: "no database configured"}}
+	}
+	// Don't wait long for a database which is down
+	ctx, cancel := context.WithTimeout(context.Background(), min(cfg.DatabaseConnectTimeout, 10*time.Second))
+	defer cancel()
+	db, err := server.Connect(ctx, cfg.DatabaseURL, cfg.DatabasePool)
+	if err != nil {
+		return []Check{
+			{Name: "database", Status: StatusError, Detail: err.Error()},
+			{Name: "migrations", Status: StatusSkipped, Detail: "can't connect to the database"},
+		}
+	}
+	d.store = server.NewDiscordServerStore(db)
+	checks := []Check{{Name: "database", Status: StatusOK, Detail: "connected"}}
+
+	version, dirty, latest, err := migrate.Status(cfg.DatabaseURL)
+	switch {
+	case err != nil:
+		checks = append(checks, Check{Name: "migrations", Status: StatusError, Detail: err.Error()})
+	case dirty:
+		checks = append(checks, Check{Name: "migrations", Status: StatusError, Detail: fmt.Sprintf("migration %d failed halfway, fix the database and force the version", version)})
+	case version < latest:
+		checks = append(checks, Check{Name: "migrations", Status: StatusError, Detail: fmt.Sprintf("at version %d, run `tardis migrate` to migrate to %d", version, latest)})
+	default:
+		d.databaseOK = true
+		checks = append(checks, Check{Name: "migrations", Status: StatusOK, Detail: fmt.Sprintf("at version %d", version)})
+	}
+	return checks
+}
+
+// Application flags telling which privileged intents are enabled.
+const (
+	applicationFlagGatewayGuildMembers        = 1 << 14
+	applicationFlagGatewayGuildMembersLimited = 1 << 15
+)
+
+func (d *doctor) checkDiscord() []Check {
+	cfg := d.opts.Config
+	if cfg.DiscordToken == "" {
+		return []Check{{Name: "discord login", Status: StatusSkipped, Detail: "no token configured"}}
+	}
+	s, err := discordgo.New("Bot " + cfg.DiscordToken)
+	if err != nil {
+		return []Check{{Name: "discord login", Status: StatusError, Detail: err.Error()}}
+	}
+	user, err := s.User("@me")
+	if err != nil {
+		return []Check{{Name: "discord login", Status: StatusError, Detail: fmt.Sprintf("failed to log in, is the token right? %s", err)}}
+	}
+	d.session, d.botUser = s, user
+	checks := []Check{{Name: "discord login", Status: StatusOK, Detail: fmt.Sprintf("logged in as %s (%s)", user.String(), user.ID)}}
+
+	app, err := s.Application("@me")
+	if err != nil {
+		return append(checks, Check{Name: "intents", Status: StatusError, Detail: fmt.Sprintf("failed to fetch the application: %s", err)})
+	}
+	if cfg.ApplicationID != "" && app.ID != cfg.ApplicationID {
+		checks = append(checks, Check{Name: "application", Status: StatusError, Detail: fmt.Sprintf("the token belongs to application %s, but the application ID is %s", app.ID, cfg.ApplicationID)})
+	}
+	if app.Flags&(applicationFlagGatewayGuildMembers|applicationFlagGatewayGuildMembersLimited) == 0 {
+		checks = append(checks, Check{Name: "intents", Status: StatusError, Detail: "the server members intent is off, turn it on in the developer portal so the bot sees joins and leaves"})
+	} else {
+		checks = append(checks, Check{Name: "intents", Status: StatusOK, Detail: "the server members intent is on"})
+	}
+	return checks
+}
+
+func (d *doctor) guilds() ([]*discordgo.UserGuild, error) {
+	guilds := make([]*discordgo.UserGuild, 0)
+	after := ""
+	for {
+		page, err := d.session.UserGuilds(200, "", after, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list guilds: %w", err)
+		}
+		for _, guild := range page {
+			if d.opts.GuildID == "" || guild.ID == d.opts.GuildID {
+				guilds = append(guilds, guild)
+			}
+		}
+		if len(page) < 200 {
+			break
+		}
+		after = page[len(page)-1].ID
+	}
+	if d.opts.GuildID != "" && len(guilds) == 0 {
+		return nil, fmt.Errorf("the bot isn't in guild %s", d.opts.GuildID)
+	}
+	return guilds, nil
+}
+
+// requiredPermission is a permission the bot needs, and what for.
+type requiredPermission struct {
+	Permission int64
+	Name       string
+	Usage      string
+	// Optional permissions are only needed by some modules.
+	Optional bool
+}
+
+var requiredPermissions = []requiredPermission{
+	{discordgo.PermissionViewChannel, "View Channels", "seeing channels", false},
+	{discordgo.PermissionSendMessages, "Send Messages", "replying", false},
+	{discordgo.PermissionEmbedLinks, "Embed Links", "replying with embeds", false},
+	{discordgo.PermissionAddReactions, "Add Reactions", "reacting to commands", false},
+	{discordgo.PermissionReadMessageHistory, "Read Message History", "reaction roles", false},
+	{discordgo.PermissionManageRoles, "Manage Roles", "reaction roles and auto-roles", false},
+	{discordgo.PermissionKickMembers, "Kick Members", "kicking unverified members", true},
+	{discordgo.PermissionViewAuditLogs, "View Audit Log", "logging kicks and bans in the mod-log", true},
+	{discordgo.PermissionManageServer, "Manage Server", "raising the verification level in a raid", true},
+}
+
+func (d *doctor) checkGuild(ctx context.Context, userGuild *discordgo.UserGuild) *GuildReport {
+	report := &GuildReport{ID: userGuild.ID, Name: userGuild.Name, Checks: make([]Check, 0)}
+
+	guild, err := d.session.Guild(userGuild.ID)
+	if err != nil {
+		report.Checks = append(report.Checks, Check{Name: "guild", Status: StatusError, Detail: fmt.Sprintf("failed to fetch guild: %s", err)})
+		return report
+	}
+	member, err := d.session.GuildMember(guild.ID, d.botUser.ID)
+	if err != nil {
+		report.Checks = append(report.Checks, Check{Name: "guild", Status: StatusError, Detail: fmt.Sprintf("failed to fetch the bot's member: %s", err)})
+		return report
+	}
+
+	report.Checks = append(report.Checks, checkPermissions(guild, member))
+	if !d.databaseOK {
+		report.Checks = append(report.Checks, Check{Name: "stored config", Status: StatusSkipped, Detail: "the database isn't usable"})
+		return report
+	}
+	report.Checks = append(report.Checks, d.checkRoles(ctx, guild, member))
+	report.Checks = append(report.Checks, d.checkReactRoleMessages(ctx, guild))
+	report.Checks = append(report.Checks, d.checkWelcomeChannels(ctx, guild))
+	return report
+}
+
+// memberPermissions returns the guild wide permissions of the member.
+func memberPermissions(guild *discordgo.Guild, member *discordgo.Member) int64 {
+	if guild.OwnerID == member.User.ID {
+		return discordgo.PermissionAll
+	}
+	var permissions int64
+	for _, role := range guild.Roles {
+		if role.ID == guild.ID || slices.Contains(member.Roles, role.ID) {
+			permissions |= role.Permissions
+		}
+	}
+	if permissions&discordgo.PermissionAdministrator != 0 {
+		return discordgo.PermissionAll
+	}
+	return permissions
+}
+
+func checkPermissions(guild *discordgo.Guild, member *discordgo.Member) Check {
+	permissions := memberPermissions(guild, member)
+
+	missing, missingOptional := make([]string, 0), make([]string, 0)
+	for _, required := range requiredPermissions {
+		if permissions&required.Permission != 0 {
+			continue
+		}
+		description := fmt.Sprintf("%s (for %s)", required.Name, required.Usage)
+		if required.Optional {
+			missingOptional = append(missingOptional, description)
+		} else {
+			missing = append(missing, description)
+		}
+	}
+
+	switch {
+	case len(missing) > 0:
+		return Check{Name: "permissions", Status: StatusError, Detail: "missing " + strings.Join(append(missing, missingOptional...), ", ")}
+	case len(missingOptional) > 0:
+		return Check{Name: "permissions", Status: StatusWarning, Detail: "missing " + strings.Join(missingOptional, ", ")}
+	}
+	return Check{Name: "permissions", Status: StatusOK, Detail: "has every permission it needs"}
+}
+
+// boundRoles returns the roles the bot gives members, with what it gives
+// them for.
+func (d *doctor) boundRoles(ctx context.Context, guildID string) (map[string]string, error) {
+	roles := make(map[string]string)
+
+	reactRoles, err := d.store.GetReactRoleRoles(ctx, guildID)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range reactRoles {
+		roles[role] = "reaction role"
+	}
+
+	autoRoles, err := d.store.GetAutoRoles(ctx, guildID)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range autoRoles.Roles {
+		roles[role] = "auto-role"
+	}
+	for _, role := range autoRoles.StickyRoles {
+		roles[role] = "sticky role"
+	}
+
+	verification, err := d.store.GetVerification(ctx, guildID)
+	if err != nil && !errors.Is(err, server.ErrNotFound) {
+		return nil, err
+	}
+	if verification != nil && verification.RoleID != "" {
+		roles[verification.RoleID] = "verified role"
+	}
+
+	raid, err := d.store.GetRaidProtection(ctx, guildID)
+	if err != nil && !errors.Is(err, server.ErrNotFound) {
+		return nil, err
+	}
+	if raid != nil && raid.QuarantineRole != "" {
+		roles[raid.QuarantineRole] = "quarantine role"
+	}
+	return roles, nil
+}
+
+func (d *doctor) checkRoles(ctx context.Context, guild *discordgo.Guild, member *discordgo.Member) Check {
+	bound, err := d.boundRoles(ctx, guild.ID)
+	if err != nil {
+		return Check{Name: "roles", Status: StatusError, Detail: fmt.Sprintf("failed to fetch the roles the bot gives: %s", err)}
+	}
+	if len(bound) == 0 {
+		return Check{Name: "roles", Status: StatusOK, Detail: "the bot gives no roles"}
+	}
+
+	// The bot can only give roles below its highest role
+	top := &discordgo.Role{Name: "@everyone"}
+	for _, role := range guild.Roles {
+		if slices.Contains(member.Roles, role.ID) && role.Position > top.Position {
+			top = role
+		}
+	}
+
+	problems := make([]string, 0)
+	for roleID, usage := range bound {
+		i := slices.IndexFunc(guild.Roles, func(role *discordgo.Role) bool { return role.ID == roleID })
+		if i < 0 {
+			problems = append(problems, fmt.Sprintf("%s %s was deleted", usage, roleID))
+			continue
+		}
+		role := guild.Roles[i]
+		if role.Position >= top.Position {
+			problems = append(problems, fmt.Sprintf("%s @%s is above the bot's highest role @%s", usage, role.Name, top.Name))
+		}
+	}
+	if len(problems) > 0 {
+		slices.Sort(problems)
+		return Check{Name: "roles", Status: StatusError, Detail: strings.Join(problems, ", ")}
+	}
+	return Check{Name: "roles", Status: StatusOK, Detail: fmt.Sprintf("can give all %d roles", len(bound))}
+}
+
+func (d *doctor) checkReactRoleMessages(ctx context.Context, guild *discordgo.Guild) Check {
+	messages, err := d.store.GetReactRoleMessages(ctx, guild.ID)
+	if err != nil {
+		return Check{Name: "reaction roles", Status: StatusError, Detail: fmt.Sprintf("failed to fetch reaction role messages: %s", err)}
+	}
+
+	unreachable := make([]string, 0)
+	for _, message := range messages {
+		if _, err := d.session.ChannelMessage(message.ChannelID, message.ID); err != nil {
+			unreachable = append(unreachable, fmt.Sprintf("message %s in channel %s (%s)", message.ID, message.ChannelID, restErrorMessage(err)))
+		}
+	}
+	if len(unreachable) > 0 {
+		return Check{Name: "reaction roles", Status: StatusError, Detail: "can't reach " + strings.Join(unreachable, ", ")}
+	}
+	return Check{Name: "reaction roles", Status: StatusOK, Detail: fmt.Sprintf("can reach all %d messages", len(messages))}
+}
+
+func (d *doctor) checkWelcomeChannels(ctx context.Context, guild *discordgo.Guild) Check {
+	welcome, err := d.store.GetWelcomeChannel(ctx, guild.ID)
+	if err != nil && !errors.Is(err, server.ErrNotFound) {
+		return Check{Name: "welcome channel", Status: StatusError, Detail: fmt.Sprintf("failed to fetch welcome channel: %s", err)}
+	}
+	if welcome == nil || welcome.MessageChannelID == "" {
+		return Check{Name: "welcome channel", Status: StatusOK, Detail: "not set"}
+	}
+
+	missing := make([]string, 0)
+	for name, channelID := range map[string]string{"welcome channel": welcome.MessageChannelID, "emoji channel": welcome.EmojiChannelID} {
+		if channelID == "" {
+			continue
+		}
+		if channel, err := d.session.Channel(channelID); err != nil || channel.GuildID != guild.ID {
+			missing = append(missing, fmt.Sprintf("%s %s", name, channelID))
+		}
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		return Check{Name: "welcome channel", Status: StatusError, Detail: strings.Join(missing, ", ") + " is gone or can't be seen"}
+	}
+	return Check{Name: "welcome channel", Status: StatusOK, Detail: "exists"}
+}
+
+// restErrorMessage returns what Discord said went wrong.
+func restErrorMessage(err error) string {
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Message != nil {
+		return restErr.Message.Message
+	}
+	return err.Error()
+}
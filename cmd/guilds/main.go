@@ -0,0 +1,63 @@
+package guilds
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sklirg/tardis/config"
+	"github.com/sklirg/tardis/server"
+)
+
+// List prints the guilds the bot is in.
+func List(ctx context.Context, cfg *config.Config) error {
+	store, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	registry := server.GuildRegistry{Store: store}
+	if err := registry.Load(ctx); err != nil {
+		return fmt.Errorf("failed to load guilds: %w", err)
+	}
+
+	guilds := registry.Guilds()
+	fmt.Printf("%d guilds\n", len(guilds))
+	for _, guild := range guilds {
+		fmt.Printf("  %-20s %-32s owner %-20s joined %s\n", guild.ID, guild.Name, guild.OwnerID, guild.JoinedAt.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// Purge deletes the data of guilds that were left longer than the grace
+// period ago, the same way the bot does periodically.
+func Purge(ctx context.Context, cfg *config.Config) error {
+	store, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	registry := server.GuildRegistry{Store: store, PurgeGrace: cfg.GuildPurgeGrace}
+	if err := registry.Load(ctx); err != nil {
+		return fmt.Errorf("failed to load guilds: %w", err)
+	}
+
+	purged, err := registry.PurgeExpired(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Purged %d guilds\n", purged)
+	return nil
+}
+
+func connect(cfg *config.Config) (*server.DiscordServerStore, error) {
+	if err := cfg.Require(config.DatabaseURL); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DatabaseConnectTimeout)
+	defer cancel()
+	db, err := server.Connect(ctx, cfg.DatabaseURL, cfg.DatabasePool)
+	if err != nil {
+		return nil, err
+	}
+	return server.NewDiscordServerStore(db), nil
+}
@@ -2,6 +2,8 @@ package migrate
 
 import (
 	"embed"
+	"errors"
+	"fmt"
 	"os"
 
 	"github.com/golang-migrate/migrate/v4"
@@ -9,31 +11,68 @@ import (
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
 	log "github.com/sirupsen/logrus"
+	"github.com/sklirg/tardis/config"
 )
 
 //go:embed migrations/*.sql
 var fs embed.FS
 
-func Migrate() {
+func Migrate(cfg *config.Config) {
 	log.Info("Starting database migration")
-	d, err := iofs.New(fs, "migrations")
 
-	connStr := os.Getenv("DATABASE_URL")
-	if connStr == "" {
-		log.Error("Missing DATABASE_URL environment variable")
+	if err := cfg.Require(config.DatabaseURL); err != nil {
+		log.WithError(err).Error("Can't migrate the database")
 		os.Exit(1)
 	}
 
-	m, err := migrate.NewWithSourceInstance("iofs", d, connStr)
-	if err != nil {
-		log.WithError(err).Error("Failed to read migrations")
+	if err := Up(cfg.DatabaseURL); err != nil {
+		log.WithError(err).Error("Failed to migrate the database")
 		os.Exit(1)
 	}
+
+	log.Info("Successfully applied migrations")
+}
+
+// Up applies the migrations which haven't been applied to the database
+// yet.
+func Up(databaseURL string) error {
+	d, err := iofs.New(fs, "migrations")
+	if err != nil {
+		return fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	m, err := migrate.NewWithSourceInstance("iofs", d, databaseURL)
+	if err != nil {
+		return fmt.Errorf("failed to read migrations: %w", err)
+	}
 	defer m.Close()
-	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
-		log.WithError(err).Error("Failed to apply migrations")
-		os.Exit(1)
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("failed to apply migrations: %w", err)
 	}
+	return nil
+}
 
-	log.Info("Successfully applied migrations")
+// Status returns the version the database is migrated to, whether the
+// last migration failed halfway (dirty), and the latest version there is
+// a migration for. The version is 0 if no migrations have been applied.
+func Status(databaseURL string) (version uint, dirty bool, latest uint, err error) {
+	d, err := iofs.New(fs, "migrations")
+	if err != nil {
+		return 0, false, 0, fmt.Errorf("failed to read migrations: %w", err)
+	}
+	for v, err := d.First(); err == nil; v, err = d.Next(v) {
+		latest = v
+	}
+
+	m, err := migrate.NewWithSourceInstance("iofs", d, databaseURL)
+	if err != nil {
+		return 0, false, latest, fmt.Errorf("failed to read migrations: %w", err)
+	}
+	defer m.Close()
+
+	version, dirty, err = m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return 0, false, latest, nil
+	}
+	return version, dirty, latest, err
 }
@@ -0,0 +1,6 @@
+ALTER TABLE servers
+    DROP COLUMN name,
+    DROP COLUMN owner_id,
+    DROP COLUMN joined_at,
+    DROP COLUMN left_at,
+    DROP COLUMN purge_after;
@@ -0,0 +1,6 @@
+ALTER TABLE servers
+    ADD COLUMN name TEXT NOT NULL DEFAULT '',
+    ADD COLUMN owner_id VARCHAR(32) NOT NULL DEFAULT '',
+    ADD COLUMN joined_at timestamp with time zone NOT NULL DEFAULT now(),
+    ADD COLUMN left_at timestamp with time zone,
+    ADD COLUMN purge_after timestamp with time zone;
@@ -0,0 +1,11 @@
+CREATE TABLE guild_settings (
+    guild VARCHAR(32) PRIMARY KEY,
+    prefix VARCHAR(8) NOT NULL DEFAULT '!',
+    locale VARCHAR(8) NOT NULL DEFAULT 'en-US',
+    timezone TEXT NOT NULL DEFAULT 'Europe/Oslo',
+    admin_log_channel VARCHAR(32) NOT NULL DEFAULT '',
+    module_hots BOOLEAN NOT NULL DEFAULT true,
+    module_run BOOLEAN NOT NULL DEFAULT true,
+    module_reactrole BOOLEAN NOT NULL DEFAULT true,
+    module_welcome BOOLEAN NOT NULL DEFAULT true
+);
@@ -0,0 +1 @@
+DROP TABLE command_permissions;
@@ -0,0 +1,7 @@
+CREATE TABLE command_permissions (
+    guild VARCHAR(32),
+    command TEXT,
+    roles VARCHAR(32)[] NOT NULL DEFAULT '{}',
+    permissions BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY(guild, command)
+);
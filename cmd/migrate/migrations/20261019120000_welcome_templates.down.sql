@@ -0,0 +1 @@
+ALTER TABLE welcome_channel DROP COLUMN templates;
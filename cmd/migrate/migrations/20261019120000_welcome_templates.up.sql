@@ -0,0 +1 @@
+ALTER TABLE welcome_channel ADD COLUMN templates jsonb NOT NULL DEFAULT '[]';
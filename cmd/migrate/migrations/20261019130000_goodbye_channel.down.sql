@@ -0,0 +1 @@
+DROP TABLE goodbye_channel;
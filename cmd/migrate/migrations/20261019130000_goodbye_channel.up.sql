@@ -0,0 +1,5 @@
+CREATE TABLE goodbye_channel (
+    guild VARCHAR(32) PRIMARY KEY,
+    channel VARCHAR(32) NOT NULL,
+    template jsonb NOT NULL
+);
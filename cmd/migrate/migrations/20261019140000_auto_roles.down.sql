@@ -0,0 +1,2 @@
+DROP TABLE sticky_member_roles;
+DROP TABLE auto_roles;
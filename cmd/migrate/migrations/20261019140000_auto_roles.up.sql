@@ -0,0 +1,16 @@
+CREATE TABLE auto_roles (
+    guild VARCHAR(32) PRIMARY KEY,
+    roles VARCHAR(32)[] NOT NULL DEFAULT '{}',
+    delay_seconds INTEGER NOT NULL DEFAULT 0,
+    skip_bots BOOLEAN NOT NULL DEFAULT true,
+    wait_for_screening BOOLEAN NOT NULL DEFAULT true,
+    sticky_roles VARCHAR(32)[] NOT NULL DEFAULT '{}'
+);
+
+CREATE TABLE sticky_member_roles (
+    guild VARCHAR(32) NOT NULL,
+    member VARCHAR(32) NOT NULL,
+    roles VARCHAR(32)[] NOT NULL,
+    left_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY(guild, member)
+);
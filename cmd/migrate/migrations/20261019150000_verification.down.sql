@@ -0,0 +1,2 @@
+DROP TABLE member_verification;
+DROP TABLE verification;
@@ -0,0 +1,18 @@
+CREATE TABLE verification (
+    guild VARCHAR(32) PRIMARY KEY,
+    channel VARCHAR(32) NOT NULL,
+    message VARCHAR(32) NOT NULL DEFAULT '',
+    role VARCHAR(32) NOT NULL,
+    challenge VARCHAR(16) NOT NULL DEFAULT 'math',
+    kick_after_seconds INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE member_verification (
+    guild VARCHAR(32) NOT NULL,
+    member VARCHAR(32) NOT NULL,
+    joined_at timestamp with time zone NOT NULL DEFAULT now(),
+    verified_at timestamp with time zone,
+    kicked_at timestamp with time zone,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY(guild, member)
+);
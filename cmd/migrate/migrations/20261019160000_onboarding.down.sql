@@ -0,0 +1,2 @@
+DROP TABLE member_onboarding;
+DROP TABLE onboarding_reminders;
@@ -0,0 +1,15 @@
+CREATE TABLE onboarding_reminders (
+    guild VARCHAR(32) PRIMARY KEY,
+    delay_seconds INTEGER NOT NULL,
+    method VARCHAR(16) NOT NULL DEFAULT 'dm'
+);
+
+CREATE TABLE member_onboarding (
+    guild VARCHAR(32) NOT NULL,
+    member VARCHAR(32) NOT NULL,
+    joined_at timestamp with time zone NOT NULL DEFAULT now(),
+    completed_at timestamp with time zone,
+    reminded_at timestamp with time zone,
+    left_at timestamp with time zone,
+    PRIMARY KEY(guild, member)
+);
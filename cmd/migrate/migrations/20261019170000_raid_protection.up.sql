@@ -0,0 +1,12 @@
+CREATE TABLE raid_protection (
+    guild VARCHAR(32) PRIMARY KEY,
+    threshold INTEGER NOT NULL DEFAULT 10,
+    window_seconds INTEGER NOT NULL DEFAULT 60,
+    new_account_seconds INTEGER NOT NULL DEFAULT 604800,
+    action VARCHAR(16) NOT NULL DEFAULT 'verification',
+    quarantine_role VARCHAR(32) NOT NULL DEFAULT '',
+    alert_channel VARCHAR(32) NOT NULL DEFAULT '',
+    alert_role VARCHAR(32) NOT NULL DEFAULT '',
+    locked_at timestamp with time zone,
+    previous_verification_level INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1,5 @@
+CREATE TABLE mod_log (
+    guild VARCHAR(32) PRIMARY KEY,
+    channel VARCHAR(32) NOT NULL,
+    disabled_events TEXT[] NOT NULL DEFAULT '{}'
+);
@@ -0,0 +1 @@
+DROP INDEX reaction_message_reactions_guild;
@@ -0,0 +1 @@
+CREATE INDEX reaction_message_reactions_guild ON reaction_message_reactions (message_guild);
@@ -0,0 +1 @@
+ALTER TABLE mod_log DROP COLUMN enabled_events;
@@ -0,0 +1 @@
+ALTER TABLE mod_log ADD COLUMN enabled_events TEXT[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,147 @@
+package tardis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+	"github.com/sklirg/tardis/metrics"
+	"github.com/sklirg/tardis/server"
+)
+
+// handlerTimeout is the deadline of a gateway handler, after which its
+// queries fail and it is reported as stuck.
+const handlerTimeout = 30 * time.Second
+
+// guard wraps a gateway handler so a panic is reported instead of taking
+// down the process. The handler gets a context with a deadline, and is
+// reported as stuck if it runs past it. Events arriving after shutdown
+// has begun are dropped.
+func guard[E any](t *tardis, name string, handler func(context.Context, *discordgo.Session, E)) func(*discordgo.Session, E) {
+	return func(s *discordgo.Session, event E) {
+		if !t.lifecycle.enter() {
+			log.WithField("handler", name).Debug("Shutting down, dropping event")
+			return
+		}
+		defer t.lifecycle.leave()
+		metrics.Events.WithLabelValues(strings.TrimPrefix(fmt.Sprintf("%T", event), "*discordgo.")).Inc()
+
+		ctx, cancel := context.WithTimeout(t.lifecycle.work, handlerTimeout)
+		defer cancel()
+		stop := context.AfterFunc(ctx, func() {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				t.Reporter.Report(s, server.ErrorReport{
+					Source: name,
+					Err:    fmt.Sprintf("ran past its deadline of %s", handlerTimeout),
+					Event:  eventSummary(event),
+				})
+			}
+		})
+		defer stop()
+
+		t.protect(name, eventSummary(event), func() {
+			handler(ctx, s, event)
+		})
+	}
+}
+
+// protect runs fn, reporting a panic instead of taking down the process.
+func (t *tardis) protect(name, event string, fn func()) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			t.Reporter.Report(t.dg, server.ErrorReport{
+				Source: name,
+				Err:    fmt.Sprint(recovered),
+				Event:  event,
+				Stack:  string(debug.Stack()),
+				Panic:  true,
+			})
+		}
+	}()
+	fn()
+}
+
+// goProtect runs fn in a goroutine which shutdown waits for, reporting
+// a panic instead of taking down the process. fn gets the same deadline
+// as handlers, and isn't run if shutdown has begun.
+func (t *tardis) goProtect(name, event string, fn func(ctx context.Context)) {
+	t.lifecycle.goTracked(func() {
+		ctx, cancel := context.WithTimeout(t.lifecycle.work, handlerTimeout)
+		defer cancel()
+		t.protect(name, event, func() {
+			fn(ctx)
+		})
+	})
+}
+
+// goProtectAfter is goProtect after a delay. Shutdown doesn't wait for
+// the delay, and fn is dropped if shutdown has begun by then.
+func (t *tardis) goProtectAfter(delay time.Duration, name, event string, fn func(ctx context.Context)) {
+	time.AfterFunc(delay, func() {
+		t.goProtect(name, event, fn)
+	})
+}
+
+// every runs a job periodically until shutdown. A panic is reported, and
+// the job runs again next time. The context of the job is cancelled when
+// shutdown begins, as it picks up where it left off the next time.
+func (t *tardis) every(name string, interval time.Duration, job func(ctx context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.lifecycle.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !t.lifecycle.enter() {
+			return
+		}
+		t.protect(name, "", func() {
+			job(t.lifecycle.ctx)
+		})
+		t.lifecycle.leave()
+	}
+}
+
+// eventSummary describes a gateway event for error reports, without
+// message content.
+func eventSummary(event any) string {
+	switch e := event.(type) {
+	case *discordgo.MessageCreate:
+		return fmt.Sprintf("message %s in guild %s channel %s by user %s", e.ID, e.GuildID, e.ChannelID, e.Author.ID)
+	case *discordgo.MessageUpdate:
+		return fmt.Sprintf("edit of message %s in guild %s channel %s", e.ID, e.GuildID, e.ChannelID)
+	case *discordgo.MessageDelete:
+		return fmt.Sprintf("delete of message %s in guild %s channel %s", e.ID, e.GuildID, e.ChannelID)
+	case *discordgo.MessageReactionAdd:
+		return fmt.Sprintf("reaction %s added to message %s in guild %s by user %s", e.Emoji.APIName(), e.MessageID, e.GuildID, e.UserID)
+	case *discordgo.MessageReactionRemove:
+		return fmt.Sprintf("reaction %s removed from message %s in guild %s by user %s", e.Emoji.APIName(), e.MessageID, e.GuildID, e.UserID)
+	case *discordgo.GuildMemberAdd:
+		return fmt.Sprintf("user %s joined guild %s", e.User.ID, e.GuildID)
+	case *discordgo.GuildMemberUpdate:
+		return fmt.Sprintf("user %s updated in guild %s", e.User.ID, e.GuildID)
+	case *discordgo.GuildMemberRemove:
+		return fmt.Sprintf("user %s left guild %s", e.User.ID, e.GuildID)
+	case *discordgo.GuildMembersChunk:
+		return fmt.Sprintf("member chunk %d of %d for guild %s", e.ChunkIndex+1, e.ChunkCount, e.GuildID)
+	case *discordgo.GuildBanAdd:
+		return fmt.Sprintf("user %s banned in guild %s", e.User.ID, e.GuildID)
+	case *discordgo.GuildBanRemove:
+		return fmt.Sprintf("user %s unbanned in guild %s", e.User.ID, e.GuildID)
+	case *discordgo.GuildCreate:
+		return fmt.Sprintf("guild %s available", e.ID)
+	case *discordgo.GuildDelete:
+		return fmt.Sprintf("guild %s gone", e.ID)
+	case *discordgo.InteractionCreate:
+		return server.InteractionSummary(e)
+	}
+	return fmt.Sprintf("%T", event)
+}
@@ -0,0 +1,83 @@
+package tardis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sklirg/tardis/metrics"
+)
+
+// readyCheckTimeout is how long the readiness checks may take together.
+const readyCheckTimeout = 2 * time.Second
+
+// startHTTP serves health and readiness probes and metrics on addr.
+func (t *tardis) startHTTP(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", t.handleReady)
+	mux.Handle("/metrics", metrics.Handler())
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		log.WithField("addr", addr).Info("Serving health checks and metrics")
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).Error("HTTP server failed")
+		}
+	}()
+	return srv
+}
+
+// handleReady reports whether the bot is connected to the gateway and the
+// database, and has registered its application commands. It responds with
+// what failed, as JSON.
+func (t *tardis) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyCheckTimeout)
+	defer cancel()
+
+	checks := map[string]string{
+		"gateway":  "ok",
+		"database": "ok",
+		"commands": "ok",
+	}
+	ready := true
+	fail := func(check, reason string) {
+		checks[check] = reason
+		ready = false
+	}
+
+	if t.lifecycle.stopped() {
+		fail("gateway", "shutting down")
+	} else if !t.gatewayReady() {
+		fail("gateway", "not connected")
+	}
+	if err := t.ServerManager.Ping(ctx); err != nil {
+		fail("database", err.Error())
+	}
+	if !t.commandsSynced.Load() {
+		fail("commands", "not registered yet")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(checks)
+}
+
+// gatewayReady returns whether the session is connected and has received
+// the ready event.
+func (t *tardis) gatewayReady() bool {
+	t.dg.RLock()
+	defer t.dg.RUnlock()
+	return t.dg.DataReady
+}
@@ -0,0 +1,104 @@
+package tardis
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shutdownTimeout is how long shutdown waits for in-flight handlers and
+// jobs before closing the gateway and the database anyway.
+const shutdownTimeout = 30 * time.Second
+
+// lifecycle tracks the work in flight, so shutdown can stop accepting new
+// work and wait for what is running to finish.
+type lifecycle struct {
+	// ctx is cancelled when shutdown begins.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// work is the parent context of handlers. It outlives ctx, so the
+	// handlers in flight can finish during shutdown, and is cancelled
+	// when shutdown gives up waiting for them.
+	work  context.Context
+	abort context.CancelFunc
+
+	// mu makes sure no work is started after stop, so the wait group is
+	// never added to while it is waited on.
+	mu       sync.RWMutex
+	stopping bool
+	running  sync.WaitGroup
+	inFlight atomic.Int64
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	work, abort := context.WithCancel(context.Background())
+	return &lifecycle{ctx: ctx, cancel: cancel, work: work, abort: abort}
+}
+
+// enter registers a unit of work, and returns false if shutdown has begun
+// and the work should be dropped. Every successful enter must be followed
+// by a call to leave.
+func (l *lifecycle) enter() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.stopping {
+		return false
+	}
+	l.running.Add(1)
+	l.inFlight.Add(1)
+	return true
+}
+
+// leave marks a unit of work registered with enter as done.
+func (l *lifecycle) leave() {
+	l.inFlight.Add(-1)
+	l.running.Done()
+}
+
+// goTracked runs fn in a goroutine, unless shutdown has begun.
+func (l *lifecycle) goTracked(fn func()) {
+	if !l.enter() {
+		return
+	}
+	go func() {
+		defer l.leave()
+		fn()
+	}()
+}
+
+// stop stops accepting new work, and cancels the lifecycle context.
+func (l *lifecycle) stop() {
+	l.mu.Lock()
+	l.stopping = true
+	l.mu.Unlock()
+
+	l.cancel()
+}
+
+// stopped returns whether shutdown has begun.
+func (l *lifecycle) stopped() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.stopping
+}
+
+// wait waits for the work in flight to finish, and returns false if
+// some was still running after the timeout, cancelling what is left.
+func (l *lifecycle) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		l.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		l.abort()
+		return false
+	}
+}
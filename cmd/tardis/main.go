@@ -1,47 +1,99 @@
 package tardis
 
 import (
+	"context"
 	"fmt"
-	"os"
+	"net/http"
 	"os/signal"
-	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	log "github.com/sirupsen/logrus"
 	"github.com/sklirg/tardis/coder"
+	"github.com/sklirg/tardis/config"
 	"github.com/sklirg/tardis/hots"
+	"github.com/sklirg/tardis/metrics"
+	"github.com/sklirg/tardis/modules"
 	"github.com/sklirg/tardis/server"
+	"github.com/sklirg/tardis/textcommands"
 )
 
+// tardis is the bot runtime. Handlers run concurrently, so its fields
+// are set up in Run before the gateway is opened, and only read after
+// that. State which changes while running lives in types which are safe
+// for concurrent use, like the registries, caches and devListenChannel.
 type tardis struct {
-	AramBuilds       *hots.AramBuilds
-	ServerManager    server.DiscordServerStore
-	DevMode          bool
-	DevListenChannel string
-	DevGuildID       string
-	WelcomeChannel   map[string]*server.WelcomeChannel
-	Commands         *server.ApplicationCommands
-	dg               *discordgo.Session
+	AramBuilds    *hots.AramBuilds
+	ServerManager *server.DiscordServerStore
+	Guilds        *server.GuildRegistry
+	DevMode       bool
+	DevGuildID    string
+	ApplicationID string
+	CommandScope  server.CommandScope
+	Members       *server.MemberCache
+	Verifier      *server.Verifier
+	Raids         *server.RaidDetector
+	Commands      *server.Router
+	Reporter      *server.ErrorReporter
+	TextCommands  *textcommands.Registry
+	dg            *discordgo.Session
+	lifecycle     *lifecycle
+	http          *http.Server
+
+	// commandsSynced is set when application commands have been
+	// registered, for the readiness check.
+	commandsSynced atomic.Bool
+	// databaseDown is set while the database can't be reached.
+	databaseDown atomic.Bool
+
+	// devListenChannel is the channel listened to in dev mode, changed
+	// with the listen command.
+	devListenChannel atomic.Value
 
 	cleanUpMissingMembers bool
 }
 
-func Run() {
-	discordBotToken := os.Getenv("TARDIS_DISCORD_TOKEN")
-	applicationID := os.Getenv("TARDIS_APPLICATION_ID")
+// listenChannel returns the channel listened to in dev mode.
+func (tardis *tardis) listenChannel() string {
+	channelID, _ := tardis.devListenChannel.Load().(string)
+	return channelID
+}
+
+// Run runs the bot until it is interrupted. It returns an error if it
+// fails to start.
+func Run(cfg *config.Config) error {
+	if err := cfg.Require(config.DiscordToken, config.ApplicationID, config.DatabaseURL); err != nil {
+		return err
+	}
 
-	applicationCommands := server.ApplicationCommands{Commands: make(map[string]*server.ApplicationCommand)}
+	// Stop on interrupt, also while still connecting
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	connectCtx, cancel := context.WithTimeout(ctx, cfg.DatabaseConnectTimeout)
+	db, err := server.Connect(connectCtx, cfg.DatabaseURL, cfg.DatabasePool)
+	cancel()
+	if err != nil {
+		return err
+	}
 
 	state := tardis{
-		DevMode:    os.Getenv("TARDIS_DEV") != "",
-		DevGuildID: os.Getenv("TARDIS_DEV_GUILD"),
+		ApplicationID: cfg.ApplicationID,
+		CommandScope:  cfg.CommandScope,
+		DevMode:       cfg.DevMode,
+		DevGuildID:    cfg.DevGuildID,
 		AramBuilds: &hots.AramBuilds{
-			SheetID:    os.Getenv("TARDIS_HOTS_ARAM_SHEET_ID"),
-			SheetRange: os.Getenv("TARDIS_HOTS_ARAM_SHEET_RANGE"),
+			SheetID:    cfg.AramSheetID,
+			SheetRange: cfg.AramSheetRange,
 		},
-		ServerManager: server.DiscordServerStore{},
-		Commands:      &applicationCommands,
+		ServerManager: server.NewDiscordServerStore(db),
+		Commands:      server.NewRouter(),
+		Reporter:      server.NewErrorReporter(cfg.OpsChannel),
+		TextCommands:  textcommands.NewRegistry(),
+		Members:       server.NewMemberCache(),
+		lifecycle:     newLifecycle(),
 
 		cleanUpMissingMembers: false,
 	}
@@ -54,68 +106,106 @@ func Run() {
 		log.SetLevel(log.TraceLevel)
 	}
 
-	state.WelcomeChannel = make(map[string]*server.WelcomeChannel)
+	state.Guilds = &server.GuildRegistry{
+		Store:      state.ServerManager,
+		PurgeGrace: cfg.GuildPurgeGrace,
+	}
+	if err := state.Guilds.Load(ctx); err != nil {
+		log.WithError(err).Warn("Failed to load known guilds")
+	}
 
-	dg, err := discordConnect(discordBotToken)
+	dg, err := discordConnect(cfg.DiscordToken)
 	if err != nil {
-		fmt.Println("error connecting", err)
-		return
+		return fmt.Errorf("failed to set up Discord session: %w", err)
 	}
 
 	state.dg = dg
+	state.Commands.Reporter = state.Reporter
 
-	dg.AddHandler(state.messageCreate)
-	dg.AddHandler(state.handleReactionAdd)
-	dg.AddHandler(state.handleReactionRemove)
-	dg.AddHandler(state.handleMemberJoin)
-	dg.AddHandler(state.handleApplicationCommands)
-	dg.AddHandler(state.handleMemberChunk)
-	dg.AddHandler(state.handleGuildReady)
+	for _, applicationCommand := range modules.ApplicationCommands(state.ServerManager, state.AramBuilds) {
+		state.Commands.Register(applicationCommand)
+	}
+	state.Verifier = server.NewVerifier(state.ServerManager)
+	state.Verifier.Register(state.Commands)
+	state.Raids = server.NewRaidDetector(state.ServerManager)
+	state.registerTextCommands()
+	metrics.RegisterSyncAge(state.AramBuilds.LastSync)
+
+	dg.AddHandler(guard(&state, "messageCreate", state.messageCreate))
+	dg.AddHandler(guard(&state, "handleReactionAdd", state.handleReactionAdd))
+	dg.AddHandler(guard(&state, "handleReactionRemove", state.handleReactionRemove))
+	dg.AddHandler(guard(&state, "handleMemberJoin", state.handleMemberJoin))
+	dg.AddHandler(guard(&state, "handleMemberUpdate", state.handleMemberUpdate))
+	dg.AddHandler(guard(&state, "handleMemberRemove", state.handleMemberRemove))
+	dg.AddHandler(guard(&state, "handleApplicationCommands", state.handleApplicationCommands))
+	dg.AddHandler(guard(&state, "handleMemberChunk", state.handleMemberChunk))
+	dg.AddHandler(guard(&state, "handleMessageUpdate", state.handleMessageUpdate))
+	dg.AddHandler(guard(&state, "handleMessageDelete", state.handleMessageDelete))
+	dg.AddHandler(guard(&state, "handleBanAdd", state.handleBanAdd))
+	dg.AddHandler(guard(&state, "handleBanRemove", state.handleBanRemove))
+	dg.AddHandler(guard(&state, "handleGuildReady", state.handleGuildReady))
+	dg.AddHandler(guard(&state, "handleGuildCreate", state.handleGuildCreate))
+	dg.AddHandler(guard(&state, "handleGuildDelete", state.handleGuildDelete))
+
+	if cfg.HTTPAddr != "" {
+		state.http = state.startHTTP(cfg.HTTPAddr)
+	}
 
-	err = dg.Open()
-	if err != nil {
-		fmt.Println("error opening connection,", err)
-		return
+	if err := dg.Open(); err != nil {
+		return fmt.Errorf("failed to connect to the gateway: %w", err)
 	}
 
 	log.Info("Bot is now running. Press CTRL-C to exit.")
 
-	for _, guild := range dg.State.Ready.Guilds {
-		// Fetch guild info from database if we have it
-		log.WithField("guild_id", guild.ID).Debugf("Connected to '%s'", guild.Name)
+	for _, guild := range state.Guilds.Guilds() {
+		log.WithField("guild_id", guild.ID).Debugf("Known guild '%s', joined at %s", guild.Name, guild.JoinedAt)
 	}
 
-	log.Infof("Registering %d application commands", len(server.AvailableApplicationCommands(nil)))
+	go state.every("purgeLeftGuilds", time.Hour, state.purgeLeftGuilds)
+	go state.every("kickUnverifiedMembers", 10*time.Minute, state.kickUnverifiedMembers)
+	go state.every("sendOnboardingReminders", 5*time.Minute, state.sendOnboardingReminders)
+	go state.every("checkDatabase", 30*time.Second, state.checkDatabase)
+	go state.every("expireCommands", time.Minute, state.Commands.Expire)
 
-	for _, guild := range dg.State.Ready.Guilds {
-		for _, applicationCommand := range server.AvailableApplicationCommands(&state.ServerManager) {
-			logger := log.WithField("application_name", applicationCommand.Name)
-			registered, err := dg.ApplicationCommandCreate(applicationID, guild.ID, applicationCommand.Command)
-			if err != nil {
-				logger.WithError(err).Errorf("Failed to register command: %v", applicationCommand.Command)
-			} else {
-				logger.WithField("id", registered.ID).Info("Registered command")
-				applicationCommand.ID = registered.ID
-				state.Commands.Commands[registered.ID] = applicationCommand
-			}
-		}
+	if state.CommandScope == server.GlobalCommandScope {
+		state.syncApplicationCommands("")
 	}
 
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt, os.Kill)
-	<-sc
+	<-ctx.Done()
 
 	log.Info("Received interrupt, shutting down.")
 
-	for _, guild := range dg.State.Ready.Guilds {
-		for id := range state.Commands.Commands {
-			if err := dg.ApplicationCommandDelete(applicationID, guild.ID, id); err != nil {
-				log.WithError(err).Warn("failed to delete application")
-			}
-		}
+	state.shutdown()
+	return nil
+}
+
+// shutdown stops handling new events, waits for the handlers and jobs
+// which are running, and then closes the gateway and the database.
+func (t *tardis) shutdown() {
+	t.lifecycle.stop()
+
+	// Running code would hold up shutdown for up to a minute, so stop it
+	// right away. The handlers reply that it was cancelled.
+	coder.CancelAll()
+
+	if !t.lifecycle.wait(shutdownTimeout) {
+		log.WithField("in_flight", t.lifecycle.inFlight.Load()).Warnf("Handlers and jobs still running after %s, shutting down anyway", shutdownTimeout)
 	}
 
-	dg.Close()
+	if err := t.dg.Close(); err != nil {
+		log.WithError(err).Warn("Failed to close gateway connection")
+	}
+	if err := t.ServerManager.Close(); err != nil {
+		log.WithError(err).Warn("Failed to close database")
+	}
+	if t.http != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := t.http.Shutdown(ctx); err != nil {
+			log.WithError(err).Warn("Failed to stop HTTP server")
+		}
+	}
+	log.Info("Shut down")
 }
 
 func discordConnect(token string) (*discordgo.Session, error) {
@@ -125,6 +215,7 @@ func discordConnect(token string) (*discordgo.Session, error) {
 		return nil, err
 	}
 
+	client.Client.Transport = metrics.Transport(client.Client.Transport)
 	client.Identify = discordgo.Identify{
 		Token: token,
 		Properties: discordgo.IdentifyProperties{
@@ -138,13 +229,22 @@ func discordConnect(token string) (*discordgo.Session, error) {
 	client.StateEnabled = true
 	client.State.TrackMembers = true
 	client.State.TrackRoles = true
+	// Keep the last messages of every channel, so the mod-log can show
+	// what edited and deleted messages said
+	client.State.MaxMessageCount = 100
 
 	return client, nil
 }
 
-func (tardis *tardis) handleGuildReady(s *discordgo.Session, _ *discordgo.Ready) {
+func (tardis *tardis) handleGuildReady(ctx context.Context, s *discordgo.Session, _ *discordgo.Ready) {
 	log.Info("Received guilds ready event")
 
+	// Guild commands are registered when guilds become available, so
+	// without guilds there is nothing to register
+	if tardis.CommandScope == server.GuildCommandScope && len(s.State.Guilds) == 0 {
+		tardis.commandsSynced.Store(true)
+	}
+
 	for _, guild := range s.State.Guilds {
 		tardis.dg.State.GuildAdd(guild)
 		log.WithField("guild_id", guild.ID).Info("Requesting guild members")
@@ -155,24 +255,124 @@ func (tardis *tardis) handleGuildReady(s *discordgo.Session, _ *discordgo.Ready)
 	}
 }
 
-func (tardis *tardis) handleMemberChunk(_ *discordgo.Session, c *discordgo.GuildMembersChunk) {
+// handleGuildCreate is called for every guild when connecting, and when
+// the bot joins a new guild.
+func (tardis *tardis) handleGuildCreate(ctx context.Context, _ *discordgo.Session, g *discordgo.GuildCreate) {
+	logger := log.WithField("guild_id", g.ID).WithField("guild_name", g.Name)
+	if !tardis.Guilds.Has(g.ID) {
+		logger.Info("Joined guild")
+	}
+	if err := tardis.Guilds.Join(ctx, g.Guild); err != nil {
+		logger.WithError(err).Error("Failed to record guild")
+	}
+	for _, member := range g.Members {
+		tardis.Members.Remember(g.ID, member)
+	}
+
+	if tardis.CommandScope == server.GuildCommandScope {
+		tardis.syncApplicationCommands(g.ID)
+	}
+}
+
+// handleGuildDelete is called when the bot leaves or is removed from a
+// guild, and when a guild becomes unavailable because of an outage.
+func (tardis *tardis) handleGuildDelete(ctx context.Context, _ *discordgo.Session, g *discordgo.GuildDelete) {
+	logger := log.WithField("guild_id", g.ID)
+	if g.Unavailable {
+		logger.Warn("Guild became unavailable")
+		return
+	}
+
+	logger.Info("Left guild, scheduling purge of its data")
+	tardis.Members.ForgetGuild(g.ID)
+	if err := tardis.Guilds.Leave(ctx, g.ID); err != nil {
+		logger.WithError(err).Error("Failed to record leaving guild")
+	}
+}
+
+// purgeLeftGuilds periodically purges data of guilds we left.
+func (tardis *tardis) purgeLeftGuilds(ctx context.Context) {
+	if purged, err := tardis.Guilds.PurgeExpired(ctx); err != nil {
+		log.WithError(err).Error("Failed to purge data of guilds we left")
+	} else if purged > 0 {
+		log.Infof("Purged data of %d guilds", purged)
+	}
+}
+
+// checkDatabase periodically pings the database, and reports when the
+// connection is lost and when it comes back. The pool reconnects by
+// itself, so queries work again as soon as the database is back.
+func (tardis *tardis) checkDatabase(ctx context.Context) {
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := tardis.ServerManager.Ping(pingCtx)
+	if ctx.Err() != nil {
+		// Shutting down
+		return
+	}
+	switch {
+	case err != nil && !tardis.databaseDown.Swap(true):
+		tardis.Reporter.Report(tardis.dg, server.ErrorReport{
+			Source: "checkDatabase",
+			Err:    fmt.Sprintf("lost connection to database: %s", err),
+		})
+	case err == nil && tardis.databaseDown.Swap(false):
+		log.Info("Reconnected to database")
+	}
+}
+
+// kickUnverifiedMembers periodically removes members who didn't verify
+// in time.
+func (tardis *tardis) kickUnverifiedMembers(ctx context.Context) {
+	if kicked, err := tardis.Verifier.KickUnverified(ctx, tardis.dg); err != nil {
+		log.WithError(err).Error("Failed to remove unverified members")
+	} else if kicked > 0 {
+		log.Infof("Removed %d unverified members", kicked)
+	}
+}
+
+// sendOnboardingReminders periodically reminds new members who haven't
+// picked any roles.
+func (tardis *tardis) sendOnboardingReminders(ctx context.Context) {
+	if reminded, err := tardis.ServerManager.SendOnboardingReminders(ctx, tardis.dg); err != nil {
+		log.WithError(err).Error("Failed to send onboarding reminders")
+	} else if reminded > 0 {
+		log.Infof("Reminded %d members to pick roles", reminded)
+	}
+}
+
+func (tardis *tardis) syncApplicationCommands(guildID string) {
+	logger := log.WithField("guild_id", guildID)
+	desired := server.ApplicationCommandDefinitions(tardis.Commands.Commands())
+	changed, err := server.SyncApplicationCommands(tardis.dg, tardis.ApplicationID, guildID, desired)
+	if err != nil {
+		logger.WithError(err).Error("Failed to sync application commands")
+		return
+	}
+	logger.WithField("changed", changed).Infof("Synced %d application commands", len(desired))
+	tardis.commandsSynced.Store(true)
+}
+
+func (tardis *tardis) handleMemberChunk(ctx context.Context, _ *discordgo.Session, c *discordgo.GuildMembersChunk) {
 	log.Infof("Got guild member chunk %d of %d (%d members)", c.ChunkIndex+1, c.ChunkCount, len(c.Members))
 
 	for _, member := range c.Members {
+		tardis.Members.Remember(c.GuildID, member)
 		if err := tardis.dg.State.MemberAdd(member); err != nil {
 			log.WithError(err).Error("failed to add guild member")
 			break
 		}
 	}
 
-	if c.ChunkIndex == c.ChunkCount-1 {
-		if err := tardis.syncReactionRoles(c.GuildID); err != nil {
+	if c.ChunkIndex == c.ChunkCount-1 && tardis.ServerManager.GuildSettings(ctx, c.GuildID).ModuleEnabled(server.ModuleReactRole) {
+		if err := tardis.syncReactionRoles(ctx, c.GuildID); err != nil {
 			log.WithError(err).Error("failed to sync reaction roles")
 		}
 	}
 }
 
-func (tardis *tardis) messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
+func (tardis *tardis) messageCreate(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
 	if m.Author.ID == s.State.SessionID {
 		return
 	}
@@ -181,105 +381,80 @@ func (tardis *tardis) messageCreate(s *discordgo.Session, m *discordgo.MessageCr
 		"author":    m.Author.String(),
 	})
 
-	if len(m.Content) == 0 {
-		return
-	}
-
-	if m.Content[0] != '!' {
+	settings := tardis.ServerManager.GuildSettings(ctx, m.GuildID)
+	trigger, args, ok := textcommands.Parse(m.Content, settings.Prefix)
+	if !ok {
 		return
 	}
 
-	tokens := strings.Split(strings.ReplaceAll(m.Content[1:], "\n", " "), " ")
-
-	if len(tokens) == 0 {
-		return
-	}
-
-	trigger := tokens[0]
-
 	if tardis.DevMode {
-		if !(trigger == "listen" || m.ChannelID == tardis.DevListenChannel || m.GuildID == tardis.DevGuildID) {
+		if !(trigger == "listen" || m.ChannelID == tardis.listenChannel() || m.GuildID == tardis.DevGuildID) {
 			// In DevMode and received message in a channel I don't listen to, so skip
 			// But will allow the keyword 'listen' through
 			return
 		}
 	}
-	logger = logger.WithField("trigger", trigger)
 
-	switch trigger {
-	case "aram", "hots":
-		{
-			tardis.AramBuilds.HandleDiscordMessage(s, m)
-		}
-	case "listen":
-		{
+	tardis.TextCommands.Dispatch(&textcommands.Context{
+		Context:  ctx,
+		Session:  s,
+		Message:  m,
+		Trigger:  trigger,
+		Args:     args,
+		Prefix:   settings.Prefix,
+		Location: settings.Location(),
+		Logger:   logger,
+	})
+}
+
+// registerTextCommands registers the text commands of every module.
+func (tardis *tardis) registerTextCommands() {
+	tardis.TextCommands.ModuleEnabled = func(ctx context.Context, guildID, module string) bool {
+		return tardis.ServerManager.GuildSettings(ctx, guildID).ModuleEnabled(server.Module(module))
+	}
+	tardis.TextCommands.Allowed = tardis.canRunAdminCommand
+
+	for _, hybrid := range modules.HybridCommands(tardis.ServerManager, tardis.AramBuilds) {
+		tardis.TextCommands.Register(hybrid.TextCommand())
+	}
+	tardis.TextCommands.Register(&textcommands.Command{
+		Name:        "listen",
+		Usage:       "listen",
+		Description: "Listen to this channel in dev mode",
+		Hidden:      true,
+		Handler: func(ctx *textcommands.Context) error {
 			if !tardis.DevMode {
 				// If we receive the `listen` trigger while not in DevMode we don't care
-				return
-			}
-			tardis.DevListenChannel = m.ChannelID
-			s.ChannelMessageSend(m.ChannelID, ":robot: :construction: Listening to this channel")
-		}
-	case "reactrole":
-		go tardis.ServerManager.HandleDiscordMessage(s, m)
-	case "setwelcomechannel":
-		{
-			canSet := false
-			for _, role := range m.Member.Roles {
-				log.WithField("role", role).Debug("User has role")
-				if role == "697835126733799476" || role == "173844144609951744" {
-					canSet = true
-					break
-				}
-			}
-			if !canSet {
-				return
-			}
-			w := server.WelcomeChannel{
-				GuildID:          m.GuildID,
-				MessageChannelID: m.ChannelID,
-			}
-			if len(tokens) >= 2 {
-				if tokens[1][0] == '<' {
-					chanID := tokens[1][2 : len(tokens[1])-1]
-					log.WithField("channel_id", chanID).WithField("token", tokens[1]).Debug("Looking up emoji channel")
-					if c, err := s.Channel(chanID); err == nil && c != nil {
-						log.WithField("channel", c.Name).Debug("Found emoji channel")
-						w.EmojiChannelID = c.ID
-					} else {
-						log.WithError(err).WithField("channel", c).Debug("Failed to lookup emoji channel")
-					}
-				}
-			}
-			if err := tardis.ServerManager.StoreWelcomeChannel(w); err != nil {
-				s.MessageReactionAdd(m.ChannelID, m.ID, "👎")
-				s.ChannelMessageSend(m.ChannelID, ":robot: Failed to set welcome channel.")
-			} else {
-				s.MessageReactionAdd(m.ChannelID, m.ID, "👍")
-				tardis.WelcomeChannel[w.GuildID] = &w
-			}
-		}
-	case "run":
-		{
-			if err := coder.Run(s, m); err != nil {
-				s.ChannelMessageSend(m.ChannelID, fmt.Sprintf(":x: Something went wrong: %s", err))
-				coder.SendHelp(s, m)
-			}
-		}
-	default:
-		{
-			if tardis.DevMode {
-				logger.Debug("Received unknown trigger")
+				return nil
 			}
-		}
+			tardis.devListenChannel.Store(ctx.Message.ChannelID)
+			return ctx.Reply(":robot: :construction: Listening to this channel")
+		},
+	})
+}
+
+// canRunAdminCommand checks whether the author of a message may run an
+// admin command, as configured with /permissions.
+func (tardis *tardis) canRunAdminCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate, command string) bool {
+	if m.GuildID == "" {
+		return false
+	}
+	allowed := tardis.ServerManager.CanRunAdminCommandInChannel(ctx, s, m.GuildID, m.ChannelID, command, m.Member, m.Author.ID)
+	if !allowed {
+		log.WithField("author_id", m.Author.ID).WithField("command", command).Info("Denied admin command")
 	}
+	return allowed
 }
 
-func (t *tardis) handleReactionAdd(s *discordgo.Session, reaction *discordgo.MessageReactionAdd) {
+func (t *tardis) handleReactionAdd(ctx context.Context, s *discordgo.Session, reaction *discordgo.MessageReactionAdd) {
 	if reaction.UserID == s.State.User.ID {
 		return
 	}
-	if roles, err := t.ServerManager.GetReactRolesForMessage(server.ReactRoleMessage{GuildID: reaction.GuildID, ChannelID: reaction.ChannelID, ID: reaction.MessageID}); err == nil && roles != nil {
+	t.Commands.HandleReaction(ctx, s, reaction)
+	if !t.ServerManager.GuildSettings(ctx, reaction.GuildID).ModuleEnabled(server.ModuleReactRole) {
+		return
+	}
+	if roles, err := t.ServerManager.GetReactRolesForMessage(ctx, server.ReactRoleMessage{GuildID: reaction.GuildID, ChannelID: reaction.ChannelID, ID: reaction.MessageID}); err == nil {
 		log.Debug("Adding roles to user")
 		for _, rr := range roles {
 			if reaction.Emoji.APIName() != rr.Emoji {
@@ -287,16 +462,24 @@ func (t *tardis) handleReactionAdd(s *discordgo.Session, reaction *discordgo.Mes
 			}
 			if err := s.GuildMemberRoleAdd(reaction.GuildID, reaction.UserID, rr.Role); err != nil {
 				log.WithError(err).WithField("rr.Role_id", rr.Role).WithField("user_id", reaction.UserID).Error("Failed to add rr.Role to user")
+				continue
+			}
+			t.logBotAction(ctx, s, reaction.GuildID, reaction.UserID, fmt.Sprintf("Gave <@&%s> to <@%s> for reacting with %s", rr.Role, reaction.UserID, reaction.Emoji.MessageFormat()))
+			if err := t.ServerManager.CompleteOnboarding(ctx, reaction.GuildID, reaction.UserID); err != nil {
+				log.WithError(err).WithField("user_id", reaction.UserID).Warn("Failed to complete onboarding")
 			}
 		}
 	}
 }
 
-func (t *tardis) handleReactionRemove(s *discordgo.Session, reaction *discordgo.MessageReactionRemove) {
+func (t *tardis) handleReactionRemove(ctx context.Context, s *discordgo.Session, reaction *discordgo.MessageReactionRemove) {
 	if reaction.UserID == s.State.SessionID {
 		return
 	}
-	if roles, err := t.ServerManager.GetReactRolesForMessage(server.ReactRoleMessage{GuildID: reaction.GuildID, ChannelID: reaction.ChannelID, ID: reaction.MessageID}); err == nil && roles != nil {
+	if !t.ServerManager.GuildSettings(ctx, reaction.GuildID).ModuleEnabled(server.ModuleReactRole) {
+		return
+	}
+	if roles, err := t.ServerManager.GetReactRolesForMessage(ctx, server.ReactRoleMessage{GuildID: reaction.GuildID, ChannelID: reaction.ChannelID, ID: reaction.MessageID}); err == nil {
 		log.Debug("Removing roles to user")
 		for _, rr := range roles {
 			if reaction.Emoji.APIName() != rr.Emoji {
@@ -304,133 +487,222 @@ func (t *tardis) handleReactionRemove(s *discordgo.Session, reaction *discordgo.
 			}
 			if err := s.GuildMemberRoleRemove(reaction.GuildID, reaction.UserID, rr.Role); err != nil {
 				log.WithError(err).WithField("role_id", rr.Role).WithField("user", reaction.UserID).Error("Failed to remove role from user")
+				continue
 			}
+			t.logBotAction(ctx, s, reaction.GuildID, reaction.UserID, fmt.Sprintf("Took <@&%s> from <@%s> for removing their %s reaction", rr.Role, reaction.UserID, reaction.Emoji.MessageFormat()))
 		}
 	}
 }
 
-func (t *tardis) handleMemberJoin(s *discordgo.Session, join *discordgo.GuildMemberAdd) {
+func (t *tardis) handleMemberJoin(ctx context.Context, s *discordgo.Session, join *discordgo.GuildMemberAdd) {
 	log.Infof("Handling member join, %s, at %s", join.DisplayName(), join.JoinedAt)
 	guildID := join.GuildID
-	ch := t.WelcomeChannel[guildID]
-	if ch == nil {
-		welcomeChan, err := t.ServerManager.GetWelcomeChannel(guildID)
-		if err != nil {
-			return
+	t.Members.Remember(guildID, join.Member)
+	t.logMemberJoin(ctx, s, join.Member)
+	// Raid protection, verification and onboarding are turned on by
+	// setting them up, not by the welcome module
+	var raid *server.RaidProtection
+	if !join.User.Bot {
+		raid = t.Raids.Join(ctx, s, join.Member)
+		t.startVerification(ctx, join.Member)
+		if err := t.ServerManager.StartOnboarding(ctx, guildID, join.User.ID); err != nil {
+			log.WithError(err).WithField("guild_id", guildID).Warn("Failed to start tracking onboarding")
 		}
-		if welcomeChan == nil {
-			log.Error("Could not find a channel to write welcomes to")
-			return
+	}
+	// During a lockdown new members get no roles besides the quarantine
+	// role, and aren't welcomed
+	if raid != nil {
+		if raid.Action == server.RaidActionQuarantine && raid.QuarantineRole != "" {
+			log.WithField("guild_id", guildID).WithField("user_id", join.User.ID).Info("Quarantining member who joined during lockdown")
+			giveRoles(s, guildID, join.User.ID, []string{raid.QuarantineRole})
+			t.logBotAction(ctx, s, guildID, join.User.ID, fmt.Sprintf("Quarantined <@%s> with <@&%s>, they joined during a lockdown", join.User.ID, raid.QuarantineRole))
 		}
-		t.WelcomeChannel[guildID] = welcomeChan
-		ch = welcomeChan
+		return
 	}
-	if ch.EmojiChannelID == "" {
-		// Skip if we don't have a stored emoji channel
+	if !t.ServerManager.GuildSettings(ctx, guildID).ModuleEnabled(server.ModuleWelcome) {
 		return
 	}
-	s.ChannelMessageSend(ch.MessageChannelID, fmt.Sprintf("Welcome, %s! The channel you are looking for might be hidden, or appear locked, but you can access them after you've clicked the appropriate emoji-reaction below the message in <#%s>. (tip: click on the link to go directly to that message)", join.Mention(), ch.EmojiChannelID))
-}
+	t.goProtect("giveJoinRoles", eventSummary(join), func(ctx context.Context) {
+		t.giveJoinRoles(ctx, s, join.Member)
+	})
 
-func handleHelp(s *discordgo.Session, m *discordgo.MessageCreate) {
-	fieldTexts := [][]string{
-		{"hots", "aliases: aram | find build guides for HotS ARAM matches"},
+	channelID, msg, err := t.ServerManager.WelcomeMessage(ctx, s, join.Member)
+	if err != nil {
+		log.WithError(err).WithField("guild_id", guildID).Error("Failed to create welcome message")
+		return
+	}
+	if msg == nil {
+		log.WithField("guild_id", guildID).Debug("No welcome channel set, not welcoming member")
+		return
+	}
+	if _, err := s.ChannelMessageSendComplex(channelID, msg); err != nil {
+		log.WithError(err).WithField("guild_id", guildID).Error("Failed to send welcome message")
 	}
+}
 
-	fields := make([]*discordgo.MessageEmbedField, 0)
+func (t *tardis) handleMemberUpdate(ctx context.Context, s *discordgo.Session, update *discordgo.GuildMemberUpdate) {
+	t.Members.Remember(update.GuildID, update.Member)
+	t.logMemberUpdate(ctx, s, update)
 
-	for _, data := range fieldTexts {
-		field := discordgo.MessageEmbedField{
-			Name:  data[0],
-			Value: data[1],
-		}
-		fields = append(fields, &field)
+	// Members who were waiting for membership screening get their auto-roles now
+	if update.BeforeUpdate == nil || !update.BeforeUpdate.Pending || update.Pending {
+		return
+	}
+	if !t.ServerManager.GuildSettings(ctx, update.GuildID).ModuleEnabled(server.ModuleWelcome) {
+		return
+	}
+	autoRoles, err := t.ServerManager.GetAutoRoles(ctx, update.GuildID)
+	if err != nil || !autoRoles.WaitForScreening || (update.User.Bot && autoRoles.SkipBots) {
+		return
+	}
+	t.giveAutoRoles(ctx, s, update.Member, autoRoles)
+}
+
+// startVerification starts the clock for new members to verify, if the
+// guild wants them to.
+func (t *tardis) startVerification(ctx context.Context, member *discordgo.Member) {
+	logger := log.WithField("guild_id", member.GuildID).WithField("user_id", member.User.ID)
+	if _, err := t.ServerManager.GetVerification(ctx, member.GuildID); err != nil {
+		return
+	}
+	if err := t.ServerManager.StartMemberVerification(ctx, member.GuildID, member.User.ID); err != nil {
+		logger.WithError(err).Error("Failed to start verification")
 	}
+}
 
-	msg := discordgo.MessageEmbed{
-		URL:         "https://github.com/sklirg/tardis",
-		Title:       "TARDIS",
-		Description: "For feature requests and help, click the title (link).",
-		Fields:      fields,
+// giveJoinRoles gives back sticky roles to members who rejoin, and gives
+// auto-roles to new members unless they have to complete membership
+// screening first.
+func (t *tardis) giveJoinRoles(ctx context.Context, s *discordgo.Session, member *discordgo.Member) {
+	logger := log.WithField("guild_id", member.GuildID).WithField("user_id", member.User.ID)
+	autoRoles, err := t.ServerManager.GetAutoRoles(ctx, member.GuildID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to load auto-roles")
+		return
 	}
 
-	_, err := s.ChannelMessageSendEmbed(m.ChannelID, &msg)
+	sticky, err := t.ServerManager.TakeStickyRoles(ctx, member.GuildID, member.User.ID)
 	if err != nil {
-		fmt.Println("Failed to send help message :(")
+		logger.WithError(err).Error("Failed to load sticky roles")
+	}
+	// Only give back roles which are still sticky
+	if sticky = autoRoles.Sticky(sticky); len(sticky) > 0 {
+		logger.Infof("Giving back %d sticky roles", len(sticky))
+		giveRoles(s, member.GuildID, member.User.ID, sticky)
+		t.logBotAction(ctx, s, member.GuildID, member.User.ID, fmt.Sprintf("Gave back sticky roles to <@%s>: %s", member.User.ID, mentionRoles(sticky)))
+	}
+
+	if member.User.Bot && autoRoles.SkipBots {
+		return
+	}
+	if member.Pending && autoRoles.WaitForScreening {
+		logger.Debug("Waiting for membership screening before giving auto-roles")
+		return
 	}
+	t.giveAutoRoles(ctx, s, member, autoRoles)
 }
 
-func (tardis *tardis) handleApplicationCommands(s *discordgo.Session, event *discordgo.InteractionCreate) {
-	tardis.Commands.HandleApplicationCommands(s, event)
+func (t *tardis) giveAutoRoles(ctx context.Context, s *discordgo.Session, member *discordgo.Member, autoRoles *server.AutoRoles) {
+	if len(autoRoles.Roles) == 0 {
+		return
+	}
+	if autoRoles.Delay > 0 {
+		// Don't hold up the handler while waiting
+		t.goProtectAfter(autoRoles.Delay, "giveAutoRoles", fmt.Sprintf("auto-roles for user %s in guild %s", member.User.ID, member.GuildID), func(ctx context.Context) {
+			t.grantAutoRoles(ctx, s, member, autoRoles)
+		})
+		return
+	}
+	t.grantAutoRoles(ctx, s, member, autoRoles)
 }
 
-func (tardis *tardis) syncReactionRoles(guildID string) error {
-	logger := log.WithField("func", "syncReactionRoles")
-	logger.Info("Syncing reaction roles")
+func (t *tardis) grantAutoRoles(ctx context.Context, s *discordgo.Session, member *discordgo.Member, autoRoles *server.AutoRoles) {
+	log.WithField("guild_id", member.GuildID).WithField("user_id", member.User.ID).Infof("Giving %d auto-roles", len(autoRoles.Roles))
+	giveRoles(s, member.GuildID, member.User.ID, autoRoles.Roles)
+	t.logBotAction(ctx, s, member.GuildID, member.User.ID, fmt.Sprintf("Gave auto-roles to <@%s>: %s", member.User.ID, mentionRoles(autoRoles.Roles)))
+}
 
-	roles, err := tardis.ServerManager.GetReactionRoles()
-	if err != nil {
-		return err
+func giveRoles(s *discordgo.Session, guildID, userID string, roles []string) {
+	for _, role := range roles {
+		if err := s.GuildMemberRoleAdd(guildID, userID, role); err != nil {
+			log.WithError(err).WithField("role_id", role).WithField("user_id", userID).Error("Failed to add role to user")
+		}
 	}
+}
 
-	for _, role := range roles {
-		logger = logger.WithField("role_id", role.Role)
-
-		paginationEnd := ""
-		users := make([]*discordgo.User, 0)
-		for {
-			reactions, err := tardis.dg.MessageReactions(role.Message.ChannelID, role.Message.ID, role.Emoji, 100, "", paginationEnd)
-			if err != nil {
-				logger.Error("failed to get reactions for emoji")
-				break
-			}
-			logger.Infof("found %d %s reactions on %s, last one: %s, pageEnd: %s", len(reactions), role.Emoji, role.Message.ID, reactions[len(reactions)-1].ID, paginationEnd)
-			users = append(users, reactions...)
+// auditLogDelay gives the audit log time to record a kick or ban before
+// we look for it.
+const auditLogDelay = 2 * time.Second
 
-			if len(reactions) < 100 || paginationEnd == reactions[len(reactions)-1].ID {
-				break
+func (t *tardis) handleMemberRemove(ctx context.Context, s *discordgo.Session, leave *discordgo.GuildMemberRemove) {
+	if leave.Member == nil || leave.User == nil {
+		return
+	}
+	guildID := leave.GuildID
+	// The member is already gone from the state, so use what we remembered
+	snapshot, known := t.Members.Forget(guildID, leave.User.ID)
+	logger := log.WithField("guild_id", guildID).WithField("user_id", leave.User.ID)
+	logger.WithField("known", known).Infof("Handling member leave, %s", leave.User.Username)
+	t.logMemberLeave(ctx, s, guildID, leave.User, snapshot, known)
+
+	if leave.User.ID == s.State.User.ID {
+		return
+	}
+
+	if err := t.ServerManager.DeleteMemberVerification(ctx, guildID, leave.User.ID); err != nil {
+		logger.WithError(err).Warn("Failed to forget verification of member who left")
+	}
+	if err := t.ServerManager.LeaveOnboarding(ctx, guildID, leave.User.ID); err != nil {
+		logger.WithError(err).Warn("Failed to record member leaving onboarding")
+	}
+	if !t.ServerManager.GuildSettings(ctx, guildID).ModuleEnabled(server.ModuleWelcome) {
+		return
+	}
+	if autoRoles, err := t.ServerManager.GetAutoRoles(ctx, guildID); err == nil {
+		if sticky := autoRoles.Sticky(snapshot.Roles); len(sticky) > 0 {
+			if err := t.ServerManager.StoreStickyRoles(ctx, guildID, leave.User.ID, sticky); err != nil {
+				logger.WithError(err).Error("Failed to remember sticky roles")
 			}
-			paginationEnd = reactions[len(reactions)-1].ID
 		}
+	}
 
-		for _, user := range users {
-			logger = logger.WithFields(log.Fields{
-				"user_display_name": user.String(),
-				"user_id":           user.ID,
-			})
-			member, err := tardis.dg.State.Member(guildID, user.ID)
-			if err != nil {
-				logger.WithError(err).Warnf("Failed getting guild member, they might not be a member any more")
-
-				// Clean up reactions from the missing members
-				if tardis.cleanUpMissingMembers {
-					if err := tardis.dg.MessageReactionRemove(role.Message.ChannelID, role.Message.ID, role.Emoji, user.ID); err != nil {
-						logger.WithError(err).Error("Failed to clean up emoji for probably not a member any more")
-					}
-				}
-				continue
-			}
+	goodbye, err := t.ServerManager.GetGoodbyeChannel(ctx, guildID)
+	if err != nil {
+		return
+	}
 
-			// Figure out if user already has the role,
-			hasRole := false
-			for _, roleID := range member.Roles {
-				if roleID == role.Role {
-					hasRole = true
-					break
-				}
-			}
-			// if so, we can skip adding it.
-			if hasRole {
-				continue
-			}
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(auditLogDelay):
+	}
+	reason, moderator := server.MemberDeparture(s, guildID, leave.User.ID)
+	if moderator != "" {
+		reason = fmt.Sprintf("%s by <@%s>", reason, moderator)
+	}
 
-			logger.Info("Adding role to user")
+	data := server.WelcomeData{
+		Member: &discordgo.Member{
+			GuildID:  guildID,
+			User:     leave.User,
+			Nick:     snapshot.Nick,
+			JoinedAt: snapshot.JoinedAt,
+		},
+		Reason: reason,
+	}
+	if guild, err := s.State.Guild(guildID); err == nil {
+		data.Guild = guild
+	}
+	if _, err := s.ChannelMessageSendComplex(goodbye.ChannelID, goodbye.Render(data)); err != nil {
+		logger.WithError(err).Error("Failed to send goodbye message")
+	}
+}
 
-			if err := tardis.dg.GuildMemberRoleAdd(role.Message.GuildID, user.ID, role.Role); err != nil {
-				logger.WithError(err).Error("failed to sync role for user")
-			}
-		}
+func (tardis *tardis) handleApplicationCommands(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate) {
+	tardis.Commands.HandleInteraction(ctx, s, event)
+}
 
-	}
-	return nil
+func (tardis *tardis) syncReactionRoles(ctx context.Context, guildID string) error {
+	_, err := tardis.ServerManager.SyncReactionRoles(ctx, tardis.dg, guildID, tardis.cleanUpMissingMembers)
+	return err
 }
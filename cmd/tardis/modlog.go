@@ -0,0 +1,155 @@
+package tardis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/sklirg/tardis/server"
+)
+
+// Mod-log handlers record what happens in a guild in its mod-log channel.
+// They rely on discordgo's state for the before side of updates: members
+// and roles are tracked, and the last messages of every channel are kept
+// so edits and deletes can show what the message said.
+
+func (t *tardis) logMemberJoin(ctx context.Context, s *discordgo.Session, member *discordgo.Member) {
+	description := fmt.Sprintf(":inbox_tray: <@%s> joined", member.User.ID)
+	if created, err := discordgo.SnowflakeTimestamp(member.User.ID); err == nil {
+		description = fmt.Sprintf("%s, account created <t:%d:R>", description, created.Unix())
+	}
+	if member.User.Bot {
+		description += " (bot)"
+	}
+	t.ServerManager.LogModEvent(ctx, s, member.GuildID, server.ModLogJoins, server.ModLogUserEmbed(member.User, server.ModLogColorGood, description))
+}
+
+func (t *tardis) logMemberLeave(ctx context.Context, s *discordgo.Session, guildID string, user *discordgo.User, snapshot server.MemberSnapshot, known bool) {
+	description := fmt.Sprintf(":outbox_tray: <@%s> left", user.ID)
+	if known && !snapshot.JoinedAt.IsZero() {
+		description = fmt.Sprintf("%s after %s", description, server.HumanizeDuration(time.Since(snapshot.JoinedAt)))
+		if len(snapshot.Roles) > 0 {
+			description = fmt.Sprintf("%s\n**Roles:** %s", description, mentionRoles(snapshot.Roles))
+		}
+	}
+	t.ServerManager.LogModEvent(ctx, s, guildID, server.ModLogLeaves, server.ModLogUserEmbed(user, server.ModLogColorBad, description))
+}
+
+// logMemberUpdate records nickname and role changes, if discordgo knew
+// the member before the update.
+func (t *tardis) logMemberUpdate(ctx context.Context, s *discordgo.Session, update *discordgo.GuildMemberUpdate) {
+	before := update.BeforeUpdate
+	if before == nil || update.User == nil {
+		return
+	}
+
+	if before.Nick != update.Nick {
+		description := fmt.Sprintf(":pencil: <@%s> changed nickname from %s to %s", update.User.ID, quoteNick(before.Nick), quoteNick(update.Nick))
+		t.ServerManager.LogModEvent(ctx, s, update.GuildID, server.ModLogNicknames, server.ModLogUserEmbed(update.User, server.ModLogColorNeutral, description))
+	}
+
+	added, removed := diffRoles(before.Roles, update.Roles)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	lines := []string{fmt.Sprintf(":label: <@%s>'s roles changed", update.User.ID)}
+	if len(added) > 0 {
+		lines = append(lines, fmt.Sprintf("**Added:** %s", mentionRoles(added)))
+	}
+	if len(removed) > 0 {
+		lines = append(lines, fmt.Sprintf("**Removed:** %s", mentionRoles(removed)))
+	}
+	t.ServerManager.LogModEvent(ctx, s, update.GuildID, server.ModLogRoles, server.ModLogUserEmbed(update.User, server.ModLogColorNeutral, strings.Join(lines, "\n")))
+}
+
+func (t *tardis) handleMessageUpdate(ctx context.Context, s *discordgo.Session, update *discordgo.MessageUpdate) {
+	before := update.BeforeUpdate
+	// Embeds being added to a message are updates too, only log edits
+	if update.GuildID == "" || before == nil || before.Author == nil || before.Author.Bot || before.Content == update.Content {
+		return
+	}
+	description := fmt.Sprintf(":pencil2: <@%s> edited [a message](%s) in <#%s>", before.Author.ID, server.MessageLink(&discordgo.Message{GuildID: update.GuildID, ChannelID: update.ChannelID, ID: update.ID}), update.ChannelID)
+	t.ServerManager.LogModEvent(ctx, s, update.GuildID, server.ModLogMessageEdits, server.ModLogMessageEmbed(before, server.ModLogColorNeutral, description, before.Content, update.Content))
+}
+
+func (t *tardis) handleMessageDelete(ctx context.Context, s *discordgo.Session, deleted *discordgo.MessageDelete) {
+	if deleted.GuildID == "" {
+		return
+	}
+	before := deleted.BeforeDelete
+	if before == nil || before.Author == nil {
+		// Too old to be in the state, so all we know is where it was. Most
+		// of these are the bot cleaning up, so they have their own event
+		t.ServerManager.LogModEvent(ctx, s, deleted.GuildID, server.ModLogOldMessageDeletes, &discordgo.MessageEmbed{
+			Description: fmt.Sprintf(":wastebasket: A message was deleted in <#%s>, it's too old to show", deleted.ChannelID),
+			Color:       server.ModLogColorBad,
+			Footer:      &discordgo.MessageEmbedFooter{Text: fmt.Sprintf("Message ID: %s", deleted.ID)},
+		})
+		return
+	}
+	if before.Author.Bot {
+		return
+	}
+	description := fmt.Sprintf(":wastebasket: A message by <@%s> was deleted in <#%s>", before.Author.ID, deleted.ChannelID)
+	if len(before.Attachments) > 0 {
+		description = fmt.Sprintf("%s, with %d attachments", description, len(before.Attachments))
+	}
+	t.ServerManager.LogModEvent(ctx, s, deleted.GuildID, server.ModLogMessageDeletes, server.ModLogMessageEmbed(before, server.ModLogColorBad, description, before.Content, ""))
+}
+
+func (t *tardis) handleBanAdd(ctx context.Context, s *discordgo.Session, ban *discordgo.GuildBanAdd) {
+	t.ServerManager.LogModEvent(ctx, s, ban.GuildID, server.ModLogBans, server.ModLogUserEmbed(ban.User, server.ModLogColorBad, fmt.Sprintf(":hammer: <@%s> was banned", ban.User.ID)))
+}
+
+func (t *tardis) handleBanRemove(ctx context.Context, s *discordgo.Session, ban *discordgo.GuildBanRemove) {
+	t.ServerManager.LogModEvent(ctx, s, ban.GuildID, server.ModLogBans, server.ModLogUserEmbed(ban.User, server.ModLogColorGood, fmt.Sprintf(":unlock: <@%s> was unbanned", ban.User.ID)))
+}
+
+// logBotAction records a change the bot made to a member itself.
+func (t *tardis) logBotAction(ctx context.Context, s *discordgo.Session, guildID, userID, description string) {
+	t.ServerManager.LogModEvent(ctx, s, guildID, server.ModLogBotActions, &discordgo.MessageEmbed{
+		Description: fmt.Sprintf(":robot: %s", description),
+		Color:       server.ModLogColorNeutral,
+		Footer:      &discordgo.MessageEmbedFooter{Text: fmt.Sprintf("User ID: %s", userID)},
+	})
+}
+
+// diffRoles returns the roles in after but not before, and the roles in
+// before but not after.
+func diffRoles(before, after []string) ([]string, []string) {
+	had := make(map[string]bool, len(before))
+	for _, role := range before {
+		had[role] = true
+	}
+	added := make([]string, 0)
+	for _, role := range after {
+		if !had[role] {
+			added = append(added, role)
+		}
+		delete(had, role)
+	}
+	removed := make([]string, 0, len(had))
+	for _, role := range before {
+		if had[role] {
+			removed = append(removed, role)
+		}
+	}
+	return added, removed
+}
+
+func mentionRoles(roles []string) string {
+	mentions := make([]string, 0, len(roles))
+	for _, role := range roles {
+		mentions = append(mentions, fmt.Sprintf("<@&%s>", role))
+	}
+	return strings.Join(mentions, " ")
+}
+
+func quoteNick(nick string) string {
+	if nick == "" {
+		return "*none*"
+	}
+	return fmt.Sprintf("`%s`", nick)
+}
@@ -0,0 +1,52 @@
+package coder
+
+import (
+	"fmt"
+
+	"github.com/sklirg/tardis/metrics"
+	"github.com/sklirg/tardis/server"
+)
+
+// HybridCommand is the run command, which runs code in a container.
+func HybridCommand() *server.HybridCommand {
+	return &server.HybridCommand{
+		Name:        "run",
+		Description: "Run a code block and reply with what it prints",
+		Options: []*server.HybridOption{
+			{Name: "code", Description: "A code block starting with the language, like ```python print(1)```", Type: server.HybridText, Required: true},
+		},
+		Module:  server.ModuleRun,
+		Handler: handleRun,
+	}
+}
+
+func handleRun(ctx *server.HybridContext) error {
+	ctx.React("🚀")
+	ctx.Defer()
+
+	embed, err := Run(ctx.String("code"))
+	switch {
+	case err == TimeoutError:
+		metrics.CodeRuns.WithLabelValues("timeout").Inc()
+		ctx.React("⏰")
+	case err == CancelledError:
+		metrics.CodeRuns.WithLabelValues("cancelled").Inc()
+		ctx.React("🛑")
+		return ctx.Reply(":robot: Your code was stopped, because I'm restarting. Try again in a minute!")
+	case err != nil:
+		metrics.CodeRuns.WithLabelValues("error").Inc()
+		ctx.React("❌")
+	default:
+		metrics.CodeRuns.WithLabelValues("ok").Inc()
+	}
+	if err != nil {
+		return ctx.Reply(fmt.Sprintf(":x: Something went wrong: %s\n%s", err, Help))
+	}
+
+	// We got a successful response
+	ctx.React("✅")
+	if err := ctx.ReplyEmbed(embed); err != nil {
+		return ctx.Reply(":robot: Failed to send reply. :( Maybe the output is too long?")
+	}
+	return nil
+}
@@ -19,6 +19,16 @@ import (
 
 var UnsupportedLanguage = errors.New("unsupported programming language")
 var TimeoutError = errors.New("code execution timeout")
+var CancelledError = errors.New("code execution cancelled, the bot is shutting down")
+
+// running is the parent context of all code runs, cancelled by CancelAll.
+var running, cancelRunning = context.WithCancel(context.Background())
+
+// CancelAll stops all running code, killing their containers, and makes
+// later runs fail with CancelledError. It is called on shutdown.
+func CancelAll() {
+	cancelRunning()
+}
 
 func dockerRun(ctx context.Context, msg string) (<-chan *Code, error) {
 	c := make(chan *Code, 1)
@@ -79,6 +89,11 @@ func dockerRun(ctx context.Context, msg string) (<-chan *Code, error) {
 	startOptions := types.ContainerStartOptions{}
 	if err := cli.ContainerStart(ctx, container.ID, startOptions); err != nil {
 		log.WithError(err).Error("failed to start container")
+		// AutoRemove only removes containers which were started
+		if err := cli.ContainerRemove(context.Background(), container.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			log.WithError(err).WithField("container_id", container.ID).Error("failed to remove container")
+		}
+		c <- nil
 		return c, err
 	}
 	defer func() {
@@ -162,16 +177,15 @@ func dockerRun(ctx context.Context, msg string) (<-chan *Code, error) {
 	return c, nil
 }
 
-func Run(s *discordgo.Session, m *discordgo.MessageCreate) error {
+// Run runs the code block in msg in a container, and returns an embed
+// with the code and what it printed.
+func Run(msg string) (*discordgo.MessageEmbed, error) {
 	log.Debug("running some code smile")
-	if err := s.MessageReactionAdd(m.ChannelID, m.ID, "🚀"); err != nil {
-		log.WithError(err).Error("failed to add start-code reaction")
-	}
 	//cli, err := client.NewEnvClient()
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	ctx, cancel := context.WithTimeout(running, 1*time.Minute)
 	defer cancel()
 
-	ch, err := dockerRun(ctx, m.Content)
+	ch, err := dockerRun(ctx, msg)
 
 	var code *Code
 	select {
@@ -185,21 +199,21 @@ func Run(s *discordgo.Session, m *discordgo.MessageCreate) error {
 		}
 	}
 
+	if running.Err() != nil {
+		log.Info("Code run cancelled by shutdown")
+		return nil, CancelledError
+	}
+
 	if err != nil {
 		log.WithError(err).Error("dockerRun has err")
-		s.MessageReactionAdd(m.ChannelID, m.ID, "❌")
-		return err
+		return nil, err
 	}
 
 	if err := ctx.Err(); err != nil {
 		log.WithError(err).Error("ctx has err")
-		s.MessageReactionAdd(m.ChannelID, m.ID, "⏰")
-		return TimeoutError
+		return nil, TimeoutError
 	}
 
-	// We got a successful response
-	s.MessageReactionAdd(m.ChannelID, m.ID, "✅")
-
 	lines := strings.Join(code.Lines, "\n")
 	responseMessage := discordgo.MessageEmbed{
 		Title:       "Coder",
@@ -220,18 +234,11 @@ func Run(s *discordgo.Session, m *discordgo.MessageCreate) error {
 		})
 	}
 
-	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &responseMessage)
-	if err != nil {
-		log.WithError(err).Error("Failed to reply with output")
-		s.ChannelMessageSend(m.ChannelID, ":robot: Failed to send reply. :( Maybe the output is too long?")
-	}
-
-	return nil
+	return &responseMessage, nil
 }
 
-func SendHelp(s *discordgo.Session, m *discordgo.MessageCreate) {
-	s.ChannelMessageSend(m.ChannelID, ":robot: Use the `!run` command like this:\n!run\n\\`\\`\\`python\nprint(\"Hello, world!\")\n\\`\\`\\`\nWhere 'python' can be any supported language.`")
-}
+// Help explains how to use the run command.
+const Help = ":robot: Use the `!run` command like this:\n!run\n\\`\\`\\`python\nprint(\"Hello, world!\")\n\\`\\`\\`\nWhere 'python' can be any supported language. As a slash command, put it on one line: \\`\\`\\`python print(\"Hello, world!\")\\`\\`\\`"
 
 type Code struct {
 	Lines    []string
@@ -266,8 +273,12 @@ func parseCode(msg string) (*Code, error) {
 		logger.WithField("i", i).Tracef("Code: %s", line)
 	}
 
-	// language will always be before the first newline
+	// language will always be before the first newline, or the first
+	// space for code on one line, like slash commands send
 	lines := strings.Split(code1, "\n")
+	if lang, line, ok := strings.Cut(lines[0], " "); ok && len(lines) == 1 {
+		lines = []string{lang, line}
+	}
 	lang, err := parseLang(lines[0])
 	if err != nil {
 		return nil, err
@@ -0,0 +1,327 @@
+// Package config loads the configuration of the bot from command line
+// flags, environment variables and a YAML file, in that order of
+// precedence.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sklirg/tardis/server"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the bot.
+type Config struct {
+	DiscordToken  string
+	ApplicationID string
+	CommandScope  server.CommandScope
+	DatabaseURL   string
+	DatabasePool  server.PoolOptions
+	// DatabaseConnectTimeout is how long to keep retrying to connect to
+	// the database on start.
+	DatabaseConnectTimeout time.Duration
+	DevMode                bool
+	DevGuildID             string
+	AramSheetID            string
+	AramSheetRange         string
+	// GuildPurgeGrace is how long to keep a guild's data after the bot
+	// leaves it.
+	GuildPurgeGrace time.Duration
+	// OpsChannel is where handler errors and panics are reported.
+	OpsChannel string
+	// HTTPAddr is where health checks and metrics are served, if set.
+	HTTPAddr string
+}
+
+// Default returns the configuration used for what isn't configured.
+func Default() *Config {
+	return &Config{
+		CommandScope:           server.GuildCommandScope,
+		DatabasePool:           server.DefaultPoolOptions,
+		DatabaseConnectTimeout: time.Minute,
+		GuildPurgeGrace:        server.DefaultGuildPurgeGrace,
+	}
+}
+
+// Setting names of required settings, for Require.
+const (
+	DiscordToken  = "discord-token"
+	ApplicationID = "application-id"
+	DatabaseURL   = "database-url"
+)
+
+// configFileFlag is the flag, and configFileEnv the environment variable,
+// naming the YAML config file.
+const (
+	configFileFlag = "config"
+	configFileEnv  = "TARDIS_CONFIG"
+)
+
+// setting is a configurable value. It is set by the flag Name, the
+// environment variable Env, or the key in the config file, which is Name
+// with dashes replaced by underscores.
+//
+// A secret setting can also be read from a file, named by the flag
+// Name-file, the variable Env_FILE or the key Name_file, so it doesn't
+// have to be put in the environment or the config file.
+type setting struct {
+	Name   string
+	Env    string
+	Usage  string
+	Secret bool
+	Bool   bool
+	set    func(string) error
+	isSet  func() bool
+}
+
+func (s setting) key() string {
+	return strings.ReplaceAll(s.Name, "-", "_")
+}
+
+// sources describes where a setting can be configured, for errors.
+func (s setting) sources() string {
+	return fmt.Sprintf("--%s, %s or %s in the config file", s.Name, s.Env, s.key())
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		stringSetting(DiscordToken, "TARDIS_DISCORD_TOKEN", "token for connecting to the Discord API gateway", true, &c.DiscordToken),
+		stringSetting(ApplicationID, "TARDIS_APPLICATION_ID", "application ID used for registering application (slash) commands", false, &c.ApplicationID),
+		{
+			Name:  "command-scope",
+			Env:   "TARDIS_COMMAND_SCOPE",
+			Usage: "register application commands per 'guild' or 'global'-ly",
+			set: func(value string) error {
+				scope, err := server.ParseCommandScope(value)
+				c.CommandScope = scope
+				return err
+			},
+		},
+		stringSetting(DatabaseURL, "DATABASE_URL", "URL of the postgres database", true, &c.DatabaseURL),
+		intSetting("database-max-open-conns", "TARDIS_DATABASE_MAX_OPEN_CONNS", "most database connections open at once, 0 for no limit", &c.DatabasePool.MaxOpenConns),
+		intSetting("database-max-idle-conns", "TARDIS_DATABASE_MAX_IDLE_CONNS", "database connections kept open while idle", &c.DatabasePool.MaxIdleConns),
+		durationSetting("database-conn-max-lifetime", "TARDIS_DATABASE_CONN_MAX_LIFETIME", "how long to use a database connection before replacing it", &c.DatabasePool.ConnMaxLifetime),
+		durationSetting("database-connect-timeout", "TARDIS_DATABASE_CONNECT_TIMEOUT", "how long to retry connecting to the database on start", &c.DatabaseConnectTimeout),
+		{
+			Name:  "dev",
+			Env:   "TARDIS_DEV",
+			Usage: "run in dev mode, only listening to one channel and logging everything",
+			Bool:  true,
+			set: func(value string) (err error) {
+				c.DevMode, err = strconv.ParseBool(value)
+				return err
+			},
+		},
+		stringSetting("dev-guild", "TARDIS_DEV_GUILD", "guild to register commands in during development", false, &c.DevGuildID),
+		stringSetting("hots-aram-sheet-id", "TARDIS_HOTS_ARAM_SHEET_ID", "ID of the Google sheet with ARAM builds", false, &c.AramSheetID),
+		stringSetting("hots-aram-sheet-range", "TARDIS_HOTS_ARAM_SHEET_RANGE", "range of the ARAM builds in the sheet", false, &c.AramSheetRange),
+		durationSetting("guild-purge-grace", "TARDIS_GUILD_PURGE_GRACE", "how long to keep a guild's data after the bot leaves it", &c.GuildPurgeGrace),
+		stringSetting("ops-channel", "TARDIS_OPS_CHANNEL", "channel ID to report handler errors and panics in", false, &c.OpsChannel),
+		stringSetting("http-addr", "TARDIS_HTTP_ADDR", "address to serve health checks and metrics on, like :8080", false, &c.HTTPAddr),
+	}
+}
+
+func stringSetting(name, env, usage string, secret bool, value *string) setting {
+	return setting{
+		Name:   name,
+		Env:    env,
+		Usage:  usage,
+		Secret: secret,
+		set: func(v string) error {
+			*value = v
+			return nil
+		},
+		isSet: func() bool {
+			return *value != ""
+		},
+	}
+}
+
+func intSetting(name, env, usage string, value *int) setting {
+	return setting{
+		Name:  name,
+		Env:   env,
+		Usage: usage,
+		set: func(v string) (err error) {
+			*value, err = strconv.Atoi(v)
+			return err
+		},
+	}
+}
+
+func durationSetting(name, env, usage string, value *time.Duration) setting {
+	return setting{
+		Name:  name,
+		Env:   env,
+		Usage: usage,
+		set: func(v string) (err error) {
+			*value, err = time.ParseDuration(v)
+			return err
+		},
+	}
+}
+
+// RegisterFlags adds the flags for every setting, and for the config
+// file, to flags.
+func RegisterFlags(flags *pflag.FlagSet) {
+	flags.String(configFileFlag, "", fmt.Sprintf("YAML config file (env %s)", configFileEnv))
+	for _, s := range Default().settings() {
+		flags.String(s.Name, "", fmt.Sprintf("%s (env %s)", s.Usage, s.Env))
+		if s.Bool {
+			flags.Lookup(s.Name).NoOptDefVal = "true"
+		}
+		if s.Secret {
+			flags.String(s.Name+"-file", "", fmt.Sprintf("file to read the %s from (env %s_FILE)", s.Name, s.Env))
+		}
+	}
+}
+
+// Load loads the configuration from the defaults, the config file, the
+// environment and flags, where later ones take precedence. flags must
+// have been registered with RegisterFlags, and may be nil to skip them.
+func Load(flags *pflag.FlagSet) (*Config, error) {
+	c := Default()
+	settings := c.settings()
+
+	path := os.Getenv(configFileEnv)
+	if flags != nil && flags.Changed(configFileFlag) {
+		path, _ = flags.GetString(configFileFlag)
+	}
+	if path != "" {
+		values, err := readFile(path, settings)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range settings {
+			if err := apply(s, values[s.key()], values[s.key()+"_file"], fmt.Sprintf("%s in %s", s.key(), path)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, s := range settings {
+		value, file := os.Getenv(s.Env), ""
+		if s.Secret {
+			file = os.Getenv(s.Env + "_FILE")
+		}
+		if err := apply(s, value, file, s.Env); err != nil {
+			return nil, err
+		}
+	}
+
+	if flags != nil {
+		for _, s := range settings {
+			value, file := "", ""
+			if flags.Changed(s.Name) {
+				value, _ = flags.GetString(s.Name)
+			}
+			if s.Secret && flags.Changed(s.Name+"-file") {
+				file, _ = flags.GetString(s.Name + "-file")
+			}
+			if err := apply(s, value, file, "--"+s.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// apply sets the setting to value, or what the file contains, if either
+// is given. source names where they came from, for errors.
+func apply(s setting, value, file, source string) error {
+	if value != "" && file != "" {
+		return fmt.Errorf("%s is set both directly and from a file", source)
+	}
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s from file: %w", source, err)
+		}
+		value = strings.TrimSpace(string(content))
+		if value == "" {
+			return fmt.Errorf("%s: %s is empty", source, file)
+		}
+	}
+	if value == "" {
+		return nil
+	}
+	if err := s.set(value); err != nil {
+		return fmt.Errorf("invalid %s: %w", source, err)
+	}
+	return nil
+}
+
+// readFile reads the config file into values by key, and makes sure it
+// has no unknown keys, which are most likely typos.
+func readFile(path string, settings []setting) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	values := make(map[string]string)
+	if err := yaml.NewDecoder(bytes.NewReader(content)).Decode(&values); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	known := make(map[string]bool)
+	for _, s := range settings {
+		known[s.key()] = true
+		if s.Secret {
+			known[s.key()+"_file"] = true
+		}
+	}
+	for key := range values {
+		if !known[key] {
+			return nil, fmt.Errorf("unknown setting %s in config file %s", key, path)
+		}
+	}
+	return values, nil
+}
+
+func (c *Config) validate() error {
+	if c.GuildPurgeGrace <= 0 {
+		return fmt.Errorf("invalid guild purge grace %s, it must be positive", c.GuildPurgeGrace)
+	}
+	if c.DatabasePool.MaxOpenConns < 0 || c.DatabasePool.MaxIdleConns < 0 {
+		return errors.New("invalid database pool size, it can't be negative")
+	}
+	if c.DatabaseConnectTimeout <= 0 {
+		return fmt.Errorf("invalid database connect timeout %s, it must be positive", c.DatabaseConnectTimeout)
+	}
+	if c.HTTPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.HTTPAddr); err != nil {
+			return fmt.Errorf("invalid HTTP address '%s': %w", c.HTTPAddr, err)
+		}
+	}
+	return nil
+}
+
+// Require returns an error naming the settings which aren't set, and
+// where they can be set.
+func (c *Config) Require(names ...string) error {
+	missing := make([]string, 0)
+	for _, s := range c.settings() {
+		for _, name := range names {
+			if s.Name == name && s.isSet != nil && !s.isSet() {
+				missing = append(missing, fmt.Sprintf("%s (%s)", s.Name, s.sources()))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing configuration: %s", strings.Join(missing, "; "))
+	}
+	return nil
+}
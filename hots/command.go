@@ -0,0 +1,67 @@
+package hots
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sklirg/tardis/server"
+)
+
+// HybridCommand is the hots command, which looks up ARAM builds.
+func (b *AramBuilds) HybridCommand() *server.HybridCommand {
+	return &server.HybridCommand{
+		Name:              "hots",
+		Aliases:           []string{"aram"},
+		Description:       "Find build guides for HotS ARAM matches",
+		Module:            server.ModuleHots,
+		DefaultSubcommand: "build",
+		Subcommands: []*server.HybridCommand{
+			{
+				Name:        "build",
+				Description: "Find the ARAM build for a hero",
+				Options: []*server.HybridOption{
+					{Name: "hero", Description: "Name or alias of the hero", Type: server.HybridText, Required: true},
+				},
+				Handler: b.handleBuild,
+			},
+			{
+				Name:        "alias",
+				Description: "Add or remove an alias for a hero",
+				Options: []*server.HybridOption{
+					{Name: "action", Description: "Whether to add or remove the alias", Type: server.HybridString, Required: true, Choices: []string{"add", "remove"}},
+					{Name: "alias", Description: "alias=heroname to add, e.g. ll=li li, or the alias to remove", Type: server.HybridText, Required: true},
+				},
+				Permission: server.AdminCommandHotsAlias,
+				Handler: func(ctx *server.HybridContext) error {
+					b.load()
+					return ctx.Reply(b.handleAliasEdit([]string{"hots", "alias", ctx.String("action"), ctx.String("alias")}))
+				},
+			},
+			{
+				Name:        "sync",
+				Aliases:     []string{"_sync"},
+				Description: "Fetch the builds from the sheet again",
+				Permission:  server.AdminCommandHotsSync,
+				Handler:     b.handleSync,
+			},
+		},
+	}
+}
+
+func (b *AramBuilds) handleBuild(ctx *server.HybridContext) error {
+	ctx.Defer()
+	b.load()
+
+	msg, err := b.handleAramMessage(ctx.String("hero"), ctx.Location)
+	if err != nil {
+		return ctx.Reply(fmt.Sprintf(":warning: Failed to lookup build. ('error: %s')", err))
+	}
+	return ctx.ReplyEmbed(msg)
+}
+
+func (b *AramBuilds) handleSync(ctx *server.HybridContext) error {
+	b.load()
+	ctx.Reply(fmt.Sprintf(":robot: Okay, I'll sync (last sync at %s).", b.LastSync().In(ctx.Location).Format(time.RFC3339)))
+	b.sync()
+	return ctx.Reply(":robot: Done!")
+}
@@ -23,14 +23,17 @@ type AramBuild struct {
 // AramBuilds is a collection of ARAM builds.
 // The wrapper exists to set a LastSync attribute to avoid
 // fetching new buils all the time.
+// It is safe for concurrent use; the builds and aliases are only
+// accessed with mu held.
 type AramBuilds struct {
-	once        sync.Once
-	osloLoc     *time.Location
-	SheetID     string
-	SheetRange  string
-	LastSync    time.Time
-	Builds      *map[string]*AramBuild
-	HeroAliases map[string]string
+	once       sync.Once
+	SheetID    string
+	SheetRange string
+
+	mu          sync.RWMutex
+	lastSync    time.Time
+	builds      map[string]*AramBuild
+	heroAliases map[string]string
 }
 
 func readHeroAliasesMap() map[string]string {
@@ -107,13 +110,19 @@ func fetchAramBuilds(sheetID, sheetRange string) map[string]*AramBuild {
 // It will check the supplied hero name against a list of known
 // aliases for the heroes
 func (b *AramBuilds) GetAramBuild(h string, force bool) (*AramBuild, error) {
-	hero, _ := b.GetHeroName(h)
+	if b == nil {
+		return nil, fmt.Errorf("builds are not defined, try running '!hots _sync' maybe?")
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-	if b == nil || b.Builds == nil {
+	hero, _ := b.heroName(h)
+
+	if b.builds == nil {
 		return nil, fmt.Errorf("builds are not defined, try running '!hots _sync' maybe?")
 	}
 
-	for _, b := range *b.Builds {
+	for _, b := range b.builds {
 		if strings.ToLower(b.Hero) == strings.ToLower(hero) {
 			return b, nil
 		}
@@ -126,7 +135,14 @@ func (b *AramBuilds) GetAramBuild(h string, force bool) (*AramBuild, error) {
 // If it doesn't exist, it will return the original name together
 // with an error.
 func (b *AramBuilds) GetHeroName(hero string) (string, error) {
-	for k, h := range b.HeroAliases {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.heroName(hero)
+}
+
+// heroName is GetHeroName for callers which hold mu.
+func (b *AramBuilds) heroName(hero string) (string, error) {
+	for k, h := range b.heroAliases {
 		if hero == h {
 			return hero, nil
 		}
@@ -138,67 +154,40 @@ func (b *AramBuilds) GetHeroName(hero string) (string, error) {
 	return hero, fmt.Errorf("hero '%s' missing in heroes map", hero)
 }
 
-// HandleDiscordMessage handles discord messages to craft replies based on
-// the tokens of a message.
-func (b *AramBuilds) HandleDiscordMessage(s *discordgo.Session, m *discordgo.MessageCreate) {
+// load fetches the builds and reads the aliases the first time they are
+// needed.
+func (b *AramBuilds) load() {
 	b.once.Do(func() {
-		builds := fetchAramBuilds(b.SheetID, b.SheetRange)
-		loc, err := time.LoadLocation("Europe/Oslo")
+		b.sync()
 
-		if err != nil {
-			fmt.Println("Failed to load timezone")
-			loc = time.Local
-		}
-
-		b.osloLoc = loc
-		b.Builds = &builds
-		b.LastSync = time.Now()
-		b.HeroAliases = readHeroAliasesMap()
+		b.mu.Lock()
+		b.heroAliases = readHeroAliasesMap()
+		b.mu.Unlock()
 	})
+}
 
-	tokens := strings.Split(m.Content[1:], " ")
-
-	switch tokens[0] {
-	case "aram", "hots":
-		if len(tokens) == 1 {
-			s.ChannelMessageSend(m.ChannelID, ":warning: Error: Add the hero name you want to look up.")
-			return
-		}
-
-		// Magic keyword to re-fetch the builds
-		if tokens[1] == "_sync" {
-			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf(":robot: Okay, I'll sync (last sync at %s).", b.LastSync.Format(time.RFC3339)))
-			builds := fetchAramBuilds(b.SheetID, b.SheetRange)
-			b.Builds = &builds
-			b.LastSync = time.Now()
-			s.ChannelMessageSend(m.ChannelID, ":robot: Done!")
-			return
-		}
-
-		// Magic keyword for adding alias for hero
-		if tokens[1] == "alias" {
-			msg := b.handleAliasEdit(m.Content)
-			s.ChannelMessageSend(m.ChannelID, msg)
-			return
-		}
-
-		msg, err := b.handleAramMessage(strings.Join(tokens[1:], " "))
-
-		if err != nil {
-			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf(":warning: Failed to lookup build. ('error: %s')", err))
-			return
-		}
+// LastSync is when the builds were last fetched from the sheet.
+func (b *AramBuilds) LastSync() time.Time {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.lastSync
+}
 
-		_, err = s.ChannelMessageSendEmbed(m.ChannelID, msg)
+// sync fetches the builds from the sheet. The sheet is read without
+// holding the lock, so lookups aren't blocked meanwhile.
+func (b *AramBuilds) sync() {
+	b.setBuilds(fetchAramBuilds(b.SheetID, b.SheetRange))
+}
 
-		if err != nil {
-			fmt.Println("Failed to send ARAM message")
-		}
-		return
-	}
+// setBuilds replaces the builds with freshly fetched ones.
+func (b *AramBuilds) setBuilds(builds map[string]*AramBuild) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.builds = builds
+	b.lastSync = time.Now()
 }
 
-func (b *AramBuilds) handleAramMessage(h string) (*discordgo.MessageEmbed, error) {
+func (b *AramBuilds) handleAramMessage(h string, loc *time.Location) (*discordgo.MessageEmbed, error) {
 
 	hero, _ := b.GetHeroName(h)
 
@@ -220,7 +209,7 @@ func (b *AramBuilds) handleAramMessage(h string) (*discordgo.MessageEmbed, error
 	}
 
 	footer := discordgo.MessageEmbedFooter{
-		Text: fmt.Sprintf("Last update from sheets: %s", b.LastSync.In(b.osloLoc).Format("2006/01/02 15:04:05 MST")),
+		Text: fmt.Sprintf("Last update from sheets: %s", b.LastSync().In(loc).Format("2006/01/02 15:04:05 MST")),
 	}
 
 	return &discordgo.MessageEmbed{
@@ -233,10 +222,14 @@ func (b *AramBuilds) handleAramMessage(h string) (*discordgo.MessageEmbed, error
 	}, nil
 }
 
-func (b *AramBuilds) handleAliasEdit(msg string) string {
+func (b *AramBuilds) handleAliasEdit(tokens []string) string {
+	// The aliases file is read and written as a whole, so edits mustn't
+	// interleave
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	help := ":information_source: specify either 'add' or 'remove' followed by `alias=heroname`, e.g. `anub=anub'arak` or `ll=li li`"
 
-	tokens := strings.Split(msg[1:], " ")
 	if len(tokens) <= 3 {
 		return help
 	}
@@ -252,7 +245,7 @@ func (b *AramBuilds) handleAliasEdit(msg string) string {
 			hero := strings.TrimSpace(aliasTokens[1])
 			aliases := readHeroAliasesMap()
 			aliases[alias] = hero
-			b.HeroAliases = aliases
+			b.heroAliases = aliases
 			writeHeroAliasesMap(aliases, true)
 			return ":robot: Done!"
 		}
@@ -261,7 +254,7 @@ func (b *AramBuilds) handleAliasEdit(msg string) string {
 			alias := strings.TrimSpace(tokens[3])
 			aliases := readHeroAliasesMap()
 			delete(aliases, alias)
-			b.HeroAliases = aliases
+			b.heroAliases = aliases
 			writeHeroAliasesMap(aliases, false)
 			return ":robot: Done!"
 		}
@@ -0,0 +1,65 @@
+package hots
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestAramBuildsConcurrently looks up builds while aliases are edited and
+// the builds are replaced, the way handlers and syncs run at once. It is
+// meant to be run with -race.
+func TestAramBuildsConcurrently(t *testing.T) {
+	// The aliases are kept in the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err := os.WriteFile("./heroaliases.json", []byte(`{"ll": "Li Li"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &AramBuilds{
+		builds: map[string]*AramBuild{
+			"Li Li": {Hero: "Li Li", Abilities: []string{"Q", "W", "E"}},
+		},
+		heroAliases: readHeroAliasesMap(),
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				switch worker % 4 {
+				case 0:
+					b.handleAliasEdit([]string{"!hots", "alias", "add", fmt.Sprintf("alias%d=Li Li", i)})
+				case 1:
+					// What sync does once the sheet is fetched
+					b.setBuilds(map[string]*AramBuild{
+						"Li Li": {Hero: "Li Li", Abilities: []string{"Q", "W", "E"}},
+					})
+				case 2:
+					if _, err := b.handleAramMessage("ll", time.UTC); err != nil {
+						t.Errorf("expected a build for ll, got %s", err)
+					}
+				default:
+					b.GetHeroName("ll")
+					b.LastSync()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if hero, err := b.GetHeroName("alias99"); err != nil || hero != "Li Li" {
+		t.Errorf("expected alias99 to be Li Li, got %s (%v)", hero, err)
+	}
+}
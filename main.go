@@ -3,8 +3,12 @@ package main
 import (
 	"os"
 
+	"github.com/sklirg/tardis/cmd/commands"
+	"github.com/sklirg/tardis/cmd/doctor"
+	"github.com/sklirg/tardis/cmd/guilds"
 	"github.com/sklirg/tardis/cmd/migrate"
 	"github.com/sklirg/tardis/cmd/tardis"
+	"github.com/sklirg/tardis/config"
 	"github.com/spf13/cobra"
 )
 
@@ -12,11 +16,20 @@ var rootCmd = &cobra.Command{
 	Use:   "tardis",
 	Short: "",
 	Long:  ``,
-	Run: func(cmd *cobra.Command, args []string) {
-		tardis.Run()
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		cfg, err = config.Load(cmd.Flags())
+		return err
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tardis.Run(cfg)
 	},
+	SilenceUsage: true,
 }
 
+// cfg is the configuration, loaded before any command runs.
+var cfg *config.Config
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -24,7 +37,23 @@ func main() {
 }
 
 func init() {
+	config.RegisterFlags(rootCmd.PersistentFlags())
+
 	rootCmd.AddCommand(versionCmd)
+
+	for _, cmd := range []*cobra.Command{commandsSyncCmd, commandsListCmd, commandsPurgeCmd} {
+		cmd.Flags().StringVar(&commandsOpts.GuildID, "guild", "", "only act on this guild")
+		cmd.Flags().BoolVar(&commandsOpts.Global, "global", false, "act on global commands instead of guild commands")
+		commandsCmd.AddCommand(cmd)
+	}
+	rootCmd.AddCommand(commandsCmd)
+
+	guildsCmd.AddCommand(guildsListCmd, guildsPurgeCmd)
+	rootCmd.AddCommand(guildsCmd)
+
+	doctorCmd.Flags().StringVar(&doctorOpts.GuildID, "guild", "", "only check this guild")
+	doctorCmd.Flags().BoolVar(&doctorOpts.JSON, "json", false, "print the report as JSON")
+	rootCmd.AddCommand(doctorCmd)
 }
 
 var versionCmd = &cobra.Command{
@@ -32,6 +61,80 @@ var versionCmd = &cobra.Command{
 	Short: "run migrations",
 	Long:  `Run database migrations for tardis`,
 	Run: func(cmd *cobra.Command, args []string) {
-		migrate.Migrate()
+		migrate.Migrate(cfg)
+	},
+}
+
+var commandsOpts commands.Options
+
+var commandsCmd = &cobra.Command{
+	Use:   "commands",
+	Short: "manage application commands",
+	Long:  `Manage the application (slash) commands registered with Discord`,
+}
+
+var commandsSyncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "register application commands",
+	Long:  `Register application commands, only overwriting them where they differ`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		commandsOpts.Config = cfg
+		return commands.Sync(commandsOpts)
+	},
+}
+
+var commandsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list registered application commands",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		commandsOpts.Config = cfg
+		return commands.List(commandsOpts)
+	},
+}
+
+var commandsPurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "remove all registered application commands",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		commandsOpts.Config = cfg
+		return commands.Purge(commandsOpts)
+	},
+}
+
+var guildsCmd = &cobra.Command{
+	Use:   "guilds",
+	Short: "manage known guilds",
+	Long:  `Inspect the guilds the bot is in, and purge data of guilds it left`,
+}
+
+var guildsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the guilds the bot is in",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return guilds.List(cmd.Context(), cfg)
+	},
+}
+
+var guildsPurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "purge data of guilds left longer than the grace period ago",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return guilds.Purge(cmd.Context(), cfg)
+	},
+}
+
+var doctorOpts doctor.Options
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "check the configuration, database and Discord setup",
+	Long:  `Check the configuration, the database and its migrations, and the bot's login, intents, permissions, roles and channels in every guild it is in`,
+	// Report a bad configuration instead of failing before running
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		doctorOpts.Config, doctorOpts.ConfigErr = config.Load(cmd.Flags())
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doctor.Run(cmd.Context(), doctorOpts)
 	},
 }
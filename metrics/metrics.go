@@ -0,0 +1,149 @@
+// Package metrics has the Prometheus metrics of the bot.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "tardis"
+
+var (
+	// Events counts the gateway events handled, by event type.
+	Events = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_total",
+		Help:      "Gateway events handled, by event type.",
+	}, []string{"type"})
+
+	// CommandDuration is how long commands take to handle, by kind (slash,
+	// component, modal or text) and command.
+	CommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "command_duration_seconds",
+		Help:      "Time taken to handle commands, by kind and command.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"kind", "command"})
+
+	// RoleMutations counts roles given to and taken from members.
+	RoleMutations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "role_mutations_total",
+		Help:      "Roles given to (add) and taken from (remove) members, by result.",
+	}, []string{"action", "result"})
+
+	// APIErrors counts Discord API requests failing with an error status,
+	// besides rate limits.
+	APIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "discord_api_errors_total",
+		Help:      "Discord API requests failing, by status code. Rate limits are counted separately.",
+	}, []string{"status"})
+
+	// RateLimits counts Discord API requests which were rate limited.
+	RateLimits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "discord_rate_limits_total",
+		Help:      "Discord API requests which were rate limited, by scope (global or route).",
+	}, []string{"scope"})
+
+	// CodeRuns counts the code run with the run command, by result.
+	CodeRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "code_runs_total",
+		Help:      "Code run with the run command, by result.",
+	}, []string{"result"})
+)
+
+// Handler serves the metrics for Prometheus to scrape.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveCommand records how long a command took since start.
+func ObserveCommand(kind, command string, start time.Time) {
+	CommandDuration.WithLabelValues(kind, command).Observe(time.Since(start).Seconds())
+}
+
+// RegisterSyncAge exports how long ago lastSync says the ARAM builds
+// were fetched from the sheet, or -1 if they haven't been.
+func RegisterSyncAge(lastSync func() time.Time) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "aram_sync_age_seconds",
+		Help:      "Seconds since the ARAM builds were fetched from the sheet, -1 if they haven't been.",
+	}, func() float64 {
+		last := lastSync()
+		if last.IsZero() {
+			return -1
+		}
+		return time.Since(last).Seconds()
+	})
+}
+
+// Transport counts Discord API errors, rate limits and role mutations
+// from the responses to requests made with next.
+func Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return roundTripper{next: next}
+}
+
+type roundTripper struct {
+	next http.RoundTripper
+}
+
+func (rt roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.next.RoundTrip(req)
+
+	action := roleMutation(req)
+	switch {
+	case err != nil:
+		APIErrors.WithLabelValues("network").Inc()
+	case resp.StatusCode == http.StatusTooManyRequests:
+		scope := "route"
+		if resp.Header.Get("X-RateLimit-Global") == "true" {
+			scope = "global"
+		}
+		RateLimits.WithLabelValues(scope).Inc()
+		// Rate limited requests are retried, so only the retry counts as
+		// a role mutation
+		return resp, err
+	case resp.StatusCode >= 400:
+		APIErrors.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+	}
+
+	if action != "" {
+		result := "ok"
+		if err != nil || resp.StatusCode >= 400 {
+			result = "error"
+		}
+		RoleMutations.WithLabelValues(action, result).Inc()
+	}
+	return resp, err
+}
+
+// roleMutation returns whether the request gives a member a role (add)
+// or takes it (remove), or "" if it does neither.
+func roleMutation(req *http.Request) string {
+	// /api/v9/guilds/<guild>/members/<user>/roles/<role>
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	n := len(parts)
+	if n < 6 || parts[n-6] != "guilds" || parts[n-4] != "members" || parts[n-2] != "roles" {
+		return ""
+	}
+	switch req.Method {
+	case http.MethodPut:
+		return "add"
+	case http.MethodDelete:
+		return "remove"
+	}
+	return ""
+}
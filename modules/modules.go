@@ -0,0 +1,37 @@
+// Package modules lists the commands of the modules which live outside
+// the server package, so the bot and the command tooling agree on them.
+package modules
+
+import (
+	"github.com/sklirg/tardis/coder"
+	"github.com/sklirg/tardis/hots"
+	"github.com/sklirg/tardis/server"
+)
+
+// HybridCommands returns every hybrid command, which are both text and
+// slash commands. The builds may be nil when only the definitions are
+// needed.
+func HybridCommands(store *server.DiscordServerStore, builds *hots.AramBuilds) []*server.HybridCommand {
+	if builds == nil {
+		builds = &hots.AramBuilds{}
+	}
+	commands := []*server.HybridCommand{
+		builds.HybridCommand(),
+		coder.HybridCommand(),
+	}
+	return append(commands, store.HybridCommands()...)
+}
+
+// ApplicationCommands returns every application command, including the
+// slash commands of the hybrid commands.
+func ApplicationCommands(store *server.DiscordServerStore, builds *hots.AramBuilds) []*server.ApplicationCommand {
+	commands := server.AvailableApplicationCommands(store)
+	for _, hybrid := range HybridCommands(store, builds) {
+		if hybrid.SlashSubcommand != "" {
+			// Registered by the command it's a subcommand of
+			continue
+		}
+		commands = append(commands, hybrid.ApplicationCommand(store))
+	}
+	return commands
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// autoRoleCommand lets admins pick roles given to members when they join.
+func autoRoleCommand(store *DiscordServerStore) *ApplicationCommand {
+
+	roleOption := &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionRole,
+		Name:        "role",
+		Description: "The role",
+		Required:    true,
+	}
+
+	cmd := &ApplicationCommand{
+		Name: "autorole",
+		Command: &discordgo.ApplicationCommand{
+			Name:        "autorole",
+			Description: "Give roles to members when they join",
+			Version:     "1",
+			Type:        discordgo.ChatApplicationCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "add",
+					Description: "Give a role to members when they join",
+					Options:     []*discordgo.ApplicationCommandOption{roleOption},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "remove",
+					Description: "Stop giving a role to members when they join",
+					Options:     []*discordgo.ApplicationCommandOption{roleOption},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "show",
+					Description: "Show which roles members get when they join",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "options",
+					Description: "Change when members get the roles",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "delay",
+							Description: "How long to wait after they join, e.g. 10m, or 0 to not wait",
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionBoolean,
+							Name:        "skip-bots",
+							Description: "Don't give the roles to bots",
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionBoolean,
+							Name:        "wait-for-screening",
+							Description: "Wait until members have agreed to the rules",
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+					Name:        "sticky",
+					Description: "Give roles back to members who leave and rejoin",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "add",
+							Description: "Give this role back to members who rejoin",
+							Options:     []*discordgo.ApplicationCommandOption{roleOption},
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "remove",
+							Description: "Stop giving this role back to members who rejoin",
+							Options:     []*discordgo.ApplicationCommandOption{roleOption},
+						},
+					},
+				},
+			},
+		},
+		Module:     ModuleWelcome,
+		Permission: AdminCommandAutoRole,
+		store:      store,
+	}
+	cmd.Subcommands = map[string]SubcommandHandler{
+		"add": cmd.autoRolesUpdate(func(a *AutoRoles, role *discordgo.Role, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) (string, error) {
+			if err := assignableRole(a.GuildID, role); err != nil {
+				return "", err
+			}
+			if !slices.Contains(a.Roles, role.ID) {
+				a.Roles = append(a.Roles, role.ID)
+			}
+			return fmt.Sprintf("gives <@&%s> to members who join", role.ID), nil
+		}),
+		"remove": cmd.autoRolesUpdate(func(a *AutoRoles, role *discordgo.Role, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) (string, error) {
+			a.Roles = slices.DeleteFunc(a.Roles, func(id string) bool { return id == role.ID })
+			return fmt.Sprintf("no longer gives <@&%s> to members who join", role.ID), nil
+		}),
+		"options": cmd.autoRolesUpdate(func(a *AutoRoles, _ *discordgo.Role, options map[string]*discordgo.ApplicationCommandInteractionDataOption) (string, error) {
+			if option, ok := options["delay"]; ok {
+				delay, err := time.ParseDuration(option.StringValue())
+				if option.StringValue() == "0" {
+					delay, err = 0, nil
+				}
+				if err != nil || delay < 0 || delay > 24*time.Hour {
+					return "", fmt.Errorf("the delay has to be like 30s or 10m, and at most a day")
+				}
+				a.Delay = delay
+			}
+			if option, ok := options["skip-bots"]; ok {
+				a.SkipBots = option.BoolValue()
+			}
+			if option, ok := options["wait-for-screening"]; ok {
+				a.WaitForScreening = option.BoolValue()
+			}
+			return fmt.Sprintf("changed auto-role options: %s", describeAutoRoleOptions(a)), nil
+		}),
+		"sticky add": cmd.autoRolesUpdate(func(a *AutoRoles, role *discordgo.Role, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) (string, error) {
+			if err := assignableRole(a.GuildID, role); err != nil {
+				return "", err
+			}
+			if !slices.Contains(a.StickyRoles, role.ID) {
+				a.StickyRoles = append(a.StickyRoles, role.ID)
+			}
+			return fmt.Sprintf("gives <@&%s> back to members who rejoin", role.ID), nil
+		}),
+		"sticky remove": cmd.autoRolesUpdate(func(a *AutoRoles, role *discordgo.Role, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) (string, error) {
+			a.StickyRoles = slices.DeleteFunc(a.StickyRoles, func(id string) bool { return id == role.ID })
+			return fmt.Sprintf("no longer gives <@&%s> back to members who rejoin", role.ID), nil
+		}),
+		"show": cmd.autoRolesShow,
+	}
+
+	return cmd
+}
+
+// assignableRole checks that the bot can give the role to members.
+func assignableRole(guildID string, role *discordgo.Role) error {
+	if role.ID == guildID {
+		return fmt.Errorf("everyone already has @everyone")
+	}
+	if role.Managed {
+		return fmt.Errorf("<@&%s> is managed by an integration, and can't be given to members", role.ID)
+	}
+	return nil
+}
+
+// autoRolesUpdate creates a subcommand handler which applies a change to
+// the auto-roles of a guild and returns a description of it.
+func (cmd *ApplicationCommand) autoRolesUpdate(apply func(*AutoRoles, *discordgo.Role, map[string]*discordgo.ApplicationCommandInteractionDataOption) (string, error)) SubcommandHandler {
+	return func(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+		var role *discordgo.Role
+		if option, ok := options["role"]; ok {
+			role = option.RoleValue(s, event.GuildID)
+		}
+
+		var change string
+		var invalid error
+		_, err := cmd.store.UpdateAutoRoles(ctx, event.GuildID, func(a *AutoRoles) error {
+			change, invalid = apply(a, role, options)
+			return invalid
+		})
+		if invalid != nil {
+			return respondEphemeral(s, event.Interaction, fmt.Sprintf(":x: %s.", invalid))
+		}
+		if err != nil {
+			log.WithError(err).WithField("guild_id", event.GuildID).Warn("Failed to update auto-roles")
+			return respondEphemeral(s, event.Interaction, ":x: Couldn't change the auto-roles.")
+		}
+
+		cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":busts_in_silhouette: <@%s> %s", interactionUserID(event), change))
+
+		return respondEphemeral(s, event.Interaction, fmt.Sprintf(":+1: Okay, the bot now %s.", change))
+	}
+}
+
+func (cmd *ApplicationCommand) autoRolesShow(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	a, err := cmd.store.GetAutoRoles(ctx, event.GuildID)
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the auto-roles.")
+	}
+
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+			Embeds: []*discordgo.MessageEmbed{
+				{
+					Title:       "Auto-roles",
+					Description: "The bot can only give roles below its own highest role.",
+					Fields: []*discordgo.MessageEmbedField{
+						{Name: "Given on join", Value: describeRoles(a.Roles)},
+						{Name: "Options", Value: describeAutoRoleOptions(a)},
+						{Name: "Given back on rejoin", Value: describeRoles(a.StickyRoles)},
+					},
+				},
+			},
+		},
+	})
+}
+
+func describeRoles(roles []string) string {
+	if len(roles) == 0 {
+		return "none"
+	}
+	mentions := make([]string, 0, len(roles))
+	for _, role := range roles {
+		mentions = append(mentions, fmt.Sprintf("<@&%s>", role))
+	}
+	return strings.Join(mentions, ", ")
+}
+
+func describeAutoRoleOptions(a *AutoRoles) string {
+	return fmt.Sprintf("delay %s, skip bots %s, wait for screening %s", a.Delay, onOff(a.SkipBots), onOff(a.WaitForScreening))
+}
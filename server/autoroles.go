@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// AutoRoles are roles given to members when they join a guild.
+type AutoRoles struct {
+	GuildID string
+	Roles   []string
+	// Delay waits before giving the roles, e.g. to keep raids from
+	// seeing channels right away.
+	Delay time.Duration
+	// SkipBots doesn't give the roles to bots.
+	SkipBots bool
+	// WaitForScreening waits until the member has completed membership
+	// screening (the rules) before giving the roles.
+	WaitForScreening bool
+	// StickyRoles are given back to members who rejoin, if they had them
+	// when they left.
+	StickyRoles []string
+}
+
+func DefaultAutoRoles(guildID string) *AutoRoles {
+	return &AutoRoles{
+		GuildID:          guildID,
+		Roles:            []string{},
+		SkipBots:         true,
+		WaitForScreening: true,
+		StickyRoles:      []string{},
+	}
+}
+
+// Sticky returns which of the roles are sticky.
+func (a *AutoRoles) Sticky(roles []string) []string {
+	sticky := make([]string, 0)
+	for _, role := range roles {
+		if slices.Contains(a.StickyRoles, role) {
+			sticky = append(sticky, role)
+		}
+	}
+	return sticky
+}
+
+// GetAutoRoles returns the auto-roles of a guild, or the defaults if it
+// hasn't configured any.
+func (srv *DiscordServerStore) GetAutoRoles(ctx context.Context, guildID string) (*AutoRoles, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	a := DefaultAutoRoles(guildID)
+	var delay int
+	err := srv.db.QueryRowContext(ctx, `
+                SELECT roles, delay_seconds, skip_bots, wait_for_screening, sticky_roles
+                FROM auto_roles WHERE guild = $1`, guildID).Scan(pq.Array(&a.Roles), &delay, &a.SkipBots, &a.WaitForScreening, pq.Array(&a.StickyRoles))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return a, nil
+		}
+		log.WithError(err).Error("Failed to fetch auto-roles")
+		return nil, err
+	}
+	a.Delay = time.Duration(delay) * time.Second
+
+	return a, nil
+}
+
+// UpdateAutoRoles applies a change to the auto-roles of a guild, and
+// returns them as stored. The row is locked while the change is applied,
+// so concurrent changes don't overwrite each other. If update fails
+// nothing is stored.
+func (srv *DiscordServerStore) UpdateAutoRoles(ctx context.Context, guildID string, update func(*AutoRoles) error) (*AutoRoles, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	a := DefaultAutoRoles(guildID)
+	err := srv.inTx(ctx, func(tx *sql.Tx) error {
+		// Make sure there is a row to lock
+		if _, err := tx.ExecContext(ctx, `
+                        INSERT INTO auto_roles
+                                (guild, roles, delay_seconds, skip_bots, wait_for_screening, sticky_roles)
+                        VALUES ($1, $2, $3, $4, $5, $6)
+                        ON CONFLICT (guild) DO NOTHING`,
+			a.GuildID, pq.Array(a.Roles), int(a.Delay/time.Second), a.SkipBots, a.WaitForScreening, pq.Array(a.StickyRoles)); err != nil {
+			log.WithError(err).Error("Failed to create auto-roles")
+			return err
+		}
+
+		var delay int
+		if err := tx.QueryRowContext(ctx, `
+                        SELECT roles, delay_seconds, skip_bots, wait_for_screening, sticky_roles
+                        FROM auto_roles WHERE guild = $1 FOR UPDATE`, guildID).Scan(pq.Array(&a.Roles), &delay, &a.SkipBots, &a.WaitForScreening, pq.Array(&a.StickyRoles)); err != nil {
+			log.WithError(err).Error("Failed to fetch auto-roles")
+			return err
+		}
+		a.Delay = time.Duration(delay) * time.Second
+
+		if err := update(a); err != nil {
+			return err
+		}
+
+		log.WithField("guild_id", a.GuildID).Debug("Storing auto-roles in DB")
+		if _, err := tx.ExecContext(ctx, `
+                        UPDATE auto_roles
+                        SET roles = $2, delay_seconds = $3, skip_bots = $4, wait_for_screening = $5, sticky_roles = $6
+                        WHERE guild = $1`,
+			a.GuildID, pq.Array(a.Roles), int(a.Delay/time.Second), a.SkipBots, a.WaitForScreening, pq.Array(a.StickyRoles)); err != nil {
+			log.WithError(err).Error("Failed to store auto-roles")
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// StoreStickyRoles remembers the sticky roles of a member who left.
+func (srv *DiscordServerStore) StoreStickyRoles(ctx context.Context, guildID, userID string, roles []string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	log.WithField("guild_id", guildID).WithField("user_id", userID).Debug("Storing sticky roles in DB")
+	_, err := srv.db.ExecContext(ctx, `
+                INSERT INTO sticky_member_roles (guild, member, roles, left_at)
+                VALUES ($1, $2, $3, now())
+                ON CONFLICT (guild, member)
+                DO UPDATE SET roles = $3, left_at = now()`,
+		guildID, userID, pq.Array(roles))
+	if err != nil {
+		log.WithError(err).Error("Failed to store sticky roles")
+		return err
+	}
+
+	return nil
+}
+
+// TakeStickyRoles returns the sticky roles a member had when they left,
+// and forgets them.
+func (srv *DiscordServerStore) TakeStickyRoles(ctx context.Context, guildID, userID string) ([]string, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	roles := make([]string, 0)
+	err := srv.db.QueryRowContext(ctx, "DELETE FROM sticky_member_roles WHERE guild = $1 AND member = $2 RETURNING roles", guildID, userID).Scan(pq.Array(&roles))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return roles, nil
+		}
+		log.WithError(err).Error("Failed to fetch sticky roles")
+		return nil, err
+	}
+
+	return roles, nil
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// The caches are shared by handlers running concurrently. These tests
+// hammer them from many goroutines, and are meant to be run with -race.
+
+const (
+	raceWorkers    = 8
+	raceIterations = 200
+)
+
+// hammer runs fn from raceWorkers goroutines at once, raceIterations
+// times each.
+func hammer(fn func(worker, i int)) {
+	var wg sync.WaitGroup
+	for w := 0; w < raceWorkers; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < raceIterations; i++ {
+				fn(worker, i)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestWizardsInFlightConcurrently(t *testing.T) {
+	w := newWizardsInFlight()
+
+	hammer(func(worker, i int) {
+		id := fmt.Sprint(i % 10)
+		l := &wizardListener{id: id, channelID: "channel", messageID: "message", userID: fmt.Sprint(worker)}
+
+		unlock := w.lock(id)
+		w.touch(id)
+		w.listen(l)
+		w.waiting(l)
+		w.listening("channel", "message", fmt.Sprint(worker))
+		w.idle(time.Now())
+		w.idleSince(id, time.Now())
+		w.active()
+		if i%3 == 0 {
+			w.stop(id)
+		}
+		unlock()
+		if i%5 == 0 {
+			w.finish(id)
+		}
+	})
+
+	for i := 0; i < 10; i++ {
+		w.finish(fmt.Sprint(i))
+	}
+	if active := w.active(); len(active) != 0 {
+		t.Errorf("expected no wizards in flight after finishing them, got %v", active)
+	}
+}
+
+func TestWizardsInFlightLockIsExclusive(t *testing.T) {
+	w := newWizardsInFlight()
+
+	count := 0
+	hammer(func(worker, i int) {
+		unlock := w.lock("wizard")
+		// Only safe since the lock is held
+		count++
+		unlock()
+	})
+
+	if count != raceWorkers*raceIterations {
+		t.Errorf("expected %d, got %d", raceWorkers*raceIterations, count)
+	}
+}
+
+func TestMemberCacheConcurrently(t *testing.T) {
+	c := NewMemberCache()
+
+	hammer(func(worker, i int) {
+		guildID := fmt.Sprint(worker % 2)
+		userID := fmt.Sprint(i % 20)
+		c.Remember(guildID, &discordgo.Member{
+			User:  &discordgo.User{ID: userID},
+			Nick:  fmt.Sprint(worker),
+			Roles: []string{"role"},
+		})
+		if snapshot, ok := c.Forget(guildID, userID); ok && snapshot.UserID != userID {
+			t.Errorf("expected snapshot of %s, got %s", userID, snapshot.UserID)
+		}
+		if i%50 == 0 {
+			c.ForgetGuild(guildID)
+		}
+	})
+}
+
+func TestMemberCacheSnapshotsRoles(t *testing.T) {
+	c := NewMemberCache()
+	member := &discordgo.Member{User: &discordgo.User{ID: "user"}, Roles: []string{"a"}}
+	c.Remember("guild", member)
+	member.Roles[0] = "b"
+
+	snapshot, ok := c.Forget("guild", "user")
+	if !ok {
+		t.Fatal("expected the member to be remembered")
+	}
+	if snapshot.Roles[0] != "a" {
+		t.Errorf("expected the snapshot to keep role a, got %s", snapshot.Roles[0])
+	}
+	if _, ok := c.Forget("guild", "user"); ok {
+		t.Error("expected the member to be forgotten")
+	}
+}
+
+func TestSettingsCacheConcurrently(t *testing.T) {
+	srv := NewDiscordServerStore(nil)
+	ctx := context.Background()
+
+	hammer(func(worker, i int) {
+		guildID := fmt.Sprint(i % 10)
+		switch worker % 3 {
+		case 0:
+			settings := DefaultGuildSettings(guildID)
+			settings.Prefix = fmt.Sprint(worker)
+			srv.settings.set(guildID, settings)
+		case 1:
+			srv.settings.invalidate(guildID)
+		default:
+			// Changing the copy we get mustn't touch the cached one
+			settings := srv.GuildSettings(ctx, guildID)
+			settings.Prefix = "changed"
+			settings.Modules[ModuleHots] = false
+		}
+	})
+
+	for i := 0; i < 10; i++ {
+		guildID := fmt.Sprint(i)
+		if settings, ok := srv.settings.get(guildID); ok && (settings.Prefix == "changed" || !settings.ModuleEnabled(ModuleHots)) {
+			t.Errorf("cached settings of guild %s were changed through a copy", guildID)
+		}
+	}
+}
+
+func TestSettingsWithoutDatabaseAreNotCached(t *testing.T) {
+	srv := NewDiscordServerStore(nil)
+
+	settings := srv.GuildSettings(context.Background(), "guild")
+	if settings.Prefix != DefaultPrefix {
+		t.Errorf("expected the default prefix, got %s", settings.Prefix)
+	}
+	for _, module := range Modules {
+		if settings.ModuleEnabled(module) {
+			t.Errorf("expected module %s to be off when the settings can't be loaded", module)
+		}
+	}
+	if _, ok := srv.settings.get("guild"); ok {
+		t.Error("expected settings which failed to load not to be cached")
+	}
+}
+
+func TestCachedSettingsOutliveTheDatabase(t *testing.T) {
+	srv := NewDiscordServerStore(nil)
+	cached := DefaultGuildSettings("guild")
+	cached.Modules[ModuleHots] = false
+	srv.settings.set("guild", cached)
+
+	settings := srv.GuildSettings(context.Background(), "guild")
+	if settings.ModuleEnabled(ModuleHots) || !settings.ModuleEnabled(ModuleRun) {
+		t.Errorf("expected the cached modules, got %v", settings.Modules)
+	}
+}
+
+func TestWelcomeCacheConcurrently(t *testing.T) {
+	srv := NewDiscordServerStore(nil)
+	ctx := context.Background()
+
+	hammer(func(worker, i int) {
+		guildID := fmt.Sprint(i % 10)
+		switch worker % 3 {
+		case 0:
+			w := &WelcomeChannel{GuildID: guildID, MessageChannelID: fmt.Sprint(worker)}
+			if i%2 == 0 {
+				// Guilds without a welcome channel are cached as nil
+				w = nil
+			}
+			srv.welcome.set(guildID, w)
+		case 1:
+			srv.welcome.invalidate(guildID)
+		default:
+			w, err := srv.WelcomeChannel(ctx, guildID)
+			if err == nil && w != nil {
+				w.MessageChannelID = "changed"
+			}
+		}
+	})
+
+	for i := 0; i < 10; i++ {
+		guildID := fmt.Sprint(i)
+		if w, ok := srv.welcome.get(guildID); ok && w != nil && w.MessageChannelID == "changed" {
+			t.Errorf("cached welcome channel of guild %s was changed through a copy", guildID)
+		}
+	}
+}
+
+func TestGuildRegistryConcurrently(t *testing.T) {
+	// Without a database only the registry itself is updated, which is
+	// what is shared between handlers
+	r := &GuildRegistry{Store: NewDiscordServerStore(nil)}
+	ctx := context.Background()
+
+	hammer(func(worker, i int) {
+		guildID := fmt.Sprint(i % 10)
+		switch worker % 3 {
+		case 0:
+			r.Join(ctx, &discordgo.Guild{ID: guildID, Name: fmt.Sprint(worker)})
+		case 1:
+			r.Leave(ctx, guildID)
+		default:
+			r.Has(guildID)
+			guilds := r.Guilds()
+			for j := 1; j < len(guilds); j++ {
+				if guilds[j-1].ID >= guilds[j].ID {
+					t.Errorf("expected guilds sorted by ID, got %s before %s", guilds[j-1].ID, guilds[j].ID)
+				}
+			}
+		}
+	})
+}
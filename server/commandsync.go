@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// CommandScope decides where application commands are registered.
+type CommandScope string
+
+const (
+	// GuildCommandScope registers commands in every guild the bot is in.
+	// Changes show up immediately, which is handy during development.
+	GuildCommandScope CommandScope = "guild"
+	// GlobalCommandScope registers commands once for the application.
+	GlobalCommandScope CommandScope = "global"
+)
+
+// ParseCommandScope parses a command scope, defaulting to the guild scope.
+func ParseCommandScope(scope string) (CommandScope, error) {
+	switch CommandScope(scope) {
+	case "", GuildCommandScope:
+		return GuildCommandScope, nil
+	case GlobalCommandScope:
+		return GlobalCommandScope, nil
+	}
+	return "", fmt.Errorf("unknown command scope '%s', expected '%s' or '%s'", scope, GuildCommandScope, GlobalCommandScope)
+}
+
+// ApplicationCommandDefinitions returns the definitions Discord needs to
+// register the commands.
+func ApplicationCommandDefinitions(commands []*ApplicationCommand) []*discordgo.ApplicationCommand {
+	definitions := make([]*discordgo.ApplicationCommand, 0, len(commands))
+	for _, cmd := range commands {
+		definitions = append(definitions, cmd.Command)
+	}
+	sort.Slice(definitions, func(i, j int) bool {
+		return definitions[i].Name < definitions[j].Name
+	})
+	return definitions
+}
+
+// SyncApplicationCommands makes the commands registered in a guild, or
+// globally if guildID is empty, match the desired commands. Commands are
+// only overwritten when they differ, so their IDs stay the same across
+// restarts. It returns whether anything was changed.
+func SyncApplicationCommands(s *discordgo.Session, appID, guildID string, desired []*discordgo.ApplicationCommand) (bool, error) {
+	logger := log.WithFields(log.Fields{
+		"guild_id": guildID,
+		"desired":  len(desired),
+	})
+
+	existing, err := s.ApplicationCommands(appID, guildID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to list registered application commands")
+		return false, err
+	}
+
+	if commandsEqual(existing, desired) {
+		logger.Debug("Application commands are up to date")
+		return false, nil
+	}
+
+	logger.WithField("existing", len(existing)).Info("Overwriting application commands")
+	if _, err := s.ApplicationCommandBulkOverwrite(appID, guildID, desired); err != nil {
+		logger.WithError(err).Error("Failed to overwrite application commands")
+		return false, err
+	}
+
+	return true, nil
+}
+
+// PurgeApplicationCommands removes every command registered in a guild,
+// or globally if guildID is empty.
+func PurgeApplicationCommands(s *discordgo.Session, appID, guildID string) error {
+	log.WithField("guild_id", guildID).Info("Purging application commands")
+	_, err := s.ApplicationCommandBulkOverwrite(appID, guildID, []*discordgo.ApplicationCommand{})
+	return err
+}
+
+func commandsEqual(existing, desired []*discordgo.ApplicationCommand) bool {
+	if len(existing) != len(desired) {
+		return false
+	}
+	signatures := make(map[string]bool, len(existing))
+	for _, cmd := range existing {
+		signatures[commandSignature(cmd)] = true
+	}
+	for _, cmd := range desired {
+		if !signatures[commandSignature(cmd)] {
+			return false
+		}
+	}
+	return true
+}
+
+// commandShape holds the fields of a command we control, with Discord's
+// defaults filled in, so a command we send and the one Discord returns
+// compare equal.
+type commandShape struct {
+	Type                     discordgo.ApplicationCommandType `json:"type"`
+	Name                     string                           `json:"name"`
+	Description              string                           `json:"description"`
+	DefaultMemberPermissions *int64                           `json:"default_member_permissions"`
+	DMPermission             bool                             `json:"dm_permission"`
+	NSFW                     bool                             `json:"nsfw"`
+	Options                  []optionShape                    `json:"options"`
+}
+
+type optionShape struct {
+	Type         discordgo.ApplicationCommandOptionType `json:"type"`
+	Name         string                                 `json:"name"`
+	Description  string                                 `json:"description"`
+	Required     bool                                   `json:"required"`
+	Autocomplete bool                                   `json:"autocomplete"`
+	ChannelTypes []discordgo.ChannelType                `json:"channel_types"`
+	Choices      []string                               `json:"choices"`
+	MinValue     *float64                               `json:"min_value"`
+	MaxValue     float64                                `json:"max_value"`
+	MinLength    *int                                   `json:"min_length"`
+	MaxLength    int                                    `json:"max_length"`
+	Options      []optionShape                          `json:"options"`
+}
+
+func commandSignature(cmd *discordgo.ApplicationCommand) string {
+	shape := commandShape{
+		Type:                     cmd.Type,
+		Name:                     cmd.Name,
+		Description:              cmd.Description,
+		DefaultMemberPermissions: cmd.DefaultMemberPermissions,
+		DMPermission:             cmd.DMPermission == nil || *cmd.DMPermission,
+		NSFW:                     cmd.NSFW != nil && *cmd.NSFW,
+		Options:                  optionShapes(cmd.Options),
+	}
+	if shape.Type == 0 {
+		shape.Type = discordgo.ChatApplicationCommand
+	}
+	data, err := json.Marshal(shape)
+	if err != nil {
+		log.WithError(err).Error("Failed to marshal application command")
+		return ""
+	}
+	return string(data)
+}
+
+func optionShapes(options []*discordgo.ApplicationCommandOption) []optionShape {
+	shapes := make([]optionShape, 0, len(options))
+	for _, option := range options {
+		shape := optionShape{
+			Type:         option.Type,
+			Name:         option.Name,
+			Description:  option.Description,
+			Required:     option.Required,
+			Autocomplete: option.Autocomplete,
+			ChannelTypes: option.ChannelTypes,
+			MinValue:     option.MinValue,
+			MaxValue:     option.MaxValue,
+			MinLength:    option.MinLength,
+			MaxLength:    option.MaxLength,
+			Options:      optionShapes(option.Options),
+		}
+		for _, choice := range option.Choices {
+			shape.Choices = append(shape.Choices, fmt.Sprintf("%s=%v", choice.Name, choice.Value))
+		}
+		shapes = append(shapes, shape)
+	}
+	return shapes
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// PoolOptions tune the database connection pool.
+type PoolOptions struct {
+	// MaxOpenConns limits the connections open at once, 0 is unlimited.
+	MaxOpenConns int
+	// MaxIdleConns is how many connections are kept open while idle.
+	MaxIdleConns int
+	// ConnMaxLifetime closes connections after a while, so they are
+	// spread over database replicas and pick up DNS changes.
+	ConnMaxLifetime time.Duration
+	// ConnMaxIdleTime closes connections which haven't been used in a
+	// while.
+	ConnMaxIdleTime time.Duration
+}
+
+// DefaultPoolOptions suit the bot, which mostly does small queries while
+// handling events.
+var DefaultPoolOptions = PoolOptions{
+	MaxOpenConns:    10,
+	MaxIdleConns:    5,
+	ConnMaxLifetime: 30 * time.Minute,
+	ConnMaxIdleTime: 5 * time.Minute,
+}
+
+// ErrNotFound is returned when a stored item doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned when storing an item conflicts with one which
+// is already stored.
+var ErrConflict = errors.New("conflicts with what is already stored")
+
+// pqUniqueViolation is the postgres error code of unique constraint
+// violations.
+const pqUniqueViolation = "23505"
+
+const (
+	connectPingTimeout  = 5 * time.Second
+	connectBackoffStart = 500 * time.Millisecond
+	connectBackoffMax   = 30 * time.Second
+)
+
+// Connect opens the database at the URL, and waits until it can be
+// reached, retrying with backoff until ctx is done. Connections which
+// break later are replaced by the pool, so the handle keeps working when
+// the database comes back after an outage.
+func Connect(ctx context.Context, databaseURL string, pool PoolOptions) (*sql.DB, error) {
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database URL: %w", err)
+	}
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
+
+	backoff := connectBackoffStart
+	for attempt := 1; ; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, connectPingTimeout)
+		err = db.PingContext(pingCtx)
+		cancel()
+		if err == nil {
+			return db, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		log.WithError(err).WithField("attempt", attempt).Warnf("Failed to connect to database, retrying in %s", backoff)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		backoff = min(2*backoff, connectBackoffMax)
+	}
+
+	db.Close()
+	return nil, fmt.Errorf("failed to connect to database: %w", err)
+}
+
+// Ping checks that the database can be reached.
+func (srv *DiscordServerStore) Ping(ctx context.Context) error {
+	if srv.db == nil {
+		return errors.New("not connected to database")
+	}
+	return srv.db.PingContext(ctx)
+}
+
+// Close closes the database. It is called on shutdown, after the handlers
+// have finished.
+func (srv *DiscordServerStore) Close() error {
+	if srv.db == nil {
+		return nil
+	}
+	return srv.db.Close()
+}
+
+// storeError wraps err with ErrNotFound or ErrConflict, if it is one, so
+// callers can check for them with errors.Is.
+func storeError(err error) error {
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation:
+		return fmt.Errorf("%w: %w", ErrConflict, err)
+	}
+	return err
+}
+
+// inTx runs fn in a transaction, which is committed if fn succeeds and
+// rolled back if not.
+func (srv *DiscordServerStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := srv.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithError(err).Error("Failed to begin transaction")
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.WithError(err).Error("Failed to commit transaction")
+		return err
+	}
+	return nil
+}
@@ -1,13 +1,15 @@
 package server
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"time"
 
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
-
-	// Imported for side effects
-	_ "github.com/lib/pq"
 )
 
 type ReactRole struct {
@@ -29,39 +31,75 @@ type WelcomeChannel struct {
 	EmojiChannelID   string
 }
 
-func (srv *DiscordServerStore) StoreReactRole(rr ReactRole) error {
-	if db == nil {
+// StoreReactRole makes the emoji on a message give the role. It returns
+// ErrConflict if the emoji already gives a role on the message.
+func (srv *DiscordServerStore) StoreReactRole(ctx context.Context, rr ReactRole) error {
+	if srv.db == nil {
 		log.Error("Database is nil!")
 		return errors.New("not connected to database")
 	}
 
-	log.Debug("Inserting ReactRoleMessage in DB")
-	_, err := db.Query("INSERT INTO reaction_messages (guild, channel, id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", rr.Message.GuildID, rr.Message.ChannelID, rr.Message.ID)
-	if err != nil {
-		log.WithError(err).Error("Failed to insert reaction messages")
-		return err
-	}
+	return srv.inTx(ctx, func(tx *sql.Tx) error {
+		log.Debug("Inserting ReactRoleMessage in DB")
+		if _, err := tx.ExecContext(ctx, "INSERT INTO reaction_messages (guild, channel, id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", rr.Message.GuildID, rr.Message.ChannelID, rr.Message.ID); err != nil {
+			log.WithError(err).Error("Failed to insert reaction messages")
+			return err
+		}
 
-	log.Debug("Inserting ReactRole in DB")
-	_, err = db.Query("INSERT INTO reaction_message_reactions (message_guild, message_channel, message_id, reaction, role) VALUES ($1, $2, $3, $4, $5)", rr.Message.GuildID, rr.Message.ChannelID, rr.Message.ID, rr.Emoji, rr.Role)
-	if err != nil {
-		log.WithError(err).Error("Failed to insert reaction messages")
-		return err
+		log.Debug("Inserting ReactRole in DB")
+		if _, err := tx.ExecContext(ctx, "INSERT INTO reaction_message_reactions (message_guild, message_channel, message_id, reaction, role) VALUES ($1, $2, $3, $4, $5)", rr.Message.GuildID, rr.Message.ChannelID, rr.Message.ID, rr.Emoji, rr.Role); err != nil {
+			log.WithError(err).Error("Failed to insert reaction message reactions")
+			return storeError(err)
+		}
+		return nil
+	})
+}
+
+// StoreReactRoles stores several reaction roles in one transaction, so
+// either all of them are stored or none are. Existing bindings for the
+// same emoji on a message get their role replaced.
+func (srv *DiscordServerStore) StoreReactRoles(ctx context.Context, rrs []ReactRole) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
 	}
 
-	return nil
+	return srv.inTx(ctx, func(tx *sql.Tx) error {
+		for _, rr := range rrs {
+			log.WithField("emoji", rr.Emoji).WithField("role", rr.Role).Debug("Inserting ReactRole in DB")
+			if _, err := tx.ExecContext(ctx, "INSERT INTO reaction_messages (guild, channel, id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", rr.Message.GuildID, rr.Message.ChannelID, rr.Message.ID); err != nil {
+				log.WithError(err).Error("Failed to insert reaction messages")
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `
+                        INSERT INTO reaction_message_reactions
+                                (message_guild, message_channel, message_id, reaction, role)
+                        VALUES ($1, $2, $3, $4, $5)
+                        ON CONFLICT ON CONSTRAINT reaction_message_channel_message_role_uniquer
+                        DO UPDATE SET role = $5`,
+				rr.Message.GuildID, rr.Message.ChannelID, rr.Message.ID, rr.Emoji, rr.Role); err != nil {
+				log.WithError(err).Error("Failed to insert reaction message reactions")
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-func (srv *DiscordServerStore) GetReactRolesForMessage(rm ReactRoleMessage) ([]*ReactRole, error) {
-	if db == nil {
+// GetReactRolesForMessage returns the reaction roles of a message, or
+// ErrNotFound if it has none.
+func (srv *DiscordServerStore) GetReactRolesForMessage(ctx context.Context, rm ReactRoleMessage) ([]*ReactRole, error) {
+	if srv.db == nil {
 		log.Error("Database is nil!")
 		return nil, errors.New("not connected to database")
 	}
 
-	rows, err := db.Query("SELECT id, reaction, role FROM reaction_message_reactions WHERE message_guild = $1 AND message_channel = $2 AND message_id = $3", rm.GuildID, rm.ChannelID, rm.ID)
+	rows, err := srv.db.QueryContext(ctx, "SELECT id, reaction, role FROM reaction_message_reactions WHERE message_guild = $1 AND message_channel = $2 AND message_id = $3", rm.GuildID, rm.ChannelID, rm.ID)
 	if err != nil {
 		log.WithError(err).Error("Failed to SELECT")
+		return nil, err
 	}
+	defer rows.Close()
 
 	roles := make([]*ReactRole, 0) // len of res?
 	for rows.Next() {
@@ -74,55 +112,79 @@ func (srv *DiscordServerStore) GetReactRolesForMessage(rm ReactRoleMessage) ([]*
 		}
 		roles = append(roles, &rr)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 	if len(roles) == 0 {
 		log.Trace("Found no reactrolemessagereactions for message")
-		return nil, nil
+		return nil, fmt.Errorf("reaction roles of message %s: %w", rm.ID, ErrNotFound)
 	}
 	return roles, nil
 }
 
-func (srv *DiscordServerStore) StoreWelcomeChannel(w WelcomeChannel) error {
-	if db == nil {
+func (srv *DiscordServerStore) StoreWelcomeChannel(ctx context.Context, w WelcomeChannel) error {
+	if srv.db == nil {
 		log.Error("Database is nil!")
 		return errors.New("not connected to database")
 	}
 
 	log.Debug("Inserting Welcome Channel in DB")
-	_, err := db.Query("INSERT INTO welcome_channel (guild, message_channel, emoji_channel) VALUES ($1, $2, $3) ON CONFLICT (guild) DO UPDATE SET message_channel = $2", w.GuildID, w.MessageChannelID, w.EmojiChannelID)
+	_, err := srv.db.ExecContext(ctx, `
+                INSERT INTO welcome_channel (guild, message_channel, emoji_channel)
+                VALUES ($1, $2, $3)
+                ON CONFLICT (guild)
+                DO UPDATE SET message_channel = $2, emoji_channel = $3`,
+		w.GuildID, w.MessageChannelID, w.EmojiChannelID)
 	if err != nil {
 		log.WithError(err).Error("Failed to insert welcome channel")
 		return err
 	}
+	srv.welcome.invalidate(w.GuildID)
 
 	return nil
 }
 
-func (srv *DiscordServerStore) GetWelcomeChannel(guildID string) (*WelcomeChannel, error) {
-	if db == nil {
+// DisableWelcomeChannel stops welcoming members, but keeps the templates.
+func (srv *DiscordServerStore) DisableWelcomeChannel(ctx context.Context, guildID string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	log.WithField("guild_id", guildID).Debug("Disabling welcome channel in DB")
+	if _, err := srv.db.ExecContext(ctx, "UPDATE welcome_channel SET message_channel = '', emoji_channel = '' WHERE guild = $1", guildID); err != nil {
+		log.WithError(err).Error("Failed to disable welcome channel")
+		return err
+	}
+	srv.welcome.invalidate(guildID)
+
+	return nil
+}
+
+// GetWelcomeChannel returns the welcome channel of a guild, or ErrNotFound
+// if it hasn't set one.
+func (srv *DiscordServerStore) GetWelcomeChannel(ctx context.Context, guildID string) (*WelcomeChannel, error) {
+	if srv.db == nil {
 		log.Error("Database is nil!")
 		return nil, errors.New("not connected to database")
 	}
 
 	log.Debug("Fetching welcome channel from DB")
-	rows, err := db.Query("SELECT guild, message_channel, emoji_channel FROM welcome_channel WHERE guild = $1", guildID)
+	w := WelcomeChannel{}
+	err := srv.db.QueryRowContext(ctx, "SELECT guild, message_channel, emoji_channel FROM welcome_channel WHERE guild = $1", guildID).
+		Scan(&w.GuildID, &w.MessageChannelID, &w.EmojiChannelID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storeError(err)
+	}
 	if err != nil {
 		log.WithError(err).Error("Failed to fetch welcome channel from DB")
 		return nil, err
 	}
-
-	for rows.Next() {
-		w := WelcomeChannel{}
-		if err := rows.Scan(&w.GuildID, &w.MessageChannelID, &w.EmojiChannelID); err != nil {
-			log.WithError(err).Error("Failed to scan database row")
-			return &w, err
-		}
-		return &w, nil
-	}
-	return nil, nil
+	return &w, nil
 }
 
-func (srv *DiscordServerStore) CreateReactRoleInteractionProgress(wip *ReactRoleInteraction) (string, error) {
-	if db == nil {
+func (srv *DiscordServerStore) CreateReactRoleInteractionProgress(ctx context.Context, wip *ReactRoleInteraction) (string, error) {
+	if srv.db == nil {
 		log.Error("Database is nil!")
 		return "", errors.New("not connected to database")
 	}
@@ -132,74 +194,62 @@ func (srv *DiscordServerStore) CreateReactRoleInteractionProgress(wip *ReactRole
 	data, err := json.Marshal(wip)
 	if err != nil {
 		log.WithError(err).Error("failed to create placeholder react role interaction in progress")
+		return "", err
 	}
 
-	rows, err := db.Query("INSERT INTO interaction_in_progress (data) VALUES($1) RETURNING id", data)
-	if err != nil {
+	var id string
+	if err := srv.db.QueryRowContext(ctx, "INSERT INTO interaction_in_progress (data) VALUES($1) RETURNING id", data).Scan(&id); err != nil {
 		log.WithError(err).Error("Failed to create interaction in progress")
 		return "", err
 	}
-	for rows.Next() {
-		var id string
-		if err := rows.Scan(&id); err != nil {
-			log.WithError(err).Error("Failed to scan database row")
-			return id, err
-		}
-		return id, nil
-	}
-
-	return "", nil
+	return id, nil
 }
 
-func (srv *DiscordServerStore) GetReactRoleInteractionProgress(id string) (*ReactRoleInteraction, error) {
-	if db == nil {
+// GetReactRoleInteractionProgress returns the progress of a reaction role
+// wizard, or ErrNotFound if it has expired.
+func (srv *DiscordServerStore) GetReactRoleInteractionProgress(ctx context.Context, id string) (*ReactRoleInteraction, error) {
+	if srv.db == nil {
 		log.Error("Database is nil!")
 		return nil, errors.New("not connected to database")
 	}
 
 	log.WithField("id", id).Debug("Getting interaction in progress from DB")
-	rows, err := db.Query("SELECT id, data FROM interaction_in_progress WHERE id = $1", id)
-	if err != nil {
-		log.WithError(err).Error("Failed to get interaction in progress")
-		return nil, err
-	}
-	for rows.Next() {
-		var id string
-		var j []byte
-		var data ReactRoleInteraction
-		if err := rows.Scan(&id, &j); err != nil {
-			log.WithError(err).Error("Failed to scan database row")
-			return nil, err
-		}
-		err := json.Unmarshal(j, &data)
-		data.ID = id
-		if err != nil {
-			log.WithError(err).Error("failed to unmarshal interaction in prgoress")
+	var j []byte
+	var data ReactRoleInteraction
+	if err := srv.db.QueryRowContext(ctx, "SELECT id, data FROM interaction_in_progress WHERE id = $1", id).Scan(&id, &j); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.WithError(err).Error("Failed to get interaction in progress")
 		}
-		log.WithFields(log.Fields{
-			"interaction": data,
-		}).Debug("Got this interaction in progress")
-		return &data, nil
+		return nil, storeError(err)
 	}
-
-	return nil, nil
+	if err := json.Unmarshal(j, &data); err != nil {
+		log.WithError(err).Error("failed to unmarshal interaction in prgoress")
+	}
+	data.ID = id
+	log.WithFields(log.Fields{
+		"interaction": data,
+	}).Debug("Got this interaction in progress")
+	return &data, nil
 }
 
-func (srv *DiscordServerStore) StoreReactRoleInteractionProgress(interaction *ReactRoleInteraction) error {
-	if db == nil {
+func (srv *DiscordServerStore) StoreReactRoleInteractionProgress(ctx context.Context, interaction *ReactRoleInteraction) error {
+	if srv.db == nil {
 		log.Error("Database is nil!")
 		return errors.New("not connected to database")
 	}
 
-	data, _ := json.Marshal(interaction)
+	data, err := json.Marshal(interaction)
+	if err != nil {
+		return err
+	}
 
 	log.Debug("Inserting interaction in progress in DB")
-	_, err := db.Query(`
+	_, err = srv.db.ExecContext(ctx, `
                 INSERT INTO interaction_in_progress
                         (id, data)
                 VALUES ($1, $2)
                 ON CONFLICT (id)
-                DO UPDATE SET data = $2`,
+                DO UPDATE SET data = $2, timestamp = now()`,
 		interaction.ID, data)
 	if err != nil {
 		log.WithError(err).Error("Failed to insert interaction in progress")
@@ -210,43 +260,87 @@ func (srv *DiscordServerStore) StoreReactRoleInteractionProgress(interaction *Re
 }
 
 type ReactRoleInteraction struct {
-	ID           string `json:"id"`
-	ChannelID    string `json:"channel_id"`
-	MessageID    string `json:"message_id"`
-	EmojiID      string `json:"emoji_id"`
-	RoleID       string `json:"role_id"`
-	emojiHandler func()
+	ID        string             `json:"id"`
+	GuildID   string             `json:"guild_id"`
+	UserID    string             `json:"user_id"`
+	ChannelID string             `json:"channel_id"`
+	MessageID string             `json:"message_id"`
+	EmojiID   string             `json:"emoji_id"`
+	RoleID    string             `json:"role_id"`
+	Bindings  []ReactRoleBinding `json:"bindings"`
 }
 
-type ReactRoleAction int
+// ReactRoleBinding is a single emoji -> role pair collected by the
+// reaction role wizard before it is committed.
+type ReactRoleBinding struct {
+	Emoji string `json:"emoji"`
+	Role  string `json:"role"`
+}
 
-const (
-	Initial ReactRoleAction = iota + 1
-	RoleSelect
-	EmojiSelect
-	Confirm
-)
+// AddBinding adds an emoji -> role pair, replacing the role if the emoji
+// is already bound since a message can only have one role per reaction.
+func (i *ReactRoleInteraction) AddBinding(emoji, role string) {
+	for idx, binding := range i.Bindings {
+		if binding.Emoji == emoji {
+			i.Bindings[idx].Role = role
+			return
+		}
+	}
+	i.Bindings = append(i.Bindings, ReactRoleBinding{Emoji: emoji, Role: role})
+}
+
+func (srv *DiscordServerStore) DeleteReactRoleInteractionProgress(ctx context.Context, id string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
 
-func (i *ReactRoleInteraction) GetAction() ReactRoleAction {
-	if i.ChannelID == "" || i.MessageID == "" || i.RoleID == "" {
-		return RoleSelect
-	} else if i.EmojiID == "" {
-		return EmojiSelect
-	} else {
-		return Confirm
+	log.WithField("id", id).Debug("Deleting interaction in progress from DB")
+	if _, err := srv.db.ExecContext(ctx, "DELETE FROM interaction_in_progress WHERE id = $1", id); err != nil {
+		log.WithError(err).Error("Failed to delete interaction in progress")
+		return err
 	}
+
+	return nil
 }
 
-func (srv *DiscordServerStore) GetReactionRoles() ([]*ReactRole, error) {
-	if db == nil {
+// DeleteReactRoleInteractionsBefore deletes the progress of wizards which
+// haven't changed since the time, except the ones to keep. It returns how
+// many were deleted.
+func (srv *DiscordServerStore) DeleteReactRoleInteractionsBefore(ctx context.Context, before time.Time, keep []string) (int, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return 0, errors.New("not connected to database")
+	}
+
+	res, err := srv.db.ExecContext(ctx, "DELETE FROM interaction_in_progress WHERE timestamp < $1 AND NOT (id::text = ANY($2))", before, pq.Array(keep))
+	if err != nil {
+		log.WithError(err).Error("Failed to delete old interactions in progress")
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
+
+// GetReactionRolesForGuild returns every reaction role of a guild.
+func (srv *DiscordServerStore) GetReactionRolesForGuild(ctx context.Context, guildID string) ([]*ReactRole, error) {
+	if srv.db == nil {
 		log.Error("Database is nil!")
 		return nil, errors.New("not connected to database")
 	}
 
-	rows, err := db.Query("SELECT id, message_guild, message_channel, message_id, reaction, role FROM reaction_message_reactions")
+	rows, err := srv.db.QueryContext(ctx, `
+                SELECT id, message_guild, message_channel, message_id, reaction, role
+                FROM reaction_message_reactions WHERE message_guild = $1
+                ORDER BY message_channel, message_id, id`, guildID)
 	if err != nil {
 		log.WithError(err).Error("Failed to SELECT")
+		return nil, err
 	}
+	defer rows.Close()
 
 	roles := make([]*ReactRole, 0)
 	for rows.Next() {
@@ -260,5 +354,27 @@ func (srv *DiscordServerStore) GetReactionRoles() ([]*ReactRole, error) {
 		roles = append(roles, &rr)
 	}
 
-	return roles, nil
+	return roles, rows.Err()
+}
+
+// DeleteReactRole removes the binding for an emoji on a message.
+// It returns false if there was no such binding.
+func (srv *DiscordServerStore) DeleteReactRole(ctx context.Context, rm ReactRoleMessage, emoji string) (bool, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return false, errors.New("not connected to database")
+	}
+
+	log.WithField("message_id", rm.ID).WithField("emoji", emoji).Debug("Deleting ReactRole from DB")
+	res, err := srv.db.ExecContext(ctx, "DELETE FROM reaction_message_reactions WHERE message_guild = $1 AND message_channel = $2 AND message_id = $3 AND reaction = $4", rm.GuildID, rm.ChannelID, rm.ID, emoji)
+	if err != nil {
+		log.WithError(err).Error("Failed to delete reaction message reaction")
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
 }
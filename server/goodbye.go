@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// Reasons a member is no longer in a guild, used for {reason}.
+const (
+	DepartureLeft   = "left"
+	DepartureKicked = "was kicked"
+	DepartureBanned = "was banned"
+)
+
+// auditLogWindow is how old an audit log entry can be and still be the
+// cause of a member leaving.
+const auditLogWindow = 30 * time.Second
+
+// DefaultGoodbyeTemplate is used when a goodbye channel is set without
+// a message.
+var DefaultGoodbyeTemplate = WelcomeTemplate{
+	Content: "{username} {reason} after {time_in_server}.",
+}
+
+// GoodbyeChannel is where members leaving a guild are announced.
+type GoodbyeChannel struct {
+	GuildID   string
+	ChannelID string
+	Template  WelcomeTemplate
+}
+
+// Render fills in the template for a member who left. Nobody is pinged,
+// as the member is already gone.
+func (g GoodbyeChannel) Render(data WelcomeData) *discordgo.MessageSend {
+	msg := g.Template.Render(data)
+	msg.AllowedMentions = &discordgo.MessageAllowedMentions{}
+	return msg
+}
+
+// MemberDeparture looks in the audit log for why a member is gone, and
+// returns the reason and the moderator responsible, if any. Without
+// access to the audit log the member is assumed to have left.
+func MemberDeparture(s *discordgo.Session, guildID, userID string) (string, string) {
+	for _, departure := range []struct {
+		reason string
+		action discordgo.AuditLogAction
+	}{
+		{DepartureBanned, discordgo.AuditLogActionMemberBanAdd},
+		{DepartureKicked, discordgo.AuditLogActionMemberKick},
+	} {
+		auditLog, err := s.GuildAuditLog(guildID, "", "", int(departure.action), 5)
+		if err != nil {
+			log.WithError(err).WithField("guild_id", guildID).Debug("Unable to read audit log")
+			return DepartureLeft, ""
+		}
+		for _, entry := range auditLog.AuditLogEntries {
+			if entry.TargetID != userID {
+				continue
+			}
+			created, err := discordgo.SnowflakeTimestamp(entry.ID)
+			if err != nil || time.Since(created) > auditLogWindow {
+				continue
+			}
+			return departure.reason, entry.UserID
+		}
+	}
+
+	return DepartureLeft, ""
+}
+
+// GetGoodbyeChannel returns the goodbye channel of a guild, or ErrNotFound
+// if it hasn't set one.
+func (srv *DiscordServerStore) GetGoodbyeChannel(ctx context.Context, guildID string) (*GoodbyeChannel, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	log.WithField("guild_id", guildID).Debug("Fetching goodbye channel from DB")
+	row := srv.db.QueryRowContext(ctx, "SELECT channel, template FROM goodbye_channel WHERE guild = $1", guildID)
+
+	g := GoodbyeChannel{GuildID: guildID}
+	var data []byte
+	if err := row.Scan(&g.ChannelID, &data); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storeError(err)
+		}
+		log.WithError(err).Error("Failed to fetch goodbye channel")
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &g.Template); err != nil {
+		log.WithError(err).Error("Failed to unmarshal goodbye template")
+		return nil, err
+	}
+
+	return &g, nil
+}
+
+func (srv *DiscordServerStore) StoreGoodbyeChannel(ctx context.Context, g GoodbyeChannel) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	data, err := json.Marshal(g.Template)
+	if err != nil {
+		return err
+	}
+
+	log.WithField("guild_id", g.GuildID).Debug("Storing goodbye channel in DB")
+	_, err = srv.db.ExecContext(ctx, `
+                INSERT INTO goodbye_channel (guild, channel, template)
+                VALUES ($1, $2, $3)
+                ON CONFLICT (guild)
+                DO UPDATE SET channel = $2, template = $3`,
+		g.GuildID, g.ChannelID, data)
+	if err != nil {
+		log.WithError(err).Error("Failed to store goodbye channel")
+		return err
+	}
+
+	return nil
+}
+
+func (srv *DiscordServerStore) DeleteGoodbyeChannel(ctx context.Context, guildID string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	log.WithField("guild_id", guildID).Debug("Deleting goodbye channel from DB")
+	if _, err := srv.db.ExecContext(ctx, "DELETE FROM goodbye_channel WHERE guild = $1", guildID); err != nil {
+		log.WithError(err).Error("Failed to delete goodbye channel")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// goodbyeCommand lets admins announce members leaving the guild.
+func goodbyeCommand(store *DiscordServerStore) *ApplicationCommand {
+
+	cmd := &ApplicationCommand{
+		Name: "goodbye",
+		Command: &discordgo.ApplicationCommand{
+			Name:        "goodbye",
+			Description: "Announce members leaving the server",
+			Version:     "1",
+			Type:        discordgo.ChatApplicationCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "set",
+					Description: "Set where and how members leaving are announced",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:         discordgo.ApplicationCommandOptionChannel,
+							Name:         "channel",
+							Description:  "Channel to announce members leaving in",
+							Required:     true,
+							ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText},
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "content",
+							Description: "Message, with placeholders like {username}, {reason}, {time_in_server}",
+							MaxLength:   2000,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionBoolean,
+							Name:        "embed",
+							Description: "Send the message as an embed",
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "title",
+							Description: "Title of the embed",
+							MaxLength:   256,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "color",
+							Description: "Color of the embed, e.g. #40c7eb",
+							MaxLength:   7,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "show",
+					Description: "Show where and how members leaving are announced",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "disable",
+					Description: "Stop announcing members leaving",
+				},
+			},
+		},
+		Module:     ModuleWelcome,
+		Permission: AdminCommandGoodbye,
+		store:      store,
+	}
+	cmd.Subcommands = map[string]SubcommandHandler{
+		"set":     cmd.goodbyeSet,
+		"show":    cmd.goodbyeShow,
+		"disable": cmd.goodbyeDisable,
+	}
+
+	return cmd
+}
+
+func (cmd *ApplicationCommand) goodbyeSet(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	g := GoodbyeChannel{
+		GuildID:   event.GuildID,
+		ChannelID: options["channel"].ChannelValue(nil).ID,
+		Template:  DefaultGoodbyeTemplate,
+	}
+	if option, ok := options["content"]; ok {
+		g.Template.Content = option.StringValue()
+	}
+	if option, ok := options["embed"]; ok {
+		g.Template.Embed = option.BoolValue()
+	}
+	if option, ok := options["title"]; ok {
+		g.Template.Title = option.StringValue()
+	}
+	if option, ok := options["color"]; ok {
+		color, err := parseColor(option.StringValue())
+		if err != nil {
+			return respondEphemeral(s, event.Interaction, ":x: The color has to be a hex color, like #40c7eb.")
+		}
+		g.Template.Color = color
+	}
+
+	if err := cmd.store.StoreGoodbyeChannel(ctx, g); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't save the goodbye channel.")
+	}
+
+	cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":wave: <@%s> set the goodbye channel to <#%s>", interactionUserID(event), g.ChannelID))
+
+	return cmd.respondGoodbyePreview(s, event, g, fmt.Sprintf(":+1: Members leaving are announced in <#%s>, like this:", g.ChannelID))
+}
+
+func (cmd *ApplicationCommand) goodbyeShow(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	g, err := cmd.store.GetGoodbyeChannel(ctx, event.GuildID)
+	if errors.Is(err, ErrNotFound) {
+		return respondEphemeral(s, event.Interaction, ":robot: Members leaving aren't announced. Use `/goodbye set` to announce them.")
+	}
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the goodbye channel.")
+	}
+
+	return cmd.respondGoodbyePreview(s, event, *g, fmt.Sprintf(":robot: Members leaving are announced in <#%s>, like this:", g.ChannelID))
+}
+
+func (cmd *ApplicationCommand) goodbyeDisable(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	if err := cmd.store.DeleteGoodbyeChannel(ctx, event.GuildID); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't disable the goodbye channel.")
+	}
+
+	cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":wave: <@%s> disabled goodbye messages", interactionUserID(event)))
+
+	return respondEphemeral(s, event.Interaction, ":+1: Members leaving are no longer announced.")
+}
+
+// respondGoodbyePreview renders the goodbye message as if the member who
+// used the command had left.
+func (cmd *ApplicationCommand) respondGoodbyePreview(s *discordgo.Session, event *discordgo.InteractionCreate, g GoodbyeChannel, content string) error {
+	data := WelcomeData{Member: event.Member, Reason: DepartureLeft}
+	if guild, err := s.State.Guild(event.GuildID); err == nil {
+		data.Guild = guild
+	}
+
+	msg := g.Render(data)
+	if msg.Content != "" {
+		content = content + "\n" + msg.Content
+	}
+
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content:         content,
+			Embeds:          msg.Embeds,
+			Flags:           discordgo.MessageFlagsEphemeral,
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		},
+	})
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultGuildPurgeGrace is how long data is kept after leaving a guild,
+// in case the bot was removed by accident and is added back.
+const DefaultGuildPurgeGrace = 7 * 24 * time.Hour
+
+// Guild is a guild the bot is, or has been, a member of.
+type Guild struct {
+	ID         string
+	Name       string
+	OwnerID    string
+	JoinedAt   time.Time
+	LeftAt     *time.Time
+	PurgeAfter *time.Time
+}
+
+// GuildRegistry keeps track of the guilds the bot is in, backed by the
+// servers table. It is the source of truth for which guilds to register
+// commands in and manage.
+type GuildRegistry struct {
+	Store *DiscordServerStore
+	// PurgeGrace is how long to wait after leaving a guild before its
+	// data is deleted.
+	PurgeGrace time.Duration
+
+	mu     sync.RWMutex
+	guilds map[string]*Guild
+}
+
+// Load reads the guilds the bot is in from the database.
+func (r *GuildRegistry) Load(ctx context.Context) error {
+	guilds, err := r.Store.GetGuilds(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.guilds = make(map[string]*Guild, len(guilds))
+	for _, g := range guilds {
+		r.guilds[g.ID] = g
+	}
+	return nil
+}
+
+// Join records that the bot is in a guild. Rejoining a guild that was left
+// cancels the pending purge of its data.
+func (r *GuildRegistry) Join(ctx context.Context, g *discordgo.Guild) error {
+	guild := &Guild{
+		ID:       g.ID,
+		Name:     g.Name,
+		OwnerID:  g.OwnerID,
+		JoinedAt: g.JoinedAt,
+	}
+	if guild.JoinedAt.IsZero() {
+		guild.JoinedAt = time.Now()
+	}
+
+	r.mu.Lock()
+	if r.guilds == nil {
+		r.guilds = make(map[string]*Guild)
+	}
+	r.guilds[g.ID] = guild
+	r.mu.Unlock()
+
+	return r.Store.UpsertGuild(ctx, guild)
+}
+
+// Leave records that the bot left a guild, and schedules its data to be
+// purged after the grace period.
+func (r *GuildRegistry) Leave(ctx context.Context, guildID string) error {
+	r.mu.Lock()
+	delete(r.guilds, guildID)
+	r.mu.Unlock()
+
+	grace := r.PurgeGrace
+	if grace == 0 {
+		grace = DefaultGuildPurgeGrace
+	}
+	return r.Store.MarkGuildLeft(ctx, guildID, time.Now().Add(grace))
+}
+
+// Guilds returns the guilds the bot is in, sorted by ID.
+func (r *GuildRegistry) Guilds() []*Guild {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	guilds := make([]*Guild, 0, len(r.guilds))
+	for _, g := range r.guilds {
+		guilds = append(guilds, g)
+	}
+	sort.Slice(guilds, func(i, j int) bool {
+		return guilds[i].ID < guilds[j].ID
+	})
+	return guilds
+}
+
+// Has returns whether the bot is in the guild.
+func (r *GuildRegistry) Has(guildID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.guilds[guildID]
+	return ok
+}
+
+// PurgeExpired deletes the data of guilds that were left longer than the
+// grace period ago. It returns the number of guilds purged.
+func (r *GuildRegistry) PurgeExpired(ctx context.Context) (int, error) {
+	guilds, err := r.Store.GetGuildsToPurge(ctx, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, g := range guilds {
+		logger := log.WithField("guild_id", g.ID).WithField("guild_name", g.Name)
+		if r.Has(g.ID) {
+			// We joined again since, don't purge anything
+			continue
+		}
+		if err := r.Store.PurgeGuild(ctx, g.ID); err != nil {
+			logger.WithError(err).Error("Failed to purge guild data")
+			continue
+		}
+		logger.Info("Purged data for guild we left")
+		purged++
+	}
+	return purged, nil
+}
+
+func (srv *DiscordServerStore) UpsertGuild(ctx context.Context, g *Guild) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	log.WithField("guild_id", g.ID).Debug("Upserting guild in DB")
+	_, err := srv.db.ExecContext(ctx, `
+                INSERT INTO servers
+                        (id, name, owner_id, joined_at)
+                VALUES ($1, $2, $3, $4)
+                ON CONFLICT (id)
+                DO UPDATE SET
+                        name = $2,
+                        owner_id = $3,
+                        joined_at = CASE WHEN servers.left_at IS NULL THEN servers.joined_at ELSE $4 END,
+                        left_at = NULL,
+                        purge_after = NULL`,
+		g.ID, g.Name, g.OwnerID, g.JoinedAt)
+	if err != nil {
+		log.WithError(err).Error("Failed to upsert guild")
+		return err
+	}
+
+	return nil
+}
+
+func (srv *DiscordServerStore) MarkGuildLeft(ctx context.Context, guildID string, purgeAfter time.Time) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	log.WithField("guild_id", guildID).WithField("purge_after", purgeAfter).Debug("Marking guild as left in DB")
+	_, err := srv.db.ExecContext(ctx, "UPDATE servers SET left_at = now(), purge_after = $2 WHERE id = $1", guildID, purgeAfter)
+	if err != nil {
+		log.WithError(err).Error("Failed to mark guild as left")
+		return err
+	}
+
+	return nil
+}
+
+// GetGuilds returns the guilds the bot is currently in.
+func (srv *DiscordServerStore) GetGuilds(ctx context.Context) ([]*Guild, error) {
+	return srv.queryGuilds(ctx, "SELECT id, name, owner_id, joined_at, left_at, purge_after FROM servers WHERE left_at IS NULL")
+}
+
+// GetGuildsToPurge returns the guilds that were left and whose grace
+// period is over.
+func (srv *DiscordServerStore) GetGuildsToPurge(ctx context.Context, now time.Time) ([]*Guild, error) {
+	return srv.queryGuilds(ctx, "SELECT id, name, owner_id, joined_at, left_at, purge_after FROM servers WHERE left_at IS NOT NULL AND purge_after <= $1", now)
+}
+
+func (srv *DiscordServerStore) queryGuilds(ctx context.Context, query string, args ...interface{}) ([]*Guild, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	rows, err := srv.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.WithError(err).Error("Failed to fetch guilds")
+		return nil, err
+	}
+	defer rows.Close()
+
+	guilds := make([]*Guild, 0)
+	for rows.Next() {
+		var g Guild
+		var leftAt, purgeAfter sql.NullTime
+		if err := rows.Scan(&g.ID, &g.Name, &g.OwnerID, &g.JoinedAt, &leftAt, &purgeAfter); err != nil {
+			log.WithError(err).Error("Failed to scan database row")
+			return nil, err
+		}
+		if leftAt.Valid {
+			g.LeftAt = &leftAt.Time
+		}
+		if purgeAfter.Valid {
+			g.PurgeAfter = &purgeAfter.Time
+		}
+		guilds = append(guilds, &g)
+	}
+
+	return guilds, rows.Err()
+}
+
+// PurgeGuild deletes everything stored for a guild.
+func (srv *DiscordServerStore) PurgeGuild(ctx context.Context, guildID string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	err := srv.inTx(ctx, func(tx *sql.Tx) error {
+		for _, query := range []string{
+			"DELETE FROM reaction_message_reactions WHERE message_guild = $1",
+			"DELETE FROM reaction_messages WHERE guild = $1",
+			"DELETE FROM welcome_channel WHERE guild = $1",
+			"DELETE FROM goodbye_channel WHERE guild = $1",
+			"DELETE FROM auto_roles WHERE guild = $1",
+			"DELETE FROM sticky_member_roles WHERE guild = $1",
+			"DELETE FROM verification WHERE guild = $1",
+			"DELETE FROM member_verification WHERE guild = $1",
+			"DELETE FROM onboarding_reminders WHERE guild = $1",
+			"DELETE FROM member_onboarding WHERE guild = $1",
+			"DELETE FROM raid_protection WHERE guild = $1",
+			"DELETE FROM mod_log WHERE guild = $1",
+			"DELETE FROM guild_settings WHERE guild = $1",
+			"DELETE FROM command_permissions WHERE guild = $1",
+			"DELETE FROM interaction_in_progress WHERE data->>'guild_id' = $1",
+			"DELETE FROM servers WHERE id = $1",
+		} {
+			if _, err := tx.ExecContext(ctx, query, guildID); err != nil {
+				log.WithError(err).WithField("query", query).Error("Failed to purge guild data")
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	srv.settings.invalidate(guildID)
+	srv.welcome.invalidate(guildID)
+	srv.modLog.invalidate(guildID)
+
+	return nil
+}
@@ -0,0 +1,589 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+	"github.com/sklirg/tardis/textcommands"
+)
+
+// HybridOptionType is the type of a hybrid command option.
+type HybridOptionType int
+
+const (
+	// HybridString is a single word in text commands.
+	HybridString HybridOptionType = iota
+	// HybridText is the rest of the message in text commands, with its
+	// line breaks, so it has to be the last option.
+	HybridText
+	HybridInteger
+	// HybridChannel is a channel mention or ID in text commands.
+	HybridChannel
+	// HybridRole is a role mention, ID or name in text commands.
+	HybridRole
+)
+
+// HybridOption is an option of a hybrid command. Values are handed to the
+// handler as strings, with channels and roles as their IDs.
+type HybridOption struct {
+	Name        string
+	Description string
+	Type        HybridOptionType
+	Required    bool
+	Choices     []string
+}
+
+// HybridHandler runs a hybrid command, whether it was used as a slash
+// command or a text command.
+type HybridHandler func(ctx *HybridContext) error
+
+// HybridCommand is a command defined once, and exposed both as a chat
+// input application command and as a prefixed text command.
+type HybridCommand struct {
+	Name string
+	// Aliases are other names for the text command.
+	Aliases     []string
+	Description string
+	Options     []*HybridOption
+	// Subcommands, if set, are chosen by the first word of text commands.
+	// DefaultSubcommand is used when the first word isn't a subcommand.
+	Subcommands       []*HybridCommand
+	DefaultSubcommand string
+	// Module, if set, is the module which has to be turned on in the
+	// guild for the command to be used.
+	Module Module
+	// Permission, if set, is the admin command the member needs
+	// permission to run to use the command, or the subcommand.
+	Permission string
+	// SlashSubcommand, if set, is the subcommand of another application
+	// command which runs the command as a slash command, like
+	// "reactionrole add". The command then has no slash command of its
+	// own.
+	SlashSubcommand string
+	// Ephemeral makes slash command replies only visible to the user.
+	Ephemeral bool
+	Handler   HybridHandler
+}
+
+// HybridContext is a hybrid command being run. Handlers reply through it
+// the same way no matter how the command was used. It carries the
+// deadline of the handler it is run from.
+type HybridContext struct {
+	context.Context
+	Session   *discordgo.Session
+	GuildID   string
+	ChannelID string
+	UserID    string
+	Location  *time.Location
+	// Message is the message a text command was used with, nil for slash
+	// commands.
+	Message *discordgo.MessageCreate
+
+	options map[string]string
+	replier hybridReplier
+}
+
+// String returns the value of an option, or "" if it wasn't given.
+func (ctx *HybridContext) String(name string) string {
+	return ctx.options[name]
+}
+
+// Has returns whether an option was given.
+func (ctx *HybridContext) Has(name string) bool {
+	_, ok := ctx.options[name]
+	return ok
+}
+
+// Int returns the value of an integer option, and whether it was given.
+func (ctx *HybridContext) Int(name string) (int64, bool) {
+	v, err := strconv.ParseInt(ctx.options[name], 10, 64)
+	return v, err == nil
+}
+
+// Reply sends a message in reply to the command.
+func (ctx *HybridContext) Reply(content string) error {
+	return ctx.Send(&discordgo.MessageSend{Content: content})
+}
+
+// ReplyEmbed sends an embed in reply to the command.
+func (ctx *HybridContext) ReplyEmbed(embed *discordgo.MessageEmbed) error {
+	return ctx.Send(&discordgo.MessageSend{Embeds: []*discordgo.MessageEmbed{embed}})
+}
+
+// Send sends a message in reply to the command, without pinging anyone.
+func (ctx *HybridContext) Send(msg *discordgo.MessageSend) error {
+	if msg.AllowedMentions == nil {
+		msg.AllowedMentions = &discordgo.MessageAllowedMentions{}
+	}
+	return ctx.replier.send(msg)
+}
+
+// Defer tells the user the bot is working on it, for commands which take
+// more than a couple of seconds to reply.
+func (ctx *HybridContext) Defer() error {
+	return ctx.replier.deferReply()
+}
+
+// React reacts to the message of a text command. Slash commands which
+// haven't replied when the handler returns are answered with the last
+// reaction instead.
+func (ctx *HybridContext) React(emoji string) error {
+	return ctx.replier.react(emoji)
+}
+
+type hybridReplier interface {
+	send(msg *discordgo.MessageSend) error
+	deferReply() error
+	react(emoji string) error
+}
+
+type messageReplier struct {
+	s *discordgo.Session
+	m *discordgo.MessageCreate
+}
+
+func (r *messageReplier) send(msg *discordgo.MessageSend) error {
+	_, err := r.s.ChannelMessageSendComplex(r.m.ChannelID, msg)
+	return err
+}
+
+func (r *messageReplier) deferReply() error {
+	return r.s.ChannelTyping(r.m.ChannelID)
+}
+
+func (r *messageReplier) react(emoji string) error {
+	return r.s.MessageReactionAdd(r.m.ChannelID, r.m.ID, emoji)
+}
+
+// interactionReplier responds to the interaction first, and follows up
+// after that.
+type interactionReplier struct {
+	s           *discordgo.Session
+	interaction *discordgo.Interaction
+	flags       discordgo.MessageFlags
+	deferred    bool
+	responded   bool
+	reaction    string
+}
+
+func (r *interactionReplier) send(msg *discordgo.MessageSend) error {
+	switch {
+	case r.responded:
+		_, err := r.s.FollowupMessageCreate(r.interaction, true, &discordgo.WebhookParams{
+			Content:         msg.Content,
+			Embeds:          msg.Embeds,
+			AllowedMentions: msg.AllowedMentions,
+			Flags:           r.flags,
+		})
+		return err
+	case r.deferred:
+		r.responded = true
+		_, err := r.s.InteractionResponseEdit(r.interaction, &discordgo.WebhookEdit{
+			Content:         &msg.Content,
+			Embeds:          &msg.Embeds,
+			AllowedMentions: msg.AllowedMentions,
+		})
+		return err
+	}
+	r.responded = true
+	return r.s.InteractionRespond(r.interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content:         msg.Content,
+			Embeds:          msg.Embeds,
+			AllowedMentions: msg.AllowedMentions,
+			Flags:           r.flags,
+		},
+	})
+}
+
+func (r *interactionReplier) deferReply() error {
+	if r.deferred || r.responded {
+		return nil
+	}
+	r.deferred = true
+	return r.s.InteractionRespond(r.interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: r.flags},
+	})
+}
+
+func (r *interactionReplier) react(emoji string) error {
+	r.reaction = emoji
+	return nil
+}
+
+// finish answers the interaction if the handler didn't, so it doesn't
+// time out.
+func (r *interactionReplier) finish() error {
+	if r.responded {
+		return nil
+	}
+	content := r.reaction
+	if content == "" {
+		content = ":+1:"
+	}
+	return r.send(&discordgo.MessageSend{Content: content})
+}
+
+// subcommand finds a subcommand by its name or an alias.
+func (h *HybridCommand) subcommand(name string) *HybridCommand {
+	for _, sub := range h.Subcommands {
+		if sub.Name == name || slices.Contains(sub.Aliases, name) {
+			return sub
+		}
+	}
+	return nil
+}
+
+// Usage describes how to use the text command, without the prefix.
+func (h *HybridCommand) Usage() string {
+	if len(h.Subcommands) == 0 {
+		return usage(h.Name, h.Options)
+	}
+	usages := make([]string, 0, len(h.Subcommands))
+	for _, sub := range h.Subcommands {
+		name := h.Name + " " + sub.Name
+		if sub.Name == h.DefaultSubcommand {
+			name = h.Name
+		}
+		usages = append(usages, usage(name, sub.Options))
+	}
+	return strings.Join(usages, " | ")
+}
+
+func usage(name string, options []*HybridOption) string {
+	words := []string{name}
+	for _, option := range options {
+		word := option.Name
+		if len(option.Choices) > 0 {
+			word = strings.Join(option.Choices, "|")
+		}
+		if option.Type == HybridText {
+			word += "..."
+		}
+		if option.Required {
+			word = "<" + word + ">"
+		} else {
+			word = "[" + word + "]"
+		}
+		words = append(words, word)
+	}
+	return strings.Join(words, " ")
+}
+
+// TextCommand creates the text command of the hybrid command.
+func (h *HybridCommand) TextCommand() *textcommands.Command {
+	cmd := &textcommands.Command{
+		Name:        h.Name,
+		Aliases:     h.Aliases,
+		Usage:       h.Usage(),
+		Description: h.Description,
+		Module:      string(h.Module),
+		Permission:  h.Permission,
+		Handler:     h.runText,
+	}
+	for _, sub := range h.Subcommands {
+		if sub.Permission == "" {
+			continue
+		}
+		if cmd.SubcommandPermissions == nil {
+			cmd.SubcommandPermissions = make(map[string]string)
+		}
+		for _, name := range append([]string{sub.Name}, sub.Aliases...) {
+			cmd.SubcommandPermissions[name] = sub.Permission
+		}
+	}
+	return cmd
+}
+
+func (h *HybridCommand) runText(tctx *textcommands.Context) error {
+	m := tctx.Message
+	ctx := &HybridContext{
+		Context:   tctx,
+		Session:   tctx.Session,
+		GuildID:   m.GuildID,
+		ChannelID: m.ChannelID,
+		UserID:    m.Author.ID,
+		Location:  tctx.Location,
+		Message:   m,
+		replier:   &messageReplier{s: tctx.Session, m: m},
+	}
+
+	args := splitArgs(m.Content[len(tctx.Prefix)+len(tctx.Trigger):])
+	cmd := h
+	if len(h.Subcommands) > 0 {
+		var sub *HybridCommand
+		if len(args.words) > 0 {
+			sub = h.subcommand(args.words[0])
+		}
+		if sub != nil {
+			args = args.shift()
+		} else if sub = h.subcommand(h.DefaultSubcommand); sub == nil {
+			return ctx.Reply(fmt.Sprintf(":robot: Use it like `%s%s`.", tctx.Prefix, h.Usage()))
+		}
+		cmd = sub
+	}
+
+	options, err := parseTextOptions(tctx.Session, m.GuildID, cmd.Options, args)
+	if err != nil {
+		return ctx.Reply(fmt.Sprintf(":robot: %s. Use it like `%s%s`.", err, tctx.Prefix, h.Usage()))
+	}
+	ctx.options = options
+	return cmd.Handler(ctx)
+}
+
+// textArgs are the words of a text command, and where they start, so
+// text options can keep the line breaks of the rest of the message.
+type textArgs struct {
+	raw    string
+	words  []string
+	starts []int
+}
+
+func splitArgs(raw string) textArgs {
+	args := textArgs{raw: raw}
+	start := -1
+	for i, r := range raw {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				args.words = append(args.words, raw[start:i])
+				args.starts = append(args.starts, start)
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		args.words = append(args.words, raw[start:])
+		args.starts = append(args.starts, start)
+	}
+	return args
+}
+
+func (a textArgs) shift() textArgs {
+	return textArgs{raw: a.raw, words: a.words[1:], starts: a.starts[1:]}
+}
+
+// parseTextOptions assigns the words of a text command to the options in
+// order. Optional options are only filled when there are words to spare,
+// so an optional option can come before required ones.
+func parseTextOptions(s *discordgo.Session, guildID string, options []*HybridOption, args textArgs) (map[string]string, error) {
+	required := 0
+	for _, option := range options {
+		if option.Required {
+			required++
+		}
+	}
+	spare := len(args.words) - required
+
+	values := make(map[string]string, len(options))
+	i := 0
+	for _, option := range options {
+		if i >= len(args.words) {
+			if option.Required {
+				return nil, fmt.Errorf("`%s` is missing", option.Name)
+			}
+			continue
+		}
+		if !option.Required {
+			if spare <= 0 {
+				continue
+			}
+			spare--
+		}
+
+		raw := args.words[i]
+		i++
+		if option.Type == HybridText {
+			raw = strings.TrimSpace(args.raw[args.starts[i-1]:])
+			i = len(args.words)
+		}
+		value, err := option.parse(s, guildID, raw)
+		if err != nil {
+			return nil, err
+		}
+		values[option.Name] = value
+	}
+	if i < len(args.words) {
+		return nil, errors.New("that's too many arguments")
+	}
+
+	return values, nil
+}
+
+func (o *HybridOption) parse(s *discordgo.Session, guildID, raw string) (string, error) {
+	if len(o.Choices) > 0 {
+		for _, choice := range o.Choices {
+			if strings.EqualFold(choice, raw) {
+				return choice, nil
+			}
+		}
+		return "", fmt.Errorf("`%s` has to be one of %s", o.Name, strings.Join(o.Choices, ", "))
+	}
+
+	switch o.Type {
+	case HybridInteger:
+		if _, err := strconv.ParseInt(raw, 10, 64); err != nil {
+			return "", fmt.Errorf("`%s` has to be a number", o.Name)
+		}
+	case HybridChannel:
+		id := strings.TrimSuffix(strings.TrimPrefix(raw, "<#"), ">")
+		if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+			return "", fmt.Errorf("`%s` has to be a channel", o.Name)
+		}
+		return id, nil
+	case HybridRole:
+		id := strings.TrimSuffix(strings.TrimPrefix(raw, "<@&"), ">")
+		if _, err := strconv.ParseUint(id, 10, 64); err == nil {
+			return id, nil
+		}
+		// Not an ID, so look it up by name
+		if guild, err := s.State.Guild(guildID); err == nil {
+			for _, role := range guild.Roles {
+				if strings.EqualFold(role.Name, raw) {
+					return role.ID, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("I can't find the role `%s`", raw)
+	}
+	return raw, nil
+}
+
+// ApplicationCommand creates the slash command of the hybrid command.
+func (h *HybridCommand) ApplicationCommand(store *DiscordServerStore) *ApplicationCommand {
+	command := &discordgo.ApplicationCommand{
+		Name:        h.Name,
+		Description: h.Description,
+		Version:     "1",
+		Type:        discordgo.ChatApplicationCommand,
+	}
+
+	cmd := &ApplicationCommand{
+		Name:       h.Name,
+		Command:    command,
+		Module:     h.Module,
+		Permission: h.Permission,
+		store:      store,
+	}
+	if len(h.Subcommands) == 0 {
+		command.Options = slashOptions(h.Options)
+		cmd.Handler = func(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate) error {
+			return h.runSlash(ctx, s, event, optionMap(event.ApplicationCommandData().Options), store)
+		}
+		return cmd
+	}
+
+	cmd.Subcommands = make(map[string]SubcommandHandler, len(h.Subcommands))
+	for _, sub := range h.Subcommands {
+		command.Options = append(command.Options, &discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        sub.Name,
+			Description: sub.Description,
+			Options:     slashOptions(sub.Options),
+		})
+		cmd.Subcommands[sub.Name] = func(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+			return sub.runSlash(ctx, s, event, options, store)
+		}
+	}
+	return cmd
+}
+
+// SubcommandHandler runs the command as the subcommand of another
+// application command, see SlashSubcommand.
+func (h *HybridCommand) SubcommandHandler(store *DiscordServerStore) SubcommandHandler {
+	return func(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+		return h.runSlash(ctx, s, event, options, store)
+	}
+}
+
+// slashOptions converts the options, with required ones first as Discord
+// wants them.
+func slashOptions(options []*HybridOption) []*discordgo.ApplicationCommandOption {
+	converted := make([]*discordgo.ApplicationCommandOption, 0, len(options))
+	for _, required := range []bool{true, false} {
+		for _, option := range options {
+			if option.Required != required {
+				continue
+			}
+			o := &discordgo.ApplicationCommandOption{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        option.Name,
+				Description: option.Description,
+				Required:    option.Required,
+			}
+			switch option.Type {
+			case HybridInteger:
+				o.Type = discordgo.ApplicationCommandOptionInteger
+			case HybridChannel:
+				o.Type = discordgo.ApplicationCommandOptionChannel
+				o.ChannelTypes = []discordgo.ChannelType{discordgo.ChannelTypeGuildText}
+			case HybridRole:
+				o.Type = discordgo.ApplicationCommandOptionRole
+			}
+			for _, choice := range option.Choices {
+				o.Choices = append(o.Choices, &discordgo.ApplicationCommandOptionChoice{Name: choice, Value: choice})
+			}
+			converted = append(converted, o)
+		}
+	}
+	return converted
+}
+
+func (h *HybridCommand) runSlash(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption, store *DiscordServerStore) error {
+	// The router checks the permission of the command, but not of its
+	// subcommands
+	if h.Permission != "" && store != nil {
+		if event.Member == nil || !store.CanRunAdminCommand(ctx, event.GuildID, h.Permission, event.Member, event.Member.Permissions) {
+			return respondPermissionDenied(s, event)
+		}
+	}
+
+	replier := &interactionReplier{s: s, interaction: event.Interaction}
+	if h.Ephemeral {
+		replier.flags = discordgo.MessageFlagsEphemeral
+	}
+	hctx := &HybridContext{
+		Context:   ctx,
+		Session:   s,
+		GuildID:   event.GuildID,
+		ChannelID: event.ChannelID,
+		UserID:    interactionUserID(event),
+		Location:  time.UTC,
+		options:   make(map[string]string, len(options)),
+		replier:   replier,
+	}
+	if store != nil {
+		hctx.Location = store.GuildSettings(ctx, event.GuildID).Location()
+	}
+	for name, option := range options {
+		switch option.Type {
+		case discordgo.ApplicationCommandOptionInteger:
+			hctx.options[name] = strconv.FormatInt(option.IntValue(), 10)
+		case discordgo.ApplicationCommandOptionChannel:
+			hctx.options[name] = option.ChannelValue(nil).ID
+		case discordgo.ApplicationCommandOptionRole:
+			hctx.options[name] = option.RoleValue(nil, "").ID
+		default:
+			hctx.options[name] = option.StringValue()
+		}
+	}
+
+	log.WithField("command", h.Name).WithField("guild_id", event.GuildID).Debug("Running hybrid command")
+	if err := h.Handler(hctx); err != nil {
+		return err
+	}
+	return replier.finish()
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+)
+
+// HybridCommands are the text commands for managing reaction roles and
+// the welcome channel. As slash commands they are subcommands of
+// /reactionrole and /welcome.
+func (srv *DiscordServerStore) HybridCommands() []*HybridCommand {
+	return []*HybridCommand{
+		srv.reactRoleCommand(),
+		srv.setWelcomeChannelCommand(),
+	}
+}
+
+func (srv *DiscordServerStore) reactRoleCommand() *HybridCommand {
+	return &HybridCommand{
+		Name:            "reactrole",
+		SlashSubcommand: "reactionrole add",
+		Description:     "Give members a role when they react to a message with an emoji",
+		Options: []*HybridOption{
+			{Name: "channel", Description: "Channel the message is in, this channel if left out", Type: HybridChannel},
+			{Name: "message", Description: "ID of the message", Type: HybridString, Required: true},
+			{Name: "emoji", Description: "Emoji to react with, from this server", Type: HybridString, Required: true},
+			{Name: "role", Description: "Role to give", Type: HybridRole, Required: true},
+		},
+		Module:     ModuleReactRole,
+		Permission: AdminCommandReactRole,
+		Ephemeral:  true,
+		Handler:    srv.addReactRole,
+	}
+}
+
+func (srv *DiscordServerStore) setWelcomeChannelCommand() *HybridCommand {
+	return &HybridCommand{
+		Name:            "setwelcomechannel",
+		SlashSubcommand: "welcome set",
+		Description:     "Welcome new members in this channel, pointing them to the reaction roles",
+		Options: []*HybridOption{
+			{Name: "emoji-channel", Description: "Channel with the reaction roles", Type: HybridChannel},
+		},
+		Module:     ModuleWelcome,
+		Permission: AdminCommandSetWelcomeChannel,
+		Ephemeral:  true,
+		Handler:    srv.setWelcomeChannel,
+	}
+}
+
+// setWelcomeChannel welcomes new members in the channel it is used in, or
+// the one given to the slash command.
+func (srv *DiscordServerStore) setWelcomeChannel(ctx *HybridContext) error {
+	w := WelcomeChannel{
+		GuildID:          ctx.GuildID,
+		MessageChannelID: ctx.ChannelID,
+	}
+	if ctx.Has("channel") {
+		w.MessageChannelID = ctx.String("channel")
+	}
+	// Keep the emoji channel unless a new one is given
+	if ctx.Has("emoji-channel") {
+		w.EmojiChannelID = ctx.String("emoji-channel")
+	} else if current, err := srv.WelcomeChannel(ctx, ctx.GuildID); err == nil && current != nil {
+		w.EmojiChannelID = current.EmojiChannelID
+	}
+
+	if err := srv.StoreWelcomeChannel(ctx, w); err != nil {
+		return ctx.Reply(":x: Couldn't save the welcome channel.")
+	}
+
+	srv.AdminLog(ctx, ctx.Session, ctx.GuildID, fmt.Sprintf(":wave: <@%s> set the welcome channel: %s", ctx.UserID, describeWelcomeChannel(&w)))
+
+	if ctx.Message != nil {
+		return ctx.React("👍")
+	}
+	return ctx.Reply(fmt.Sprintf(":+1: Okay, %s.", describeWelcomeChannel(&w)))
+}
@@ -1,9 +1,10 @@
 package server
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"os"
 	"strconv"
 	"strings"
 
@@ -11,174 +12,94 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-var db *sql.DB
-
 // DiscordServerStore contains the relevant items for discord server management
 type DiscordServerStore struct {
-}
-
-func init() {
-	connectionStr := os.Getenv("DATABASE_URL")
-
-	if connectionStr == "" {
-		log.Error("Database URL is empty")
-		return
-	}
-
-	var err error
-	db, err = sql.Open("postgres", connectionStr)
+	db *sql.DB
 
-	if err != nil {
-		log.WithError(err).Error("Failed to connect to database")
-		return
-	}
+	settings settingsCache
+	welcome  welcomeCache
+	modLog   modLogCache
+}
 
-	if err := db.Ping(); err != nil {
-		log.WithError(err).Error("Failed to ping database")
-		return
-	}
+// NewDiscordServerStore creates a store using the database. The store
+// methods return an error if db is nil.
+func NewDiscordServerStore(db *sql.DB) *DiscordServerStore {
+	return &DiscordServerStore{db: db}
 }
 
-// HandleDiscordMessage handles a relevant incoming discord message and responds to it
-func (srv *DiscordServerStore) HandleDiscordMessage(s *discordgo.Session, m *discordgo.MessageCreate) error {
-	logger := log.WithField("handler", "reactrole")
-	logger = logger.WithFields(log.Fields{
-		"author_id":       m.Author.ID,
-		"author_nickname": m.Author.String(),
-	})
-	tokens := strings.Split(m.Content, " ")
-	params := tokens[1:] // @ToDo: Fix allowing spaces by wrapping in ""
-	if len(params) < 3 || params[0] == "help" {
-		s.ChannelMessageSend(m.ChannelID, ":robot: !reactrole <channel ID> <message ID> <reaction> <role>. Omit <channel ID> if in same channel.")
-		return nil
-	}
-
-	var channel, message, reaction, roleParam string
-	if len(params) == 3 {
-		logger.Trace("Using current channel as target for message")
-		channel = m.ChannelID
-		message = params[0]
-		reaction = params[1]
-		roleParam = params[2]
-	} else {
-		channel = params[0]
-		message = params[1]
-		reaction = params[2]
-		roleParam = params[3]
-	}
-	logger = logger.WithFields(log.Fields{
-		"channel_param": channel,
-		"message_param": message,
-		"emoji_param":   reaction,
-		"role_param":    roleParam,
+// addReactRole makes members get a role when they react to a message
+// with an emoji.
+func (srv *DiscordServerStore) addReactRole(ctx *HybridContext) error {
+	s := ctx.Session
+	channel := ctx.ChannelID
+	if ctx.Has("channel") {
+		channel = ctx.String("channel")
+	}
+	message, roleID := ctx.String("message"), ctx.String("role")
+	logger := log.WithFields(log.Fields{
+		"handler":    "reactrole",
+		"author_id":  ctx.UserID,
+		"channel_id": channel,
+		"message_id": message,
+		"role_id":    roleID,
 	})
 
-	// Find emoji
-	emojiName, err := GetValidEmoji(reaction, m.GuildID, s)
+	emoji, err := parseEmojiOption(s, ctx.GuildID, ctx.String("emoji"))
 	if err != nil {
-		s.ChannelMessageSend(m.ChannelID, ":robot: I can't find that emoji. It has to be from this server.")
-		return fmt.Errorf("failed to find emoji")
-	}
-	logger = logger.WithField("emoji", emojiName)
-	logger.Debug("Identified emoji")
-
-	// Find role
-	var role *discordgo.Role
-	_, err = strconv.ParseUint(roleParam, 10, 64)
-	roleParamIsID := err == nil // if we got no error parsing the param to int, it is potentially a valid role ID
-	logger.WithField("role_param_is_id", roleParamIsID).Debug("Identified role param")
-
-	if roleParamIsID {
-		var err error
-		if role, err = s.State.Role(m.GuildID, roleParam); err != nil {
-			logger.WithError(err).Error("Failed to fetch role by id")
-			return fmt.Errorf("Failed to fetch role by ID")
-		}
-	} else {
-		// Role param is a string, most likely the role name. Let's try to find it.
-		guild, err := s.State.Guild(m.GuildID)
-		if err != nil {
-			logger.WithError(err).Error("Failed fetching guild")
-			return fmt.Errorf("failed to fetch guild")
-		}
-
-		for _, rol := range guild.Roles {
-			if strings.ToLower(rol.Name) == strings.ToLower(roleParam) {
-				role = rol
-				break
-			}
-		}
-		if role == nil {
-			logger.Error("Failed finding role")
-			return fmt.Errorf("failed to find role")
-		}
-		logger.WithField("role", role).Debug("Found role")
+		return ctx.Reply(":robot: I can't find that emoji. It has to be from this server.")
 	}
-	logger = logger.WithField("role_id", role.ID).WithField("role_name", role.Name)
-	logger.Debug("Identified role")
+	logger = logger.WithField("emoji", emoji)
 
-	var userPermissions int64
-	if perms, err := s.State.UserChannelPermissions(m.Author.ID, channel); err != nil {
-		logger.WithError(err).Error("Failed to look up user permissions")
-	} else {
-		userPermissions = perms
-	}
-	logger.WithField("user_perms", userPermissions).Debug("Identified user permissions")
-
-	if !hasPerms(discordgo.PermissionManageRoles, userPermissions) {
-		s.MessageReactionAdd(m.ChannelID, m.ID, "👎")
-		logger.Warn("User does not have enough permission to assign role, aborting")
-		return fmt.Errorf("user has not enough permissions")
+	role, err := s.State.Role(ctx.GuildID, roleID)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to find role")
+		return ctx.Reply(":robot: I can't find that role.")
 	}
 
 	var botPerms int64
-	if perms, err := s.State.UserChannelPermissions(s.State.Ready.User.ID, channel); err != nil {
+	if perms, err := s.State.UserChannelPermissions(s.State.User.ID, channel); err != nil {
 		logger.WithError(err).Error("Failed to look up my own user permissions")
 	} else {
 		botPerms = perms
 	}
-
 	if !hasPerms(discordgo.PermissionManageRoles, botPerms) {
-		s.ChannelMessageSend(m.ChannelID, ":robot: It seems like I don't have the correct permissions to assign this role. I need 'Manage Roles', and that role has to be above the one I am assigning.")
-		log.Warn("Bot does not have enough permission to assign role")
-		return fmt.Errorf("bot has not enough permissions")
+		return ctx.Reply(":robot: It seems like I don't have the correct permissions to assign this role. I need 'Manage Roles', and that role has to be above the one I am assigning.")
 	}
 
 	msg, err := s.ChannelMessage(channel, message)
 	if err != nil {
 		logger.WithError(err).Error("Failed to find message")
-		s.ChannelMessageSend(m.ChannelID, ":robot: I couldn't find that message :(")
-		return fmt.Errorf("failed to find requested message")
+		return ctx.Reply(":robot: I couldn't find that message :(")
 	}
-	msg.GuildID = m.GuildID // this is not set when we retrieve the message
+	msg.GuildID = ctx.GuildID // this is not set when we retrieve the message
 
-	// All seems good, let's persist this
-	// store in db smile
-	if err := srv.StoreReactRole(ReactRole{
+	if err := srv.StoreReactRole(ctx, ReactRole{
 		Message: &ReactRoleMessage{
 			GuildID:   msg.GuildID,
 			ChannelID: msg.ChannelID,
 			ID:        msg.ID,
 		},
 		Role:  role.ID,
-		Emoji: emojiName,
+		Emoji: emoji,
 	}); err != nil {
-		return fmt.Errorf("failed to store in db")
+		if errors.Is(err, ErrConflict) {
+			return ctx.Reply(fmt.Sprintf(":x: %s already gives a role on that message, remove it first.", renderEmoji(s, ctx.GuildID, emoji)))
+		}
+		logger.WithError(err).Error("Failed to store reaction role")
+		return ctx.Reply(":x: Failed to save the reaction role.")
 	}
 
-	if err := s.MessageReactionAdd(msg.ChannelID, msg.ID, emojiName); err != nil {
+	if err := s.MessageReactionAdd(msg.ChannelID, msg.ID, emoji); err != nil {
 		logger.WithError(err).Error("Failed to add reaction to message")
-
-		return fmt.Errorf("failed to find message to add reaction to")
 	}
-	if _, err := s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Okay! Giving %s to users when they click %s on that message in <#%s> (%s).", role.Mention(), reaction, channel, messageLink(msg))); err != nil {
-		logger.WithError(err).Error("Failed to send message")
-		return fmt.Errorf("failed to send response message")
+	if err := ctx.Reply(fmt.Sprintf(":+1: Okay, giving %s to users when they click %s on %s.", role.Mention(), renderEmoji(s, ctx.GuildID, emoji), MessageLink(msg))); err != nil {
+		return err
 	}
-	// Finally, clean up the request message since it looks ugly AF
-	if err := s.ChannelMessageDelete(m.ChannelID, m.ID); err != nil {
-		logger.WithError(err).Error("Failed to delete request message")
-		return fmt.Errorf("failed to delete request message")
+	// Clean up the request message, since it clutters the channel
+	if ctx.Message != nil {
+		if err := s.ChannelMessageDelete(ctx.ChannelID, ctx.Message.ID); err != nil {
+			logger.WithError(err).Warn("Failed to delete request message")
+		}
 	}
 	return nil
 }
@@ -187,13 +108,19 @@ func (srv *DiscordServerStore) HandleDiscordMessage(s *discordgo.Session, m *dis
 // returns a valid identifier to use with the Discord API.
 // It will either be the Emoji ID or the UTF-8 emoji.
 func GetValidEmoji(emoji, guildID string, s *discordgo.Session) (string, error) {
+	if emoji == "" {
+		return "", fmt.Errorf("no emoji given")
+	}
 	if emoji[0] == '<' {
 		if s == nil {
 			return "", fmt.Errorf("Cannot return a valid emoji without a discordgo.Session")
 		}
+		// Custom emoji look like <:name:id>, or <a:name:id> if animated
 		parts := strings.Split(emoji, ":")
-		id := parts[2]
-		id = id[:len(id)-1] // Remove the '>'
+		if len(parts) != 3 || !strings.HasSuffix(parts[2], ">") {
+			return "", fmt.Errorf("'%s' is not a custom emoji", emoji)
+		}
+		id := strings.TrimSuffix(parts[2], ">")
 		if emoji, err := s.State.Emoji(guildID, id); err == nil {
 			return emoji.APIName(), nil
 		} else {
@@ -235,10 +162,97 @@ func hasPerms(expectedPermission, permissions int64) bool {
 	return r
 }
 
-func messageLink(msg *discordgo.Message) string {
+// MessageLink returns a link to a message, without an embed preview.
+func MessageLink(msg *discordgo.Message) string {
 	return fmt.Sprintf("<https://discordapp.com/channels/%s/%s/%s>", msg.GuildID, msg.ChannelID, msg.ID)
 }
 
 func Main() {
 	log.Info("In server package")
 }
+
+// SyncReactionRoles grants the bound role to every member of the guild who
+// has reacted to a reaction role message, in case reactions were added
+// while the bot was offline. It returns the number of roles granted.
+func (srv *DiscordServerStore) SyncReactionRoles(ctx context.Context, s *discordgo.Session, guildID string, cleanUpMissingMembers bool) (int, error) {
+	logger := log.WithField("func", "syncReactionRoles")
+	logger.Info("Syncing reaction roles")
+
+	roles, err := srv.GetReactionRolesForGuild(ctx, guildID)
+	if err != nil {
+		return 0, err
+	}
+
+	granted := 0
+	for _, role := range roles {
+		logger = logger.WithField("role_id", role.Role)
+
+		paginationEnd := ""
+		users := make([]*discordgo.User, 0)
+		for {
+			reactions, err := s.MessageReactions(role.Message.ChannelID, role.Message.ID, role.Emoji, 100, "", paginationEnd)
+			if err != nil {
+				logger.Error("failed to get reactions for emoji")
+				break
+			}
+			if len(reactions) == 0 {
+				break
+			}
+			logger.Infof("found %d %s reactions on %s, last one: %s, pageEnd: %s", len(reactions), role.Emoji, role.Message.ID, reactions[len(reactions)-1].ID, paginationEnd)
+			users = append(users, reactions...)
+
+			if len(reactions) < 100 || paginationEnd == reactions[len(reactions)-1].ID {
+				break
+			}
+			paginationEnd = reactions[len(reactions)-1].ID
+		}
+
+		for _, user := range users {
+			logger = logger.WithFields(log.Fields{
+				"user_display_name": user.String(),
+				"user_id":           user.ID,
+			})
+			member, err := s.State.Member(guildID, user.ID)
+			if err != nil {
+				logger.WithError(err).Warnf("Failed getting guild member, they might not be a member any more")
+
+				// Clean up reactions from the missing members
+				if cleanUpMissingMembers {
+					if err := s.MessageReactionRemove(role.Message.ChannelID, role.Message.ID, role.Emoji, user.ID); err != nil {
+						logger.WithError(err).Error("Failed to clean up emoji for probably not a member any more")
+					}
+				}
+				continue
+			}
+
+			// Figure out if user already has the role,
+			hasRole := false
+			for _, roleID := range member.Roles {
+				if roleID == role.Role {
+					hasRole = true
+					break
+				}
+			}
+			// if so, we can skip adding it.
+			if hasRole {
+				continue
+			}
+
+			logger.Info("Adding role to user")
+
+			if err := s.GuildMemberRoleAdd(role.Message.GuildID, user.ID, role.Role); err != nil {
+				logger.WithError(err).Error("failed to sync role for user")
+				continue
+			}
+			granted++
+		}
+
+	}
+	if granted > 0 {
+		srv.LogModEvent(ctx, s, guildID, ModLogBotActions, &discordgo.MessageEmbed{
+			Description: fmt.Sprintf(":arrows_counterclockwise: Synced reaction roles, gave out %d roles", granted),
+			Color:       ModLogColorNeutral,
+		})
+	}
+	return granted, nil
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// MemberSnapshot is what we remember about a member, so it is still
+// known after they leave. discordgo removes members from its state before
+// our handlers see the GuildMemberRemove event.
+type MemberSnapshot struct {
+	GuildID  string
+	UserID   string
+	Nick     string
+	JoinedAt time.Time
+	Roles    []string
+}
+
+// MemberCache keeps a snapshot of every member we've seen, per guild.
+type MemberCache struct {
+	mu      sync.Mutex
+	members map[string]map[string]MemberSnapshot
+}
+
+func NewMemberCache() *MemberCache {
+	return &MemberCache{members: make(map[string]map[string]MemberSnapshot)}
+}
+
+// Remember stores a snapshot of the member, replacing any older one.
+func (c *MemberCache) Remember(guildID string, member *discordgo.Member) {
+	if member == nil || member.User == nil {
+		return
+	}
+
+	snapshot := MemberSnapshot{
+		GuildID:  guildID,
+		UserID:   member.User.ID,
+		Nick:     member.Nick,
+		JoinedAt: member.JoinedAt,
+		Roles:    append([]string(nil), member.Roles...),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.members[guildID] == nil {
+		c.members[guildID] = make(map[string]MemberSnapshot)
+	}
+	c.members[guildID][snapshot.UserID] = snapshot
+}
+
+// Forget removes the member and returns the last snapshot of them.
+func (c *MemberCache) Forget(guildID, userID string) (MemberSnapshot, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snapshot, ok := c.members[guildID][userID]
+	delete(c.members[guildID], userID)
+	return snapshot, ok
+}
+
+// ForgetGuild removes every member of a guild.
+func (c *MemberCache) ForgetGuild(guildID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.members, guildID)
+}
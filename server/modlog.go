@@ -0,0 +1,285 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// ModLogEvent is a kind of event which can be recorded in the mod-log
+// channel.
+type ModLogEvent string
+
+const (
+	ModLogJoins          ModLogEvent = "joins"
+	ModLogLeaves         ModLogEvent = "leaves"
+	ModLogNicknames      ModLogEvent = "nicknames"
+	ModLogRoles          ModLogEvent = "roles"
+	ModLogMessageEdits   ModLogEvent = "message-edits"
+	ModLogMessageDeletes ModLogEvent = "message-deletes"
+	ModLogBans           ModLogEvent = "bans"
+	// ModLogBotActions are changes the bot makes itself, like giving
+	// reaction roles.
+	ModLogBotActions ModLogEvent = "bot-actions"
+	// ModLogOldMessageDeletes are deletes of messages too old to show. Most
+	// of them are the bot cleaning up after itself, so they are off unless
+	// turned on.
+	ModLogOldMessageDeletes ModLogEvent = "old-message-deletes"
+)
+
+// ModLogEvents lists every mod-log event, in the order they are shown.
+var ModLogEvents = []ModLogEvent{
+	ModLogJoins,
+	ModLogLeaves,
+	ModLogNicknames,
+	ModLogRoles,
+	ModLogMessageEdits,
+	ModLogMessageDeletes,
+	ModLogBans,
+	ModLogBotActions,
+	ModLogOldMessageDeletes,
+}
+
+// modLogEventsOffByDefault are the events which aren't recorded unless
+// they are turned on.
+var modLogEventsOffByDefault = map[ModLogEvent]bool{
+	ModLogOldMessageDeletes: true,
+}
+
+// Colors of mod-log embeds, so events can be told apart at a glance.
+const (
+	ModLogColorGood    = 0x43b581
+	ModLogColorNeutral = 0x7289da
+	ModLogColorBad     = 0xf04747
+)
+
+// ModLog is the channel a guild records moderation events in. Most events
+// are recorded unless they are turned off, so new kinds of events show up
+// without having to turn them on.
+type ModLog struct {
+	GuildID   string
+	ChannelID string
+	Events    map[ModLogEvent]bool
+}
+
+// Enabled returns whether an event is recorded.
+func (m *ModLog) Enabled(event ModLogEvent) bool {
+	enabled, ok := m.Events[event]
+	if !ok {
+		return !modLogEventsOffByDefault[event]
+	}
+	return enabled
+}
+
+// changedEvents returns the events turned on which are off by default, and
+// the events turned off which are on by default.
+func (m *ModLog) changedEvents() ([]string, []string) {
+	enabled, disabled := make([]string, 0), make([]string, 0)
+	for _, event := range ModLogEvents {
+		switch on := m.Enabled(event); {
+		case on && modLogEventsOffByDefault[event]:
+			enabled = append(enabled, string(event))
+		case !on && !modLogEventsOffByDefault[event]:
+			disabled = append(disabled, string(event))
+		}
+	}
+	return enabled, disabled
+}
+
+func (m *ModLog) clone() *ModLog {
+	c := *m
+	c.Events = make(map[ModLogEvent]bool, len(m.Events))
+	for event, enabled := range m.Events {
+		c.Events[event] = enabled
+	}
+	return &c
+}
+
+// modLogCache caches mod-log channels, since they are read for every
+// message edit and delete. Guilds without a mod-log channel are cached as
+// nil.
+type modLogCache struct {
+	mu       sync.RWMutex
+	channels map[string]*ModLog
+}
+
+func (c *modLogCache) get(guildID string) (*ModLog, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	m, ok := c.channels[guildID]
+	if m != nil {
+		m = m.clone()
+	}
+	return m, ok
+}
+
+func (c *modLogCache) set(guildID string, m *ModLog) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.channels == nil {
+		c.channels = make(map[string]*ModLog)
+	}
+	c.channels[guildID] = m
+}
+
+func (c *modLogCache) invalidate(guildID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.channels, guildID)
+}
+
+// ModLog returns the cached mod-log channel of a guild, or nil if it
+// doesn't have one.
+func (srv *DiscordServerStore) ModLog(ctx context.Context, guildID string) (*ModLog, error) {
+	if m, ok := srv.modLog.get(guildID); ok {
+		return m, nil
+	}
+
+	m, err := srv.GetModLog(ctx, guildID)
+	if errors.Is(err, ErrNotFound) {
+		// Cache that there is none, so we don't ask again
+		m, err = nil, nil
+	}
+	if err != nil {
+		// Don't cache, so we try again next time
+		return nil, err
+	}
+	srv.modLog.set(guildID, m)
+	m, _ = srv.modLog.get(guildID)
+	return m, nil
+}
+
+// LogModEvent records an event in the mod-log channel of the guild, if it
+// has one and the event is turned on. Nobody is pinged by the embed.
+func (srv *DiscordServerStore) LogModEvent(ctx context.Context, s *discordgo.Session, guildID string, event ModLogEvent, embed *discordgo.MessageEmbed) {
+	logger := log.WithField("guild_id", guildID).WithField("event", event)
+	m, err := srv.ModLog(ctx, guildID)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to load mod-log channel")
+		return
+	}
+	if m == nil || !m.Enabled(event) {
+		return
+	}
+
+	if embed.Timestamp == "" {
+		embed.Timestamp = time.Now().Format(time.RFC3339)
+	}
+	if _, err := s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+		Embeds:          []*discordgo.MessageEmbed{embed},
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	}); err != nil {
+		logger.WithError(err).Warn("Failed to post to mod-log channel")
+	}
+}
+
+// ModLogUserEmbed creates a compact mod-log embed about a user, with the
+// user as author and their ID in the footer so it can be searched for.
+func ModLogUserEmbed(user *discordgo.User, color int, description string) *discordgo.MessageEmbed {
+	return &discordgo.MessageEmbed{
+		Author: &discordgo.MessageEmbedAuthor{
+			Name:    user.String(),
+			IconURL: user.AvatarURL("64"),
+		},
+		Description: description,
+		Color:       color,
+		Footer:      &discordgo.MessageEmbedFooter{Text: fmt.Sprintf("User ID: %s", user.ID)},
+	}
+}
+
+// modLogText shortens message content to fit in an embed field.
+func modLogText(content string) string {
+	const max = 1000
+	if content == "" {
+		return "*No text*"
+	}
+	if len(content) > max {
+		return strings.ToValidUTF8(content[:max], "") + "…"
+	}
+	return content
+}
+
+// ModLogMessageEmbed creates a mod-log embed about a message being edited
+// or deleted, with the content before and after if there is any.
+func ModLogMessageEmbed(msg *discordgo.Message, color int, description string, before, after string) *discordgo.MessageEmbed {
+	embed := ModLogUserEmbed(msg.Author, color, description)
+	if before != "" || after == "" {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Before", Value: modLogText(before)})
+	}
+	if after != "" {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "After", Value: modLogText(after)})
+	}
+	return embed
+}
+
+// GetModLog returns the mod log of a guild, or ErrNotFound if it hasn't
+// set one up.
+func (srv *DiscordServerStore) GetModLog(ctx context.Context, guildID string) (*ModLog, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	m := ModLog{GuildID: guildID, Events: make(map[ModLogEvent]bool)}
+	var enabled, disabled []string
+	err := srv.db.QueryRowContext(ctx, "SELECT channel, enabled_events, disabled_events FROM mod_log WHERE guild = $1", guildID).Scan(&m.ChannelID, pq.Array(&enabled), pq.Array(&disabled))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storeError(err)
+		}
+		log.WithError(err).Error("Failed to fetch mod-log channel")
+		return nil, err
+	}
+	for _, event := range enabled {
+		m.Events[ModLogEvent(event)] = true
+	}
+	for _, event := range disabled {
+		m.Events[ModLogEvent(event)] = false
+	}
+
+	return &m, nil
+}
+
+func (srv *DiscordServerStore) StoreModLog(ctx context.Context, m *ModLog) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	log.WithField("guild_id", m.GuildID).Debug("Storing mod-log channel in DB")
+	enabled, disabled := m.changedEvents()
+	_, err := srv.db.ExecContext(ctx, `
+                INSERT INTO mod_log (guild, channel, enabled_events, disabled_events) VALUES ($1, $2, $3, $4)
+                ON CONFLICT (guild) DO UPDATE SET channel = $2, enabled_events = $3, disabled_events = $4`,
+		m.GuildID, m.ChannelID, pq.Array(enabled), pq.Array(disabled))
+	if err != nil {
+		log.WithError(err).Error("Failed to store mod-log channel")
+		return err
+	}
+	srv.modLog.invalidate(m.GuildID)
+
+	return nil
+}
+
+func (srv *DiscordServerStore) DeleteModLog(ctx context.Context, guildID string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	if _, err := srv.db.ExecContext(ctx, "DELETE FROM mod_log WHERE guild = $1", guildID); err != nil {
+		log.WithError(err).Error("Failed to delete mod-log channel")
+		return err
+	}
+	srv.modLog.invalidate(guildID)
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestModLogEventDefaults(t *testing.T) {
+	m := &ModLog{Events: make(map[ModLogEvent]bool)}
+	if !m.Enabled(ModLogMessageDeletes) {
+		t.Error("expected message deletes to be recorded by default")
+	}
+	if m.Enabled(ModLogOldMessageDeletes) {
+		t.Error("expected old message deletes not to be recorded by default")
+	}
+	if enabled, disabled := m.changedEvents(); len(enabled) != 0 || len(disabled) != 0 {
+		t.Errorf("expected nothing to store for the defaults, got %v and %v", enabled, disabled)
+	}
+
+	m.Events[ModLogOldMessageDeletes] = true
+	m.Events[ModLogJoins] = false
+	// Turning an event on which is already on isn't stored
+	m.Events[ModLogLeaves] = true
+	enabled, disabled := m.changedEvents()
+	if !reflect.DeepEqual(enabled, []string{string(ModLogOldMessageDeletes)}) {
+		t.Errorf("expected only old message deletes to be stored as on, got %v", enabled)
+	}
+	if !reflect.DeepEqual(disabled, []string{string(ModLogJoins)}) {
+		t.Errorf("expected only joins to be stored as off, got %v", disabled)
+	}
+}
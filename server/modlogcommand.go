@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// modLogCommand lets admins choose where moderation events are recorded,
+// and which.
+func modLogCommand(store *DiscordServerStore) *ApplicationCommand {
+
+	eventChoices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(ModLogEvents))
+	for _, event := range ModLogEvents {
+		eventChoices = append(eventChoices, &discordgo.ApplicationCommandOptionChoice{
+			Name:  string(event),
+			Value: string(event),
+		})
+	}
+
+	cmd := &ApplicationCommand{
+		Name: "modlog",
+		Command: &discordgo.ApplicationCommand{
+			Name:        "modlog",
+			Description: "Record joins, leaves, edits, deletes, bans and role changes in a channel",
+			Version:     "1",
+			Type:        discordgo.ChatApplicationCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "set",
+					Description: "Set the channel to record moderation events in",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:         discordgo.ApplicationCommandOptionChannel,
+							Name:         "channel",
+							Description:  "The mod-log channel",
+							Required:     true,
+							ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText},
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "show",
+					Description: "Show the mod-log channel and which events are recorded",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "event",
+					Description: "Turn recording an event on or off",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "event",
+							Description: "The event",
+							Required:    true,
+							Choices:     eventChoices,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionBoolean,
+							Name:        "enabled",
+							Description: "Whether to record it",
+							Required:    true,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "disable",
+					Description: "Stop recording moderation events",
+				},
+			},
+		},
+		Permission: AdminCommandModLog,
+		store:      store,
+	}
+	cmd.Subcommands = map[string]SubcommandHandler{
+		"set":     cmd.modLogSet,
+		"show":    cmd.modLogShow,
+		"event":   cmd.modLogEvent,
+		"disable": cmd.modLogDisable,
+	}
+
+	return cmd
+}
+
+func (cmd *ApplicationCommand) modLogSet(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	m, err := cmd.store.GetModLog(ctx, event.GuildID)
+	if errors.Is(err, ErrNotFound) {
+		m, err = &ModLog{GuildID: event.GuildID, Events: make(map[ModLogEvent]bool)}, nil
+	}
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the mod-log channel.")
+	}
+	m.ChannelID = options["channel"].ChannelValue(nil).ID
+	if err := cmd.store.StoreModLog(ctx, m); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't save the mod-log channel.")
+	}
+
+	cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":scroll: <@%s> set the mod-log channel to <#%s>", interactionUserID(event), m.ChannelID))
+
+	return respondEphemeral(s, event.Interaction, fmt.Sprintf(":+1: Okay, moderation events are recorded in <#%s>.", m.ChannelID))
+}
+
+func (cmd *ApplicationCommand) modLogShow(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	m, err := cmd.store.GetModLog(ctx, event.GuildID)
+	if errors.Is(err, ErrNotFound) {
+		return respondEphemeral(s, event.Interaction, ":robot: No mod-log channel is set. Use `/modlog set` to set one.")
+	}
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the mod-log channel.")
+	}
+
+	events := make([]string, 0, len(ModLogEvents))
+	for _, e := range ModLogEvents {
+		events = append(events, fmt.Sprintf("`%s`: %s", e, onOff(m.Enabled(e))))
+	}
+	return respondEphemeral(s, event.Interaction, fmt.Sprintf(":scroll: Moderation events are recorded in <#%s>.\n%s", m.ChannelID, strings.Join(events, "\n")))
+}
+
+func (cmd *ApplicationCommand) modLogEvent(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	m, err := cmd.store.GetModLog(ctx, event.GuildID)
+	if errors.Is(err, ErrNotFound) {
+		return respondEphemeral(s, event.Interaction, ":robot: No mod-log channel is set. Use `/modlog set` to set one first.")
+	}
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the mod-log channel.")
+	}
+
+	e := ModLogEvent(options["event"].StringValue())
+	enabled := options["enabled"].BoolValue()
+	m.Events[e] = enabled
+	if err := cmd.store.StoreModLog(ctx, m); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't save the mod-log channel.")
+	}
+
+	cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":scroll: <@%s> turned %s recording `%s` in the mod-log", interactionUserID(event), onOff(enabled), e))
+
+	return respondEphemeral(s, event.Interaction, fmt.Sprintf(":+1: Okay, recording `%s` is turned %s.", e, onOff(enabled)))
+}
+
+func (cmd *ApplicationCommand) modLogDisable(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	if err := cmd.store.DeleteModLog(ctx, event.GuildID); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't turn off the mod-log.")
+	}
+
+	cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":scroll: <@%s> turned off the mod-log", interactionUserID(event)))
+
+	return respondEphemeral(s, event.Interaction, ":+1: Moderation events are no longer recorded.")
+}
@@ -0,0 +1,385 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// Ways to remind members who haven't picked any roles.
+const (
+	ReminderDM      = "dm"
+	ReminderChannel = "channel"
+)
+
+// OnboardingReminders reminds new members who haven't picked any roles
+// through the reaction roles after a while.
+type OnboardingReminders struct {
+	GuildID string
+	Delay   time.Duration
+	Method  string
+}
+
+// OnboardingReport tells how many of the members who joined picked roles.
+type OnboardingReport struct {
+	Joined            int
+	Completed         int
+	Reminded          int
+	CompletedReminded int
+	Left              int
+}
+
+// CompletionRate is the share of members who joined and picked roles.
+func (r *OnboardingReport) CompletionRate() float64 {
+	if r.Joined == 0 {
+		return 0
+	}
+	return float64(r.Completed) / float64(r.Joined)
+}
+
+// onboardingMember is a member who should be reminded to pick roles.
+type onboardingMember struct {
+	GuildID string
+	UserID  string
+	Method  string
+}
+
+// SendOnboardingReminders reminds members who haven't picked any roles
+// once, and returns how many were reminded.
+func (srv *DiscordServerStore) SendOnboardingReminders(ctx context.Context, s *discordgo.Session) (int, error) {
+	members, err := srv.getMembersToRemind(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	reminded := 0
+	for _, m := range members {
+		logger := log.WithField("guild_id", m.GuildID).WithField("user_id", m.UserID)
+
+		member, err := s.State.Member(m.GuildID, m.UserID)
+		if err != nil {
+			// They left without us noticing
+			if err := srv.LeaveOnboarding(ctx, m.GuildID, m.UserID); err != nil {
+				logger.WithError(err).Warn("Failed to record member leaving")
+			}
+			continue
+		}
+
+		roles, err := srv.GetReactRoleRoles(ctx, m.GuildID)
+		if err != nil {
+			continue
+		}
+		if slices.ContainsFunc(member.Roles, func(role string) bool { return slices.Contains(roles, role) }) {
+			// They got the roles some other way, e.g. from a moderator
+			if err := srv.CompleteOnboarding(ctx, m.GuildID, m.UserID); err != nil {
+				logger.WithError(err).Warn("Failed to complete onboarding")
+			}
+			continue
+		}
+
+		menus, err := srv.GetReactRoleMessages(ctx, m.GuildID)
+		if err != nil || len(menus) == 0 {
+			continue
+		}
+		menu := menus[0]
+		if w, err := srv.GetWelcomeChannel(ctx, m.GuildID); err == nil {
+			// Prefer the menu the welcome message points to
+			for _, rm := range menus {
+				if rm.ChannelID == w.EmojiChannelID {
+					menu = rm
+					break
+				}
+			}
+		}
+
+		if err := srv.remind(ctx, s, m, member, menu); err != nil {
+			logger.WithError(err).Warn("Failed to remind member to pick roles")
+		} else {
+			logger.Info("Reminded member to pick roles")
+			reminded++
+		}
+		// Only ever try once, so nobody is spammed
+		if err := srv.MarkOnboardingReminded(ctx, m.GuildID, m.UserID); err != nil {
+			logger.WithError(err).Warn("Failed to record reminder")
+		}
+	}
+
+	return reminded, nil
+}
+
+func (srv *DiscordServerStore) remind(ctx context.Context, s *discordgo.Session, m onboardingMember, member *discordgo.Member, menu ReactRoleMessage) error {
+	guildName := "the server"
+	if guild, err := s.State.Guild(m.GuildID); err == nil {
+		guildName = guild.Name
+	}
+	link := MessageLink(&discordgo.Message{GuildID: menu.GuildID, ChannelID: menu.ChannelID, ID: menu.ID})
+
+	if m.Method == ReminderDM {
+		channel, err := s.UserChannelCreate(m.UserID)
+		if err == nil {
+			content := fmt.Sprintf(":wave: Hi! You haven't picked any roles in **%s** yet, so some channels are still hidden. Pick yours here: %s", guildName, link)
+			if _, err = s.ChannelMessageSend(channel.ID, content); err == nil {
+				return nil
+			}
+		}
+		// Members can turn off DMs, so ping them in the welcome channel instead
+		log.WithError(err).WithField("user_id", m.UserID).Debug("Failed to DM member, pinging in the welcome channel")
+	}
+
+	w, err := srv.GetWelcomeChannel(ctx, m.GuildID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if w == nil || w.MessageChannelID == "" {
+		return errors.New("no welcome channel to remind in")
+	}
+	_, err = s.ChannelMessageSendComplex(w.MessageChannelID, &discordgo.MessageSend{
+		Content:         fmt.Sprintf(":wave: %s, you haven't picked any roles yet, so some channels are still hidden. Pick yours here: %s", member.Mention(), link),
+		AllowedMentions: &discordgo.MessageAllowedMentions{Users: []string{m.UserID}},
+	})
+	return err
+}
+
+// GetOnboardingReminders returns the reminder settings of a guild, or
+// ErrNotFound if it doesn't send reminders.
+func (srv *DiscordServerStore) GetOnboardingReminders(ctx context.Context, guildID string) (*OnboardingReminders, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	o := OnboardingReminders{GuildID: guildID}
+	var delay int
+	err := srv.db.QueryRowContext(ctx, "SELECT delay_seconds, method FROM onboarding_reminders WHERE guild = $1", guildID).Scan(&delay, &o.Method)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storeError(err)
+		}
+		log.WithError(err).Error("Failed to fetch onboarding reminders")
+		return nil, err
+	}
+	o.Delay = time.Duration(delay) * time.Second
+
+	return &o, nil
+}
+
+func (srv *DiscordServerStore) StoreOnboardingReminders(ctx context.Context, o *OnboardingReminders) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	log.WithField("guild_id", o.GuildID).Debug("Storing onboarding reminders in DB")
+	_, err := srv.db.ExecContext(ctx, `
+                INSERT INTO onboarding_reminders (guild, delay_seconds, method)
+                VALUES ($1, $2, $3)
+                ON CONFLICT (guild)
+                DO UPDATE SET delay_seconds = $2, method = $3`,
+		o.GuildID, int(o.Delay/time.Second), o.Method)
+	if err != nil {
+		log.WithError(err).Error("Failed to store onboarding reminders")
+		return err
+	}
+
+	return nil
+}
+
+func (srv *DiscordServerStore) DeleteOnboardingReminders(ctx context.Context, guildID string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	if _, err := srv.db.ExecContext(ctx, "DELETE FROM onboarding_reminders WHERE guild = $1", guildID); err != nil {
+		log.WithError(err).Error("Failed to delete onboarding reminders")
+		return err
+	}
+
+	return nil
+}
+
+// StartOnboarding tracks a member who joined, until they pick roles.
+func (srv *DiscordServerStore) StartOnboarding(ctx context.Context, guildID, userID string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	_, err := srv.db.ExecContext(ctx, `
+                INSERT INTO member_onboarding (guild, member, joined_at)
+                VALUES ($1, $2, now())
+                ON CONFLICT (guild, member)
+                DO UPDATE SET joined_at = now(), completed_at = NULL, reminded_at = NULL, left_at = NULL`,
+		guildID, userID)
+	if err != nil {
+		log.WithError(err).Error("Failed to start onboarding")
+		return err
+	}
+
+	return nil
+}
+
+// CompleteOnboarding records that a member picked roles. Members who
+// joined before tracking started are ignored.
+func (srv *DiscordServerStore) CompleteOnboarding(ctx context.Context, guildID, userID string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	if _, err := srv.db.ExecContext(ctx, "UPDATE member_onboarding SET completed_at = now() WHERE guild = $1 AND member = $2 AND completed_at IS NULL", guildID, userID); err != nil {
+		log.WithError(err).Error("Failed to complete onboarding")
+		return err
+	}
+
+	return nil
+}
+
+func (srv *DiscordServerStore) MarkOnboardingReminded(ctx context.Context, guildID, userID string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	if _, err := srv.db.ExecContext(ctx, "UPDATE member_onboarding SET reminded_at = now() WHERE guild = $1 AND member = $2", guildID, userID); err != nil {
+		log.WithError(err).Error("Failed to mark onboarding reminded")
+		return err
+	}
+
+	return nil
+}
+
+// LeaveOnboarding records that a member left before picking roles.
+func (srv *DiscordServerStore) LeaveOnboarding(ctx context.Context, guildID, userID string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	if _, err := srv.db.ExecContext(ctx, "UPDATE member_onboarding SET left_at = now() WHERE guild = $1 AND member = $2 AND left_at IS NULL", guildID, userID); err != nil {
+		log.WithError(err).Error("Failed to record member leaving onboarding")
+		return err
+	}
+
+	return nil
+}
+
+func (srv *DiscordServerStore) getMembersToRemind(ctx context.Context) ([]onboardingMember, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	rows, err := srv.db.QueryContext(ctx, `
+                SELECT m.guild, m.member, r.method
+                FROM member_onboarding m
+                JOIN onboarding_reminders r ON r.guild = m.guild
+                WHERE m.completed_at IS NULL AND m.reminded_at IS NULL AND m.left_at IS NULL
+                  AND m.joined_at < now() - r.delay_seconds * interval '1 second'`)
+	if err != nil {
+		log.WithError(err).Error("Failed to fetch members to remind")
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]onboardingMember, 0)
+	for rows.Next() {
+		var m onboardingMember
+		if err := rows.Scan(&m.GuildID, &m.UserID, &m.Method); err != nil {
+			log.WithError(err).Error("Failed to scan database row")
+			return nil, err
+		}
+		members = append(members, m)
+	}
+
+	return members, rows.Err()
+}
+
+// GetOnboardingReport counts members who joined since the given time.
+func (srv *DiscordServerStore) GetOnboardingReport(ctx context.Context, guildID string, since time.Time) (*OnboardingReport, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	var r OnboardingReport
+	err := srv.db.QueryRowContext(ctx, `
+                SELECT count(*),
+                       count(*) FILTER (WHERE completed_at IS NOT NULL),
+                       count(*) FILTER (WHERE reminded_at IS NOT NULL),
+                       count(*) FILTER (WHERE reminded_at IS NOT NULL AND completed_at > reminded_at),
+                       count(*) FILTER (WHERE left_at IS NOT NULL AND completed_at IS NULL)
+                FROM member_onboarding WHERE guild = $1 AND joined_at >= $2`, guildID, since).Scan(&r.Joined, &r.Completed, &r.Reminded, &r.CompletedReminded, &r.Left)
+	if err != nil {
+		log.WithError(err).Error("Failed to fetch onboarding report")
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// GetReactRoleMessages returns the reaction role messages of a guild,
+// oldest first.
+func (srv *DiscordServerStore) GetReactRoleMessages(ctx context.Context, guildID string) ([]ReactRoleMessage, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	rows, err := srv.db.QueryContext(ctx, `
+                SELECT message_channel, message_id FROM reaction_message_reactions
+                WHERE message_guild = $1
+                GROUP BY message_channel, message_id
+                ORDER BY min(id)`, guildID)
+	if err != nil {
+		log.WithError(err).Error("Failed to fetch reaction role messages")
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]ReactRoleMessage, 0)
+	for rows.Next() {
+		rm := ReactRoleMessage{GuildID: guildID}
+		if err := rows.Scan(&rm.ChannelID, &rm.ID); err != nil {
+			log.WithError(err).Error("Failed to scan database row")
+			return nil, err
+		}
+		messages = append(messages, rm)
+	}
+
+	return messages, rows.Err()
+}
+
+// GetReactRoleRoles returns every role members can get through reaction
+// roles in a guild.
+func (srv *DiscordServerStore) GetReactRoleRoles(ctx context.Context, guildID string) ([]string, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	rows, err := srv.db.QueryContext(ctx, "SELECT DISTINCT role FROM reaction_message_reactions WHERE message_guild = $1", guildID)
+	if err != nil {
+		log.WithError(err).Error("Failed to fetch reaction role roles")
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := make([]string, 0)
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			log.WithError(err).Error("Failed to scan database row")
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// onboardingCommand lets admins remind new members to pick roles, and
+// see how many do.
+func onboardingCommand(store *DiscordServerStore) *ApplicationCommand {
+	var minDays float64 = 1
+
+	cmd := &ApplicationCommand{
+		Name: "onboarding",
+		Command: &discordgo.ApplicationCommand{
+			Name:        "onboarding",
+			Description: "Follow up on new members who haven't picked any roles",
+			Version:     "1",
+			Type:        discordgo.ChatApplicationCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "remind",
+					Description: "Remind members who haven't picked any roles, once",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "after",
+							Description: "How long after they join, e.g. 1h or 24h",
+							Required:    true,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "method",
+							Description: "How to remind them",
+							Choices: []*discordgo.ApplicationCommandOptionChoice{
+								{Name: "Direct message, or a ping in the welcome channel if DMs are closed", Value: ReminderDM},
+								{Name: "Ping in the welcome channel", Value: ReminderChannel},
+							},
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "disable",
+					Description: "Stop reminding members",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "report",
+					Description: "Show how many new members picked roles",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionInteger,
+							Name:        "days",
+							Description: "Members who joined in the last number of days, 30 if left out",
+							MinValue:    &minDays,
+							MaxValue:    365,
+						},
+					},
+				},
+			},
+		},
+		Permission: AdminCommandOnboarding,
+		store:      store,
+	}
+	cmd.Subcommands = map[string]SubcommandHandler{
+		"remind":  cmd.onboardingRemind,
+		"disable": cmd.onboardingDisable,
+		"report":  cmd.onboardingReport,
+	}
+
+	return cmd
+}
+
+func (cmd *ApplicationCommand) onboardingRemind(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	delay, err := time.ParseDuration(options["after"].StringValue())
+	if err != nil || delay < time.Minute || delay > 30*24*time.Hour {
+		return respondEphemeral(s, event.Interaction, ":x: The time has to be like 1h or 24h, between a minute and 30 days.")
+	}
+
+	o := &OnboardingReminders{
+		GuildID: event.GuildID,
+		Delay:   delay,
+		Method:  ReminderDM,
+	}
+	if option, ok := options["method"]; ok {
+		o.Method = option.StringValue()
+	}
+	if err := cmd.store.StoreOnboardingReminders(ctx, o); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't save the reminders.")
+	}
+
+	cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":bell: <@%s> turned on onboarding reminders: %s", interactionUserID(event), describeOnboardingReminders(o)))
+
+	return respondEphemeral(s, event.Interaction, fmt.Sprintf(":+1: Okay, %s.", describeOnboardingReminders(o)))
+}
+
+func (cmd *ApplicationCommand) onboardingDisable(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	if err := cmd.store.DeleteOnboardingReminders(ctx, event.GuildID); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't turn off the reminders.")
+	}
+
+	cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":bell: <@%s> turned off onboarding reminders", interactionUserID(event)))
+
+	return respondEphemeral(s, event.Interaction, ":+1: Members are no longer reminded to pick roles.")
+}
+
+func (cmd *ApplicationCommand) onboardingReport(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	days := 30
+	if option, ok := options["days"]; ok {
+		days = int(option.IntValue())
+	}
+
+	report, err := cmd.store.GetOnboardingReport(ctx, event.GuildID, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the report.")
+	}
+	reminders, err := cmd.store.GetOnboardingReminders(ctx, event.GuildID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.WithError(err).WithField("guild_id", event.GuildID).Warn("Failed to load onboarding reminders")
+	}
+	description := "Members aren't reminded to pick roles."
+	if reminders != nil {
+		description = fmt.Sprintf("Members are reminded to pick roles: %s.", describeOnboardingReminders(reminders))
+	}
+
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+			Embeds: []*discordgo.MessageEmbed{
+				{
+					Title:       fmt.Sprintf("Onboarding, last %d days", days),
+					Description: description,
+					Fields: []*discordgo.MessageEmbedField{
+						{Name: "Joined", Value: fmt.Sprint(report.Joined), Inline: true},
+						{Name: "Picked roles", Value: fmt.Sprintf("%d (%.0f%%)", report.Completed, report.CompletionRate()*100), Inline: true},
+						{Name: "Left without picking", Value: fmt.Sprint(report.Left), Inline: true},
+						{Name: "Reminded", Value: fmt.Sprint(report.Reminded), Inline: true},
+						{Name: "Picked after reminder", Value: fmt.Sprint(report.CompletedReminded), Inline: true},
+					},
+				},
+			},
+		},
+	})
+}
+
+func describeOnboardingReminders(o *OnboardingReminders) string {
+	method := "a direct message"
+	if o.Method == ReminderChannel {
+		method = "a ping in the welcome channel"
+	}
+	return fmt.Sprintf("members who haven't picked any roles %s after joining get %s", HumanizeDuration(o.Delay), method)
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// Admin commands whose access is configured per guild.
+const (
+	AdminCommandSetWelcomeChannel = "setwelcomechannel"
+	AdminCommandHotsSync          = "hots.sync"
+	AdminCommandHotsAlias         = "hots.alias"
+	AdminCommandReactRole         = "reactrole"
+	AdminCommandSettings          = "settings"
+	AdminCommandPermissions       = "permissions"
+	AdminCommandGoodbye           = "goodbye"
+	AdminCommandAutoRole          = "autorole"
+	AdminCommandVerification      = "verification"
+	AdminCommandOnboarding        = "onboarding"
+	AdminCommandRaid              = "raid"
+	AdminCommandModLog            = "modlog"
+)
+
+// AdminCommands lists every admin command, in the order they are shown.
+var AdminCommands = []string{
+	AdminCommandSetWelcomeChannel,
+	AdminCommandHotsSync,
+	AdminCommandHotsAlias,
+	AdminCommandReactRole,
+	AdminCommandSettings,
+	AdminCommandPermissions,
+	AdminCommandGoodbye,
+	AdminCommandAutoRole,
+	AdminCommandVerification,
+	AdminCommandOnboarding,
+	AdminCommandRaid,
+	AdminCommandModLog,
+}
+
+// DefaultAdminPermission is required to run admin commands in guilds
+// which haven't configured anything else.
+const DefaultAdminPermission int64 = discordgo.PermissionManageServer
+
+// CommandPermission decides who may run an admin command in a guild.
+// Members with any of the roles, or all of the Discord permissions, may
+// run it. Zero permissions means only the roles are allowed.
+type CommandPermission struct {
+	GuildID     string
+	Command     string
+	Roles       []string
+	Permissions int64
+}
+
+// Allows returns whether a member with the given roles and computed
+// permissions may run the command.
+func (p *CommandPermission) Allows(roles []string, permissions int64) bool {
+	for _, allowed := range p.Roles {
+		for _, role := range roles {
+			if role == allowed {
+				return true
+			}
+		}
+	}
+	if p.Permissions != 0 && hasPerms(p.Permissions, permissions) {
+		return true
+	}
+	// Administrators can always run everything, so nobody gets locked out
+	return hasPerms(discordgo.PermissionAdministrator, permissions)
+}
+
+// DefaultCommandPermission is used for commands a guild hasn't configured.
+func DefaultCommandPermission(guildID, command string) *CommandPermission {
+	return &CommandPermission{
+		GuildID:     guildID,
+		Command:     command,
+		Roles:       []string{},
+		Permissions: DefaultAdminPermission,
+	}
+}
+
+// CanRunAdminCommand returns whether a member may run an admin command.
+// permissions are the member's computed permissions in the channel.
+func (srv *DiscordServerStore) CanRunAdminCommand(ctx context.Context, guildID, command string, member *discordgo.Member, permissions int64) bool {
+	if member == nil {
+		return false
+	}
+	allowed := srv.CommandPermission(ctx, guildID, command).Allows(member.Roles, permissions)
+	log.WithFields(log.Fields{
+		"guild_id": guildID,
+		"command":  command,
+		"allowed":  allowed,
+	}).Debug("Checked admin command permission")
+	return allowed
+}
+
+// CanRunAdminCommandInChannel is CanRunAdminCommand for text commands,
+// computing the member's permissions in the channel from state.
+func (srv *DiscordServerStore) CanRunAdminCommandInChannel(ctx context.Context, s *discordgo.Session, guildID, channelID, command string, member *discordgo.Member, userID string) bool {
+	permissions, err := s.State.UserChannelPermissions(userID, channelID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", userID).Warn("Failed to look up user permissions")
+	}
+	return srv.CanRunAdminCommand(ctx, guildID, command, member, permissions)
+}
+
+// CommandPermission returns the configured permission for a command, or
+// the default if nothing is configured or it can't be loaded.
+func (srv *DiscordServerStore) CommandPermission(ctx context.Context, guildID, command string) *CommandPermission {
+	p, err := srv.GetCommandPermission(ctx, guildID, command)
+	if err != nil {
+		return DefaultCommandPermission(guildID, command)
+	}
+	return p
+}
+
+// GetCommandPermission returns who may run a command in a guild, or
+// ErrNotFound if the guild hasn't restricted it.
+func (srv *DiscordServerStore) GetCommandPermission(ctx context.Context, guildID, command string) (*CommandPermission, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	p := CommandPermission{GuildID: guildID, Command: command}
+	err := srv.db.QueryRowContext(ctx, "SELECT roles, permissions FROM command_permissions WHERE guild = $1 AND command = $2", guildID, command).Scan(pq.Array(&p.Roles), &p.Permissions)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storeError(err)
+		}
+		log.WithError(err).Error("Failed to fetch command permission")
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+func (srv *DiscordServerStore) StoreCommandPermission(ctx context.Context, p *CommandPermission) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	log.WithField("guild_id", p.GuildID).WithField("command", p.Command).Debug("Storing command permission in DB")
+	_, err := srv.db.ExecContext(ctx, `
+                INSERT INTO command_permissions
+                        (guild, command, roles, permissions)
+                VALUES ($1, $2, $3, $4)
+                ON CONFLICT (guild, command)
+                DO UPDATE SET roles = $3, permissions = $4`,
+		p.GuildID, p.Command, pq.Array(p.Roles), p.Permissions)
+	if err != nil {
+		log.WithError(err).Error("Failed to store command permission")
+		return err
+	}
+
+	return nil
+}
+
+func (srv *DiscordServerStore) DeleteCommandPermission(ctx context.Context, guildID, command string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	if _, err := srv.db.ExecContext(ctx, "DELETE FROM command_permissions WHERE guild = $1 AND command = $2", guildID, command); err != nil {
+		log.WithError(err).Error("Failed to delete command permission")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// permissionNames are the Discord permissions admin commands can require.
+var permissionNames = []struct {
+	Name       string
+	Permission int64
+}{
+	{"None (roles only)", 0},
+	{"Manage Server", discordgo.PermissionManageServer},
+	{"Manage Roles", discordgo.PermissionManageRoles},
+	{"Manage Channels", discordgo.PermissionManageChannels},
+	{"Manage Messages", discordgo.PermissionManageMessages},
+	{"Kick Members", discordgo.PermissionKickMembers},
+	{"Ban Members", discordgo.PermissionBanMembers},
+	{"Administrator", discordgo.PermissionAdministrator},
+}
+
+// permissionsCommand lets admins decide who may run admin commands.
+func permissionsCommand(store *DiscordServerStore) *ApplicationCommand {
+
+	commandChoices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(AdminCommands))
+	for _, command := range AdminCommands {
+		commandChoices = append(commandChoices, &discordgo.ApplicationCommandOptionChoice{
+			Name:  command,
+			Value: command,
+		})
+	}
+	permissionChoices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(permissionNames))
+	for _, p := range permissionNames {
+		permissionChoices = append(permissionChoices, &discordgo.ApplicationCommandOptionChoice{
+			Name:  p.Name,
+			Value: fmt.Sprint(p.Permission),
+		})
+	}
+	commandOption := func(required bool) *discordgo.ApplicationCommandOption {
+		return &discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "command",
+			Description: "Admin command",
+			Required:    required,
+			Choices:     commandChoices,
+		}
+	}
+	roleOption := &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionRole,
+		Name:        "role",
+		Description: "Role",
+		Required:    true,
+	}
+
+	cmd := &ApplicationCommand{
+		Name: "permissions",
+		Command: &discordgo.ApplicationCommand{
+			Name:        "permissions",
+			Description: "Decide who may run admin commands",
+			Version:     "1",
+			Type:        discordgo.ChatApplicationCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "show",
+					Description: "Show who may run admin commands",
+					Options:     []*discordgo.ApplicationCommandOption{commandOption(false)},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "allow-role",
+					Description: "Let members with a role run a command",
+					Options:     []*discordgo.ApplicationCommandOption{commandOption(true), roleOption},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "remove-role",
+					Description: "Stop letting members with a role run a command",
+					Options:     []*discordgo.ApplicationCommandOption{commandOption(true), roleOption},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "set-permission",
+					Description: "Let members with a Discord permission run a command",
+					Options: []*discordgo.ApplicationCommandOption{
+						commandOption(true),
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "permission",
+							Description: "Discord permission",
+							Required:    true,
+							Choices:     permissionChoices,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "reset",
+					Description: "Go back to the default of requiring Manage Server",
+					Options:     []*discordgo.ApplicationCommandOption{commandOption(true)},
+				},
+			},
+		},
+		Permission: AdminCommandPermissions,
+		store:      store,
+	}
+	cmd.Subcommands = map[string]SubcommandHandler{
+		"show": cmd.permissionsShow,
+		"allow-role": cmd.permissionsUpdate(func(p *CommandPermission, options map[string]*discordgo.ApplicationCommandInteractionDataOption) string {
+			role := options["role"].RoleValue(nil, "").ID
+			for _, existing := range p.Roles {
+				if existing == role {
+					return fmt.Sprintf("already allowed <@&%s> to run `%s`", role, p.Command)
+				}
+			}
+			p.Roles = append(p.Roles, role)
+			return fmt.Sprintf("allowed <@&%s> to run `%s`", role, p.Command)
+		}),
+		"remove-role": cmd.permissionsUpdate(func(p *CommandPermission, options map[string]*discordgo.ApplicationCommandInteractionDataOption) string {
+			role := options["role"].RoleValue(nil, "").ID
+			roles := make([]string, 0, len(p.Roles))
+			for _, existing := range p.Roles {
+				if existing != role {
+					roles = append(roles, existing)
+				}
+			}
+			p.Roles = roles
+			return fmt.Sprintf("stopped allowing <@&%s> to run `%s`", role, p.Command)
+		}),
+		"set-permission": cmd.permissionsUpdate(func(p *CommandPermission, options map[string]*discordgo.ApplicationCommandInteractionDataOption) string {
+			fmt.Sscan(options["permission"].StringValue(), &p.Permissions)
+			return fmt.Sprintf("set `%s` to require %s", p.Command, permissionName(p.Permissions))
+		}),
+		"reset": cmd.permissionsReset,
+	}
+
+	return cmd
+}
+
+func (cmd *ApplicationCommand) permissionsShow(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	commands := AdminCommands
+	if option, ok := options["command"]; ok {
+		commands = []string{option.StringValue()}
+	}
+
+	fields := make([]*discordgo.MessageEmbedField, 0, len(commands))
+	for _, command := range commands {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:  command,
+			Value: describeCommandPermission(cmd.store.CommandPermission(ctx, event.GuildID, command)),
+		})
+	}
+
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+			Embeds: []*discordgo.MessageEmbed{
+				{
+					Title:       "Admin command permissions",
+					Description: "Administrators can always run every command. Slash commands are also subject to the server's Integrations settings.",
+					Fields:      fields,
+				},
+			},
+		},
+	})
+}
+
+// permissionsUpdate creates a subcommand handler which applies a change
+// to the permission of a command and returns a description of it.
+func (cmd *ApplicationCommand) permissionsUpdate(apply func(*CommandPermission, map[string]*discordgo.ApplicationCommandInteractionDataOption) string) SubcommandHandler {
+	return func(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+		command := options["command"].StringValue()
+		current, err := cmd.store.GetCommandPermission(ctx, event.GuildID, command)
+		if errors.Is(err, ErrNotFound) {
+			current, err = DefaultCommandPermission(event.GuildID, command), nil
+		}
+		if err != nil {
+			return respondEphemeral(s, event.Interaction, ":x: Couldn't load the current permissions.")
+		}
+
+		change := apply(current, options)
+		if err := cmd.store.StoreCommandPermission(ctx, current); err != nil {
+			log.WithError(err).WithField("guild_id", event.GuildID).Warn("Failed to update command permission")
+			return respondEphemeral(s, event.Interaction, ":x: Couldn't change the permissions.")
+		}
+
+		cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":lock: <@%s> %s", interactionUserID(event), change))
+
+		return respondEphemeral(s, event.Interaction, fmt.Sprintf(":+1: Okay, %s. Now: %s", change, describeCommandPermission(current)))
+	}
+}
+
+func (cmd *ApplicationCommand) permissionsReset(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	command := options["command"].StringValue()
+	if err := cmd.store.DeleteCommandPermission(ctx, event.GuildID, command); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't reset the permissions.")
+	}
+
+	cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":lock: <@%s> reset who may run `%s`", interactionUserID(event), command))
+
+	return respondEphemeral(s, event.Interaction, fmt.Sprintf(":+1: Okay, `%s` is back to: %s", command, describeCommandPermission(DefaultCommandPermission(event.GuildID, command))))
+}
+
+func describeCommandPermission(p *CommandPermission) string {
+	parts := make([]string, 0, 2)
+	if len(p.Roles) > 0 {
+		parts = append(parts, fmt.Sprintf("members with %s", describeRoles(p.Roles)))
+	}
+	if p.Permissions != 0 {
+		parts = append(parts, fmt.Sprintf("members with %s", permissionName(p.Permissions)))
+	}
+	if len(parts) == 0 {
+		return "administrators only"
+	}
+	return strings.Join(parts, " or ")
+}
+
+func permissionName(permission int64) string {
+	for _, p := range permissionNames {
+		if p.Permission == permission {
+			return p.Name
+		}
+	}
+	return fmt.Sprintf("permissions %d", permission)
+}
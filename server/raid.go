@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// What to do when a raid is detected, besides pausing welcome messages
+// and alerting moderators.
+const (
+	// RaidActionVerification raises the server verification level to
+	// High, so new accounts have to wait before they can talk.
+	RaidActionVerification = "verification"
+	// RaidActionQuarantine gives members who join during the lockdown the
+	// quarantine role.
+	RaidActionQuarantine = "quarantine"
+)
+
+const raidActionUnlock = "unlock"
+
+// RaidProtection is how a guild detects join raids and locks down.
+// Every join weighs 1, plus 1 for an account younger than NewAccountAge
+// and 1 for a default avatar. The guild locks down when the joins within
+// Window weigh Threshold or more.
+type RaidProtection struct {
+	GuildID        string
+	Threshold      int
+	Window         time.Duration
+	NewAccountAge  time.Duration
+	Action         string
+	QuarantineRole string
+	// AlertChannel is where moderators are alerted, the admin log channel
+	// if empty. AlertRole is pinged, if set.
+	AlertChannel string
+	AlertRole    string
+	// LockedAt is when the guild locked down, nil if it isn't.
+	LockedAt                  *time.Time
+	PreviousVerificationLevel discordgo.VerificationLevel
+}
+
+func DefaultRaidProtection(guildID string) *RaidProtection {
+	return &RaidProtection{
+		GuildID:       guildID,
+		Threshold:     10,
+		Window:        time.Minute,
+		NewAccountAge: 7 * 24 * time.Hour,
+		Action:        RaidActionVerification,
+	}
+}
+
+// Locked tells if the guild is locked down.
+func (r *RaidProtection) Locked() bool {
+	return r.LockedAt != nil
+}
+
+// JoinWeight is how much a member joining counts towards a raid.
+func (r *RaidProtection) JoinWeight(member *discordgo.Member, now time.Time) int {
+	weight := 1
+	if created, err := discordgo.SnowflakeTimestamp(member.User.ID); err == nil && now.Sub(created) < r.NewAccountAge {
+		weight++
+	}
+	if member.User.Avatar == "" {
+		weight++
+	}
+	return weight
+}
+
+type raidJoin struct {
+	at     time.Time
+	weight int
+}
+
+// RaidDetector keeps a sliding window of recent joins per guild, and locks
+// guilds down when too many join at once.
+type RaidDetector struct {
+	store *DiscordServerStore
+
+	mu    sync.Mutex
+	joins map[string][]raidJoin
+}
+
+func NewRaidDetector(store *DiscordServerStore) *RaidDetector {
+	return &RaidDetector{
+		store: store,
+		joins: make(map[string][]raidJoin),
+	}
+}
+
+// Join records a member joining, and returns the raid protection of the
+// guild if it is locked down, either already or because of this join. It
+// returns nil for guilds without raid protection, or which aren't locked.
+func (d *RaidDetector) Join(ctx context.Context, s *discordgo.Session, member *discordgo.Member) *RaidProtection {
+	r, err := d.store.GetRaidProtection(ctx, member.GuildID)
+	if err != nil {
+		return nil
+	}
+	if r.Locked() {
+		return r
+	}
+
+	now := time.Now()
+	weight := r.JoinWeight(member, now)
+
+	d.mu.Lock()
+	joins := append(d.joins[member.GuildID], raidJoin{at: now, weight: weight})
+	total := 0
+	recent := joins[:0]
+	for _, join := range joins {
+		if now.Sub(join.at) <= r.Window {
+			recent = append(recent, join)
+			total += join.weight
+		}
+	}
+	tripped := total >= r.Threshold
+	if tripped {
+		// Start over, so the lockdown isn't triggered again right after
+		// an unlock
+		recent = nil
+	}
+	d.joins[member.GuildID] = recent
+	d.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"guild_id": member.GuildID,
+		"user_id":  member.User.ID,
+		"weight":   weight,
+		"total":    total,
+	}).Debug("Scored member join")
+
+	if !tripped {
+		return nil
+	}
+
+	reason := fmt.Sprintf("joins in the last %s weighed %d, the threshold is %d", HumanizeDuration(r.Window), total, r.Threshold)
+	if err := d.store.Lockdown(ctx, s, r, reason); err != nil {
+		log.WithError(err).WithField("guild_id", member.GuildID).Error("Failed to lock down guild")
+	}
+	return r
+}
+
+// Lockdown locks a guild down, and alerts moderators with a button to
+// unlock it.
+func (srv *DiscordServerStore) Lockdown(ctx context.Context, s *discordgo.Session, r *RaidProtection, reason string) error {
+	logger := log.WithField("guild_id", r.GuildID)
+	if r.Locked() {
+		return nil
+	}
+
+	now := time.Now()
+	r.LockedAt = &now
+	if r.Action == RaidActionVerification {
+		if guild, err := s.State.Guild(r.GuildID); err == nil {
+			r.PreviousVerificationLevel = guild.VerificationLevel
+		}
+		level := discordgo.VerificationLevelHigh
+		if r.PreviousVerificationLevel < level {
+			if _, err := s.GuildEdit(r.GuildID, &discordgo.GuildParams{VerificationLevel: &level}); err != nil {
+				logger.WithError(err).Error("Failed to raise verification level")
+			}
+		}
+	}
+	if err := srv.StoreRaidLockdown(ctx, r); err != nil {
+		return err
+	}
+	logger.WithField("reason", reason).Warn("Locked down guild because of a raid")
+
+	content := fmt.Sprintf(":rotating_light: **Possible raid, locked down.** %s.\nWelcome messages are paused", reason)
+	switch r.Action {
+	case RaidActionVerification:
+		content += ", and the verification level is raised to High."
+	case RaidActionQuarantine:
+		content += fmt.Sprintf(", and members who join get <@&%s>.", r.QuarantineRole)
+	}
+	msg := &discordgo.MessageSend{
+		Content:         content,
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.Button{
+						Label:    "Unlock",
+						Style:    discordgo.DangerButton,
+						CustomID: NewCustomID("raid", 1, raidActionUnlock).String(),
+					},
+				},
+			},
+		},
+	}
+	if r.AlertRole != "" {
+		msg.Content = fmt.Sprintf("<@&%s> %s", r.AlertRole, msg.Content)
+		msg.AllowedMentions.Roles = []string{r.AlertRole}
+	}
+	channelID := r.AlertChannel
+	if channelID == "" {
+		channelID = srv.GuildSettings(ctx, r.GuildID).AdminLogChannel
+	}
+	if channelID == "" {
+		logger.Warn("No channel to alert moderators of the raid in")
+		return nil
+	}
+	if _, err := s.ChannelMessageSendComplex(channelID, msg); err != nil {
+		logger.WithError(err).Error("Failed to alert moderators of the raid")
+	}
+
+	return nil
+}
+
+// Unlock ends the lockdown of a guild, restoring its verification level.
+func (srv *DiscordServerStore) Unlock(ctx context.Context, s *discordgo.Session, r *RaidProtection) error {
+	if !r.Locked() {
+		return nil
+	}
+	if r.Action == RaidActionVerification {
+		level := r.PreviousVerificationLevel
+		if _, err := s.GuildEdit(r.GuildID, &discordgo.GuildParams{VerificationLevel: &level}); err != nil {
+			log.WithError(err).WithField("guild_id", r.GuildID).Error("Failed to restore verification level")
+		}
+	}
+	r.LockedAt = nil
+	return srv.StoreRaidLockdown(ctx, r)
+}
+
+// GetRaidProtection returns the raid protection of a guild, or ErrNotFound
+// if it isn't turned on.
+func (srv *DiscordServerStore) GetRaidProtection(ctx context.Context, guildID string) (*RaidProtection, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	r := RaidProtection{GuildID: guildID}
+	var window, newAccount int
+	var lockedAt sql.NullTime
+	err := srv.db.QueryRowContext(ctx, `
+                SELECT threshold, window_seconds, new_account_seconds, action, quarantine_role,
+                       alert_channel, alert_role, locked_at, previous_verification_level
+                FROM raid_protection WHERE guild = $1`, guildID).Scan(&r.Threshold, &window, &newAccount, &r.Action, &r.QuarantineRole, &r.AlertChannel, &r.AlertRole, &lockedAt, &r.PreviousVerificationLevel)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storeError(err)
+		}
+		log.WithError(err).Error("Failed to fetch raid protection")
+		return nil, err
+	}
+	r.Window = time.Duration(window) * time.Second
+	r.NewAccountAge = time.Duration(newAccount) * time.Second
+	if lockedAt.Valid {
+		r.LockedAt = &lockedAt.Time
+	}
+
+	return &r, nil
+}
+
+// StoreRaidProtection stores the configuration, keeping the lockdown.
+func (srv *DiscordServerStore) StoreRaidProtection(ctx context.Context, r *RaidProtection) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	log.WithField("guild_id", r.GuildID).Debug("Storing raid protection in DB")
+	_, err := srv.db.ExecContext(ctx, `
+                INSERT INTO raid_protection
+                        (guild, threshold, window_seconds, new_account_seconds, action, quarantine_role, alert_channel, alert_role)
+                VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+                ON CONFLICT (guild)
+                DO UPDATE SET threshold = $2, window_seconds = $3, new_account_seconds = $4, action = $5,
+                              quarantine_role = $6, alert_channel = $7, alert_role = $8`,
+		r.GuildID, r.Threshold, int(r.Window/time.Second), int(r.NewAccountAge/time.Second), r.Action, r.QuarantineRole, r.AlertChannel, r.AlertRole)
+	if err != nil {
+		log.WithError(err).Error("Failed to store raid protection")
+		return err
+	}
+
+	return nil
+}
+
+// StoreRaidLockdown stores whether the guild is locked down. It returns
+// ErrNotFound if raid protection was turned off meanwhile.
+func (srv *DiscordServerStore) StoreRaidLockdown(ctx context.Context, r *RaidProtection) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	res, err := srv.db.ExecContext(ctx, "UPDATE raid_protection SET locked_at = $2, previous_verification_level = $3 WHERE guild = $1", r.GuildID, r.LockedAt, r.PreviousVerificationLevel)
+	if err != nil {
+		log.WithError(err).Error("Failed to store raid lockdown")
+		return err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("raid protection of guild %s: %w", r.GuildID, ErrNotFound)
+	}
+
+	return nil
+}
+
+func (srv *DiscordServerStore) DeleteRaidProtection(ctx context.Context, guildID string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	if _, err := srv.db.ExecContext(ctx, "DELETE FROM raid_protection WHERE guild = $1", guildID); err != nil {
+		log.WithError(err).Error("Failed to delete raid protection")
+		return err
+	}
+
+	return nil
+}
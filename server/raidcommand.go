@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// raidCommand lets admins lock the guild down automatically when a lot of
+// members join at once.
+func raidCommand(store *DiscordServerStore) *ApplicationCommand {
+	var minThreshold float64 = 2
+	var minWindow float64 = 5
+	var minDays float64 = 0
+
+	cmd := &ApplicationCommand{
+		Name: "raid",
+		Command: &discordgo.ApplicationCommand{
+			Name:        "raid",
+			Description: "Lock the server down when a lot of members join at once",
+			Version:     "1",
+			Type:        discordgo.ChatApplicationCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "setup",
+					Description: "Turn on raid protection, or change how it works",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionInteger,
+							Name:        "threshold",
+							Description: "How much joins weigh before locking down, new accounts and default avatars weigh more",
+							Required:    true,
+							MinValue:    &minThreshold,
+							MaxValue:    1000,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionInteger,
+							Name:        "seconds",
+							Description: "How many seconds of joins to count, 60 if left out",
+							MinValue:    &minWindow,
+							MaxValue:    3600,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "action",
+							Description: "What to do besides pausing welcome messages",
+							Choices: []*discordgo.ApplicationCommandOptionChoice{
+								{Name: "Raise the verification level to High", Value: RaidActionVerification},
+								{Name: "Give members who join a quarantine role", Value: RaidActionQuarantine},
+							},
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionRole,
+							Name:        "quarantine-role",
+							Description: "Role members who join during a lockdown get, if quarantining",
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionInteger,
+							Name:        "new-account-days",
+							Description: "Accounts younger than this many days weigh more, 7 if left out",
+							MinValue:    &minDays,
+							MaxValue:    365,
+						},
+						{
+							Type:         discordgo.ApplicationCommandOptionChannel,
+							Name:         "alert-channel",
+							Description:  "Channel to alert moderators in, the admin log channel if left out",
+							ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText},
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionRole,
+							Name:        "alert-role",
+							Description: "Role to ping when locking down",
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "show",
+					Description: "Show how raid protection is set up, and if the server is locked down",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "disable",
+					Description: "Turn off raid protection, unlocking the server if it's locked down",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "lock",
+					Description: "Lock the server down now",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "unlock",
+					Description: "End the lockdown",
+				},
+			},
+		},
+		ComponentVersion: 1,
+		Permission:       AdminCommandRaid,
+		store:            store,
+	}
+	cmd.Subcommands = map[string]SubcommandHandler{
+		"setup":   cmd.raidSetup,
+		"show":    cmd.raidShow,
+		"disable": cmd.raidDisable,
+		"lock":    cmd.raidLock,
+		"unlock":  cmd.raidUnlock,
+	}
+	cmd.Components = map[string]ComponentHandler{
+		raidActionUnlock: cmd.raidUnlockButton,
+	}
+
+	return cmd
+}
+
+func (cmd *ApplicationCommand) raidSetup(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	r, err := cmd.store.GetRaidProtection(ctx, event.GuildID)
+	if errors.Is(err, ErrNotFound) {
+		r, err = DefaultRaidProtection(event.GuildID), nil
+	}
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the raid protection.")
+	}
+
+	r.Threshold = int(options["threshold"].IntValue())
+	if option, ok := options["seconds"]; ok {
+		r.Window = time.Duration(option.IntValue()) * time.Second
+	}
+	if option, ok := options["new-account-days"]; ok {
+		r.NewAccountAge = time.Duration(option.IntValue()) * 24 * time.Hour
+	}
+	if option, ok := options["action"]; ok {
+		r.Action = option.StringValue()
+	}
+	if option, ok := options["quarantine-role"]; ok {
+		role := option.RoleValue(s, event.GuildID)
+		if err := assignableRole(event.GuildID, role); err != nil {
+			return respondEphemeral(s, event.Interaction, fmt.Sprintf(":x: %s.", err))
+		}
+		r.QuarantineRole = role.ID
+	}
+	if r.Action == RaidActionQuarantine && r.QuarantineRole == "" {
+		return respondEphemeral(s, event.Interaction, ":x: Pick a `quarantine-role` to quarantine members with.")
+	}
+	if option, ok := options["alert-channel"]; ok {
+		r.AlertChannel = option.ChannelValue(nil).ID
+	}
+	if option, ok := options["alert-role"]; ok {
+		r.AlertRole = option.RoleValue(s, event.GuildID).ID
+	}
+
+	if err := cmd.store.StoreRaidProtection(ctx, r); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't save the raid protection.")
+	}
+
+	cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":shield: <@%s> set up raid protection: %s", interactionUserID(event), describeRaidProtection(r)))
+
+	return respondEphemeral(s, event.Interaction, fmt.Sprintf(":+1: Okay, %s.", describeRaidProtection(r)))
+}
+
+func (cmd *ApplicationCommand) raidShow(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	r, err := cmd.store.GetRaidProtection(ctx, event.GuildID)
+	if errors.Is(err, ErrNotFound) {
+		return respondEphemeral(s, event.Interaction, ":robot: Raid protection is turned off. Use `/raid setup` to turn it on.")
+	}
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the raid protection.")
+	}
+
+	status := "Not locked down."
+	if r.Locked() {
+		status = fmt.Sprintf(":rotating_light: Locked down since <t:%d:R>. Use `/raid unlock` to end it.", r.LockedAt.Unix())
+	}
+	return respondEphemeral(s, event.Interaction, fmt.Sprintf(":shield: Raid protection: %s.\n%s", describeRaidProtection(r), status))
+}
+
+func (cmd *ApplicationCommand) raidDisable(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	r, err := cmd.store.GetRaidProtection(ctx, event.GuildID)
+	if errors.Is(err, ErrNotFound) {
+		return respondEphemeral(s, event.Interaction, ":robot: Raid protection is already turned off.")
+	}
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the raid protection.")
+	}
+	if err := cmd.store.Unlock(ctx, s, r); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't end the lockdown.")
+	}
+	if err := cmd.store.DeleteRaidProtection(ctx, event.GuildID); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't turn off raid protection.")
+	}
+
+	cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":shield: <@%s> turned off raid protection", interactionUserID(event)))
+
+	return respondEphemeral(s, event.Interaction, ":+1: Raid protection is turned off.")
+}
+
+func (cmd *ApplicationCommand) raidLock(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	r, err := cmd.store.GetRaidProtection(ctx, event.GuildID)
+	if errors.Is(err, ErrNotFound) {
+		return respondEphemeral(s, event.Interaction, ":robot: Raid protection is turned off. Use `/raid setup` to turn it on first.")
+	}
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the raid protection.")
+	}
+	if r.Locked() {
+		return respondEphemeral(s, event.Interaction, ":robot: The server is already locked down.")
+	}
+	if err := cmd.store.Lockdown(ctx, s, r, fmt.Sprintf("<@%s> locked the server down", interactionUserID(event))); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't lock the server down.")
+	}
+
+	return respondEphemeral(s, event.Interaction, ":+1: Okay, the server is locked down.")
+}
+
+func (cmd *ApplicationCommand) raidUnlock(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	content, err := cmd.unlockRaid(ctx, s, event)
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't end the lockdown.")
+	}
+	return respondEphemeral(s, event.Interaction, content)
+}
+
+// raidUnlockButton ends the lockdown from the button on the alert, and
+// removes the button.
+func (cmd *ApplicationCommand) raidUnlockButton(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ CustomID) error {
+	content, err := cmd.unlockRaid(ctx, s, event)
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't end the lockdown.")
+	}
+
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:         fmt.Sprintf("%s\n%s", event.Message.Content, content),
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+			Components:      []discordgo.MessageComponent{},
+		},
+	})
+}
+
+func (cmd *ApplicationCommand) unlockRaid(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate) (string, error) {
+	r, err := cmd.store.GetRaidProtection(ctx, event.GuildID)
+	if errors.Is(err, ErrNotFound) {
+		return ":robot: The server isn't locked down.", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !r.Locked() {
+		return ":robot: The server isn't locked down.", nil
+	}
+	if err := cmd.store.Unlock(ctx, s, r); err != nil {
+		log.WithError(err).WithField("guild_id", event.GuildID).Error("Failed to end lockdown")
+		return "", err
+	}
+
+	cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":shield: <@%s> ended the lockdown", interactionUserID(event)))
+
+	return fmt.Sprintf(":unlock: <@%s> ended the lockdown.", interactionUserID(event)), nil
+}
+
+func describeRaidProtection(r *RaidProtection) string {
+	description := fmt.Sprintf("lock down when joins in %s weigh %d or more, counting accounts younger than %s and default avatars extra", HumanizeDuration(r.Window), r.Threshold, HumanizeDuration(r.NewAccountAge))
+	switch r.Action {
+	case RaidActionVerification:
+		description += ", then pause welcome messages and raise the verification level"
+	case RaidActionQuarantine:
+		description += fmt.Sprintf(", then pause welcome messages and give members who join <@&%s>", r.QuarantineRole)
+	}
+	if r.AlertChannel != "" {
+		description += fmt.Sprintf(", alerting in <#%s>", r.AlertChannel)
+	}
+	if r.AlertRole != "" {
+		description += fmt.Sprintf(" pinging <@&%s>", r.AlertRole)
+	}
+	return description
+}
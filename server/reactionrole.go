@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxAutocompleteChoices is the most choices Discord accepts in an
+// autocomplete response.
+const maxAutocompleteChoices = 25
+
+// Discord rejects embeds with more fields, longer field values or more
+// text in total than these.
+const (
+	maxEmbedFields     = 25
+	maxEmbedFieldValue = 1024
+	maxEmbedLength     = 6000
+)
+
+// reactionRoleCommand is the chat input equivalent of the reaction role
+// wizard and the !reactrole text command.
+func reactionRoleCommand(store *DiscordServerStore) *ApplicationCommand {
+
+	messageOptions := func(required bool) []*discordgo.ApplicationCommandOption {
+		return []*discordgo.ApplicationCommandOption{
+			{
+				Type:         discordgo.ApplicationCommandOptionChannel,
+				Name:         "channel",
+				Description:  "Channel the message is in",
+				Required:     required,
+				ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText, discordgo.ChannelTypeGuildNews},
+			},
+			{
+				Type:         discordgo.ApplicationCommandOptionString,
+				Name:         "message",
+				Description:  "ID of the message users react to",
+				Required:     required,
+				Autocomplete: true,
+			},
+			{
+				Type:         discordgo.ApplicationCommandOptionString,
+				Name:         "emoji",
+				Description:  "Emoji users click to get the role",
+				Required:     required,
+				Autocomplete: true,
+			},
+		}
+	}
+
+	cmd := &ApplicationCommand{
+		Name: "reactionrole",
+		Command: &discordgo.ApplicationCommand{
+			Name:        "reactionrole",
+			Description: "Manage roles users get by reacting to messages",
+			Version:     "1",
+			Type:        discordgo.ChatApplicationCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "add",
+					Description: "Give a role to users who react with an emoji on a message",
+					Options: append(messageOptions(true), &discordgo.ApplicationCommandOption{
+						Type:        discordgo.ApplicationCommandOptionRole,
+						Name:        "role",
+						Description: "Role to give",
+						Required:    true,
+					}),
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "remove",
+					Description: "Stop giving a role for an emoji on a message",
+					Options:     messageOptions(true),
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "list",
+					Description: "List reaction roles in this server",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:         discordgo.ApplicationCommandOptionChannel,
+							Name:         "channel",
+							Description:  "Only list reaction roles in this channel",
+							ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText, discordgo.ChannelTypeGuildNews},
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "sync",
+					Description: "Give roles to users who reacted while I was away",
+				},
+			},
+		},
+		Module:     ModuleReactRole,
+		Permission: AdminCommandReactRole,
+		store:      store,
+	}
+	cmd.Subcommands = map[string]SubcommandHandler{
+		"add":    store.reactRoleCommand().SubcommandHandler(store),
+		"remove": cmd.reactionRoleRemove,
+		"list":   cmd.reactionRoleList,
+		"sync":   cmd.reactionRoleSync,
+	}
+	cmd.Autocomplete = cmd.reactionRoleAutocomplete
+
+	return cmd
+}
+
+func (cmd *ApplicationCommand) reactionRoleRemove(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	channel := options["channel"].ChannelValue(nil)
+	rm := ReactRoleMessage{
+		GuildID:   event.GuildID,
+		ChannelID: channel.ID,
+		ID:        options["message"].StringValue(),
+	}
+	logger := log.WithFields(log.Fields{
+		"handler":    "reactionrole remove",
+		"channel_id": rm.ChannelID,
+		"message_id": rm.ID,
+	})
+
+	emoji, err := parseEmojiOption(s, event.GuildID, options["emoji"].StringValue())
+	if err != nil {
+		// The emoji might have been deleted from the server, so try the raw value
+		emoji = options["emoji"].StringValue()
+	}
+
+	removed, err := cmd.store.DeleteReactRole(ctx, rm, emoji)
+	if err != nil {
+		logger.WithError(err).Error("Failed to delete reaction role")
+		return respondEphemeral(s, event.Interaction, ":x: Failed to remove the reaction role.")
+	}
+	if !removed {
+		return respondEphemeral(s, event.Interaction, ":robot: That emoji doesn't give any role on that message.")
+	}
+
+	if err := s.MessageReactionRemove(rm.ChannelID, rm.ID, emoji, "@me"); err != nil {
+		logger.WithError(err).Warn("Failed to remove my reaction from message")
+	}
+
+	return respondEphemeral(s, event.Interaction, fmt.Sprintf(":+1: Removed %s from %s.", renderEmoji(s, event.GuildID, emoji), MessageLink(&discordgo.Message{GuildID: rm.GuildID, ChannelID: rm.ChannelID, ID: rm.ID})))
+}
+
+func (cmd *ApplicationCommand) reactionRoleList(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	channelID := ""
+	if option, ok := options["channel"]; ok {
+		channelID = option.ChannelValue(nil).ID
+	}
+
+	roles, err := cmd.store.GetReactionRolesForGuild(ctx, event.GuildID)
+	if err != nil {
+		log.WithError(err).Error("Failed to list reaction roles")
+		return respondEphemeral(s, event.Interaction, ":x: Failed to list reaction roles.")
+	}
+
+	// Group the bindings by message, keeping the order they came in
+	order := make([]string, 0)
+	byMessage := make(map[string][]string)
+	for _, rr := range roles {
+		if channelID != "" && rr.Message.ChannelID != channelID {
+			continue
+		}
+		link := MessageLink(&discordgo.Message{GuildID: rr.Message.GuildID, ChannelID: rr.Message.ChannelID, ID: rr.Message.ID})
+		if _, ok := byMessage[link]; !ok {
+			order = append(order, link)
+		}
+		byMessage[link] = append(byMessage[link], fmt.Sprintf("%s → <@&%s>", renderEmoji(s, event.GuildID, rr.Emoji), rr.Role))
+	}
+
+	if len(order) == 0 {
+		return respondEphemeral(s, event.Interaction, ":robot: There are no reaction roles here yet.")
+	}
+
+	const title = "Reaction roles"
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+			Embeds: []*discordgo.MessageEmbed{
+				{
+					Title:  title,
+					Fields: reactionRoleFields(order, byMessage, maxEmbedLength-utf8.RuneCountInString(title)),
+				},
+			},
+		},
+	})
+}
+
+// reactionRoleFields creates an embed field per message, in order, within
+// Discord's limits. Messages which don't fit are counted in a last field.
+func reactionRoleFields(order []string, byMessage map[string][]string, length int) []*discordgo.MessageEmbedField {
+	// Room for the field about the messages left out
+	const moreLength = 100
+
+	fields := make([]*discordgo.MessageEmbedField, 0, len(order))
+	for i, link := range order {
+		field := &discordgo.MessageEmbedField{
+			Name:  "Message",
+			Value: truncate(fmt.Sprintf("%s\n%s", link, strings.Join(byMessage[link], "\n")), maxEmbedFieldValue),
+		}
+		size := utf8.RuneCountInString(field.Name) + utf8.RuneCountInString(field.Value)
+		last := i == len(order)-1
+		if (!last && (len(fields) == maxEmbedFields-1 || size > length-moreLength)) || size > length {
+			fields = append(fields, &discordgo.MessageEmbedField{
+				Name:  "…",
+				Value: fmt.Sprintf("and %d more messages, pick a channel to see them.", len(order)-i),
+			})
+			break
+		}
+		fields = append(fields, field)
+		length -= size
+	}
+	return fields
+}
+
+func (cmd *ApplicationCommand) reactionRoleSync(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	// Syncing pages through every reaction, which can take longer than
+	// Discord waits for a response
+	if err := s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	}); err != nil {
+		return err
+	}
+
+	content := ""
+	granted, err := cmd.store.SyncReactionRoles(ctx, s, event.GuildID, false)
+	if err != nil {
+		log.WithError(err).Error("failed to sync reaction roles")
+		content = ":x: Failed to sync reaction roles."
+	} else {
+		content = fmt.Sprintf(":+1: Synced reaction roles, gave out %d roles.", granted)
+	}
+
+	_, err = s.InteractionResponseEdit(event.Interaction, &discordgo.WebhookEdit{
+		Content: &content,
+	})
+	return err
+}
+
+func (cmd *ApplicationCommand) reactionRoleAutocomplete(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate) error {
+	data := event.ApplicationCommandData()
+	focused := focusedOption(data.Options)
+	if focused == nil || len(data.Options) == 0 {
+		return nil
+	}
+	options := optionMap(data.Options[0].Options)
+	typed := strings.ToLower(fmt.Sprint(focused.Value))
+
+	choices := make([]*discordgo.ApplicationCommandOptionChoice, 0, maxAutocompleteChoices)
+	switch focused.Name {
+	case "message":
+		channelID := event.ChannelID
+		if option, ok := options["channel"]; ok && option.Value != nil {
+			channelID = option.ChannelValue(nil).ID
+		}
+		messages, err := s.ChannelMessages(channelID, 50, "", "", "")
+		if err != nil {
+			log.WithError(err).WithField("channel_id", channelID).Warn("Failed to fetch recent messages for autocomplete")
+			break
+		}
+		for _, msg := range messages {
+			if len(choices) == maxAutocompleteChoices {
+				break
+			}
+			label := fmt.Sprintf("%s: %s", msg.Author.Username, strings.ReplaceAll(msg.Content, "\n", " "))
+			if typed != "" && !strings.HasPrefix(msg.ID, typed) && !strings.Contains(strings.ToLower(label), typed) {
+				continue
+			}
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+				Name:  truncate(label, 100),
+				Value: msg.ID,
+			})
+		}
+	case "emoji":
+		guild, err := s.State.Guild(event.GuildID)
+		if err != nil {
+			log.WithError(err).Warn("Failed to fetch guild for emoji autocomplete")
+			break
+		}
+		for _, emoji := range guild.Emojis {
+			if len(choices) == maxAutocompleteChoices {
+				break
+			}
+			if typed != "" && !strings.Contains(strings.ToLower(emoji.Name), strings.Trim(typed, ":")) {
+				continue
+			}
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+				Name:  fmt.Sprintf(":%s:", emoji.Name),
+				Value: emoji.APIName(),
+			})
+		}
+		// Unicode emoji aren't in the guild's list, so offer whatever was typed
+		if typed != "" && len(choices) < maxAutocompleteChoices {
+			value := fmt.Sprint(focused.Value)
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+				Name:  truncate(value, 100),
+				Value: value,
+			})
+		}
+	}
+
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{
+			Choices: choices,
+		},
+	})
+}
+
+// parseEmojiOption accepts an emoji as typed in a message (`<:name:id>`),
+// as an API name (`name:id`) or as a unicode emoji, and returns the API
+// name after making sure custom emoji are from the guild.
+func parseEmojiOption(s *discordgo.Session, guildID, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", fmt.Errorf("empty emoji")
+	}
+	if value[0] == '<' {
+		return GetValidEmoji(value, guildID, s)
+	}
+	if parts := strings.Split(value, ":"); len(parts) == 2 {
+		emoji, err := s.State.Emoji(guildID, parts[1])
+		if err != nil {
+			return "", err
+		}
+		return emoji.APIName(), nil
+	}
+	return value, nil
+}
+
+func truncate(s string, length int) string {
+	runes := []rune(s)
+	if len(runes) <= length {
+		return s
+	}
+	return string(runes[:length-1]) + "…"
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestReactionRoleFieldsFitInAnEmbed(t *testing.T) {
+	manyRoles := make([]string, 100)
+	for i := range manyRoles {
+		manyRoles[i] = fmt.Sprintf("👍 → <@&%d>", 100000000000000000+i)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		messages int
+		roles    []string
+		want     int
+		more     bool
+	}{
+		{name: "few", messages: 3, roles: manyRoles[:2], want: 3},
+		{name: "exactly as many as fit", messages: maxEmbedFields, roles: manyRoles[:1], want: maxEmbedFields},
+		{name: "more messages than fields", messages: 40, roles: manyRoles[:1], want: maxEmbedFields, more: true},
+		{name: "long values", messages: 10, roles: manyRoles, more: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			order := make([]string, tt.messages)
+			byMessage := make(map[string][]string, tt.messages)
+			for i := range order {
+				order[i] = fmt.Sprintf("https://discord.com/channels/1/2/%d", i)
+				byMessage[order[i]] = tt.roles
+			}
+
+			fields := reactionRoleFields(order, byMessage, maxEmbedLength)
+			if tt.want != 0 && len(fields) != tt.want {
+				t.Errorf("got %d fields, want %d", len(fields), tt.want)
+			}
+			if len(fields) > maxEmbedFields {
+				t.Errorf("got %d fields, more than Discord allows", len(fields))
+			}
+			length := 0
+			for _, field := range fields {
+				if n := utf8.RuneCountInString(field.Value); n > maxEmbedFieldValue {
+					t.Errorf("got a field value of %d characters, more than Discord allows", n)
+				}
+				length += utf8.RuneCountInString(field.Name) + utf8.RuneCountInString(field.Value)
+			}
+			if length > maxEmbedLength {
+				t.Errorf("got %d characters, more than Discord allows", length)
+			}
+			more := len(fields) > 0 && strings.Contains(fields[len(fields)-1].Value, "more messages")
+			if more != tt.more {
+				t.Errorf("got a field about messages left out %v, want %v", more, tt.more)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrorReport is an error or panic captured from a handler or job.
+type ErrorReport struct {
+	// Source is the handler, command or job the error happened in.
+	Source string
+	Err    string
+	// Event summarizes what was being handled, if anything.
+	Event string
+	Stack string
+	Panic bool
+}
+
+func (r ErrorReport) key() string {
+	return r.Source + "\x00" + r.Err
+}
+
+// ErrorReporter logs captured errors, and posts them to a developer
+// channel. The same error is only posted once per DedupeWindow, and at
+// most RateLimit reports are posted per minute, so a broken handler
+// can't flood the channel.
+type ErrorReporter struct {
+	ChannelID    string
+	DedupeWindow time.Duration
+	RateLimit    int
+
+	mu     sync.Mutex
+	seen   map[string]*reportedError
+	posted []time.Time
+}
+
+type reportedError struct {
+	last       time.Time
+	suppressed int
+}
+
+// NewErrorReporter creates a reporter posting to the channel, or only
+// logging if it is empty.
+func NewErrorReporter(channelID string) *ErrorReporter {
+	return &ErrorReporter{
+		ChannelID:    channelID,
+		DedupeWindow: 10 * time.Minute,
+		RateLimit:    5,
+		seen:         make(map[string]*reportedError),
+	}
+}
+
+// Report logs the error, and posts it unless it was posted recently. It
+// is safe to call on a nil reporter, which only logs.
+func (r *ErrorReporter) Report(s *discordgo.Session, report ErrorReport) {
+	logger := log.WithFields(log.Fields{
+		"source": report.Source,
+		"event":  report.Event,
+		"panic":  report.Panic,
+	})
+	if report.Stack != "" {
+		logger = logger.WithField("stack", report.Stack)
+	}
+	logger.Error(report.Err)
+
+	if r == nil || r.ChannelID == "" || s == nil {
+		return
+	}
+	suppressed, ok := r.allow(report, time.Now())
+	if !ok {
+		return
+	}
+
+	if _, err := s.ChannelMessageSendComplex(r.ChannelID, &discordgo.MessageSend{
+		Embeds:          []*discordgo.MessageEmbed{report.embed(suppressed)},
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	}); err != nil {
+		log.WithError(err).WithField("channel_id", r.ChannelID).Warn("Failed to post error report")
+	}
+}
+
+// allow decides whether to post a report, and returns how many times it
+// happened since it was last posted.
+func (r *ErrorReporter) allow(report ErrorReport, now time.Time) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen, ok := r.seen[report.key()]
+	if !ok {
+		seen = &reportedError{}
+		r.seen[report.key()] = seen
+	}
+	if ok && now.Sub(seen.last) < r.DedupeWindow {
+		seen.suppressed++
+		return 0, false
+	}
+
+	recent := r.posted[:0]
+	for _, at := range r.posted {
+		if now.Sub(at) < time.Minute {
+			recent = append(recent, at)
+		}
+	}
+	r.posted = recent
+	if len(r.posted) >= r.RateLimit {
+		seen.suppressed++
+		return 0, false
+	}
+	r.posted = append(r.posted, now)
+
+	suppressed := seen.suppressed
+	seen.last = now
+	seen.suppressed = 0
+
+	// Forget errors which haven't happened in a while
+	for key, other := range r.seen {
+		if now.Sub(other.last) > r.DedupeWindow && other.suppressed == 0 {
+			delete(r.seen, key)
+		}
+	}
+
+	return suppressed, true
+}
+
+func (report ErrorReport) embed(suppressed int) *discordgo.MessageEmbed {
+	// Discord rejects longer descriptions, so the error and event are cut
+	// short, and the stack gets what is left
+	const (
+		maxDescription = 4096
+		maxErr         = 1000
+		maxEvent       = 500
+	)
+
+	title := fmt.Sprintf("Error in %s", report.Source)
+	color := ModLogColorNeutral
+	if report.Panic {
+		title = fmt.Sprintf("Panic in %s", report.Source)
+		color = ModLogColorBad
+	}
+
+	description := fmt.Sprintf("```\n%s\n```", truncate(report.Err, maxErr))
+	if report.Event != "" {
+		description += fmt.Sprintf("\n**Event:** %s", truncate(report.Event, maxEvent))
+	}
+	if suppressed > 0 {
+		description += fmt.Sprintf("\n**Also happened** %d more times since it was last reported", suppressed)
+	}
+	const stackBlock = "\n```\n%s\n```"
+	room := maxDescription - utf8.RuneCountInString(description) - utf8.RuneCountInString(fmt.Sprintf(stackBlock, ""))
+	if report.Stack != "" && room > 0 {
+		description += fmt.Sprintf(stackBlock, truncate(report.Stack, room))
+	}
+
+	return &discordgo.MessageEmbed{
+		Title:       title,
+		Description: description,
+		Color:       color,
+		Timestamp:   time.Now().Format(time.RFC3339),
+	}
+}
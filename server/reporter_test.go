@@ -0,0 +1,27 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestErrorReportFitsInAnEmbed(t *testing.T) {
+	report := ErrorReport{
+		Source: "handler",
+		Err:    strings.Repeat("é", 5000),
+		Event:  strings.Repeat("event ", 1000),
+		Stack:  strings.Repeat("goroutine 1 [running]:\n", 500),
+	}
+
+	embed := report.embed(3)
+	if n := utf8.RuneCountInString(embed.Description); n > 4096 {
+		t.Errorf("got a description of %d characters, more than Discord allows", n)
+	}
+	if !strings.Contains(embed.Description, "goroutine 1") {
+		t.Error("expected part of the stack to fit")
+	}
+	if !strings.Contains(embed.Description, "3 more times") {
+		t.Error("expected the suppressed count to be kept")
+	}
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+	"github.com/sklirg/tardis/metrics"
+)
+
+// customIDMaxLength is the longest custom ID Discord accepts on components
+// and modals.
+const customIDMaxLength = 100
+
+const customIDSeparator = ":"
+
+var (
+	// ErrCustomIDTooLong is returned when an encoded custom ID doesn't fit
+	// in a component.
+	ErrCustomIDTooLong = errors.New("custom id is too long")
+	// ErrInvalidCustomID is returned when a custom ID wasn't created by
+	// CustomID.Encode.
+	ErrInvalidCustomID = errors.New("invalid custom id")
+)
+
+// CustomID is the typed form of a component or modal custom ID. The
+// namespace and version select the handler, so components on old
+// messages are rejected when the handler changes what it expects, and
+// the payload carries the state the handler needs.
+//
+// Encoded it looks like `namespace:v1:action:payload:payload`.
+type CustomID struct {
+	Namespace string
+	Version   int
+	Action    string
+	Payload   []string
+}
+
+// NewCustomID creates a custom ID with an optional payload.
+func NewCustomID(namespace string, version int, action string, payload ...string) CustomID {
+	return CustomID{
+		Namespace: namespace,
+		Version:   version,
+		Action:    action,
+		Payload:   payload,
+	}
+}
+
+// Encode turns the custom ID into the string sent to Discord. Payload
+// values are escaped so they may contain any character.
+func (id CustomID) Encode() (string, error) {
+	if id.Namespace == "" || strings.Contains(id.Namespace, customIDSeparator) || strings.Contains(id.Action, customIDSeparator) {
+		return "", fmt.Errorf("%w: namespace '%s', action '%s'", ErrInvalidCustomID, id.Namespace, id.Action)
+	}
+	parts := []string{id.Namespace, fmt.Sprintf("v%d", id.Version), id.Action}
+	for _, value := range id.Payload {
+		parts = append(parts, url.QueryEscape(value))
+	}
+	encoded := strings.Join(parts, customIDSeparator)
+	if len(encoded) > customIDMaxLength {
+		return "", fmt.Errorf("%w: %d characters (max %d)", ErrCustomIDTooLong, len(encoded), customIDMaxLength)
+	}
+	return encoded, nil
+}
+
+// String encodes the custom ID, logging and returning an empty string if
+// that fails. Use Encode when the payload comes from user input.
+func (id CustomID) String() string {
+	encoded, err := id.Encode()
+	if err != nil {
+		log.WithError(err).Error("Failed to encode custom id")
+		return ""
+	}
+	return encoded
+}
+
+func (id CustomID) route() string {
+	return routeKey(id.Namespace, id.Version, id.Action)
+}
+
+// ParseCustomID parses a custom ID created by CustomID.Encode.
+func ParseCustomID(customID string) (CustomID, error) {
+	parts := strings.Split(customID, customIDSeparator)
+	if len(parts) < 3 || len(parts[1]) < 2 || parts[1][0] != 'v' {
+		return CustomID{}, fmt.Errorf("%w: '%s'", ErrInvalidCustomID, customID)
+	}
+	version, err := strconv.Atoi(parts[1][1:])
+	if err != nil {
+		return CustomID{}, fmt.Errorf("%w: '%s'", ErrInvalidCustomID, customID)
+	}
+	id := CustomID{
+		Namespace: parts[0],
+		Version:   version,
+		Action:    parts[2],
+	}
+	for _, value := range parts[3:] {
+		unescaped, err := url.QueryUnescape(value)
+		if err != nil {
+			return CustomID{}, fmt.Errorf("%w: '%s'", ErrInvalidCustomID, customID)
+		}
+		id.Payload = append(id.Payload, unescaped)
+	}
+	return id, nil
+}
+
+// ComponentHandler handles a component or modal interaction, with the
+// custom ID already parsed.
+type ComponentHandler func(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, id CustomID) error
+
+// Router dispatches interactions to the application commands and the
+// component and modal handlers registered with it. Everything has to be
+// registered before interactions are handled, after that it is only read
+// and safe for concurrent use.
+type Router struct {
+	commands   map[string]*ApplicationCommand
+	components map[string]ComponentHandler
+	modals     map[string]ComponentHandler
+	namespaces map[string]int
+
+	// Reporter, if set, is told about handlers which fail or panic.
+	Reporter *ErrorReporter
+}
+
+// NewRouter creates an empty router.
+func NewRouter() *Router {
+	return &Router{
+		commands:   make(map[string]*ApplicationCommand),
+		components: make(map[string]ComponentHandler),
+		modals:     make(map[string]ComponentHandler),
+		namespaces: make(map[string]int),
+	}
+}
+
+// Register adds an application command and the component and modal
+// handlers it declares, namespaced by the command name.
+func (r *Router) Register(cmd *ApplicationCommand) {
+	r.commands[cmd.Name] = cmd
+	for action, handler := range cmd.Components {
+		r.HandleComponent(cmd.Name, cmd.ComponentVersion, action, handler)
+	}
+	for action, handler := range cmd.Modals {
+		r.HandleModal(cmd.Name, cmd.ComponentVersion, action, handler)
+	}
+}
+
+// Commands returns the registered application commands.
+func (r *Router) Commands() []*ApplicationCommand {
+	commands := make([]*ApplicationCommand, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		commands = append(commands, cmd)
+	}
+	return commands
+}
+
+// HandleComponent registers a handler for message components with custom
+// IDs in the given namespace, version and action.
+func (r *Router) HandleComponent(namespace string, version int, action string, handler ComponentHandler) {
+	r.components[routeKey(namespace, version, action)] = handler
+	r.namespaces[namespace] = version
+}
+
+// HandleModal registers a handler for modals submitted with custom IDs in
+// the given namespace, version and action.
+func (r *Router) HandleModal(namespace string, version int, action string, handler ComponentHandler) {
+	r.modals[routeKey(namespace, version, action)] = handler
+	r.namespaces[namespace] = version
+}
+
+// HandleInteraction routes an interaction to its handler. Handlers that
+// fail or panic get a generic ephemeral error sent to the user, so the
+// interaction doesn't just time out.
+func (r *Router) HandleInteraction(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate) {
+	logger := log.WithFields(log.Fields{
+		"interaction_id":   event.ID,
+		"interaction_type": event.Type,
+		"guild_id":         event.GuildID,
+	})
+	logger.Info("Handling interaction")
+	kind, command := interactionMetricLabels(event)
+	defer metrics.ObserveCommand(kind, command, time.Now())
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			r.Reporter.Report(s, ErrorReport{
+				Source: "interaction",
+				Err:    fmt.Sprint(recovered),
+				Event:  InteractionSummary(event),
+				Stack:  string(debug.Stack()),
+				Panic:  true,
+			})
+			respondFallback(s, event.Interaction)
+		}
+	}()
+
+	if err := r.route(ctx, s, event, logger); err != nil {
+		r.Reporter.Report(s, ErrorReport{
+			Source: "interaction",
+			Err:    fmt.Sprintf("failed to respond: %s", err),
+			Event:  InteractionSummary(event),
+		})
+		respondFallback(s, event.Interaction)
+	}
+}
+
+// HandleReaction tells the commands waiting for reactions about one. It
+// is called for every reaction added, so they have to filter cheaply.
+func (r *Router) HandleReaction(ctx context.Context, s *discordgo.Session, reaction *discordgo.MessageReactionAdd) {
+	for _, cmd := range r.commands {
+		if cmd.Reactions != nil {
+			cmd.Reactions(ctx, s, reaction)
+		}
+	}
+}
+
+// Expire lets the commands clean up what users abandoned.
+func (r *Router) Expire(ctx context.Context) {
+	for _, cmd := range r.commands {
+		if cmd.Expire != nil {
+			cmd.Expire(ctx)
+		}
+	}
+}
+
+func (r *Router) route(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, logger *log.Entry) error {
+	switch event.Type {
+	case discordgo.InteractionApplicationCommand, discordgo.InteractionApplicationCommandAutocomplete:
+		name := event.ApplicationCommandData().Name
+		cmd, ok := r.commands[name]
+		if !ok {
+			return fmt.Errorf("unknown application command '%s'", name)
+		}
+		logger.WithField("application_name", name).Debug("Routing application command")
+		if cmd.moduleDisabled(ctx, event.GuildID) {
+			return respondModuleDisabled(s, event, cmd.Module)
+		}
+		if cmd.permissionDenied(ctx, event) {
+			return respondPermissionDenied(s, event)
+		}
+		return cmd.Respond(ctx, s, event)
+
+	case discordgo.InteractionMessageComponent:
+		return r.routeCustomID(ctx, s, event, event.MessageComponentData().CustomID, r.components, logger)
+
+	case discordgo.InteractionModalSubmit:
+		return r.routeCustomID(ctx, s, event, event.ModalSubmitData().CustomID, r.modals, logger)
+	}
+
+	return fmt.Errorf("unsupported interaction type %s", event.Type)
+}
+
+func (r *Router) routeCustomID(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, customID string, handlers map[string]ComponentHandler, logger *log.Entry) error {
+	id, err := ParseCustomID(customID)
+	if err != nil {
+		return err
+	}
+	logger = logger.WithFields(log.Fields{
+		"namespace": id.Namespace,
+		"version":   id.Version,
+		"action":    id.Action,
+	})
+
+	handler, ok := handlers[id.route()]
+	if !ok {
+		if current, known := r.namespaces[id.Namespace]; known && current != id.Version {
+			logger.WithField("current_version", current).Info("Got interaction for an outdated component")
+			return respondEphemeral(s, event.Interaction, ":robot: This message is out of date, please start over.")
+		}
+		return fmt.Errorf("no handler for custom id '%s'", customID)
+	}
+
+	if cmd, ok := r.commands[id.Namespace]; ok {
+		if cmd.moduleDisabled(ctx, event.GuildID) {
+			return respondModuleDisabled(s, event, cmd.Module)
+		}
+		if cmd.permissionDenied(ctx, event) {
+			return respondPermissionDenied(s, event)
+		}
+	}
+
+	logger.Debug("Routing component")
+	return handler(ctx, s, event, id)
+}
+
+// interactionMetricLabels returns the kind and command of an interaction
+// for the command latency metric. Components and modals are labeled with
+// the namespace of their custom ID, which is the command they belong to.
+func interactionMetricLabels(event *discordgo.InteractionCreate) (string, string) {
+	switch event.Type {
+	case discordgo.InteractionApplicationCommand:
+		return "slash", event.ApplicationCommandData().Name
+	case discordgo.InteractionApplicationCommandAutocomplete:
+		return "autocomplete", event.ApplicationCommandData().Name
+	case discordgo.InteractionMessageComponent:
+		return "component", customIDNamespace(event.MessageComponentData().CustomID)
+	case discordgo.InteractionModalSubmit:
+		return "modal", customIDNamespace(event.ModalSubmitData().CustomID)
+	}
+	return "unknown", ""
+}
+
+func customIDNamespace(customID string) string {
+	id, err := ParseCustomID(customID)
+	if err != nil {
+		return "unknown"
+	}
+	return id.Namespace
+}
+
+// InteractionSummary describes an interaction for error reports.
+func InteractionSummary(event *discordgo.InteractionCreate) string {
+	summary := fmt.Sprintf("%s interaction in guild %s by user %s", event.Type, event.GuildID, interactionUserID(event))
+	switch event.Type {
+	case discordgo.InteractionApplicationCommand, discordgo.InteractionApplicationCommandAutocomplete:
+		summary += fmt.Sprintf(", command /%s", event.ApplicationCommandData().Name)
+	case discordgo.InteractionMessageComponent:
+		summary += fmt.Sprintf(", custom ID %s", event.MessageComponentData().CustomID)
+	case discordgo.InteractionModalSubmit:
+		summary += fmt.Sprintf(", custom ID %s", event.ModalSubmitData().CustomID)
+	}
+	return summary
+}
+
+func respondModuleDisabled(s *discordgo.Session, event *discordgo.InteractionCreate, module Module) error {
+	if event.Type == discordgo.InteractionApplicationCommandAutocomplete {
+		return nil
+	}
+	return respondEphemeral(s, event.Interaction, fmt.Sprintf(":robot: The `%s` module is turned off in this server.", module))
+}
+
+func respondPermissionDenied(s *discordgo.Session, event *discordgo.InteractionCreate) error {
+	if event.Type == discordgo.InteractionApplicationCommandAutocomplete {
+		return nil
+	}
+	return respondEphemeral(s, event.Interaction, ":robot: You don't have permission to do that here.")
+}
+
+func routeKey(namespace string, version int, action string) string {
+	return fmt.Sprintf("%s:v%d:%s", namespace, version, action)
+}
+
+// respondFallback tells the user something went wrong, either as the
+// response to the interaction or as a follow-up if it was already
+// acknowledged.
+func respondFallback(s *discordgo.Session, interaction *discordgo.Interaction) {
+	const content = ":robot: Something went wrong while handling that, sorry! Try again later."
+
+	if interaction.Type == discordgo.InteractionApplicationCommandAutocomplete {
+		return
+	}
+	if err := respondEphemeral(s, interaction, content); err == nil {
+		return
+	}
+	if _, err := s.FollowupMessageCreate(interaction, false, &discordgo.WebhookParams{
+		Content: content,
+		Flags:   discordgo.MessageFlagsEphemeral,
+	}); err != nil {
+		log.WithError(err).Warn("Failed to send fallback error response")
+	}
+}
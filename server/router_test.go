@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCustomIDRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		id   CustomID
+	}{
+		{name: "no payload", id: NewCustomID("reactionrole", 2, "save")},
+		{name: "payload", id: NewCustomID("reactionrole", 2, "role", "1234")},
+		{name: "separator in payload", id: NewCustomID("welcome", 1, "test", "a:b", ":")},
+		{name: "escapes in payload", id: NewCustomID("welcome", 1, "test", "100%", "%3A", "a+b c")},
+		{name: "empty payload value", id: NewCustomID("welcome", 1, "test", "", "x")},
+		{name: "unicode payload", id: NewCustomID("reactionrole", 2, "emoji", "👍", "name:1234")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := tt.id.Encode()
+			if err != nil {
+				t.Fatalf("Encode() = %s", err)
+			}
+			if got := strings.Count(encoded, customIDSeparator); got != 2+len(tt.id.Payload) {
+				t.Errorf("encoded %q has %d separators, want %d", encoded, got, 2+len(tt.id.Payload))
+			}
+
+			parsed, err := ParseCustomID(encoded)
+			if err != nil {
+				t.Fatalf("ParseCustomID(%q) = %s", encoded, err)
+			}
+			if parsed.Namespace != tt.id.Namespace || parsed.Version != tt.id.Version || parsed.Action != tt.id.Action {
+				t.Errorf("ParseCustomID(%q) = %+v, want %+v", encoded, parsed, tt.id)
+			}
+			if len(parsed.Payload) != len(tt.id.Payload) || (len(parsed.Payload) > 0 && !reflect.DeepEqual(parsed.Payload, tt.id.Payload)) {
+				t.Errorf("ParseCustomID(%q) payload = %q, want %q", encoded, parsed.Payload, tt.id.Payload)
+			}
+		})
+	}
+}
+
+func TestCustomIDEncodeRejects(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		id   CustomID
+		want error
+	}{
+		{name: "no namespace", id: NewCustomID("", 1, "save"), want: ErrInvalidCustomID},
+		{name: "separator in namespace", id: NewCustomID("a:b", 1, "save"), want: ErrInvalidCustomID},
+		{name: "separator in action", id: NewCustomID("welcome", 1, "a:b"), want: ErrInvalidCustomID},
+		{name: "too long", id: NewCustomID("welcome", 1, "test", strings.Repeat("x", customIDMaxLength)), want: ErrCustomIDTooLong},
+		// Escaping makes the payload three times as long
+		{name: "too long once escaped", id: NewCustomID("welcome", 1, "test", strings.Repeat(":", 30)), want: ErrCustomIDTooLong},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := tt.id.Encode()
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Encode() = %q, %v, want %v", encoded, err, tt.want)
+			}
+		})
+	}
+
+	longest := NewCustomID("welcome", 1, "test", strings.Repeat("x", customIDMaxLength-len("welcome:v1:test:")))
+	if encoded, err := longest.Encode(); err != nil || len(encoded) != customIDMaxLength {
+		t.Errorf("Encode() of exactly %d characters = %d characters, %v", customIDMaxLength, len(encoded), err)
+	}
+}
+
+func TestParseCustomID(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		customID string
+		want     CustomID
+		invalid  bool
+	}{
+		{name: "current", customID: "reactionrole:v2:role:1234", want: NewCustomID("reactionrole", 2, "role", "1234")},
+		{name: "old version", customID: "reactionrole:v1:role:1234", want: NewCustomID("reactionrole", 1, "role", "1234")},
+		{name: "version zero", customID: "reactionrole:v0:role", want: NewCustomID("reactionrole", 0, "role")},
+		{name: "from before custom IDs were versioned", customID: "1029384756;42", invalid: true},
+		{name: "placeholder from before custom IDs were versioned", customID: "Nothing", invalid: true},
+		{name: "no version", customID: "reactionrole:role:1234", invalid: true},
+		{name: "empty version", customID: "reactionrole:v:role", invalid: true},
+		{name: "unknown version format", customID: "reactionrole:version2:role", invalid: true},
+		{name: "too few parts", customID: "reactionrole:v2", invalid: true},
+		{name: "bad escape", customID: "reactionrole:v2:role:%zz", invalid: true},
+		{name: "empty", customID: "", invalid: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCustomID(tt.customID)
+			if tt.invalid {
+				if !errors.Is(err, ErrInvalidCustomID) {
+					t.Errorf("ParseCustomID(%q) = %+v, %v, want ErrInvalidCustomID", tt.customID, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseCustomID(%q) = %s", tt.customID, err)
+			}
+			if got.route() != tt.want.route() || !reflect.DeepEqual(got.Payload, tt.want.Payload) {
+				t.Errorf("ParseCustomID(%q) = %+v, want %+v", tt.customID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOldCustomIDVersionsRouteElsewhere(t *testing.T) {
+	old, err := ParseCustomID("reactionrole:v1:role:1234")
+	if err != nil {
+		t.Fatalf("ParseCustomID() = %s", err)
+	}
+	if current := NewCustomID("reactionrole", 2, "role"); old.route() == current.route() {
+		t.Errorf("version 1 routes to the version 2 handler %s", current.route())
+	}
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// Module is a feature of the bot which can be turned on or off per guild.
+type Module string
+
+const (
+	ModuleHots      Module = "hots"
+	ModuleRun       Module = "run"
+	ModuleReactRole Module = "reactrole"
+	ModuleWelcome   Module = "welcome"
+)
+
+// Modules lists every module which can be turned on or off.
+var Modules = []Module{ModuleHots, ModuleRun, ModuleReactRole, ModuleWelcome}
+
+const (
+	DefaultPrefix   = "!"
+	DefaultLocale   = discordgo.EnglishUS
+	DefaultTimezone = "Europe/Oslo"
+)
+
+// GuildSettings is the per-guild configuration of the bot.
+type GuildSettings struct {
+	GuildID         string
+	Prefix          string
+	Locale          discordgo.Locale
+	Timezone        string
+	AdminLogChannel string
+	Modules         map[Module]bool
+
+	location *time.Location
+}
+
+// DefaultGuildSettings returns the settings used for guilds which haven't
+// changed anything, and outside of guilds.
+func DefaultGuildSettings(guildID string) *GuildSettings {
+	modules := make(map[Module]bool, len(Modules))
+	for _, module := range Modules {
+		modules[module] = true
+	}
+	return &GuildSettings{
+		GuildID:  guildID,
+		Prefix:   DefaultPrefix,
+		Locale:   DefaultLocale,
+		Timezone: DefaultTimezone,
+		Modules:  modules,
+		location: defaultLocation,
+	}
+}
+
+// unavailableGuildSettings are used when a guild's settings can't be
+// loaded. Modules the guild turned off mustn't come back on, so every
+// module is off.
+func unavailableGuildSettings(guildID string) *GuildSettings {
+	settings := DefaultGuildSettings(guildID)
+	for _, module := range Modules {
+		settings.Modules[module] = false
+	}
+	return settings
+}
+
+// ModuleEnabled returns whether a module is turned on.
+func (g *GuildSettings) ModuleEnabled(module Module) bool {
+	enabled, ok := g.Modules[module]
+	return !ok || enabled
+}
+
+// Location returns the time zone of the guild, or UTC if it couldn't be
+// loaded.
+func (g *GuildSettings) Location() *time.Location {
+	if g.location == nil {
+		return time.UTC
+	}
+	return g.location
+}
+
+// defaultLocation is the location of DefaultTimezone, loaded once since
+// default settings are used a lot.
+var defaultLocation = loadLocation(DefaultTimezone)
+
+// loadLocation loads a time zone, falling back to UTC if it can't be
+// loaded.
+func loadLocation(timezone string) *time.Location {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		log.WithError(err).WithField("timezone", timezone).Warn("Failed to load timezone")
+		return time.UTC
+	}
+	return loc
+}
+
+// Validate checks that the settings can be used.
+func (g *GuildSettings) Validate() error {
+	if g.Prefix == "" || len(g.Prefix) > 8 || strings.ContainsAny(g.Prefix, " \t\n") {
+		return fmt.Errorf("the prefix must be 1 to 8 characters without spaces")
+	}
+	if _, ok := discordgo.Locales[g.Locale]; !ok {
+		return fmt.Errorf("unknown locale '%s'", g.Locale)
+	}
+	loc, err := time.LoadLocation(g.Timezone)
+	if err != nil {
+		return fmt.Errorf("unknown timezone '%s'", g.Timezone)
+	}
+	g.location = loc
+	return nil
+}
+
+func (g *GuildSettings) clone() *GuildSettings {
+	c := *g
+	c.Modules = make(map[Module]bool, len(g.Modules))
+	for module, enabled := range g.Modules {
+		c.Modules[module] = enabled
+	}
+	return &c
+}
+
+// settingsCache caches guild settings, since they are read for every
+// message and event.
+type settingsCache struct {
+	mu       sync.RWMutex
+	settings map[string]*GuildSettings
+}
+
+func (c *settingsCache) get(guildID string) (*GuildSettings, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	settings, ok := c.settings[guildID]
+	if !ok {
+		return nil, false
+	}
+	return settings.clone(), true
+}
+
+func (c *settingsCache) set(guildID string, settings *GuildSettings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.settings == nil {
+		c.settings = make(map[string]*GuildSettings)
+	}
+	c.settings[guildID] = settings.clone()
+}
+
+func (c *settingsCache) invalidate(guildID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.settings, guildID)
+}
+
+// GuildSettings returns the settings of a guild, or the defaults if the
+// guild hasn't changed anything. Settings are cached once loaded, so while
+// the database is unavailable the cached ones keep being used; if they
+// can't be loaded at all, every module is turned off until they can.
+func (srv *DiscordServerStore) GuildSettings(ctx context.Context, guildID string) *GuildSettings {
+	if guildID == "" {
+		return DefaultGuildSettings(guildID)
+	}
+
+	if cached, ok := srv.settings.get(guildID); ok {
+		return cached
+	}
+
+	settings, err := srv.GetGuildSettings(ctx, guildID)
+	if errors.Is(err, ErrNotFound) {
+		settings, err = DefaultGuildSettings(guildID), nil
+	}
+	if err != nil {
+		// Don't cache, so we try again next time
+		log.WithError(err).WithField("guild_id", guildID).Warn("Failed to load guild settings, turning every module off")
+		return unavailableGuildSettings(guildID)
+	}
+
+	srv.settings.set(guildID, settings)
+	return settings
+}
+
+// UpdateGuildSettings changes the settings of a guild, validating and
+// persisting them before they are used. The row is locked while the change
+// is applied, so concurrent changes don't overwrite each other. If update
+// fails nothing is stored.
+func (srv *DiscordServerStore) UpdateGuildSettings(ctx context.Context, guildID string, update func(*GuildSettings) error) (*GuildSettings, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	var settings *GuildSettings
+	err := srv.inTx(ctx, func(tx *sql.Tx) error {
+		// Make sure there is a row to lock
+		defaults := DefaultGuildSettings(guildID)
+		if _, err := tx.ExecContext(ctx, `
+                        INSERT INTO guild_settings
+                                (guild, prefix, locale, timezone, admin_log_channel,
+                                 module_hots, module_run, module_reactrole, module_welcome)
+                        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+                        ON CONFLICT (guild) DO NOTHING`,
+			guildSettingsArgs(defaults)...); err != nil {
+			log.WithError(err).Error("Failed to create guild settings")
+			return err
+		}
+
+		var err error
+		settings, err = scanGuildSettings(guildID, tx.QueryRowContext(ctx, `
+                        SELECT prefix, locale, timezone, admin_log_channel,
+                               module_hots, module_run, module_reactrole, module_welcome
+                        FROM guild_settings WHERE guild = $1 FOR UPDATE`, guildID))
+		if err != nil {
+			log.WithError(err).Error("Failed to fetch guild settings")
+			return err
+		}
+
+		if err := update(settings); err != nil {
+			return err
+		}
+		if err := settings.Validate(); err != nil {
+			return err
+		}
+
+		log.WithField("guild_id", guildID).Debug("Storing guild settings in DB")
+		if _, err := tx.ExecContext(ctx, `
+                        UPDATE guild_settings
+                        SET prefix = $2, locale = $3, timezone = $4, admin_log_channel = $5,
+                            module_hots = $6, module_run = $7, module_reactrole = $8, module_welcome = $9
+                        WHERE guild = $1`,
+			guildSettingsArgs(settings)...); err != nil {
+			log.WithError(err).Error("Failed to store guild settings")
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	srv.settings.set(guildID, settings)
+	return settings.clone(), nil
+}
+
+// GetGuildSettings returns the stored settings of a guild, or ErrNotFound
+// if it hasn't changed any.
+func (srv *DiscordServerStore) GetGuildSettings(ctx context.Context, guildID string) (*GuildSettings, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	log.WithField("guild_id", guildID).Debug("Fetching guild settings from DB")
+	settings, err := scanGuildSettings(guildID, srv.db.QueryRowContext(ctx, `
+                SELECT prefix, locale, timezone, admin_log_channel,
+                       module_hots, module_run, module_reactrole, module_welcome
+                FROM guild_settings WHERE guild = $1`, guildID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storeError(err)
+		}
+		log.WithError(err).Error("Failed to fetch guild settings")
+		return nil, err
+	}
+	return settings, nil
+}
+
+// scanGuildSettings reads the settings selected from guild_settings.
+func scanGuildSettings(guildID string, row *sql.Row) (*GuildSettings, error) {
+	settings := DefaultGuildSettings(guildID)
+	var hots, run, reactrole, welcome bool
+	if err := row.Scan(&settings.Prefix, &settings.Locale, &settings.Timezone, &settings.AdminLogChannel, &hots, &run, &reactrole, &welcome); err != nil {
+		return nil, err
+	}
+	settings.Modules[ModuleHots] = hots
+	settings.Modules[ModuleRun] = run
+	settings.Modules[ModuleReactRole] = reactrole
+	settings.Modules[ModuleWelcome] = welcome
+	settings.location = loadLocation(settings.Timezone)
+	return settings, nil
+}
+
+// guildSettingsArgs are the query arguments for storing the settings, in
+// the order of the guild_settings columns.
+func guildSettingsArgs(g *GuildSettings) []interface{} {
+	return []interface{}{
+		g.GuildID, g.Prefix, string(g.Locale), g.Timezone, g.AdminLogChannel,
+		g.ModuleEnabled(ModuleHots), g.ModuleEnabled(ModuleRun), g.ModuleEnabled(ModuleReactRole), g.ModuleEnabled(ModuleWelcome),
+	}
+}
+
+func (srv *DiscordServerStore) StoreGuildSettings(ctx context.Context, g *GuildSettings) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	log.WithField("guild_id", g.GuildID).Debug("Storing guild settings in DB")
+	_, err := srv.db.ExecContext(ctx, `
+                INSERT INTO guild_settings
+                        (guild, prefix, locale, timezone, admin_log_channel,
+                         module_hots, module_run, module_reactrole, module_welcome)
+                VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+                ON CONFLICT (guild)
+                DO UPDATE SET
+                        prefix = $2, locale = $3, timezone = $4, admin_log_channel = $5,
+                        module_hots = $6, module_run = $7, module_reactrole = $8, module_welcome = $9`,
+		guildSettingsArgs(g)...)
+	if err != nil {
+		log.WithError(err).Error("Failed to store guild settings")
+		return err
+	}
+
+	return nil
+}
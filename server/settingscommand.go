@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// settingsCommand lets admins manage the per-guild settings.
+func settingsCommand(store *DiscordServerStore) *ApplicationCommand {
+
+	moduleChoices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(Modules))
+	for _, module := range Modules {
+		moduleChoices = append(moduleChoices, &discordgo.ApplicationCommandOptionChoice{
+			Name:  string(module),
+			Value: string(module),
+		})
+	}
+
+	cmd := &ApplicationCommand{
+		Name: "settings",
+		Command: &discordgo.ApplicationCommand{
+			Name:        "settings",
+			Description: "Configure the bot for this server",
+			Version:     "1",
+			Type:        discordgo.ChatApplicationCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "show",
+					Description: "Show the current settings",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "prefix",
+					Description: "Set the prefix for text commands",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "prefix",
+							Description: "For example '!'",
+							Required:    true,
+							MaxLength:   8,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "locale",
+					Description: "Set the language of the server",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:         discordgo.ApplicationCommandOptionString,
+							Name:         "locale",
+							Description:  "For example 'en-US'",
+							Required:     true,
+							Autocomplete: true,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "timezone",
+					Description: "Set the time zone times are shown in",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "timezone",
+							Description: "For example 'Europe/Oslo'",
+							Required:    true,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "adminlog",
+					Description: "Set the channel where admin actions are logged",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:         discordgo.ApplicationCommandOptionChannel,
+							Name:         "channel",
+							Description:  "Leave out to stop logging",
+							ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText},
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "module",
+					Description: "Turn a module on or off",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "module",
+							Description: "Module to change",
+							Required:    true,
+							Choices:     moduleChoices,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionBoolean,
+							Name:        "enabled",
+							Description: "Whether the module is on",
+							Required:    true,
+						},
+					},
+				},
+			},
+		},
+		Permission: AdminCommandSettings,
+		store:      store,
+	}
+	cmd.Subcommands = map[string]SubcommandHandler{
+		"show": cmd.settingsShow,
+		"prefix": cmd.settingsUpdate(func(g *GuildSettings, options map[string]*discordgo.ApplicationCommandInteractionDataOption) string {
+			g.Prefix = strings.TrimSpace(options["prefix"].StringValue())
+			return fmt.Sprintf("prefix to `%s`", g.Prefix)
+		}),
+		"locale": cmd.settingsUpdate(func(g *GuildSettings, options map[string]*discordgo.ApplicationCommandInteractionDataOption) string {
+			g.Locale = discordgo.Locale(strings.TrimSpace(options["locale"].StringValue()))
+			return fmt.Sprintf("locale to `%s`", g.Locale)
+		}),
+		"timezone": cmd.settingsUpdate(func(g *GuildSettings, options map[string]*discordgo.ApplicationCommandInteractionDataOption) string {
+			g.Timezone = strings.TrimSpace(options["timezone"].StringValue())
+			return fmt.Sprintf("timezone to `%s`", g.Timezone)
+		}),
+		"adminlog": cmd.settingsUpdate(func(g *GuildSettings, options map[string]*discordgo.ApplicationCommandInteractionDataOption) string {
+			if option, ok := options["channel"]; ok {
+				g.AdminLogChannel = option.ChannelValue(nil).ID
+				return fmt.Sprintf("admin log channel to <#%s>", g.AdminLogChannel)
+			}
+			g.AdminLogChannel = ""
+			return "admin log channel to nothing"
+		}),
+		"module": cmd.settingsUpdate(func(g *GuildSettings, options map[string]*discordgo.ApplicationCommandInteractionDataOption) string {
+			module := Module(options["module"].StringValue())
+			g.Modules[module] = options["enabled"].BoolValue()
+			return fmt.Sprintf("module `%s` to %s", module, onOff(g.Modules[module]))
+		}),
+	}
+	cmd.Autocomplete = cmd.settingsAutocomplete
+
+	return cmd
+}
+
+func (cmd *ApplicationCommand) settingsShow(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags:  discordgo.MessageFlagsEphemeral,
+			Embeds: []*discordgo.MessageEmbed{settingsEmbed(cmd.store.GuildSettings(ctx, event.GuildID))},
+		},
+	})
+}
+
+// settingsUpdate creates a subcommand handler which applies a change to
+// the guild settings and returns a description of the change.
+func (cmd *ApplicationCommand) settingsUpdate(apply func(*GuildSettings, map[string]*discordgo.ApplicationCommandInteractionDataOption) string) SubcommandHandler {
+	return func(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+		var change string
+		var invalid error
+		settings, err := cmd.store.UpdateGuildSettings(ctx, event.GuildID, func(g *GuildSettings) error {
+			change = apply(g, options)
+			invalid = g.Validate()
+			return invalid
+		})
+		if invalid != nil {
+			return respondEphemeral(s, event.Interaction, fmt.Sprintf(":x: Couldn't change the settings: %s", invalid))
+		}
+		if err != nil {
+			log.WithError(err).WithField("guild_id", event.GuildID).Error("Failed to update guild settings")
+			return respondEphemeral(s, event.Interaction, ":x: Couldn't save the settings, try again later.")
+		}
+
+		cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":gear: <@%s> changed the %s", interactionUserID(event), change))
+
+		return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: fmt.Sprintf(":+1: Changed the %s.", change),
+				Flags:   discordgo.MessageFlagsEphemeral,
+				Embeds:  []*discordgo.MessageEmbed{settingsEmbed(settings)},
+			},
+		})
+	}
+}
+
+func (cmd *ApplicationCommand) settingsAutocomplete(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate) error {
+	focused := focusedOption(event.ApplicationCommandData().Options)
+	choices := make([]*discordgo.ApplicationCommandOptionChoice, 0, maxAutocompleteChoices)
+	if focused != nil && focused.Name == "locale" {
+		typed := strings.ToLower(fmt.Sprint(focused.Value))
+		locales := make([]string, 0, len(discordgo.Locales))
+		for locale := range discordgo.Locales {
+			locales = append(locales, string(locale))
+		}
+		sort.Strings(locales)
+		for _, locale := range locales {
+			name := fmt.Sprintf("%s (%s)", discordgo.Locales[discordgo.Locale(locale)], locale)
+			if len(choices) == maxAutocompleteChoices {
+				break
+			}
+			if typed != "" && !strings.Contains(strings.ToLower(name), typed) {
+				continue
+			}
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: name, Value: locale})
+		}
+	}
+
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{
+			Choices: choices,
+		},
+	})
+}
+
+func settingsEmbed(g *GuildSettings) *discordgo.MessageEmbed {
+	adminLog := "_off_"
+	if g.AdminLogChannel != "" {
+		adminLog = fmt.Sprintf("<#%s>", g.AdminLogChannel)
+	}
+	modules := make([]string, 0, len(Modules))
+	for _, module := range Modules {
+		modules = append(modules, fmt.Sprintf("`%s`: %s", module, onOff(g.ModuleEnabled(module))))
+	}
+
+	return &discordgo.MessageEmbed{
+		Title: "Settings",
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "Prefix", Value: fmt.Sprintf("`%s`", g.Prefix), Inline: true},
+			{Name: "Locale", Value: string(g.Locale), Inline: true},
+			{Name: "Timezone", Value: g.Timezone, Inline: true},
+			{Name: "Admin log", Value: adminLog, Inline: true},
+			{Name: "Modules", Value: strings.Join(modules, "\n")},
+		},
+	}
+}
+
+// AdminLog posts a message to the guild's admin log channel, if it has one.
+func (srv *DiscordServerStore) AdminLog(ctx context.Context, s *discordgo.Session, guildID, content string) {
+	channelID := srv.GuildSettings(ctx, guildID).AdminLogChannel
+	if channelID == "" {
+		return
+	}
+	if _, err := s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content:         content,
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	}); err != nil {
+		log.WithError(err).WithField("guild_id", guildID).Warn("Failed to post to admin log channel")
+	}
+}
+
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
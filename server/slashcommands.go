@@ -1,303 +1,703 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	log "github.com/sirupsen/logrus"
 )
 
-type ApplicationCommands struct {
-	Commands map[string]*ApplicationCommand
-}
-
 type ApplicationCommand struct {
-	Name     string
-	ID       string
-	Command  *discordgo.ApplicationCommand
-	store    *DiscordServerStore
-	inFlight map[string]*ReactRoleInteraction
+	Name    string
+	ID      string
+	Command *discordgo.ApplicationCommand
+	// Handler responds to the command being invoked, and to components
+	// on messages created by the command.
+	Handler func(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate) error
+	// Subcommands routes chat input commands by their first option, and
+	// takes precedence over Handler when set. Subcommands in a group are
+	// keyed by "group subcommand".
+	Subcommands map[string]SubcommandHandler
+	// Autocomplete responds to autocomplete interactions for the command.
+	Autocomplete func(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate) error
+	// Reactions, if set, is told about every reaction added to a message,
+	// for commands which wait for the user to react.
+	Reactions func(ctx context.Context, s *discordgo.Session, reaction *discordgo.MessageReactionAdd)
+	// Expire, if set, is called periodically to clean up what users
+	// abandoned, like wizards they never finished.
+	Expire func(ctx context.Context)
+	// Components and Modals are routed by the action of their custom ID,
+	// namespaced by the command name and ComponentVersion.
+	Components       map[string]ComponentHandler
+	Modals           map[string]ComponentHandler
+	ComponentVersion int
+	// Module, if set, is the module which has to be turned on in the guild
+	// for the command to be used.
+	Module Module
+	// Permission, if set, is the admin command the member needs
+	// permission to run to use the command. It is checked by the router
+	// rather than with DefaultMemberPermissions, since Discord would hide
+	// the command from roles allowed with /permissions.
+	Permission string
+	store      *DiscordServerStore
+	inFlight   *wizardsInFlight
 }
 
+// SubcommandHandler handles a single subcommand of a chat input command,
+// with the options of the subcommand keyed by their name.
+type SubcommandHandler func(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error
+
+// Actions a user can take in the reaction role wizard. They are encoded
+// as the action of the component custom IDs, with the ID of the
+// interaction in progress as the payload.
+const (
+	wizardActionRole    = "role"
+	wizardActionPending = "pending"
+	wizardActionEmoji   = "emoji"
+	wizardActionMore    = "more"
+	wizardActionRemove  = "remove"
+	wizardActionSave    = "save"
+	wizardActionCancel  = "cancel"
+)
+
 func AvailableApplicationCommands(store *DiscordServerStore) []*ApplicationCommand {
-	var adminCommandPerm int64
-	adminCommandPerm = discordgo.PermissionManageServer
 	commands := make([]*ApplicationCommand, 0)
-	commands = append(commands, &ApplicationCommand{
+	wizard := &ApplicationCommand{
 		Name: "reactionroleregister",
 		Command: &discordgo.ApplicationCommand{
-			Name:                     "reactionroleregister",
-			Version:                  "1",
-			DefaultMemberPermissions: &adminCommandPerm,
-			Type:                     discordgo.MessageApplicationCommand,
+			Name:    "reactionroleregister",
+			Version: "1",
+			Type:    discordgo.MessageApplicationCommand,
 		},
-		store:    store,
-		inFlight: make(map[string]*ReactRoleInteraction),
-	})
+		ComponentVersion: 2,
+		Module:           ModuleReactRole,
+		Permission:       AdminCommandReactRole,
+		store:            store,
+		inFlight:         newWizardsInFlight(),
+	}
+	wizard.Handler = wizard.respondWizard
+	wizard.Reactions = wizard.wizardReaction
+	wizard.Expire = wizard.expireWizards
+	wizard.Components = map[string]ComponentHandler{
+		wizardActionRole:   wizard.wizardHandler(wizard.wizardRole),
+		wizardActionEmoji:  wizard.wizardHandler(wizard.wizardEmoji),
+		wizardActionMore:   wizard.wizardHandler(wizard.wizardMore),
+		wizardActionRemove: wizard.wizardHandler(wizard.wizardRemove),
+		wizardActionSave:   wizard.wizardHandler(wizard.wizardSave),
+		wizardActionCancel: wizard.wizardHandler(wizard.wizardCancel),
+	}
+	commands = append(commands, wizard)
+	commands = append(commands, reactionRoleCommand(store))
+	commands = append(commands, settingsCommand(store))
+	commands = append(commands, permissionsCommand(store))
+	commands = append(commands, welcomeCommand(store))
+	commands = append(commands, goodbyeCommand(store))
+	commands = append(commands, autoRoleCommand(store))
+	commands = append(commands, verificationCommand(store))
+	commands = append(commands, onboardingCommand(store))
+	commands = append(commands, raidCommand(store))
+	commands = append(commands, modLogCommand(store))
 
 	log.WithField("available_commands", len(commands)).Info("Listing available commands")
 
 	return commands
 }
 
-func (app *ApplicationCommands) HandleApplicationCommands(s *discordgo.Session, event *discordgo.InteractionCreate) {
-	logger := log.WithFields(log.Fields{
-		"interaction_id":   event.Interaction.AppID,
-		"interaction_type": event.Interaction.Type,
-	})
-	logger.Info("Handling application command")
-
-	interaction := event.Interaction
-	logger.Debugf("interaction: %+v", interaction)
-
-	for id, app := range app.Commands {
-		interactionID := app.GetID(event)
-		if interactionID == id {
-			logger.WithField("application_name", app.Name).Debug("this is the app")
-			if err := app.Respond(s, event); err != nil {
-				log.WithError(err).Error("failed to respond")
+// Respond routes an interaction to the autocomplete, subcommand or
+// generic handler of the command.
+func (cmd *ApplicationCommand) Respond(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate) error {
+	switch event.Type {
+	case discordgo.InteractionMessageComponent, discordgo.InteractionModalSubmit:
+		return fmt.Errorf("command %s got a component interaction, those are routed by custom id", cmd.Name)
+	case discordgo.InteractionApplicationCommandAutocomplete:
+		if cmd.Autocomplete == nil {
+			return fmt.Errorf("command %s does not support autocomplete", cmd.Name)
+		}
+		return cmd.Autocomplete(ctx, s, event)
+	case discordgo.InteractionApplicationCommand:
+		if cmd.Subcommands != nil {
+			data := event.ApplicationCommandData()
+			if len(data.Options) == 0 {
+				return fmt.Errorf("missing subcommand for %s", cmd.Name)
 			}
+			sub := data.Options[0]
+			name := sub.Name
+			// Subcommands in groups are routed as "group subcommand"
+			if sub.Type == discordgo.ApplicationCommandOptionSubCommandGroup && len(sub.Options) > 0 {
+				sub = sub.Options[0]
+				name = fmt.Sprintf("%s %s", name, sub.Name)
+			}
+			handler, ok := cmd.Subcommands[name]
+			if !ok {
+				return fmt.Errorf("unknown subcommand %s for %s", name, cmd.Name)
+			}
+			log.WithField("application_name", cmd.Name).WithField("subcommand", name).Debug("Routing subcommand")
+			return handler(ctx, s, event, optionMap(sub.Options))
 		}
 	}
+
+	if cmd.Handler == nil {
+		return fmt.Errorf("command %s has no handler", cmd.Name)
+	}
+	return cmd.Handler(ctx, s, event)
 }
 
-func (cmd *ApplicationCommand) GetID(event *discordgo.InteractionCreate) string {
-	switch event.Type {
-	// When the app is triggered (by clicking msg -> apps -> this app)
-	case discordgo.InteractionApplicationCommand:
-		data := event.ApplicationCommandData()
-		return data.ID
-	case discordgo.InteractionMessageComponent:
-		data := event.MessageComponentData()
-		return strings.Split(data.CustomID, ";")[0]
+// moduleDisabled returns whether the module the command belongs to is
+// turned off in the guild.
+func (cmd *ApplicationCommand) moduleDisabled(ctx context.Context, guildID string) bool {
+	if cmd.Module == "" || cmd.store == nil {
+		return false
 	}
+	return !cmd.store.GuildSettings(ctx, guildID).ModuleEnabled(cmd.Module)
+}
 
-	return ""
+// permissionDenied returns whether the member who triggered the
+// interaction lacks permission to use the command.
+func (cmd *ApplicationCommand) permissionDenied(ctx context.Context, event *discordgo.InteractionCreate) bool {
+	if cmd.Permission == "" || cmd.store == nil {
+		return false
+	}
+	if event.Member == nil {
+		return true
+	}
+	return !cmd.store.CanRunAdminCommand(ctx, event.GuildID, cmd.Permission, event.Member, event.Member.Permissions)
 }
 
-func (cmd *ApplicationCommand) GetAction(event *discordgo.InteractionCreate) ReactRoleAction {
-	var interactionInProgress *ReactRoleInteraction
-	var err error
+// CustomID creates a custom ID routed to one of the command's component
+// or modal handlers.
+func (cmd *ApplicationCommand) CustomID(action string, payload ...string) CustomID {
+	return NewCustomID(cmd.Name, cmd.ComponentVersion, action, payload...)
+}
 
-	switch event.Data.Type() {
-	case discordgo.InteractionApplicationCommand:
-		data := event.ApplicationCommandData()
-		interactionInProgress, err = cmd.store.GetReactRoleInteractionProgress(data.ID)
-		if err != nil {
-			log.WithError(err).Error("Failed to get action")
-		}
-	case discordgo.InteractionMessageComponent:
-		id := strings.Split(event.MessageComponentData().CustomID, ";")[1]
-		interactionInProgress, err = cmd.store.GetReactRoleInteractionProgress(id)
-		if err != nil {
-			log.WithError(err).Error("Failed to get action")
-		}
+func (cmd *ApplicationCommand) customID(wip *ReactRoleInteraction, action string) string {
+	return cmd.CustomID(action, wip.ID).String()
+}
+
+func (cmd *ApplicationCommand) respondWizard(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate) error {
+	log.Info("Responding to interaction")
+	interaction := event.Interaction
+
+	data := interaction.ApplicationCommandData()
+	wip := ReactRoleInteraction{
+		GuildID:   event.GuildID,
+		UserID:    interactionUserID(event),
+		ChannelID: event.ChannelID,
+		MessageID: data.TargetID,
+	}
+	id, err := cmd.store.CreateReactRoleInteractionProgress(ctx, &wip)
+	if err != nil {
+		log.WithError(err).Error("failed to create interaction in progress")
+		return respondEphemeral(s, interaction, ":robot: Something went wrong, try again later.")
+	}
+	wip.ID = id
+	cmd.inFlight.touch(id)
+
+	response := discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content:    "Adding reactions to this message which allow users to get roles when clicking them. First, select a role:",
+			Flags:      discordgo.MessageFlagsEphemeral,
+			Components: cmd.roleSelectComponents(&wip),
+		},
 	}
 
-	return interactionInProgress.GetAction()
+	return s.InteractionRespond(interaction, &response)
 }
 
-func (cmd *ApplicationCommand) GetInProgressID(event *discordgo.InteractionCreate) string {
-	var interactionInProgress *ReactRoleInteraction
-	var err error
+// wizardStep is a single step of the reaction role wizard, with the
+// interaction in progress loaded.
+type wizardStep func(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, wip *ReactRoleInteraction) error
+
+// wizardTTL is how long a wizard may sit untouched before it is
+// abandoned. Discord stops accepting edits to the wizard's message after
+// 15 minutes anyway.
+const wizardTTL = 15 * time.Minute
+
+// maxWizardPairs is the most pairs a wizard collects, since Discord allows
+// 20 different reactions on a message.
+const maxWizardPairs = 20
+
+// wizardsInFlight keeps what can't be stored with the progress of
+// wizards: the wizards waiting for their emoji, a lock per wizard and
+// when each was last touched. Component and reaction handlers run
+// concurrently, so it is safe for concurrent use.
+type wizardsInFlight struct {
+	mu        sync.Mutex
+	listeners map[string]*wizardListener
+	locks     map[string]*sync.Mutex
+	touched   map[string]time.Time
+}
 
-	switch event.Data.Type() {
-	case discordgo.InteractionApplicationCommand:
-		data := event.ApplicationCommandData()
-		interactionInProgress, err = cmd.store.GetReactRoleInteractionProgress(data.ID)
-		if err != nil {
-			log.WithError(err).Error("Failed to get current int progress id")
-		}
-	case discordgo.InteractionMessageComponent:
-		id := strings.Split(event.MessageComponentData().CustomID, ";")[1]
-		log.WithField("id", id).Debug("Got ID")
-		interactionInProgress, err = cmd.store.GetReactRoleInteractionProgress(id)
-		if err != nil {
-			log.WithError(err).Error("Failed to get current int progress id")
-		}
+// wizardListener is a wizard waiting for its user to react to the
+// message it adds reaction roles to.
+type wizardListener struct {
+	id          string
+	channelID   string
+	messageID   string
+	userID      string
+	interaction *discordgo.Interaction
+}
+
+func newWizardsInFlight() *wizardsInFlight {
+	return &wizardsInFlight{
+		listeners: make(map[string]*wizardListener),
+		locks:     make(map[string]*sync.Mutex),
+		touched:   make(map[string]time.Time),
 	}
+}
 
-	return interactionInProgress.ID
+// touch records that a wizard is being used, so it isn't abandoned.
+func (w *wizardsInFlight) touch(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.touched[id] = time.Now()
 }
 
-func (cmd *ApplicationCommand) Respond(s *discordgo.Session, event *discordgo.InteractionCreate) error {
-	log.Info("Responding to interaction")
-	interaction := event.Interaction
+// idle returns the wizards which haven't been touched since the time.
+func (w *wizardsInFlight) idle(since time.Time) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	switch event.Type {
-	case discordgo.InteractionApplicationCommand:
-		data := interaction.ApplicationCommandData()
-		wip := ReactRoleInteraction{
-			ChannelID: event.ChannelID,
-			MessageID: data.TargetID,
-		}
-		id, err := cmd.store.CreateReactRoleInteractionProgress(&wip)
-		wip.ID = id
-		if err != nil {
-			log.WithError(err).Error("failed to create interaction in progress")
-		}
-		v := discordgo.InteractionResponseChannelMessageWithSource
-		response := discordgo.InteractionResponse{
-			Type: v,
-			Data: &discordgo.InteractionResponseData{
-				Content: "Adding a reaction to this message which allows users to get the selected role when clicking it. First, select a role:",
-				Flags:   discordgo.MessageFlagsEphemeral,
-				Components: []discordgo.MessageComponent{
-					discordgo.ActionsRow{
-						Components: []discordgo.MessageComponent{
-							discordgo.SelectMenu{
-								MenuType: discordgo.RoleSelectMenu,
-								CustomID: fmt.Sprintf("%s;%s", cmd.ID, wip.ID),
-							},
-						},
-					},
-				},
-			},
+	ids := make([]string, 0)
+	for id, touched := range w.touched {
+		if touched.Before(since) {
+			ids = append(ids, id)
 		}
+	}
+	return ids
+}
 
-		return s.InteractionRespond(interaction, &response)
+// idleSince returns whether the wizard hasn't been touched since the
+// time.
+func (w *wizardsInFlight) idleSince(id string, since time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	touched, ok := w.touched[id]
+	return ok && touched.Before(since)
+}
 
-	case discordgo.InteractionMessageComponent:
-		logger := log.WithField("event", "messagelol")
-		logger.Info("Respond message component")
+// active returns the wizards which are in flight.
+func (w *wizardsInFlight) active() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-		data := event.MessageComponentData()
+	ids := make([]string, 0, len(w.touched))
+	for id := range w.touched {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// lock locks a wizard, and returns the function to unlock it.
+func (w *wizardsInFlight) lock(id string) func() {
+	w.mu.Lock()
+	l, ok := w.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		w.locks[id] = l
+	}
+	w.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// listen makes a wizard wait for a reaction, replacing what it waited
+// for before.
+func (w *wizardsInFlight) listen(l *wizardListener) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.listeners[l.id] = l
+}
+
+// stop stops a wizard from waiting for a reaction.
+func (w *wizardsInFlight) stop(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.listeners, id)
+}
+
+// waiting returns whether the wizard is still waiting for the reaction it
+// was listening for.
+func (w *wizardsInFlight) waiting(l *wizardListener) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.listeners[l.id] == l
+}
+
+// listening returns the wizards waiting for the user to react to the
+// message.
+func (w *wizardsInFlight) listening(channelID, messageID, userID string) []*wizardListener {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	listeners := make([]*wizardListener, 0)
+	for _, l := range w.listeners {
+		if l.channelID == channelID && l.messageID == messageID && (l.userID == "" || l.userID == userID) {
+			listeners = append(listeners, l)
+		}
+	}
+	return listeners
+}
 
-		id := cmd.GetInProgressID(event)
-		logger = logger.WithFields(log.Fields{
+// finish forgets a wizard which is done.
+func (w *wizardsInFlight) finish(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.listeners, id)
+	delete(w.locks, id)
+	delete(w.touched, id)
+}
+
+// wizardHandler loads the interaction in progress from the custom ID
+// payload, and makes sure only the user who started the wizard drives it.
+func (cmd *ApplicationCommand) wizardHandler(step wizardStep) ComponentHandler {
+	return func(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, customID CustomID) error {
+		if len(customID.Payload) != 1 {
+			return fmt.Errorf("%w: expected interaction in progress id", ErrInvalidCustomID)
+		}
+		id := customID.Payload[0]
+		logger := log.WithFields(log.Fields{
 			"in_progress_id": id,
+			"action":         customID.Action,
 		})
+		logger.Info("Respond message component")
 
-		var emojiHandlerCancel func()
-		if cmd.inFlight[id] != nil {
-			emojiHandlerCancel = cmd.inFlight[id].emojiHandler
+		// Steps of a wizard are taken one at a time, so they don't
+		// overwrite each other's progress
+		unlock := cmd.inFlight.lock(id)
+		defer unlock()
+
+		wip, err := cmd.store.GetReactRoleInteractionProgress(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			cmd.inFlight.finish(id)
+			return respondEphemeral(s, event.Interaction, ":robot: This wizard has expired, please start over.")
 		}
-		wip, err := cmd.store.GetReactRoleInteractionProgress(id)
 		if err != nil {
 			return err
 		}
-		cmd.inFlight[id] = wip
-		cmd.inFlight[id].emojiHandler = emojiHandlerCancel
+		if wip.UserID != "" && wip.UserID != interactionUserID(event) {
+			logger.WithField("user_id", interactionUserID(event)).Warn("User tried to drive someone else's wizard")
+			return respondEphemeral(s, event.Interaction, ":robot: Only the person who started this wizard can use it.")
+		}
+		cmd.inFlight.touch(id)
 
-		action := cmd.GetAction(event)
-		logger = log.WithFields(log.Fields{
-			"action": action,
-		})
+		return step(ctx, s, event, wip)
+	}
+}
 
-		switch action {
-		case RoleSelect:
-			roles := make([]string, 0)
-			for _, role := range data.Resolved.Roles {
-				roles = append(roles, role.ID)
-			}
-			roleIDs := strings.Join(roles, ",")
-			wip.RoleID = roleIDs
-			if err := cmd.store.StoreReactRoleInteractionProgress(wip); err != nil {
-				return err
-			}
+func (cmd *ApplicationCommand) wizardRole(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, wip *ReactRoleInteraction) error {
+	data := event.MessageComponentData()
+	if len(data.Values) == 0 {
+		return respondEphemeral(s, event.Interaction, ":robot: Select a role to continue.")
+	}
+	wip.RoleID = data.Values[0]
+	wip.EmojiID = ""
+	if err := cmd.store.StoreReactRoleInteractionProgress(ctx, wip); err != nil {
+		return err
+	}
 
-			logger.Info("Role collected, prompting for emoji")
+	log.WithField("in_progress_id", wip.ID).Info("Role collected, prompting for emoji")
 
-			handler := s.AddHandler(func(s *discordgo.Session, m *discordgo.MessageReactionAdd) {
-				cmd.roleReactInteractionEmojiHandler(s, m, event)
-			})
-			cmd.inFlight[id].emojiHandler = handler
+	cmd.inFlight.listen(&wizardListener{
+		id:          wip.ID,
+		channelID:   wip.ChannelID,
+		messageID:   wip.MessageID,
+		userID:      wip.UserID,
+		interaction: event.Interaction,
+	})
 
-			v := discordgo.InteractionResponseChannelMessageWithSource
-			response := discordgo.InteractionResponse{
-				Type: v,
-				Data: &discordgo.InteractionResponseData{
-					Content: "Add the emoji you want to use to the original message (where you want the user to click)",
-					Flags:   discordgo.MessageFlagsEphemeral,
+	response := discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content: fmt.Sprintf("Add the emoji you want to use for <@&%s> to the original message (where you want the user to click)", wip.RoleID),
+			Embeds:  []*discordgo.MessageEmbed{},
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{
 					Components: []discordgo.MessageComponent{
-						discordgo.ActionsRow{
-							Components: []discordgo.MessageComponent{
-								discordgo.Button{
-									Label:    "Add an emoji",
-									Style:    discordgo.SecondaryButton,
-									CustomID: "Nothing",
-									Disabled: true,
-								},
-							},
+						discordgo.Button{
+							Label:    "Add an emoji",
+							Style:    discordgo.SecondaryButton,
+							CustomID: cmd.customID(wip, wizardActionPending),
+							Disabled: true,
+						},
+						discordgo.Button{
+							Label:    "Cancel",
+							Style:    discordgo.SecondaryButton,
+							CustomID: cmd.customID(wip, wizardActionCancel),
 						},
 					},
 				},
-			}
+			},
+		},
+	}
 
-			return s.InteractionRespond(interaction, &response)
-
-			// case EmojiSelect:
-			// Handled by roleReactInteractionEmojiHandler
-
-		case Confirm:
-			logger = logger.WithFields(log.Fields{
-				"channel_id": wip.ChannelID,
-				"message_id": wip.MessageID,
-				"role_id":    wip.RoleID,
-				"emoji":      wip.EmojiID,
-			})
-			logger.Info("Saving role reaction")
-
-			if err := cmd.store.StoreReactRole(ReactRole{
-				Message: &ReactRoleMessage{
-					GuildID:   interaction.GuildID,
-					ChannelID: wip.ChannelID,
-					ID:        wip.MessageID,
-				},
-				Role:  wip.RoleID,
-				Emoji: wip.EmojiID,
-			}); err != nil {
-				logger.WithError(err).Error("failed to store emoji in db")
-				return fmt.Errorf("failed to store reaction role in db")
-			}
+	return s.InteractionRespond(event.Interaction, &response)
+}
 
-			if !IsUnicodeEmoji(wip.EmojiID) {
-				emojiID, err := s.State.Emoji(interaction.GuildID, wip.EmojiID)
-				if err != nil {
-					logger.WithError(err).Error("failed to get emoji")
-				}
-				wip.EmojiID = emojiID.APIName()
-			}
+func (cmd *ApplicationCommand) wizardEmoji(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, wip *ReactRoleInteraction) error {
+	// The emoji itself was collected by wizardReaction
+	if wip.RoleID == "" || wip.EmojiID == "" {
+		return respondEphemeral(s, event.Interaction, ":robot: Pick a role and an emoji first.")
+	}
+	cmd.inFlight.stop(wip.ID)
+	wip.AddBinding(wip.EmojiID, wip.RoleID)
+	wip.RoleID = ""
+	wip.EmojiID = ""
+	if err := cmd.store.StoreReactRoleInteractionProgress(ctx, wip); err != nil {
+		return err
+	}
+	return cmd.respondReview(s, event.Interaction, wip, "")
+}
 
-			if err := s.MessageReactionsRemoveEmoji(wip.ChannelID, wip.MessageID, wip.EmojiID); err != nil {
-				logger.WithError(err).Errorf("Failed to clear message of reaction %s", wip.EmojiID)
-			}
-			if err := s.MessageReactionAdd(wip.ChannelID, wip.MessageID, wip.EmojiID); err != nil {
-				logger.WithError(err).Errorf("Failed to react to message with reaction %s", wip.EmojiID)
-			}
+func (cmd *ApplicationCommand) wizardMore(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, wip *ReactRoleInteraction) error {
+	cmd.inFlight.stop(wip.ID)
+	if len(wip.Bindings) >= maxWizardPairs {
+		return cmd.respondReview(s, event.Interaction, wip, "")
+	}
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    "Select the next role:",
+			Embeds:     []*discordgo.MessageEmbed{},
+			Components: cmd.roleSelectComponents(wip),
+		},
+	})
+}
+
+func (cmd *ApplicationCommand) wizardRemove(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, wip *ReactRoleInteraction) error {
+	data := event.MessageComponentData()
+	if len(data.Values) == 0 {
+		return cmd.respondReview(s, event.Interaction, wip, "")
+	}
+	idx, err := strconv.Atoi(data.Values[0])
+	if err != nil || idx < 0 || idx >= len(wip.Bindings) {
+		return cmd.respondReview(s, event.Interaction, wip, ":warning: Couldn't find that pair.")
+	}
+	removed := wip.Bindings[idx]
+	wip.Bindings = append(wip.Bindings[:idx], wip.Bindings[idx+1:]...)
+	if err := cmd.store.StoreReactRoleInteractionProgress(ctx, wip); err != nil {
+		return err
+	}
+	return cmd.respondReview(s, event.Interaction, wip, fmt.Sprintf("Removed %s → <@&%s>", renderEmoji(s, wip.GuildID, removed.Emoji), removed.Role))
+}
+
+func (cmd *ApplicationCommand) wizardSave(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, wip *ReactRoleInteraction) error {
+	cmd.inFlight.stop(wip.ID)
+	if len(wip.Bindings) == 0 {
+		return cmd.respondReview(s, event.Interaction, wip, ":warning: Add at least one emoji and role first.")
+	}
+	logger := log.WithFields(log.Fields{
+		"in_progress_id": wip.ID,
+		"channel_id":     wip.ChannelID,
+		"message_id":     wip.MessageID,
+		"bindings":       len(wip.Bindings),
+	})
+	logger.Info("Saving role reactions")
+
+	rrs := make([]ReactRole, 0, len(wip.Bindings))
+	for _, binding := range wip.Bindings {
+		rrs = append(rrs, ReactRole{
+			Message: &ReactRoleMessage{
+				GuildID:   event.GuildID,
+				ChannelID: wip.ChannelID,
+				ID:        wip.MessageID,
+			},
+			Role:  binding.Role,
+			Emoji: binding.Emoji,
+		})
+	}
+	if err := cmd.store.StoreReactRoles(ctx, rrs); err != nil {
+		logger.WithError(err).Error("failed to store reaction roles in db")
+		return cmd.respondReview(s, event.Interaction, wip, ":x: Failed to save, nothing was changed. Try again?")
+	}
+
+	for _, binding := range wip.Bindings {
+		if err := s.MessageReactionsRemoveEmoji(wip.ChannelID, wip.MessageID, binding.Emoji); err != nil {
+			logger.WithError(err).Errorf("Failed to clear message of reaction %s", binding.Emoji)
+		}
+		if err := s.MessageReactionAdd(wip.ChannelID, wip.MessageID, binding.Emoji); err != nil {
+			logger.WithError(err).Errorf("Failed to react to message with reaction %s", binding.Emoji)
+		}
+	}
+
+	cmd.finishWizard(ctx, wip)
+
+	embed := wip.summaryEmbed(s)
+	embed.Title = ":+1: Reaction roles saved"
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    "",
+			Embeds:     []*discordgo.MessageEmbed{embed},
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+}
+
+func (cmd *ApplicationCommand) wizardCancel(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, wip *ReactRoleInteraction) error {
+	cmd.inFlight.stop(wip.ID)
+	cmd.finishWizard(ctx, wip)
+
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    ":robot: Cancelled, nothing was changed.",
+			Embeds:     []*discordgo.MessageEmbed{},
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+}
+
+func (cmd *ApplicationCommand) finishWizard(ctx context.Context, wip *ReactRoleInteraction) {
+	if err := cmd.store.DeleteReactRoleInteractionProgress(ctx, wip.ID); err != nil {
+		log.WithError(err).WithField("in_progress_id", wip.ID).Warn("failed to clean up interaction in progress")
+	}
+	cmd.inFlight.finish(wip.ID)
+}
 
-			v := discordgo.InteractionResponseChannelMessageWithSource
-			response := discordgo.InteractionResponse{
-				Type: v,
-				Data: &discordgo.InteractionResponseData{
-					Content: fmt.Sprintf(":+1: Granting %s when user clicks on %s below this message: %s/%s", wip.RoleID, wip.EmojiID, wip.ChannelID, wip.MessageID),
-					Flags:   discordgo.MessageFlagsEphemeral,
+func (cmd *ApplicationCommand) roleSelectComponents(wip *ReactRoleInteraction) []discordgo.MessageComponent {
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					MenuType: discordgo.RoleSelectMenu,
+					CustomID: cmd.customID(wip, wizardActionRole),
 				},
+			},
+		},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Cancel",
+					Style:    discordgo.SecondaryButton,
+					CustomID: cmd.customID(wip, wizardActionCancel),
+				},
+			},
+		},
+	}
+}
+
+// respondReview updates the wizard message with a summary of the pairs
+// collected so far, and the buttons to add more, remove, save or cancel.
+func (cmd *ApplicationCommand) respondReview(s *discordgo.Session, interaction *discordgo.Interaction, wip *ReactRoleInteraction, content string) error {
+	if content == "" && len(wip.Bindings) >= maxWizardPairs {
+		content = fmt.Sprintf(":robot: A message can only have %d different reactions. Save these, or remove a pair to add another.", maxWizardPairs)
+	}
+	buttons := []discordgo.MessageComponent{
+		discordgo.Button{
+			Label:    "Add another",
+			Style:    discordgo.SecondaryButton,
+			CustomID: cmd.customID(wip, wizardActionMore),
+			Disabled: len(wip.Bindings) >= maxWizardPairs,
+		},
+		discordgo.Button{
+			Label:    "Save",
+			Style:    discordgo.SuccessButton,
+			CustomID: cmd.customID(wip, wizardActionSave),
+			Disabled: len(wip.Bindings) == 0,
+		},
+		discordgo.Button{
+			Label:    "Cancel",
+			Style:    discordgo.DangerButton,
+			CustomID: cmd.customID(wip, wizardActionCancel),
+		},
+	}
+	components := []discordgo.MessageComponent{}
+
+	if len(wip.Bindings) > 0 {
+		options := make([]discordgo.SelectMenuOption, 0, len(wip.Bindings))
+		for i, binding := range wip.Bindings {
+			option := discordgo.SelectMenuOption{
+				Label: fmt.Sprintf("Remove pair #%d", i+1),
+				Value: strconv.Itoa(i),
 			}
-			if err := s.InteractionRespond(interaction, &response); err != nil {
-				logger.WithError(err).Error("failed to acknowledge emoji add flow")
+			if role, err := s.State.Role(wip.GuildID, binding.Role); err == nil {
+				option.Description = fmt.Sprintf("Grants @%s", role.Name)
 			}
-			wip.emojiHandler()
+			option.Emoji = componentEmoji(binding.Emoji)
+			options = append(options, option)
 		}
+		components = append(components, discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					MenuType:    discordgo.StringSelectMenu,
+					CustomID:    cmd.customID(wip, wizardActionRemove),
+					Placeholder: "Remove a pair",
+					Options:     options,
+				},
+			},
+		})
 	}
-	return nil
+	components = append(components, discordgo.ActionsRow{Components: buttons})
+
+	return s.InteractionRespond(interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    content,
+			Embeds:     []*discordgo.MessageEmbed{wip.summaryEmbed(s)},
+			Components: components,
+		},
+	})
 }
 
-func (cmd *ApplicationCommand) roleReactInteractionEmojiHandler(s *discordgo.Session, m *discordgo.MessageReactionAdd, event *discordgo.InteractionCreate) {
-	id := cmd.GetInProgressID(event)
-	interactionInProgress, err := cmd.store.GetReactRoleInteractionProgress(id)
+// expireWizards abandons the wizards nobody touched in wizardTTL: they
+// stop waiting for a reaction, and their progress is deleted. So is
+// progress left behind by wizards from before the bot restarted.
+func (cmd *ApplicationCommand) expireWizards(ctx context.Context) {
+	since := time.Now().Add(-wizardTTL)
+	for _, id := range cmd.inFlight.idle(since) {
+		unlock := cmd.inFlight.lock(id)
+		// The wizard may have been used while we waited for the lock
+		if cmd.inFlight.idleSince(id, since) {
+			log.WithField("in_progress_id", id).Info("Wizard was abandoned")
+			cmd.finishWizard(ctx, &ReactRoleInteraction{ID: id})
+		}
+		unlock()
+	}
+
+	deleted, err := cmd.store.DeleteReactRoleInteractionsBefore(ctx, since, cmd.inFlight.active())
 	if err != nil {
-		log.WithError(err).Error("failed to get interaction in progress")
+		log.WithError(err).Warn("Failed to delete abandoned interactions in progress")
+	} else if deleted > 0 {
+		log.Infof("Deleted %d abandoned interactions in progress", deleted)
 	}
-	logger := log.WithFields(log.Fields{
-		"in_progress_id": id,
-	})
+}
 
-	if m.ChannelID != interactionInProgress.ChannelID || m.MessageID != interactionInProgress.MessageID {
+// wizardReaction collects the emoji for the wizards waiting for the user
+// to react to the message.
+func (cmd *ApplicationCommand) wizardReaction(ctx context.Context, s *discordgo.Session, m *discordgo.MessageReactionAdd) {
+	for _, l := range cmd.inFlight.listening(m.ChannelID, m.MessageID, m.UserID) {
+		cmd.roleReactInteractionEmojiHandler(ctx, s, m, l)
+	}
+}
+
+func (cmd *ApplicationCommand) roleReactInteractionEmojiHandler(ctx context.Context, s *discordgo.Session, m *discordgo.MessageReactionAdd, l *wizardListener) {
+	unlock := cmd.inFlight.lock(l.id)
+	defer unlock()
+	// The wizard may have moved on while we waited for the lock
+	if !cmd.inFlight.waiting(l) {
 		return
 	}
 
+	interactionInProgress, err := cmd.store.GetReactRoleInteractionProgress(ctx, l.id)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.WithError(err).Error("failed to get interaction in progress")
+		}
+		return
+	}
+	cmd.inFlight.touch(l.id)
+	logger := log.WithFields(log.Fields{
+		"in_progress_id": l.id,
+	})
+
 	logger.Debug("Handling emoji/message selector")
 
 	buttonText := "Add this emoji"
@@ -309,18 +709,18 @@ func (cmd *ApplicationCommand) roleReactInteractionEmojiHandler(s *discordgo.Ses
 		emojiID = m.Emoji.Name
 	}
 
-	if !GuildHasEmoji(emojiID, event.GuildID, s) {
+	if !GuildHasEmoji(emojiID, m.GuildID, s) {
 		buttonText = "That emoji is invalid! Pick another one."
 		buttonStyle = discordgo.DangerButton
 		buttonEnabled = false
 	}
 
-	msg, err := s.InteractionResponseEdit(event.Interaction, &discordgo.WebhookEdit{
+	msg, err := s.InteractionResponseEdit(l.interaction, &discordgo.WebhookEdit{
 		Components: &[]discordgo.MessageComponent{
 			discordgo.ActionsRow{
 				Components: []discordgo.MessageComponent{
 					discordgo.Button{
-						CustomID: fmt.Sprintf("%s;%s", cmd.ID, interactionInProgress.ID),
+						CustomID: cmd.customID(interactionInProgress, wizardActionEmoji),
 						Emoji: &discordgo.ComponentEmoji{
 							Name:     m.Emoji.Name,
 							ID:       m.Emoji.ID,
@@ -330,6 +730,11 @@ func (cmd *ApplicationCommand) roleReactInteractionEmojiHandler(s *discordgo.Ses
 						Label:    buttonText,
 						Style:    buttonStyle,
 					},
+					discordgo.Button{
+						Label:    "Cancel",
+						Style:    discordgo.SecondaryButton,
+						CustomID: cmd.customID(interactionInProgress, wizardActionCancel),
+					},
 				},
 			},
 		},
@@ -339,6 +744,96 @@ func (cmd *ApplicationCommand) roleReactInteractionEmojiHandler(s *discordgo.Ses
 		return
 	}
 
-	interactionInProgress.EmojiID = emojiID // TODO: use APIName() here
-	cmd.store.StoreReactRoleInteractionProgress(interactionInProgress)
+	interactionInProgress.EmojiID = m.Emoji.APIName()
+	cmd.store.StoreReactRoleInteractionProgress(ctx, interactionInProgress)
+}
+
+// summaryEmbed renders the pairs collected in the wizard with real role
+// mentions and emoji.
+func (i *ReactRoleInteraction) summaryEmbed(s *discordgo.Session) *discordgo.MessageEmbed {
+	lines := make([]string, 0, len(i.Bindings))
+	for _, binding := range i.Bindings {
+		lines = append(lines, fmt.Sprintf("%s → <@&%s>", renderEmoji(s, i.GuildID, binding.Emoji), binding.Role))
+	}
+	description := strings.Join(lines, "\n")
+	if description == "" {
+		description = "_No pairs added yet_"
+	}
+	return &discordgo.MessageEmbed{
+		Title:       "Reaction roles",
+		Description: description,
+		Fields: []*discordgo.MessageEmbedField{
+			{
+				Name:  "Message",
+				Value: MessageLink(&discordgo.Message{GuildID: i.GuildID, ChannelID: i.ChannelID, ID: i.MessageID}),
+			},
+		},
+	}
+}
+
+// renderEmoji turns an emoji API name (`name:id` or a unicode emoji) into
+// something that renders in message content and embeds.
+func renderEmoji(s *discordgo.Session, guildID, apiName string) string {
+	parts := strings.Split(apiName, ":")
+	if len(parts) != 2 {
+		return apiName
+	}
+	if s != nil {
+		if emoji, err := s.State.Emoji(guildID, parts[1]); err == nil {
+			return emoji.MessageFormat()
+		}
+	}
+	return fmt.Sprintf("<:%s>", apiName)
+}
+
+func componentEmoji(apiName string) *discordgo.ComponentEmoji {
+	parts := strings.Split(apiName, ":")
+	if len(parts) == 2 {
+		return &discordgo.ComponentEmoji{Name: parts[0], ID: parts[1]}
+	}
+	return &discordgo.ComponentEmoji{Name: apiName}
+}
+
+func interactionUserID(event *discordgo.InteractionCreate) string {
+	if event.Member != nil && event.Member.User != nil {
+		return event.Member.User.ID
+	}
+	if event.User != nil {
+		return event.User.ID
+	}
+	return ""
+}
+
+func respondEphemeral(s *discordgo.Session, interaction *discordgo.Interaction, content string) error {
+	return s.InteractionRespond(interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+}
+
+func optionMap(options []*discordgo.ApplicationCommandInteractionDataOption) map[string]*discordgo.ApplicationCommandInteractionDataOption {
+	m := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(options))
+	for _, option := range options {
+		m[option.Name] = option
+	}
+	return m
+}
+
+// focusedOption returns the option the user is currently typing in during
+// an autocomplete interaction, descending into subcommands.
+func focusedOption(options []*discordgo.ApplicationCommandInteractionDataOption) *discordgo.ApplicationCommandInteractionDataOption {
+	for _, option := range options {
+		if option.Focused {
+			return option
+		}
+		if option.Type == discordgo.ApplicationCommandOptionSubCommand || option.Type == discordgo.ApplicationCommandOptionSubCommandGroup {
+			if focused := focusedOption(option.Options); focused != nil {
+				return focused
+			}
+		}
+	}
+	return nil
 }
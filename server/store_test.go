@@ -0,0 +1,437 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/sklirg/tardis/cmd/migrate"
+	"github.com/sklirg/tardis/server"
+)
+
+// The store tests run against a real postgres database, which they
+// migrate. Point TARDIS_TEST_DATABASE_URL to a disposable one to run them.
+const testDatabaseEnv = "TARDIS_TEST_DATABASE_URL"
+
+var migrateOnce struct {
+	sync.Once
+	err error
+}
+
+// testStore connects to the test database, or skips the test if there
+// isn't one.
+func testStore(t *testing.T) *server.DiscordServerStore {
+	t.Helper()
+	url := os.Getenv(testDatabaseEnv)
+	if url == "" {
+		t.Skipf("%s isn't set", testDatabaseEnv)
+	}
+
+	migrateOnce.Do(func() {
+		migrateOnce.err = migrate.Up(url)
+	})
+	if migrateOnce.err != nil {
+		t.Fatalf("failed to migrate test database: %s", migrateOnce.err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	db, err := server.Connect(ctx, url, server.DefaultPoolOptions)
+	if err != nil {
+		t.Fatalf("failed to connect to test database: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return server.NewDiscordServerStore(db)
+}
+
+// testGuildID returns a guild ID no other test uses, so tests don't see
+// each other's rows.
+func testGuildID() string {
+	return fmt.Sprint(time.Now().UnixNano())
+}
+
+func TestGetMissingReturnsErrNotFound(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+	guildID := testGuildID()
+
+	gets := map[string]func() error{
+		"GetReactRolesForMessage": func() error {
+			_, err := store.GetReactRolesForMessage(ctx, server.ReactRoleMessage{GuildID: guildID, ChannelID: "1", ID: "1"})
+			return err
+		},
+		"GetWelcomeChannel": func() error {
+			_, err := store.GetWelcomeChannel(ctx, guildID)
+			return err
+		},
+		"GetGuildSettings": func() error {
+			_, err := store.GetGuildSettings(ctx, guildID)
+			return err
+		},
+		"GetCommandPermission": func() error {
+			_, err := store.GetCommandPermission(ctx, guildID, "welcome")
+			return err
+		},
+		"GetGoodbyeChannel": func() error {
+			_, err := store.GetGoodbyeChannel(ctx, guildID)
+			return err
+		},
+		"GetModLog": func() error {
+			_, err := store.GetModLog(ctx, guildID)
+			return err
+		},
+		"GetOnboardingReminders": func() error {
+			_, err := store.GetOnboardingReminders(ctx, guildID)
+			return err
+		},
+		"GetRaidProtection": func() error {
+			_, err := store.GetRaidProtection(ctx, guildID)
+			return err
+		},
+		"GetVerification": func() error {
+			_, err := store.GetVerification(ctx, guildID)
+			return err
+		},
+		"GetReactRoleInteractionProgress": func() error {
+			_, err := store.GetReactRoleInteractionProgress(ctx, "00000000-0000-0000-0000-000000000000")
+			return err
+		},
+	}
+	for name, get := range gets {
+		t.Run(name, func(t *testing.T) {
+			if err := get(); !errors.Is(err, server.ErrNotFound) {
+				t.Errorf("got %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestCachedLookupsOfMissingReturnNil(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+	guildID := testGuildID()
+
+	if w, err := store.WelcomeChannel(ctx, guildID); err != nil || w != nil {
+		t.Errorf("WelcomeChannel() = %v, %v, want nil, nil", w, err)
+	}
+	if m, err := store.ModLog(ctx, guildID); err != nil || m != nil {
+		t.Errorf("ModLog() = %v, %v, want nil, nil", m, err)
+	}
+	if got, want := store.GuildSettings(ctx, guildID).Prefix, server.DefaultGuildSettings(guildID).Prefix; got != want {
+		t.Errorf("GuildSettings().Prefix = %q, want the default %q", got, want)
+	}
+}
+
+func TestStoreReactRole(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+	rm := server.ReactRoleMessage{GuildID: testGuildID(), ChannelID: "2", ID: "3"}
+
+	if err := store.StoreReactRole(ctx, server.ReactRole{Message: &rm, Emoji: "👍", Role: "4"}); err != nil {
+		t.Fatalf("StoreReactRole() = %s", err)
+	}
+	err := store.StoreReactRole(ctx, server.ReactRole{Message: &rm, Emoji: "👍", Role: "5"})
+	if !errors.Is(err, server.ErrConflict) {
+		t.Errorf("storing the emoji again = %v, want ErrConflict", err)
+	}
+
+	roles, err := store.GetReactRolesForMessage(ctx, rm)
+	if err != nil {
+		t.Fatalf("GetReactRolesForMessage() = %s", err)
+	}
+	if len(roles) != 1 || roles[0].Emoji != "👍" || roles[0].Role != "4" {
+		t.Errorf("got %+v, want 👍 to give role 4", roles)
+	}
+
+	deleted, err := store.DeleteReactRole(ctx, rm, "👍")
+	if err != nil || !deleted {
+		t.Fatalf("DeleteReactRole() = %v, %v, want true, nil", deleted, err)
+	}
+	if _, err := store.GetReactRolesForMessage(ctx, rm); !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("after deleting got %v, want ErrNotFound", err)
+	}
+}
+
+func TestGetReactionRolesForGuild(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+	guildID, otherGuildID := testGuildID(), testGuildID()
+
+	for _, rr := range []server.ReactRole{
+		{Message: &server.ReactRoleMessage{GuildID: guildID, ChannelID: guildID, ID: "1"}, Emoji: "👍", Role: "4"},
+		{Message: &server.ReactRoleMessage{GuildID: otherGuildID, ChannelID: otherGuildID, ID: "1"}, Emoji: "👍", Role: "5"},
+	} {
+		if err := store.StoreReactRole(ctx, rr); err != nil {
+			t.Fatalf("StoreReactRole() = %s", err)
+		}
+	}
+
+	roles, err := store.GetReactionRolesForGuild(ctx, guildID)
+	if err != nil {
+		t.Fatalf("GetReactionRolesForGuild() = %s", err)
+	}
+	if len(roles) != 1 || roles[0].Message.GuildID != guildID || roles[0].Role != "4" {
+		t.Errorf("got %+v, want only role 4 of guild %s", roles, guildID)
+	}
+}
+
+func TestStoreReactRolesIsAllOrNothing(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+	rm := server.ReactRoleMessage{GuildID: testGuildID(), ChannelID: "2", ID: "3"}
+
+	err := store.StoreReactRoles(ctx, []server.ReactRole{
+		{Message: &rm, Emoji: "👍", Role: "4"},
+		// Too long for the role column
+		{Message: &rm, Emoji: "👎", Role: strings.Repeat("5", 64)},
+	})
+	if err == nil {
+		t.Fatal("StoreReactRoles() with an invalid role succeeded")
+	}
+	if _, err := store.GetReactRolesForMessage(ctx, rm); !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("after failing got %v, want ErrNotFound", err)
+	}
+
+	err = store.StoreReactRoles(ctx, []server.ReactRole{
+		{Message: &rm, Emoji: "👍", Role: "4"},
+		{Message: &rm, Emoji: "👎", Role: "5"},
+		{Message: &rm, Emoji: "👍", Role: "6"},
+	})
+	if err != nil {
+		t.Fatalf("StoreReactRoles() = %s", err)
+	}
+	roles, err := store.GetReactRolesForMessage(ctx, rm)
+	if err != nil {
+		t.Fatalf("GetReactRolesForMessage() = %s", err)
+	}
+	got := make(map[string]string)
+	for _, rr := range roles {
+		got[rr.Emoji] = rr.Role
+	}
+	if len(got) != 2 || got["👍"] != "6" || got["👎"] != "5" {
+		t.Errorf("got %v, want 👍 to give role 6 and 👎 role 5", got)
+	}
+}
+
+func TestReactRoleInteractionProgress(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+
+	wip := &server.ReactRoleInteraction{GuildID: testGuildID(), UserID: "1", ChannelID: "2"}
+	id, err := store.CreateReactRoleInteractionProgress(ctx, wip)
+	if err != nil {
+		t.Fatalf("CreateReactRoleInteractionProgress() = %s", err)
+	}
+	wip.ID = id
+	wip.MessageID = "3"
+	if err := store.StoreReactRoleInteractionProgress(ctx, wip); err != nil {
+		t.Fatalf("StoreReactRoleInteractionProgress() = %s", err)
+	}
+
+	got, err := store.GetReactRoleInteractionProgress(ctx, id)
+	if err != nil {
+		t.Fatalf("GetReactRoleInteractionProgress() = %s", err)
+	}
+	if got.ID != id || got.MessageID != "3" || got.UserID != "1" {
+		t.Errorf("got %+v, want %+v", got, wip)
+	}
+
+	if err := store.DeleteReactRoleInteractionProgress(ctx, id); err != nil {
+		t.Fatalf("DeleteReactRoleInteractionProgress() = %s", err)
+	}
+	if _, err := store.GetReactRoleInteractionProgress(ctx, id); !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("after deleting got %v, want ErrNotFound", err)
+	}
+}
+
+func TestUpdateGuildSettings(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+	guildID := testGuildID()
+
+	_, err := store.UpdateGuildSettings(ctx, guildID, func(g *server.GuildSettings) error {
+		g.Prefix = "?"
+		g.Locale = discordgo.Norwegian
+		g.Timezone = "America/New_York"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateGuildSettings() = %s", err)
+	}
+	stored, err := store.GetGuildSettings(ctx, guildID)
+	if err != nil {
+		t.Fatalf("GetGuildSettings() = %s", err)
+	}
+	if stored.Prefix != "?" {
+		t.Errorf("stored prefix = %q, want %q", stored.Prefix, "?")
+	}
+	if stored.Locale != discordgo.Norwegian {
+		t.Errorf("stored locale = %q, want %q", stored.Locale, discordgo.Norwegian)
+	}
+	if got := stored.Location().String(); got != "America/New_York" {
+		t.Errorf("stored location = %q, want %q", got, "America/New_York")
+	}
+
+	_, err = store.UpdateGuildSettings(ctx, guildID, func(g *server.GuildSettings) error {
+		g.Locale = "xx-XX"
+		return nil
+	})
+	if err == nil {
+		t.Error("UpdateGuildSettings() with an unknown locale succeeded")
+	}
+}
+
+func TestQueriesUseTheContext(t *testing.T) {
+	store := testStore(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := store.GetGuildSettings(ctx, testGuildID()); !errors.Is(err, context.Canceled) {
+		t.Errorf("with a cancelled context got %v, want context.Canceled", err)
+	}
+}
+
+func TestDeleteReactRoleInteractionsBefore(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+
+	abandoned, err := store.CreateReactRoleInteractionProgress(ctx, &server.ReactRoleInteraction{GuildID: testGuildID()})
+	if err != nil {
+		t.Fatalf("CreateReactRoleInteractionProgress() = %s", err)
+	}
+	inFlight, err := store.CreateReactRoleInteractionProgress(ctx, &server.ReactRoleInteraction{GuildID: testGuildID()})
+	if err != nil {
+		t.Fatalf("CreateReactRoleInteractionProgress() = %s", err)
+	}
+
+	if _, err := store.DeleteReactRoleInteractionsBefore(ctx, time.Now().Add(time.Minute), []string{inFlight}); err != nil {
+		t.Fatalf("DeleteReactRoleInteractionsBefore() = %s", err)
+	}
+	if _, err := store.GetReactRoleInteractionProgress(ctx, abandoned); !errors.Is(err, server.ErrNotFound) {
+		t.Errorf("abandoned wizard got %v, want ErrNotFound", err)
+	}
+	if _, err := store.GetReactRoleInteractionProgress(ctx, inFlight); err != nil {
+		t.Errorf("wizard in flight got %v, want it kept", err)
+	}
+	if err := store.DeleteReactRoleInteractionProgress(ctx, inFlight); err != nil {
+		t.Fatalf("DeleteReactRoleInteractionProgress() = %s", err)
+	}
+}
+
+func TestUpdateAutoRolesConcurrently(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+	guildID := testGuildID()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(role string) {
+			defer wg.Done()
+			_, err := store.UpdateAutoRoles(ctx, guildID, func(a *server.AutoRoles) error {
+				a.Roles = append(a.Roles, role)
+				return nil
+			})
+			errs <- err
+		}(fmt.Sprint(i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("UpdateAutoRoles() = %s", err)
+		}
+	}
+
+	a, err := store.GetAutoRoles(ctx, guildID)
+	if err != nil {
+		t.Fatalf("GetAutoRoles() = %s", err)
+	}
+	if len(a.Roles) != 10 {
+		t.Errorf("got roles %v, want all 10 changes kept", a.Roles)
+	}
+
+	_, err = store.UpdateAutoRoles(ctx, guildID, func(a *server.AutoRoles) error {
+		a.Roles = nil
+		return errors.New("invalid")
+	})
+	if err == nil {
+		t.Fatal("UpdateAutoRoles() with a failing update succeeded")
+	}
+	if a, _ := store.GetAutoRoles(ctx, guildID); len(a.Roles) != 10 {
+		t.Errorf("failed update changed the roles to %v", a.Roles)
+	}
+}
+
+func TestUpdateGuildSettingsConcurrently(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+	guildID := testGuildID()
+
+	// Each change touches a different setting, so none may be lost
+	changes := []func(g *server.GuildSettings) error{
+		func(g *server.GuildSettings) error { g.Prefix = "?"; return nil },
+		func(g *server.GuildSettings) error { g.Timezone = "America/New_York"; return nil },
+		func(g *server.GuildSettings) error { g.AdminLogChannel = "1234"; return nil },
+		func(g *server.GuildSettings) error { g.Modules[server.ModuleHots] = false; return nil },
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(changes))
+	for _, change := range changes {
+		wg.Add(1)
+		go func(change func(g *server.GuildSettings) error) {
+			defer wg.Done()
+			_, err := store.UpdateGuildSettings(ctx, guildID, change)
+			errs <- err
+		}(change)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("UpdateGuildSettings() = %s", err)
+		}
+	}
+
+	g, err := store.GetGuildSettings(ctx, guildID)
+	if err != nil {
+		t.Fatalf("GetGuildSettings() = %s", err)
+	}
+	if g.Prefix != "?" || g.Timezone != "America/New_York" || g.AdminLogChannel != "1234" || g.ModuleEnabled(server.ModuleHots) {
+		t.Errorf("got %+v, want all 4 changes kept", g)
+	}
+}
+
+func TestVerificationLeavesExistingMembersAlone(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+	guildID := testGuildID()
+
+	// A member who joined before verification was set up has no row, and
+	// mustn't get one which makes them unverified
+	if err := store.MarkMemberVerified(ctx, guildID, "1"); err != nil {
+		t.Fatalf("MarkMemberVerified() = %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := store.RecordVerificationAttempt(ctx, guildID, "1"); !errors.Is(err, server.ErrNotFound) {
+			t.Fatalf("RecordVerificationAttempt() for an untracked member = %v, want ErrNotFound", err)
+		}
+	}
+
+	if err := store.StartMemberVerification(ctx, guildID, "2"); err != nil {
+		t.Fatalf("StartMemberVerification() = %s", err)
+	}
+	for want := 1; want <= 2; want++ {
+		attempts, err := store.RecordVerificationAttempt(ctx, guildID, "2")
+		if err != nil || attempts != want {
+			t.Errorf("RecordVerificationAttempt() = %d, %v, want %d, nil", attempts, err, want)
+		}
+	}
+}
@@ -0,0 +1,576 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// Challenges members can be asked to solve to verify.
+const (
+	ChallengeMath  = "math"
+	ChallengeEmoji = "emoji"
+)
+
+// Verification components are used by every member, so they have their
+// own namespace instead of the admin command's, which checks permissions.
+const (
+	verifyNamespace     = "verify"
+	verifyVersion       = 1
+	verifyActionStart   = "start"
+	verifyActionAnswer  = "answer"
+	verifyActionPick    = "pick"
+	verifyAnswerInputID = "answer"
+)
+
+// challengeTTL is how long a member has to answer a challenge.
+const challengeTTL = 10 * time.Minute
+
+var challengeEmoji = []struct {
+	Emoji string
+	Name  string
+}{
+	{"🍎", "apple"},
+	{"🚀", "rocket"},
+	{"🐱", "cat"},
+	{"🎲", "die"},
+	{"🌵", "cactus"},
+	{"🍕", "pizza"},
+}
+
+// Verification is how members of a guild verify they're human before
+// getting access to the rest of the guild.
+type Verification struct {
+	GuildID   string
+	ChannelID string
+	// MessageID is the message with the verify button.
+	MessageID string
+	// RoleID is given to members who verify.
+	RoleID    string
+	Challenge string
+	// KickAfter removes members who haven't verified by then, zero keeps
+	// them around.
+	KickAfter time.Duration
+}
+
+// VerificationStats counts the members who joined since verification
+// was turned on.
+type VerificationStats struct {
+	Pending  int
+	Verified int
+	Kicked   int
+	Attempts int
+}
+
+// UnverifiedMember is a member who didn't verify in time.
+type UnverifiedMember struct {
+	GuildID  string
+	UserID   string
+	JoinedAt time.Time
+}
+
+// verifyPanel is the message members click to start verifying.
+func verifyPanel(v *Verification) *discordgo.MessageSend {
+	return &discordgo.MessageSend{
+		Embeds: []*discordgo.MessageEmbed{
+			{
+				Title:       "Verify to get access",
+				Description: "Click the button below and answer a simple question to get access to the rest of the server.",
+			},
+		},
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.Button{
+						Label:    "Verify",
+						Style:    discordgo.SuccessButton,
+						CustomID: NewCustomID(verifyNamespace, verifyVersion, verifyActionStart).String(),
+						Emoji:    &discordgo.ComponentEmoji{Name: "✅"},
+					},
+				},
+			},
+		},
+	}
+}
+
+type challenge struct {
+	answer  string
+	expires time.Time
+}
+
+// Verifier hands out challenges to members who want to verify, and
+// checks their answers.
+type Verifier struct {
+	store *DiscordServerStore
+
+	mu         sync.Mutex
+	challenges map[string]challenge
+}
+
+func NewVerifier(store *DiscordServerStore) *Verifier {
+	return &Verifier{
+		store:      store,
+		challenges: make(map[string]challenge),
+	}
+}
+
+// Register adds the handlers for the verify button and challenges.
+func (v *Verifier) Register(r *Router) {
+	r.HandleComponent(verifyNamespace, verifyVersion, verifyActionStart, v.start)
+	r.HandleComponent(verifyNamespace, verifyVersion, verifyActionPick, v.pick)
+	r.HandleModal(verifyNamespace, verifyVersion, verifyActionAnswer, v.answer)
+}
+
+func (v *Verifier) start(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ CustomID) error {
+	config, err := v.config(ctx, s, event)
+	if config == nil {
+		return err
+	}
+
+	switch config.Challenge {
+	case ChallengeEmoji:
+		return v.startEmoji(s, event)
+	default:
+		return v.startMath(s, event)
+	}
+}
+
+// config returns the verification of the guild, after responding to
+// members who can't or don't have to verify.
+func (v *Verifier) config(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate) (*Verification, error) {
+	if event.Member == nil {
+		return nil, respondEphemeral(s, event.Interaction, ":robot: You can only verify in a server.")
+	}
+	config, err := v.store.GetVerification(ctx, event.GuildID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, respondEphemeral(s, event.Interaction, ":robot: Verification is turned off in this server.")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range event.Member.Roles {
+		if role == config.RoleID {
+			return nil, respondEphemeral(s, event.Interaction, ":robot: You're already verified!")
+		}
+	}
+	return config, nil
+}
+
+func (v *Verifier) startMath(s *discordgo.Session, event *discordgo.InteractionCreate) error {
+	a, b := rand.Intn(10)+1, rand.Intn(10)+1
+	v.setChallenge(event.GuildID, interactionUserID(event), strconv.Itoa(a+b))
+
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: NewCustomID(verifyNamespace, verifyVersion, verifyActionAnswer).String(),
+			Title:    "Verify",
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							CustomID:  verifyAnswerInputID,
+							Label:     fmt.Sprintf("What is %d + %d?", a, b),
+							Style:     discordgo.TextInputShort,
+							Required:  true,
+							MaxLength: 3,
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
+func (v *Verifier) startEmoji(s *discordgo.Session, event *discordgo.InteractionCreate) error {
+	choices := rand.Perm(len(challengeEmoji))[:4]
+	target := challengeEmoji[choices[rand.Intn(len(choices))]]
+	v.setChallenge(event.GuildID, interactionUserID(event), target.Name)
+
+	buttons := make([]discordgo.MessageComponent, 0, len(choices))
+	for _, i := range choices {
+		buttons = append(buttons, discordgo.Button{
+			Style:    discordgo.SecondaryButton,
+			CustomID: NewCustomID(verifyNamespace, verifyVersion, verifyActionPick, challengeEmoji[i].Name).String(),
+			Emoji:    &discordgo.ComponentEmoji{Name: challengeEmoji[i].Emoji},
+		})
+	}
+
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags:      discordgo.MessageFlagsEphemeral,
+			Content:    fmt.Sprintf("Click the **%s**", target.Name),
+			Components: []discordgo.MessageComponent{discordgo.ActionsRow{Components: buttons}},
+		},
+	})
+}
+
+func (v *Verifier) answer(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ CustomID) error {
+	var answer string
+	for _, row := range event.ModalSubmitData().Components {
+		if row, ok := row.(*discordgo.ActionsRow); ok {
+			for _, component := range row.Components {
+				if input, ok := component.(*discordgo.TextInput); ok && input.CustomID == verifyAnswerInputID {
+					answer = strings.TrimSpace(input.Value)
+				}
+			}
+		}
+	}
+	return v.check(ctx, s, event, answer)
+}
+
+func (v *Verifier) pick(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, id CustomID) error {
+	if len(id.Payload) != 1 {
+		return fmt.Errorf("invalid verify pick payload %v", id.Payload)
+	}
+	return v.check(ctx, s, event, id.Payload[0])
+}
+
+// check gives the verified role to members who answered correctly.
+func (v *Verifier) check(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, answer string) error {
+	config, err := v.config(ctx, s, event)
+	if config == nil {
+		return err
+	}
+
+	userID := interactionUserID(event)
+	logger := log.WithField("guild_id", event.GuildID).WithField("user_id", userID)
+	expected, ok := v.takeChallenge(event.GuildID, userID)
+	if !ok {
+		return respondEphemeral(s, event.Interaction, ":robot: That question expired, click Verify to get a new one.")
+	}
+
+	if answer != expected {
+		attempts, err := v.store.RecordVerificationAttempt(ctx, event.GuildID, userID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			logger.WithError(err).Warn("Failed to record verification attempt")
+		}
+		logger.WithField("attempts", attempts).Info("Member failed verification")
+		if attempts > 0 {
+			v.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":x: <@%s> failed verification (attempt %d)", userID, attempts))
+		} else {
+			v.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":x: <@%s> failed verification", userID))
+		}
+		return respondEphemeral(s, event.Interaction, ":x: That's not right, click Verify to try again.")
+	}
+
+	if err := s.GuildMemberRoleAdd(event.GuildID, userID, config.RoleID); err != nil {
+		logger.WithError(err).Error("Failed to give verified role")
+		return respondEphemeral(s, event.Interaction, ":x: That's right, but I couldn't give you the role. Please tell a moderator.")
+	}
+	if err := v.store.MarkMemberVerified(ctx, event.GuildID, userID); err != nil {
+		logger.WithError(err).Warn("Failed to record verification")
+	}
+	logger.Info("Member verified")
+	v.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":white_check_mark: <@%s> verified", userID))
+
+	return respondEphemeral(s, event.Interaction, ":white_check_mark: Thanks, you're verified!")
+}
+
+func (v *Verifier) setChallenge(guildID, userID, answer string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	for key, c := range v.challenges {
+		if now.After(c.expires) {
+			delete(v.challenges, key)
+		}
+	}
+	v.challenges[guildID+":"+userID] = challenge{answer: answer, expires: now.Add(challengeTTL)}
+}
+
+// takeChallenge returns the answer to the member's challenge, which can
+// only be answered once.
+func (v *Verifier) takeChallenge(guildID, userID string) (string, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key := guildID + ":" + userID
+	c, ok := v.challenges[key]
+	delete(v.challenges, key)
+	if !ok || time.Now().After(c.expires) {
+		return "", false
+	}
+	return c.answer, true
+}
+
+// KickUnverified removes members who didn't verify in time, and returns
+// how many were removed.
+func (v *Verifier) KickUnverified(ctx context.Context, s *discordgo.Session) (int, error) {
+	members, err := v.store.GetUnverifiedMembers(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	kicked := 0
+	for _, m := range members {
+		logger := log.WithField("guild_id", m.GuildID).WithField("user_id", m.UserID)
+		config, err := v.store.GetVerification(ctx, m.GuildID)
+		if err != nil {
+			continue
+		}
+
+		member, err := s.State.Member(m.GuildID, m.UserID)
+		if err != nil {
+			// They're already gone
+			if err := v.store.DeleteMemberVerification(ctx, m.GuildID, m.UserID); err != nil {
+				logger.WithError(err).Warn("Failed to forget member who left")
+			}
+			continue
+		}
+		verified := false
+		for _, role := range member.Roles {
+			if role == config.RoleID {
+				verified = true
+			}
+		}
+		if verified {
+			// Someone gave them the role by hand
+			if err := v.store.MarkMemberVerified(ctx, m.GuildID, m.UserID); err != nil {
+				logger.WithError(err).Warn("Failed to record verification")
+			}
+			continue
+		}
+
+		reason := fmt.Sprintf("Didn't verify within %s", HumanizeDuration(config.KickAfter))
+		if err := s.GuildMemberDeleteWithReason(m.GuildID, m.UserID, reason); err != nil {
+			logger.WithError(err).Error("Failed to remove unverified member")
+			continue
+		}
+		if err := v.store.MarkMemberKicked(ctx, m.GuildID, m.UserID); err != nil {
+			logger.WithError(err).Warn("Failed to record removing unverified member")
+		}
+		logger.Info("Removed unverified member")
+		v.store.AdminLog(ctx, s, m.GuildID, fmt.Sprintf(":boot: Removed <@%s>, who didn't verify within %s", m.UserID, HumanizeDuration(config.KickAfter)))
+		kicked++
+	}
+
+	return kicked, nil
+}
+
+// GetVerification returns the verification set up in a guild, or
+// ErrNotFound if there is none.
+func (srv *DiscordServerStore) GetVerification(ctx context.Context, guildID string) (*Verification, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	v := Verification{GuildID: guildID}
+	var kickAfter int
+	err := srv.db.QueryRowContext(ctx, "SELECT channel, message, role, challenge, kick_after_seconds FROM verification WHERE guild = $1", guildID).Scan(&v.ChannelID, &v.MessageID, &v.RoleID, &v.Challenge, &kickAfter)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storeError(err)
+		}
+		log.WithError(err).Error("Failed to fetch verification")
+		return nil, err
+	}
+	v.KickAfter = time.Duration(kickAfter) * time.Second
+
+	return &v, nil
+}
+
+func (srv *DiscordServerStore) StoreVerification(ctx context.Context, v *Verification) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	log.WithField("guild_id", v.GuildID).Debug("Storing verification in DB")
+	_, err := srv.db.ExecContext(ctx, `
+                INSERT INTO verification
+                        (guild, channel, message, role, challenge, kick_after_seconds)
+                VALUES ($1, $2, $3, $4, $5, $6)
+                ON CONFLICT (guild)
+                DO UPDATE SET channel = $2, message = $3, role = $4, challenge = $5, kick_after_seconds = $6`,
+		v.GuildID, v.ChannelID, v.MessageID, v.RoleID, v.Challenge, int(v.KickAfter/time.Second))
+	if err != nil {
+		log.WithError(err).Error("Failed to store verification")
+		return err
+	}
+
+	return nil
+}
+
+func (srv *DiscordServerStore) DeleteVerification(ctx context.Context, guildID string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	return srv.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM verification WHERE guild = $1", guildID); err != nil {
+			log.WithError(err).Error("Failed to delete verification")
+			return err
+		}
+		// Keep the history of members who verified, but don't kick anyone
+		if _, err := tx.ExecContext(ctx, "DELETE FROM member_verification WHERE guild = $1 AND verified_at IS NULL AND kicked_at IS NULL", guildID); err != nil {
+			log.WithError(err).Error("Failed to delete pending member verifications")
+			return err
+		}
+		return nil
+	})
+}
+
+// StartMemberVerification starts the clock for a member who joined.
+func (srv *DiscordServerStore) StartMemberVerification(ctx context.Context, guildID, userID string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	_, err := srv.db.ExecContext(ctx, `
+                INSERT INTO member_verification (guild, member, joined_at)
+                VALUES ($1, $2, now())
+                ON CONFLICT (guild, member)
+                DO UPDATE SET joined_at = now(), verified_at = NULL, kicked_at = NULL, attempts = 0`,
+		guildID, userID)
+	if err != nil {
+		log.WithError(err).Error("Failed to start member verification")
+		return err
+	}
+
+	return nil
+}
+
+// MarkMemberVerified records that a member verified. Members who joined
+// before verification was set up have nothing to record, and are left
+// alone.
+func (srv *DiscordServerStore) MarkMemberVerified(ctx context.Context, guildID, userID string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	_, err := srv.db.ExecContext(ctx, "UPDATE member_verification SET verified_at = now() WHERE guild = $1 AND member = $2", guildID, userID)
+	if err != nil {
+		log.WithError(err).Error("Failed to mark member verified")
+		return err
+	}
+
+	return nil
+}
+
+func (srv *DiscordServerStore) MarkMemberKicked(ctx context.Context, guildID, userID string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	if _, err := srv.db.ExecContext(ctx, "UPDATE member_verification SET kicked_at = now() WHERE guild = $1 AND member = $2", guildID, userID); err != nil {
+		log.WithError(err).Error("Failed to mark member kicked")
+		return err
+	}
+
+	return nil
+}
+
+// RecordVerificationAttempt counts a failed attempt, and returns how many
+// the member has made, or ErrNotFound if the member joined before
+// verification was set up. Those members aren't tracked, so they can't
+// become unverified and be kicked.
+func (srv *DiscordServerStore) RecordVerificationAttempt(ctx context.Context, guildID, userID string) (int, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return 0, errors.New("not connected to database")
+	}
+
+	var attempts int
+	err := srv.db.QueryRowContext(ctx, `
+                UPDATE member_verification SET attempts = attempts + 1
+                WHERE guild = $1 AND member = $2
+                RETURNING attempts`,
+		guildID, userID).Scan(&attempts)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, storeError(err)
+		}
+		log.WithError(err).Error("Failed to record verification attempt")
+		return 0, err
+	}
+
+	return attempts, nil
+}
+
+// DeleteMemberVerification forgets a member who hasn't verified, e.g.
+// because they left.
+func (srv *DiscordServerStore) DeleteMemberVerification(ctx context.Context, guildID, userID string) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	if _, err := srv.db.ExecContext(ctx, "DELETE FROM member_verification WHERE guild = $1 AND member = $2 AND verified_at IS NULL AND kicked_at IS NULL", guildID, userID); err != nil {
+		log.WithError(err).Error("Failed to delete member verification")
+		return err
+	}
+
+	return nil
+}
+
+// GetUnverifiedMembers returns members in every guild who didn't verify
+// within the time their guild allows.
+func (srv *DiscordServerStore) GetUnverifiedMembers(ctx context.Context) ([]UnverifiedMember, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	rows, err := srv.db.QueryContext(ctx, `
+                SELECT m.guild, m.member, m.joined_at
+                FROM member_verification m
+                JOIN verification v ON v.guild = m.guild
+                WHERE m.verified_at IS NULL AND m.kicked_at IS NULL
+                  AND v.kick_after_seconds > 0
+                  AND m.joined_at < now() - v.kick_after_seconds * interval '1 second'`)
+	if err != nil {
+		log.WithError(err).Error("Failed to fetch unverified members")
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]UnverifiedMember, 0)
+	for rows.Next() {
+		var m UnverifiedMember
+		if err := rows.Scan(&m.GuildID, &m.UserID, &m.JoinedAt); err != nil {
+			log.WithError(err).Error("Failed to scan database row")
+			return nil, err
+		}
+		members = append(members, m)
+	}
+
+	return members, rows.Err()
+}
+
+func (srv *DiscordServerStore) GetVerificationStats(ctx context.Context, guildID string) (*VerificationStats, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	var stats VerificationStats
+	err := srv.db.QueryRowContext(ctx, `
+                SELECT count(*) FILTER (WHERE verified_at IS NULL AND kicked_at IS NULL),
+                       count(*) FILTER (WHERE verified_at IS NOT NULL),
+                       count(*) FILTER (WHERE kicked_at IS NOT NULL),
+                       coalesce(sum(attempts), 0)
+                FROM member_verification WHERE guild = $1`, guildID).Scan(&stats.Pending, &stats.Verified, &stats.Kicked, &stats.Attempts)
+	if err != nil {
+		log.WithError(err).Error("Failed to fetch verification stats")
+		return nil, err
+	}
+
+	return &stats, nil
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// verificationCommand lets admins make new members verify before they
+// get access to the guild.
+func verificationCommand(store *DiscordServerStore) *ApplicationCommand {
+	var maxKickAfterHours float64 = 24 * 30
+
+	cmd := &ApplicationCommand{
+		Name: "verification",
+		Command: &discordgo.ApplicationCommand{
+			Name:        "verification",
+			Description: "Make new members verify before they get access",
+			Version:     "1",
+			Type:        discordgo.ChatApplicationCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "setup",
+					Description: "Post the verify button and choose the role verified members get",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:         discordgo.ApplicationCommandOptionChannel,
+							Name:         "channel",
+							Description:  "Channel to post the verify button in",
+							Required:     true,
+							ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText},
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionRole,
+							Name:        "role",
+							Description: "Role verified members get",
+							Required:    true,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "challenge",
+							Description: "What members have to do to verify",
+							Choices: []*discordgo.ApplicationCommandOptionChoice{
+								{Name: "Solve a math question", Value: ChallengeMath},
+								{Name: "Pick the right emoji", Value: ChallengeEmoji},
+							},
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionInteger,
+							Name:        "kick-after",
+							Description: "Remove members who haven't verified after this many hours, 0 to keep them",
+							MaxValue:    maxKickAfterHours,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "show",
+					Description: "Show how verification is set up, and how many have verified",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "disable",
+					Description: "Stop asking new members to verify",
+				},
+			},
+		},
+		Permission: AdminCommandVerification,
+		store:      store,
+	}
+	cmd.Subcommands = map[string]SubcommandHandler{
+		"setup":   cmd.verificationSetup,
+		"show":    cmd.verificationShow,
+		"disable": cmd.verificationDisable,
+	}
+
+	return cmd
+}
+
+func (cmd *ApplicationCommand) verificationSetup(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	role := options["role"].RoleValue(s, event.GuildID)
+	if err := assignableRole(event.GuildID, role); err != nil {
+		return respondEphemeral(s, event.Interaction, fmt.Sprintf(":x: %s.", err))
+	}
+
+	v := &Verification{
+		GuildID:   event.GuildID,
+		ChannelID: options["channel"].ChannelValue(nil).ID,
+		RoleID:    role.ID,
+		Challenge: ChallengeMath,
+	}
+	if option, ok := options["challenge"]; ok {
+		v.Challenge = option.StringValue()
+	}
+	if option, ok := options["kick-after"]; ok && option.IntValue() > 0 {
+		v.KickAfter = time.Duration(option.IntValue()) * time.Hour
+	}
+
+	previous, err := cmd.store.GetVerification(ctx, event.GuildID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the current verification.")
+	}
+
+	msg, err := s.ChannelMessageSendComplex(v.ChannelID, verifyPanel(v))
+	if err != nil {
+		log.WithError(err).WithField("channel_id", v.ChannelID).Warn("Failed to post verify button")
+		return respondEphemeral(s, event.Interaction, fmt.Sprintf(":x: Couldn't post the verify button in <#%s>, check my permissions there.", v.ChannelID))
+	}
+	v.MessageID = msg.ID
+	if err := cmd.store.StoreVerification(ctx, v); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't save the verification.")
+	}
+	if previous != nil && previous.MessageID != "" {
+		if err := s.ChannelMessageDelete(previous.ChannelID, previous.MessageID); err != nil {
+			log.WithError(err).Debug("Failed to delete previous verify button")
+		}
+	}
+
+	cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":white_check_mark: <@%s> set up verification: %s", interactionUserID(event), describeVerification(v)))
+
+	return respondEphemeral(s, event.Interaction, fmt.Sprintf(":+1: Okay, %s. Make sure only <@&%s> can see the rest of the server, and that my role is above it.", describeVerification(v), v.RoleID))
+}
+
+func (cmd *ApplicationCommand) verificationShow(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	v, err := cmd.store.GetVerification(ctx, event.GuildID)
+	if errors.Is(err, ErrNotFound) {
+		return respondEphemeral(s, event.Interaction, ":robot: Verification is turned off. Use `/verification setup` to turn it on.")
+	}
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the verification.")
+	}
+	stats, err := cmd.store.GetVerificationStats(ctx, event.GuildID)
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the verification stats.")
+	}
+
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+			Embeds: []*discordgo.MessageEmbed{
+				{
+					Title:       "Verification",
+					Description: describeVerification(v),
+					Fields: []*discordgo.MessageEmbedField{
+						{Name: "Waiting", Value: fmt.Sprint(stats.Pending), Inline: true},
+						{Name: "Verified", Value: fmt.Sprint(stats.Verified), Inline: true},
+						{Name: "Removed", Value: fmt.Sprint(stats.Kicked), Inline: true},
+						{Name: "Failed attempts", Value: fmt.Sprint(stats.Attempts), Inline: true},
+					},
+				},
+			},
+		},
+	})
+}
+
+func (cmd *ApplicationCommand) verificationDisable(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	v, err := cmd.store.GetVerification(ctx, event.GuildID)
+	if errors.Is(err, ErrNotFound) {
+		return respondEphemeral(s, event.Interaction, ":robot: Verification is already turned off.")
+	}
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the verification.")
+	}
+	if err := cmd.store.DeleteVerification(ctx, event.GuildID); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't turn off verification.")
+	}
+	if v.MessageID != "" {
+		if err := s.ChannelMessageDelete(v.ChannelID, v.MessageID); err != nil {
+			log.WithError(err).Debug("Failed to delete verify button")
+		}
+	}
+
+	cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":white_check_mark: <@%s> turned off verification", interactionUserID(event)))
+
+	return respondEphemeral(s, event.Interaction, ":+1: Verification is turned off, and the verify button removed.")
+}
+
+func describeVerification(v *Verification) string {
+	description := fmt.Sprintf("members verify in <#%s> with a %s challenge to get <@&%s>", v.ChannelID, v.Challenge, v.RoleID)
+	if v.KickAfter > 0 {
+		description = fmt.Sprintf("%s, and are removed if they haven't after %s", description, HumanizeDuration(v.KickAfter))
+	}
+	return description
+}
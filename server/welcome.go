@@ -0,0 +1,320 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxWelcomeTemplates is how many welcome templates a guild can have.
+const MaxWelcomeTemplates = 10
+
+// DefaultWelcomeTemplate is used for guilds which haven't added any
+// templates of their own.
+var DefaultWelcomeTemplate = WelcomeTemplate{
+	Content: "Welcome, {user}! The channel you are looking for might be hidden, or appear locked, but you can access them after you've clicked the appropriate emoji-reaction below the message in {emoji_channel}. (tip: click on the link to go directly to that message)",
+}
+
+// WelcomeTemplate is a welcome message with placeholders, which are
+// filled in when a member joins:
+//
+//	{user}          mention of the member
+//	{username}      name of the member, without mentioning them
+//	{server}        name of the server
+//	{member_count}  number of members in the server
+//	{account_age}   how long ago the member's account was created
+//	{emoji_channel} the channel with reaction roles
+//	{channel:name}  mention of the channel with that name
+//
+// Goodbye messages can also use:
+//
+//	{time_in_server} how long the member was in the server
+//	{reason}         "left", or e.g. "was kicked by @moderator"
+type WelcomeTemplate struct {
+	Content string `json:"content"`
+	// Embed sends the message as an embed, with Title and Color.
+	Embed bool   `json:"embed"`
+	Title string `json:"title,omitempty"`
+	Color int    `json:"color,omitempty"`
+}
+
+// WelcomeData is what the placeholders of a welcome template are filled
+// in with.
+type WelcomeData struct {
+	Member         *discordgo.Member
+	Guild          *discordgo.Guild
+	EmojiChannelID string
+	Now            time.Time
+	// Reason is why a member is gone, for goodbye messages.
+	Reason string
+}
+
+var placeholderRegex = regexp.MustCompile(`\{([a-z_]+)(?::([^}]+))?\}`)
+
+// Render fills in the placeholders and creates the message to send.
+func (t WelcomeTemplate) Render(data WelcomeData) *discordgo.MessageSend {
+	content := t.fill(t.Content, data)
+	msg := &discordgo.MessageSend{
+		// Only ping the member who joined, not any roles or everyone in the template
+		AllowedMentions: &discordgo.MessageAllowedMentions{Users: []string{data.Member.User.ID}},
+	}
+	if !t.Embed {
+		msg.Content = content
+		return msg
+	}
+
+	msg.Embeds = []*discordgo.MessageEmbed{
+		{
+			Title:       t.fill(t.Title, data),
+			Description: content,
+			Color:       t.Color,
+			Thumbnail: &discordgo.MessageEmbedThumbnail{
+				URL: data.Member.User.AvatarURL("128"),
+			},
+		},
+	}
+	// Mentions in embeds don't ping, so mention the member in the message too
+	if strings.Contains(t.Content, "{user}") {
+		msg.Content = data.Member.Mention()
+	}
+	return msg
+}
+
+func (t WelcomeTemplate) fill(text string, data WelcomeData) string {
+	now := data.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	return placeholderRegex.ReplaceAllStringFunc(text, func(placeholder string) string {
+		match := placeholderRegex.FindStringSubmatch(placeholder)
+		name, arg := match[1], match[2]
+		switch name {
+		case "user":
+			return data.Member.Mention()
+		case "username":
+			return data.Member.DisplayName()
+		case "server":
+			if data.Guild != nil {
+				return data.Guild.Name
+			}
+		case "member_count":
+			if data.Guild != nil {
+				return fmt.Sprint(data.Guild.MemberCount)
+			}
+		case "account_age":
+			if created, err := discordgo.SnowflakeTimestamp(data.Member.User.ID); err == nil {
+				return HumanizeDuration(now.Sub(created))
+			}
+		case "time_in_server":
+			if !data.Member.JoinedAt.IsZero() {
+				return HumanizeDuration(now.Sub(data.Member.JoinedAt))
+			}
+			return "an unknown time"
+		case "reason":
+			if data.Reason != "" {
+				return data.Reason
+			}
+		case "emoji_channel":
+			if data.EmojiChannelID != "" {
+				return fmt.Sprintf("<#%s>", data.EmojiChannelID)
+			}
+		case "channel":
+			if data.Guild != nil {
+				for _, channel := range data.Guild.Channels {
+					if strings.EqualFold(channel.Name, arg) {
+						return channel.Mention()
+					}
+				}
+			}
+			return "#" + arg
+		}
+		return placeholder
+	})
+}
+
+// welcomeCache caches welcome channels, since they are read for every
+// member who joins. Guilds without a welcome channel are cached as nil.
+type welcomeCache struct {
+	mu       sync.RWMutex
+	channels map[string]*WelcomeChannel
+}
+
+func (c *welcomeCache) get(guildID string) (*WelcomeChannel, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	w, ok := c.channels[guildID]
+	if w != nil {
+		cached := *w
+		w = &cached
+	}
+	return w, ok
+}
+
+func (c *welcomeCache) set(guildID string, w *WelcomeChannel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.channels == nil {
+		c.channels = make(map[string]*WelcomeChannel)
+	}
+	c.channels[guildID] = w
+}
+
+func (c *welcomeCache) invalidate(guildID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.channels, guildID)
+}
+
+// WelcomeChannel returns the cached welcome channel of a guild, or nil if
+// it doesn't have one.
+func (srv *DiscordServerStore) WelcomeChannel(ctx context.Context, guildID string) (*WelcomeChannel, error) {
+	if w, ok := srv.welcome.get(guildID); ok {
+		return w, nil
+	}
+
+	w, err := srv.GetWelcomeChannel(ctx, guildID)
+	if errors.Is(err, ErrNotFound) {
+		// Cache that there is none, so we don't ask again
+		w, err = nil, nil
+	}
+	if err != nil {
+		// Don't cache, so we try again next time
+		return nil, err
+	}
+	srv.welcome.set(guildID, w)
+	w, _ = srv.welcome.get(guildID)
+	return w, nil
+}
+
+// WelcomeMessage creates the message to welcome a member with, and
+// returns the channel to send it to. It returns a nil message if the guild
+// doesn't welcome members.
+func (srv *DiscordServerStore) WelcomeMessage(ctx context.Context, s *discordgo.Session, member *discordgo.Member) (string, *discordgo.MessageSend, error) {
+	w, err := srv.WelcomeChannel(ctx, member.GuildID)
+	if err != nil {
+		return "", nil, err
+	}
+	if w == nil || w.MessageChannelID == "" {
+		return "", nil, nil
+	}
+
+	// Templates are read every time so edits apply immediately
+	templates, err := srv.GetWelcomeTemplates(ctx, member.GuildID)
+	if err != nil {
+		log.WithError(err).WithField("guild_id", member.GuildID).Warn("Failed to load welcome templates, using the default")
+	}
+	if len(templates) == 0 && w.EmojiChannelID == "" {
+		// The default message points to the emoji channel
+		return "", nil, nil
+	}
+
+	data := WelcomeData{
+		Member:         member,
+		EmojiChannelID: w.EmojiChannelID,
+	}
+	if guild, err := s.State.Guild(member.GuildID); err == nil {
+		data.Guild = guild
+	}
+	return w.MessageChannelID, PickWelcomeTemplate(templates).Render(data), nil
+}
+
+// PickWelcomeTemplate picks one of the templates at random, or the
+// default if there are none.
+func PickWelcomeTemplate(templates []WelcomeTemplate) WelcomeTemplate {
+	if len(templates) == 0 {
+		return DefaultWelcomeTemplate
+	}
+	return templates[rand.Intn(len(templates))]
+}
+
+// HumanizeDuration describes a duration in the largest unit that fits,
+// e.g. "3 years" or "5 days".
+func HumanizeDuration(d time.Duration) string {
+	day := 24 * time.Hour
+	units := []struct {
+		name string
+		size time.Duration
+	}{
+		{"year", 365 * day},
+		{"month", 30 * day},
+		{"week", 7 * day},
+		{"day", day},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+	}
+	for _, unit := range units {
+		if n := int(d / unit.size); n >= 1 {
+			if n == 1 {
+				return fmt.Sprintf("1 %s", unit.name)
+			}
+			return fmt.Sprintf("%d %ss", n, unit.name)
+		}
+	}
+	return "less than a minute"
+}
+
+func (srv *DiscordServerStore) GetWelcomeTemplates(ctx context.Context, guildID string) ([]WelcomeTemplate, error) {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return nil, errors.New("not connected to database")
+	}
+
+	rows, err := srv.db.QueryContext(ctx, "SELECT templates FROM welcome_channel WHERE guild = $1", guildID)
+	if err != nil {
+		log.WithError(err).Error("Failed to fetch welcome templates from DB")
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := make([]WelcomeTemplate, 0)
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			log.WithError(err).Error("Failed to scan database row")
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &templates); err != nil {
+			log.WithError(err).Error("Failed to unmarshal welcome templates")
+			return nil, err
+		}
+	}
+
+	return templates, rows.Err()
+}
+
+func (srv *DiscordServerStore) StoreWelcomeTemplates(ctx context.Context, guildID string, templates []WelcomeTemplate) error {
+	if srv.db == nil {
+		log.Error("Database is nil!")
+		return errors.New("not connected to database")
+	}
+
+	data, err := json.Marshal(templates)
+	if err != nil {
+		return err
+	}
+
+	log.WithField("guild_id", guildID).Debug("Storing welcome templates in DB")
+	_, err = srv.db.ExecContext(ctx, `
+                INSERT INTO welcome_channel
+                        (guild, message_channel, emoji_channel, templates)
+                VALUES ($1, '', '', $2)
+                ON CONFLICT (guild)
+                DO UPDATE SET templates = $2`,
+		guildID, data)
+	if err != nil {
+		log.WithError(err).Error("Failed to store welcome templates")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,369 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// welcomeCommand lets admins manage how new members are welcomed.
+func welcomeCommand(store *DiscordServerStore) *ApplicationCommand {
+	var minIndex float64 = 1
+
+	indexOption := func(required bool, description string) *discordgo.ApplicationCommandOption {
+		return &discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionInteger,
+			Name:        "number",
+			Description: description,
+			Required:    required,
+			MinValue:    &minIndex,
+			MaxValue:    MaxWelcomeTemplates,
+		}
+	}
+
+	cmd := &ApplicationCommand{
+		Name: "welcome",
+		Command: &discordgo.ApplicationCommand{
+			Name:        "welcome",
+			Description: "Configure how new members are welcomed",
+			Version:     "1",
+			Type:        discordgo.ChatApplicationCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "set",
+					Description: "Set where new members are welcomed",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:         discordgo.ApplicationCommandOptionChannel,
+							Name:         "channel",
+							Description:  "Channel to welcome new members in",
+							Required:     true,
+							ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText},
+						},
+						{
+							Type:         discordgo.ApplicationCommandOptionChannel,
+							Name:         "emoji-channel",
+							Description:  "Channel with the reaction roles, for {emoji_channel}. Leave out to keep the current one",
+							ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText},
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "show",
+					Description: "Show where new members are welcomed",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "disable",
+					Description: "Stop welcoming new members, keeping the welcome messages",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "test",
+					Description: "Welcome a member in the welcome channel as if they just joined",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionUser,
+							Name:        "member",
+							Description: "Member to welcome, yourself if left out",
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+					Name:        "template",
+					Description: "Manage welcome message templates",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "add",
+							Description: "Add a welcome message, one is picked at random for each new member",
+							Options: []*discordgo.ApplicationCommandOption{
+								{
+									Type:        discordgo.ApplicationCommandOptionString,
+									Name:        "content",
+									Description: "Message, with placeholders like {user}, {server}, {member_count}, {channel:rules}",
+									Required:    true,
+									MaxLength:   2000,
+								},
+								{
+									Type:        discordgo.ApplicationCommandOptionBoolean,
+									Name:        "embed",
+									Description: "Send the message as an embed",
+								},
+								{
+									Type:        discordgo.ApplicationCommandOptionString,
+									Name:        "title",
+									Description: "Title of the embed",
+									MaxLength:   256,
+								},
+								{
+									Type:        discordgo.ApplicationCommandOptionString,
+									Name:        "color",
+									Description: "Color of the embed, e.g. #40c7eb",
+									MaxLength:   7,
+								},
+							},
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "remove",
+							Description: "Remove a welcome message",
+							Options:     []*discordgo.ApplicationCommandOption{indexOption(true, "Number of the message, see list")},
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "list",
+							Description: "List the welcome messages",
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "preview",
+							Description: "Show what a welcome message looks like for you",
+							Options:     []*discordgo.ApplicationCommandOption{indexOption(false, "Number of the message, leave out for a random one")},
+						},
+					},
+				},
+			},
+		},
+		Module:     ModuleWelcome,
+		Permission: AdminCommandSetWelcomeChannel,
+		store:      store,
+	}
+	cmd.Subcommands = map[string]SubcommandHandler{
+		"set":              store.setWelcomeChannelCommand().SubcommandHandler(store),
+		"show":             cmd.welcomeShow,
+		"disable":          cmd.welcomeDisable,
+		"test":             cmd.welcomeTest,
+		"template add":     cmd.welcomeTemplateAdd,
+		"template remove":  cmd.welcomeTemplateRemove,
+		"template list":    cmd.welcomeTemplateList,
+		"template preview": cmd.welcomeTemplatePreview,
+	}
+
+	return cmd
+}
+
+func (cmd *ApplicationCommand) welcomeShow(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	w, err := cmd.store.WelcomeChannel(ctx, event.GuildID)
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the welcome channel.")
+	}
+	templates, err := cmd.store.GetWelcomeTemplates(ctx, event.GuildID)
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the welcome messages.")
+	}
+
+	content := fmt.Sprintf(":robot: %s.", describeWelcomeChannel(w))
+	if len(templates) == 0 {
+		content += " They get the default welcome message, which needs the emoji channel."
+	} else {
+		content += fmt.Sprintf(" They get one of %d welcome messages, see `/welcome template list`.", len(templates))
+	}
+
+	return respondEphemeral(s, event.Interaction, content)
+}
+
+func (cmd *ApplicationCommand) welcomeDisable(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	if err := cmd.store.DisableWelcomeChannel(ctx, event.GuildID); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't disable the welcome channel.")
+	}
+
+	cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":wave: <@%s> stopped welcoming new members", interactionUserID(event)))
+
+	return respondEphemeral(s, event.Interaction, ":+1: New members are no longer welcomed. The welcome messages are kept for when you turn it back on.")
+}
+
+// welcomeTest sends the welcome message the way a join would.
+func (cmd *ApplicationCommand) welcomeTest(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	member := event.Member
+	if option, ok := options["member"]; ok {
+		userID := option.UserValue(nil).ID
+		m, err := s.State.Member(event.GuildID, userID)
+		if err != nil {
+			if m, err = s.GuildMember(event.GuildID, userID); err != nil {
+				return respondEphemeral(s, event.Interaction, ":robot: That user isn't a member of this server.")
+			}
+		}
+		member = m
+	}
+	if member.GuildID == "" {
+		member.GuildID = event.GuildID
+	}
+
+	channelID, msg, err := cmd.store.WelcomeMessage(ctx, s, member)
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't create the welcome message.")
+	}
+	if msg == nil {
+		return respondEphemeral(s, event.Interaction, ":robot: New members aren't welcomed, use `/welcome set` first. The default message also needs the emoji channel.")
+	}
+	if _, err := s.ChannelMessageSendComplex(channelID, msg); err != nil {
+		log.WithError(err).WithField("channel_id", channelID).Warn("Failed to send test welcome message")
+		return respondEphemeral(s, event.Interaction, fmt.Sprintf(":x: Couldn't send the welcome message to <#%s>, check my permissions there.", channelID))
+	}
+
+	return respondEphemeral(s, event.Interaction, fmt.Sprintf(":+1: Sent a welcome message to <#%s>.", channelID))
+}
+
+func describeWelcomeChannel(w *WelcomeChannel) string {
+	if w == nil || w.MessageChannelID == "" {
+		return "new members aren't welcomed"
+	}
+	description := fmt.Sprintf("new members are welcomed in <#%s>", w.MessageChannelID)
+	if w.EmojiChannelID != "" {
+		description += fmt.Sprintf(", and pointed to the reaction roles in <#%s>", w.EmojiChannelID)
+	}
+	return description
+}
+
+func (cmd *ApplicationCommand) welcomeTemplateAdd(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	template := WelcomeTemplate{
+		Content: options["content"].StringValue(),
+	}
+	if option, ok := options["embed"]; ok {
+		template.Embed = option.BoolValue()
+	}
+	if option, ok := options["title"]; ok {
+		template.Title = option.StringValue()
+	}
+	if option, ok := options["color"]; ok {
+		color, err := parseColor(option.StringValue())
+		if err != nil {
+			return respondEphemeral(s, event.Interaction, ":x: The color has to be a hex color, like #40c7eb.")
+		}
+		template.Color = color
+	}
+
+	templates, err := cmd.store.GetWelcomeTemplates(ctx, event.GuildID)
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the welcome messages.")
+	}
+	if len(templates) >= MaxWelcomeTemplates {
+		return respondEphemeral(s, event.Interaction, fmt.Sprintf(":x: There can be at most %d welcome messages, remove one first.", MaxWelcomeTemplates))
+	}
+	templates = append(templates, template)
+	if err := cmd.store.StoreWelcomeTemplates(ctx, event.GuildID, templates); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't save the welcome message.")
+	}
+
+	cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":wave: <@%s> added welcome message #%d", interactionUserID(event), len(templates)))
+
+	return cmd.respondWelcomePreview(ctx, s, event, template, fmt.Sprintf(":+1: Added welcome message #%d, this is what it looks like:", len(templates)))
+}
+
+func (cmd *ApplicationCommand) welcomeTemplateRemove(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	templates, err := cmd.store.GetWelcomeTemplates(ctx, event.GuildID)
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the welcome messages.")
+	}
+	idx := int(options["number"].IntValue()) - 1
+	if idx < 0 || idx >= len(templates) {
+		return respondEphemeral(s, event.Interaction, ":robot: There is no welcome message with that number.")
+	}
+	templates = append(templates[:idx], templates[idx+1:]...)
+	if err := cmd.store.StoreWelcomeTemplates(ctx, event.GuildID, templates); err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't remove the welcome message.")
+	}
+
+	cmd.store.AdminLog(ctx, s, event.GuildID, fmt.Sprintf(":wave: <@%s> removed welcome message #%d", interactionUserID(event), idx+1))
+
+	return respondEphemeral(s, event.Interaction, fmt.Sprintf(":+1: Removed welcome message #%d.", idx+1))
+}
+
+func (cmd *ApplicationCommand) welcomeTemplateList(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, _ map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	templates, err := cmd.store.GetWelcomeTemplates(ctx, event.GuildID)
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the welcome messages.")
+	}
+	if len(templates) == 0 {
+		return respondEphemeral(s, event.Interaction, fmt.Sprintf(":robot: No welcome messages yet, so I'm using the default:\n>>> %s", DefaultWelcomeTemplate.Content))
+	}
+
+	fields := make([]*discordgo.MessageEmbedField, 0, len(templates))
+	for i, template := range templates {
+		name := fmt.Sprintf("#%d", i+1)
+		if template.Embed {
+			name = fmt.Sprintf("%s (embed)", name)
+		}
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:  name,
+			Value: truncate(template.Content, 1024),
+		})
+	}
+
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+			Embeds: []*discordgo.MessageEmbed{
+				{
+					Title:  "Welcome messages",
+					Fields: fields,
+				},
+			},
+		},
+	})
+}
+
+func (cmd *ApplicationCommand) welcomeTemplatePreview(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, options map[string]*discordgo.ApplicationCommandInteractionDataOption) error {
+	templates, err := cmd.store.GetWelcomeTemplates(ctx, event.GuildID)
+	if err != nil {
+		return respondEphemeral(s, event.Interaction, ":x: Couldn't load the welcome messages.")
+	}
+
+	template := PickWelcomeTemplate(templates)
+	if option, ok := options["number"]; ok {
+		idx := int(option.IntValue()) - 1
+		if idx < 0 || idx >= len(templates) {
+			return respondEphemeral(s, event.Interaction, ":robot: There is no welcome message with that number.")
+		}
+		template = templates[idx]
+	}
+
+	return cmd.respondWelcomePreview(ctx, s, event, template, "")
+}
+
+// respondWelcomePreview renders a template for the member who used the
+// command, and shows it to them only.
+func (cmd *ApplicationCommand) respondWelcomePreview(ctx context.Context, s *discordgo.Session, event *discordgo.InteractionCreate, template WelcomeTemplate, content string) error {
+	data := WelcomeData{Member: event.Member}
+	if guild, err := s.State.Guild(event.GuildID); err == nil {
+		data.Guild = guild
+	}
+	if w, err := cmd.store.WelcomeChannel(ctx, event.GuildID); err == nil && w != nil {
+		data.EmojiChannelID = w.EmojiChannelID
+	} else if err != nil {
+		log.WithError(err).Warn("Failed to look up welcome channel for preview")
+	}
+
+	msg := template.Render(data)
+	if content != "" {
+		msg.Content = strings.TrimSpace(content + "\n" + msg.Content)
+	}
+
+	return s.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content:         msg.Content,
+			Embeds:          msg.Embeds,
+			Flags:           discordgo.MessageFlagsEphemeral,
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		},
+	})
+}
+
+// parseColor parses a hex color like #40c7eb.
+func parseColor(hex string) (int, error) {
+	color, err := strconv.ParseInt(strings.TrimPrefix(hex, "#"), 16, 32)
+	if err != nil || color < 0 || color > 0xffffff {
+		return 0, fmt.Errorf("invalid color %q", hex)
+	}
+	return int(color), nil
+}
@@ -0,0 +1,95 @@
+package textcommands
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const helpURL = "https://github.com/sklirg/tardis"
+
+// help lists the commands which are turned on, or shows how to use one.
+func (r *Registry) help(ctx *Context) error {
+	if len(ctx.Args) > 0 && ctx.Args[0] != "" {
+		return r.helpCommand(ctx, strings.TrimPrefix(ctx.Args[0], ctx.Prefix))
+	}
+
+	fields := make([]*discordgo.MessageEmbedField, 0)
+	for _, cmd := range r.visible(ctx) {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:  ctx.Prefix + cmd.Name,
+			Value: summary(cmd),
+		})
+	}
+
+	_, err := ctx.Session.ChannelMessageSendEmbed(ctx.Message.ChannelID, &discordgo.MessageEmbed{
+		URL:         helpURL,
+		Title:       "TARDIS",
+		Description: fmt.Sprintf("Use `%shelp <command>` to see how to use a command. For feature requests and help, click the title (link).", ctx.Prefix),
+		Fields:      fields,
+	})
+	return err
+}
+
+func (r *Registry) helpCommand(ctx *Context, name string) error {
+	cmd, ok := r.Lookup(name)
+	if !ok || cmd.Hidden || !r.enabled(ctx, cmd) {
+		content := fmt.Sprintf(":robot: There's no `%s%s` command.", ctx.Prefix, name)
+		if suggestions := r.Suggest(ctx, name); len(suggestions) > 0 {
+			content = fmt.Sprintf(":robot: There's no `%s%s` command, did you mean %s?", ctx.Prefix, name, formatNames(ctx.Prefix, suggestions))
+		}
+		return ctx.Reply(content)
+	}
+
+	fields := []*discordgo.MessageEmbedField{
+		{Name: "Usage", Value: fmt.Sprintf("`%s%s`", ctx.Prefix, cmd.Usage)},
+	}
+	if len(cmd.Aliases) > 0 {
+		fields = append(fields, &discordgo.MessageEmbedField{Name: "Aliases", Value: formatNames(ctx.Prefix, cmd.Aliases), Inline: true})
+	}
+	if permissions := permissions(cmd); len(permissions) > 0 {
+		fields = append(fields, &discordgo.MessageEmbedField{Name: "Admin only", Value: strings.Join(permissions, "\n"), Inline: true})
+	}
+
+	_, err := ctx.Session.ChannelMessageSendEmbed(ctx.Message.ChannelID, &discordgo.MessageEmbed{
+		URL:         helpURL,
+		Title:       ctx.Prefix + cmd.Name,
+		Description: cmd.Description,
+		Fields:      fields,
+	})
+	return err
+}
+
+func summary(cmd *Command) string {
+	s := cmd.Description
+	if len(cmd.Aliases) > 0 {
+		s = fmt.Sprintf("aliases: %s | %s", strings.Join(cmd.Aliases, ", "), s)
+	}
+	if cmd.Permission != "" {
+		s += " (admin)"
+	}
+	return s
+}
+
+// permissions describes who may run the command and its subcommands.
+func permissions(cmd *Command) []string {
+	permissions := make([]string, 0)
+	if cmd.Permission != "" {
+		permissions = append(permissions, fmt.Sprintf("Needs `%s`", cmd.Permission))
+	}
+	for _, sub := range sortedKeys(cmd.SubcommandPermissions) {
+		permissions = append(permissions, fmt.Sprintf("`%s` needs `%s`", sub, cmd.SubcommandPermissions[sub]))
+	}
+	return permissions
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
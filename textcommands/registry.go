@@ -0,0 +1,254 @@
+// Package textcommands routes prefixed text commands, like !hots, to the
+// modules which register them, and generates help from what they register.
+package textcommands
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+	"github.com/sklirg/tardis/metrics"
+)
+
+// Handler runs a text command.
+type Handler func(ctx *Context) error
+
+// Command is a text command a module registers.
+type Command struct {
+	Name    string
+	Aliases []string
+	// Usage is how to call the command without the prefix, for example
+	// "hots <hero>".
+	Usage       string
+	Description string
+	// Module, if set, is the module which has to be turned on in the guild
+	// for the command to be used.
+	Module string
+	// Permission, if set, is the admin command the author must be allowed
+	// to run. SubcommandPermissions does the same for the first argument,
+	// for commands where only some subcommands are for admins.
+	Permission            string
+	SubcommandPermissions map[string]string
+	// Hidden commands are left out of help and suggestions.
+	Hidden  bool
+	Handler Handler
+}
+
+// Context is a text command being run. It carries the deadline of the
+// handler it is run from.
+type Context struct {
+	context.Context
+	Session *discordgo.Session
+	Message *discordgo.MessageCreate
+	// Trigger is the name or alias the command was called with, and Args
+	// the words after it.
+	Trigger  string
+	Args     []string
+	Prefix   string
+	Location *time.Location
+	Logger   *log.Entry
+}
+
+// Reply sends a message to the channel the command was run in.
+func (ctx *Context) Reply(content string) error {
+	_, err := ctx.Session.ChannelMessageSend(ctx.Message.ChannelID, content)
+	return err
+}
+
+// React reacts to the message the command was run with.
+func (ctx *Context) React(emoji string) error {
+	return ctx.Session.MessageReactionAdd(ctx.Message.ChannelID, ctx.Message.ID, emoji)
+}
+
+// Registry holds the text commands, and dispatches messages to them.
+// Everything must be registered before messages are dispatched.
+type Registry struct {
+	commands []*Command
+	lookup   map[string]*Command
+
+	// ModuleEnabled and Allowed decide whether a command may be run,
+	// allowing everything if they aren't set.
+	ModuleEnabled func(ctx context.Context, guildID, module string) bool
+	Allowed       func(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate, permission string) bool
+}
+
+// NewRegistry creates a registry with the help command registered.
+func NewRegistry() *Registry {
+	r := &Registry{lookup: make(map[string]*Command)}
+	r.Register(&Command{
+		Name:        "help",
+		Usage:       "help [command]",
+		Description: "List the commands, or show how to use one",
+		Handler:     r.help,
+	})
+	return r
+}
+
+// Register adds a command. It panics if the name or an alias is taken,
+// since that is a programming error.
+func (r *Registry) Register(cmd *Command) {
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		if _, taken := r.lookup[name]; taken {
+			panic(fmt.Sprintf("text command '%s' is registered twice", name))
+		}
+		r.lookup[name] = cmd
+	}
+	r.commands = append(r.commands, cmd)
+}
+
+// Lookup finds a command by its name or an alias.
+func (r *Registry) Lookup(name string) (*Command, bool) {
+	cmd, ok := r.lookup[name]
+	return cmd, ok
+}
+
+// Parse splits a message into the trigger and its arguments, if it starts
+// with the prefix.
+func Parse(content, prefix string) (string, []string, bool) {
+	if !strings.HasPrefix(content, prefix) {
+		return "", nil, false
+	}
+	tokens := strings.Split(strings.ReplaceAll(content[len(prefix):], "\n", " "), " ")
+	if tokens[0] == "" {
+		return "", nil, false
+	}
+	return tokens[0], tokens[1:], true
+}
+
+// Dispatch runs the command the context was triggered with. Commands
+// which are turned off are ignored, authors who may not run a command get
+// a thumbs down, and unknown commands get suggestions if any are close.
+func (r *Registry) Dispatch(ctx *Context) {
+	logger := ctx.Logger.WithField("trigger", ctx.Trigger)
+	cmd, ok := r.Lookup(ctx.Trigger)
+	if !ok {
+		logger.Debug("Received unknown trigger")
+		if suggestions := r.Suggest(ctx, ctx.Trigger); len(suggestions) > 0 {
+			ctx.Reply(fmt.Sprintf(":robot: I don't know `%s%s`, did you mean %s?", ctx.Prefix, ctx.Trigger, formatNames(ctx.Prefix, suggestions)))
+		}
+		return
+	}
+	if !r.enabled(ctx, cmd) {
+		return
+	}
+	if !r.allowed(ctx, cmd, ctx.Args) {
+		logger.Info("Denied text command")
+		ctx.React("👎")
+		return
+	}
+
+	defer metrics.ObserveCommand("text", cmd.Name, time.Now())
+	if err := cmd.Handler(ctx); err != nil {
+		logger.WithError(err).Warn("Failed to handle text command")
+	}
+}
+
+func (r *Registry) enabled(ctx *Context, cmd *Command) bool {
+	return cmd.Module == "" || r.ModuleEnabled == nil || r.ModuleEnabled(ctx, ctx.Message.GuildID, cmd.Module)
+}
+
+func (r *Registry) allowed(ctx *Context, cmd *Command, args []string) bool {
+	permission := cmd.Permission
+	if len(args) > 0 && cmd.SubcommandPermissions[args[0]] != "" {
+		permission = cmd.SubcommandPermissions[args[0]]
+	}
+	return permission == "" || r.Allowed == nil || r.Allowed(ctx, ctx.Session, ctx.Message, permission)
+}
+
+// visible returns the commands shown in help, in the order they were
+// registered.
+func (r *Registry) visible(ctx *Context) []*Command {
+	commands := make([]*Command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		if !cmd.Hidden && r.enabled(ctx, cmd) {
+			commands = append(commands, cmd)
+		}
+	}
+	return commands
+}
+
+// Suggest returns the names of commands close to what was typed, closest
+// first.
+func (r *Registry) Suggest(ctx *Context, typed string) []string {
+	const maxSuggestions = 3
+
+	type suggestion struct {
+		name     string
+		distance int
+	}
+	suggestions := make([]suggestion, 0)
+	for _, cmd := range r.visible(ctx) {
+		best := -1
+		for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+			distance := levenshtein(typed, name)
+			if distance > maxDistance(name) {
+				continue
+			}
+			if best < 0 || distance < best {
+				best = distance
+			}
+		}
+		if best >= 0 {
+			suggestions = append(suggestions, suggestion{name: cmd.Name, distance: best})
+		}
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].distance < suggestions[j].distance
+	})
+
+	names := make([]string, 0, maxSuggestions)
+	for _, s := range suggestions {
+		if len(names) == maxSuggestions {
+			break
+		}
+		names = append(names, s.name)
+	}
+	return names
+}
+
+// maxDistance is how many typos a name may have and still be suggested,
+// fewer for short names so everything isn't close to everything.
+func maxDistance(name string) int {
+	if len(name) <= 4 {
+		return 1
+	}
+	return 2
+}
+
+// levenshtein returns the number of single character edits between two
+// strings.
+func levenshtein(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	previous := make([]int, len(br)+1)
+	current := make([]int, len(br)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		current[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(br)]
+}
+
+func formatNames(prefix string, names []string) string {
+	formatted := make([]string, 0, len(names))
+	for _, name := range names {
+		formatted = append(formatted, fmt.Sprintf("`%s%s`", prefix, name))
+	}
+	if len(formatted) == 1 {
+		return formatted[0]
+	}
+	return fmt.Sprintf("%s or %s", strings.Join(formatted[:len(formatted)-1], ", "), formatted[len(formatted)-1])
+}